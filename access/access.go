@@ -0,0 +1,259 @@
+// The access package defines a middleware that authorizes the operations on a store with the identity
+// of the client, the pubkey it authenticated with (NIP-42), which the relay carries in the context.
+//
+//	store, err := access.New(sqliteStore,
+//		access.WithReadPolicy(access.Private(4, 1059)),
+//		access.WithWritePolicy(access.Whitelist(admins...)),
+//	)
+//	ctx = access.WithIdentity(ctx, pubkey) // after the client authenticated
+//	events, err := store.Query(ctx, filters...)
+//
+// Read policies decide which events are visible to the identity, and the other events are removed from the results,
+// so queries might return fewer events than their limit. Write policies decide whether the identity can save or replace
+// an event. Deletions are not authorized, as the relay decides what to delete (e.g. with NIP-09).
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var (
+	// ErrAuthRequired is returned by the write policies when the context has no identity.
+	ErrAuthRequired = errors.New("auth-required: authenticate to write to this relay")
+
+	// ErrRestricted is returned by the write policies when the identity is not allowed to write the event.
+	ErrRestricted = errors.New("restricted: not allowed to write to this relay")
+)
+
+// DefaultScanSize is the number of events queried at a time when counting events restricted by the read policies.
+var DefaultScanSize = 1000
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of the context carrying the pubkey the client authenticated with.
+func WithIdentity(ctx context.Context, pubkey string) context.Context {
+	return context.WithValue(ctx, identityKey{}, pubkey)
+}
+
+// Identity returns the pubkey carried by the context, and false if the client is not authenticated.
+func Identity(ctx context.Context) (string, bool) {
+	pubkey, ok := ctx.Value(identityKey{}).(string)
+	return pubkey, ok && pubkey != ""
+}
+
+// ReadPolicy decides whether the events of its kinds are visible to the identity of the context.
+type ReadPolicy struct {
+	Kinds   []int // the kinds of the events the policy applies to, or all the kinds if empty
+	Visible func(ctx context.Context, event *nostr.Event) bool
+}
+
+// applies reports whether the policy applies to the events of the kind.
+func (p ReadPolicy) applies(kind int) bool {
+	return len(p.Kinds) == 0 || slices.Contains(p.Kinds, kind)
+}
+
+// restricts reports whether the policy might apply to the events matching the filter.
+func (p ReadPolicy) restricts(filter nostr.Filter) bool {
+	if len(p.Kinds) == 0 || len(filter.Kinds) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(filter.Kinds, p.applies)
+}
+
+// Private returns a [ReadPolicy] that makes the events of the kinds visible only to their author and to the pubkeys
+// in their "p" tags, e.g. direct messages (kind 4) and gift wraps (kind 1059).
+func Private(kinds ...int) ReadPolicy {
+	return ReadPolicy{
+		Kinds: slices.Clone(kinds),
+		Visible: func(ctx context.Context, event *nostr.Event) bool {
+			pubkey, ok := Identity(ctx)
+			if !ok {
+				return false
+			}
+			return event.PubKey == pubkey || event.Tags.FindWithValue("p", pubkey) != nil
+		},
+	}
+}
+
+// WritePolicy returns an error if the identity of the context can't write the event.
+type WritePolicy func(ctx context.Context, event *nostr.Event) error
+
+// Authenticated is a [WritePolicy] that accepts the events of all the authenticated clients.
+func Authenticated(ctx context.Context, event *nostr.Event) error {
+	if _, ok := Identity(ctx); !ok {
+		return ErrAuthRequired
+	}
+	return nil
+}
+
+// Whitelist returns a [WritePolicy] that only accepts the events of the clients authenticated with one of the pubkeys.
+func Whitelist(pubkeys ...string) WritePolicy {
+	allowed := make(map[string]struct{}, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		allowed[pubkey] = struct{}{}
+	}
+
+	return func(ctx context.Context, event *nostr.Event) error {
+		pubkey, ok := Identity(ctx)
+		if !ok {
+			return ErrAuthRequired
+		}
+
+		if _, ok := allowed[pubkey]; !ok {
+			return fmt.Errorf("%w: pubkey %s", ErrRestricted, pubkey)
+		}
+		return nil
+	}
+}
+
+// Store wraps a [nastro.Store], authorizing its operations.
+type Store struct {
+	nastro.Store
+	read  []ReadPolicy
+	write []WritePolicy
+}
+
+type Option func(*Store) error
+
+// WithReadPolicy adds read policies to the store. An event is visible if all the policies that apply to it agree.
+func WithReadPolicy(policies ...ReadPolicy) Option {
+	return func(s *Store) error {
+		for _, p := range policies {
+			if p.Visible == nil {
+				return errors.New("the visible function of a read policy must not be nil")
+			}
+		}
+		s.read = append(s.read, policies...)
+		return nil
+	}
+}
+
+// WithWritePolicy adds write policies to the store. An event is written if none of the policies returns an error.
+func WithWritePolicy(policies ...WritePolicy) Option {
+	return func(s *Store) error {
+		for _, p := range policies {
+			if p == nil {
+				return errors.New("write policies must not be nil")
+			}
+		}
+		s.write = append(s.write, policies...)
+		return nil
+	}
+}
+
+// New returns a store that authorizes the operations on the store with the policies.
+func New(store nastro.Store, opts ...Option) (*Store, error) {
+	s := &Store{Store: store}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New].
+// It returns an error if any of the options is invalid.
+func Middleware(opts ...Option) (nastro.Middleware, error) {
+	if _, err := New(nil, opts...); err != nil {
+		return nil, err
+	}
+
+	return func(store nastro.Store) nastro.Store {
+		s, _ := New(store, opts...)
+		return s
+	}, nil
+}
+
+// Authorize returns the error of the first write policy that rejects the event, or nil.
+func (s *Store) Authorize(ctx context.Context, event *nostr.Event) error {
+	for _, policy := range s.write {
+		if err := policy(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visible reports whether the event is visible to the identity of the context, according to the read policies.
+func (s *Store) Visible(ctx context.Context, event *nostr.Event) bool {
+	for _, policy := range s.read {
+		if policy.applies(event.Kind) && !policy.Visible(ctx, event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.Authorize(ctx, event); err != nil {
+		return err
+	}
+	return s.Store.Save(ctx, event)
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if err := s.Authorize(ctx, event); err != nil {
+		return false, err
+	}
+	return s.Store.Replace(ctx, event)
+}
+
+// Query the store, removing the events not visible to the identity of the context from the result.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	events, err := s.Store.Query(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(events, func(event nostr.Event) bool {
+		return !s.Visible(ctx, &event)
+	}), nil
+}
+
+// Count the events matching the filters that are visible to the identity of the context.
+// If a read policy might apply to the filters, the matching events are scanned and counted one by one
+// (see [nastro.Scan]), which is much slower than counting them in the store.
+// Like the counts of the stores, the limits of the filters are ignored.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if !s.restricts(filters) {
+		return s.Store.Count(ctx, filters...)
+	}
+
+	var count int64
+	seen := make(map[string]struct{})
+	for _, filter := range filters {
+		err := nastro.Scan(ctx, s.Store, filter, DefaultScanSize, func(event nostr.Event) error {
+			if _, ok := seen[event.ID]; ok {
+				return nil
+			}
+
+			seen[event.ID] = struct{}{}
+			if s.Visible(ctx, &event) {
+				count++
+			}
+			return nil
+		})
+
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// restricts reports whether any of the read policies might apply to the events matching the filters.
+func (s *Store) restricts(filters nostr.Filters) bool {
+	for _, policy := range s.read {
+		if slices.ContainsFunc(filters, policy.restricts) {
+			return true
+		}
+	}
+	return false
+}
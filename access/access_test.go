@@ -0,0 +1,168 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newStore(t *testing.T, opts ...Option) *Store {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(backend, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return newStore(t, WithReadPolicy(Private(4, 1059)))
+	})
+}
+
+func TestIdentity(t *testing.T) {
+	if _, ok := Identity(ctx); ok {
+		t.Fatal("expected no identity")
+	}
+
+	pubkey, ok := Identity(WithIdentity(ctx, "alice"))
+	if !ok || pubkey != "alice" {
+		t.Fatalf("expected identity alice, got %q", pubkey)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	store := newStore(t, WithReadPolicy(Private(4, 1059)))
+	events := []*nostr.Event{
+		{ID: "note", PubKey: "alice", Kind: 1, CreatedAt: 1},
+		{ID: "dm", PubKey: "alice", Kind: 4, CreatedAt: 2, Tags: nostr.Tags{{"p", "bob"}}},
+		{ID: "wrap", PubKey: "random", Kind: 1059, CreatedAt: 3, Tags: nostr.Tags{{"p", "carol"}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		identity string
+		ids      []string
+	}{
+		{identity: "", ids: []string{"note"}},
+		{identity: "alice", ids: []string{"dm", "note"}},
+		{identity: "bob", ids: []string{"dm", "note"}},
+		{identity: "carol", ids: []string{"wrap", "note"}},
+	}
+
+	for _, test := range tests {
+		ctx := WithIdentity(ctx, test.identity)
+		result, err := store.Query(ctx, nostr.Filter{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result) != len(test.ids) {
+			t.Fatalf("%q: expected %v, got %v", test.identity, test.ids, result)
+		}
+
+		for i, event := range result {
+			if event.ID != test.ids[i] {
+				t.Fatalf("%q: expected %v, got %v", test.identity, test.ids, result)
+			}
+		}
+
+		count, err := store.Count(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != int64(len(test.ids)) {
+			t.Fatalf("%q: expected count %d, got %d", test.identity, len(test.ids), count)
+		}
+	}
+
+	if !store.restricts(nostr.Filters{{Kinds: []int{1, 4}}}) || store.restricts(nostr.Filters{{Kinds: []int{1}}}) {
+		t.Fatal("expected only the filters of private kinds to be restricted")
+	}
+}
+
+func TestCount(t *testing.T) {
+	store := newStore(t, WithReadPolicy(Private(4)))
+	for i := range 6 {
+		event := &nostr.Event{ID: string(rune('a' + i)), PubKey: "alice", Kind: 1 + 3*(i%2), CreatedAt: nostr.Timestamp(i)}
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice can see all her events, so the restricted count must match the count of the store
+	ctx := WithIdentity(ctx, "alice")
+	tests := []nostr.Filters{
+		{{Kinds: []int{1, 4}}},
+		{{Kinds: []int{1, 4}, Limit: 1}},
+		{{Kinds: []int{1, 4}, LimitZero: true}},
+		{{Kinds: []int{1}, Limit: 1}, {Kinds: []int{4}, LimitZero: true}},
+	}
+
+	for _, filters := range tests {
+		if !store.restricts(filters) {
+			t.Fatalf("expected the filters %v to be restricted", filters)
+		}
+
+		count, err := store.Count(ctx, filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := store.Store.Count(ctx, filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != expected || count != 6 {
+			t.Fatalf("%v: expected count %d, got %d", filters, expected, count)
+		}
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	store := newStore(t, WithWritePolicy(Whitelist("alice")))
+	tests := []struct {
+		ctx context.Context
+		err error
+	}{
+		{ctx: ctx, err: ErrAuthRequired},
+		{ctx: WithIdentity(ctx, "bob"), err: ErrRestricted},
+		{ctx: WithIdentity(ctx, "alice"), err: nil},
+	}
+
+	for _, test := range tests {
+		err := store.Save(test.ctx, &nostr.Event{ID: "a", PubKey: "alice", Kind: 1})
+		if !errors.Is(err, test.err) {
+			t.Fatalf("expected error %v, got %v", test.err, err)
+		}
+
+		if test.err != nil {
+			if _, ok := nastro.Rejection(err); !ok {
+				t.Fatalf("expected a rejection, got %v", err)
+			}
+		}
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
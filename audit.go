@@ -0,0 +1,132 @@
+package nastro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrMalformedTags is reported by [Audit] for events with empty tags, or tags with an empty key.
+var ErrMalformedTags = errors.New("invalid: malformed tags")
+
+// AuditOptions configures [Audit]. The zero value audits all the events of the store, and only reports the invalid ones.
+type AuditOptions struct {
+	Filter    nostr.Filter // the events to audit, whose limit is ignored
+	BatchSize int          // the number of events queried at a time, 1000 if zero
+
+	// SkipSignatures skips verifying the signatures, which is the most expensive check.
+	SkipSignatures bool
+
+	// Quarantine, if not nil, receives a copy of the invalid events, so that they can be inspected or restored.
+	Quarantine Store
+
+	// Delete removes the invalid events from the store. Events that fail to be quarantined are not deleted.
+	Delete bool
+
+	// OnInvalid, if not nil, is called with each invalid event and its problem.
+	OnInvalid func(event nostr.Event, problem error)
+}
+
+// maxFailures is the maximum number of errors kept in [AuditReport.Failures].
+const maxFailures = 100
+
+// AuditReport is the summary of [Audit].
+type AuditReport struct {
+	Scanned     int64
+	Invalid     int64
+	Quarantined int64
+	Deleted     int64
+	Problems    map[error]int64 // the number of invalid events by problem, e.g. ErrInvalidSignature
+	Took        time.Duration
+
+	// Failed is the number of invalid events that failed to be quarantined or deleted,
+	// and Failures are the first 100 of their errors.
+	Failed   int64
+	Failures []error
+}
+
+// Audit scans the events of the store (see [Scan]) and verifies their ids, signatures and tags, which is useful for
+// long-lived databases that accumulated events written before they were validated. Invalid events are reported,
+// and optionally quarantined and deleted. The problems are [ErrInvalidID], [ErrInvalidSignature] and [ErrMalformedTags].
+// Failures to quarantine or delete an event are recorded in the report, and the audit continues.
+//
+// Audit only sees the events that the store can decode: rows that it can't decode at all (e.g. tags that are
+// not valid JSON) make the store fail the query, which ends the audit with the error of the store and the report
+// of the events scanned so far. Such rows must be repaired or removed with the tools of the database.
+func Audit(ctx context.Context, store Store, opts AuditOptions) (AuditReport, error) {
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 1000
+	}
+
+	start := time.Now()
+	report := AuditReport{Problems: make(map[error]int64)}
+
+	err := Scan(ctx, store, opts.Filter, opts.BatchSize, func(event nostr.Event) error {
+		report.Scanned++
+		problem := check(&event, opts.SkipSignatures)
+		if problem == nil {
+			return nil
+		}
+
+		report.Invalid++
+		report.Problems[problem]++
+		if opts.OnInvalid != nil {
+			opts.OnInvalid(event, problem)
+		}
+
+		if opts.Quarantine != nil {
+			if err := opts.Quarantine.Save(ctx, &event); err != nil && !errors.Is(err, ErrDuplicate) {
+				report.fail(fmt.Errorf("failed to quarantine event ID %s: %w", event.ID, err))
+				return ctx.Err()
+			}
+			report.Quarantined++
+		}
+
+		if !opts.Delete {
+			return nil
+		}
+
+		if err := store.Delete(ctx, event.ID); err != nil {
+			report.fail(fmt.Errorf("failed to delete event ID %s: %w", event.ID, err))
+			return ctx.Err()
+		}
+
+		report.Deleted++
+		return nil
+	})
+
+	report.Took = time.Since(start)
+	return report, err
+}
+
+func (r *AuditReport) fail(err error) {
+	r.Failed++
+	if len(r.Failures) < maxFailures {
+		r.Failures = append(r.Failures, err)
+	}
+}
+
+// check returns the problem of the event, or nil if it's valid.
+func check(event *nostr.Event, skipSignature bool) error {
+	for _, tag := range event.Tags {
+		if len(tag) == 0 || tag[0] == "" {
+			return ErrMalformedTags
+		}
+	}
+
+	if !event.CheckID() {
+		return ErrInvalidID
+	}
+
+	if skipSignature {
+		return nil
+	}
+
+	if valid, err := event.CheckSignature(); err != nil || !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
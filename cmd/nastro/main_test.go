@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := parseFilter("1, 7", "alice,bob", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(filter.Kinds, []int{1, 7}) || !reflect.DeepEqual(filter.Authors, []string{"alice", "bob"}) {
+		t.Fatalf("unexpected filter %v", filter)
+	}
+
+	if filter.Since == nil || *filter.Since != 10 || filter.Until != nil {
+		t.Fatalf("unexpected filter %v", filter)
+	}
+
+	if _, err := parseFilter("note", "", 0, 0); err == nil {
+		t.Fatal("expected an error for an invalid kind")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	dirA, dirB := "fs:"+filepath.Join(t.TempDir(), "a"), "fs:"+filepath.Join(t.TempDir(), "b")
+
+	a, err := open(ctx, dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Save(ctx, &nostr.Event{ID: "a", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	closeStore(a)
+
+	var stdout, stderr bytes.Buffer
+	if code := diff(ctx, []string{"-kinds", "1", dirA, dirB}, &stdout, &stderr); code != 1 {
+		t.Fatalf("expected exit code 1, got %d: %s", code, stderr.String())
+	}
+
+	if stdout.String() != "- a\n" {
+		t.Fatalf("expected the event only in the first store, got %q", stdout.String())
+	}
+
+	if code := diff(ctx, []string{dirA, "unknown:store"}, &stdout, &stderr); code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	event := &nostr.Event{Kind: 1, CreatedAt: 1, Content: "hello", Tags: nostr.Tags{}}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "strfry.jsonl")
+	if err := os.WriteFile(path, []byte(event.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := "fs:" + filepath.Join(t.TempDir(), "store")
+	var stderr bytes.Buffer
+	if code := importDump(ctx, []string{path, dir}, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	if !strings.HasPrefix(stderr.String(), "1 events imported") {
+		t.Fatalf("expected 1 event imported, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,63 @@
+package nastro
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// diffBatchSize is the number of events queried at a time by [Diff].
+const diffBatchSize = 1000
+
+// Diff returns the IDs of the events matching any of the filters that are only in store a, and the ones only in b,
+// both sorted, for example to verify that a migration or a replica is complete. Without filters, all the events are compared.
+// The limits of the filters are ignored, and the stores are scanned (see [Scan]), keeping their IDs in memory.
+// Replaceable events superseded in only one of the stores are reported as differences.
+func Diff(ctx context.Context, a, b Store, filters ...nostr.Filter) (onlyA, onlyB []string, err error) {
+	if len(filters) == 0 {
+		filters = []nostr.Filter{{}}
+	}
+
+	inA := make(map[string]struct{})
+	for _, filter := range filters {
+		err := Scan(ctx, a, filter, diffBatchSize, func(event nostr.Event) error {
+			inA[event.ID] = struct{}{}
+			return nil
+		})
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan the first store: %w", err)
+		}
+	}
+
+	inB := make(map[string]struct{})
+	for _, filter := range filters {
+		err := Scan(ctx, b, filter, diffBatchSize, func(event nostr.Event) error {
+			if _, ok := inB[event.ID]; ok {
+				return nil
+			}
+
+			inB[event.ID] = struct{}{}
+			if _, ok := inA[event.ID]; !ok {
+				onlyB = append(onlyB, event.ID)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan the second store: %w", err)
+		}
+	}
+
+	for id := range inA {
+		if _, ok := inB[id]; !ok {
+			onlyA = append(onlyA, id)
+		}
+	}
+
+	slices.Sort(onlyA)
+	slices.Sort(onlyB)
+	return onlyA, onlyB, nil
+}
@@ -0,0 +1,117 @@
+package duckdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Dimension is what the events are grouped by in [Store.CountBy].
+type Dimension struct {
+	expr string // the expression of the group key over the events table, empty for tags
+	tag  string // the key of the tag whose values are the groups
+}
+
+var (
+	ByKind   = Dimension{expr: "CAST(e.kind AS VARCHAR)"}
+	ByPubkey = Dimension{expr: "e.pubkey"}
+	ByDay    = Dimension{expr: "strftime(to_timestamp(e.created_at), '%Y-%m-%d')"}
+)
+
+// ByTag groups the events by the values of their tags with the provided key, e.g. "t" for hashtags.
+// Events with more than one value are counted once in each of their groups.
+func ByTag(key string) Dimension {
+	return Dimension{tag: key}
+}
+
+// Group is a group of events of [Store.CountBy].
+type Group struct {
+	Key   string
+	Count int64
+}
+
+// CountBy counts the events matching any of the filters by the dimension, and returns the groups
+// with the most events first, up to the provided limit (all of them if limit is 0).
+// The limits of the filters are ignored, and all the events are counted if no filter is provided.
+//
+//	// the 10 most used hashtags of the last week
+//	since := nostr.Now() - 7*24*3600
+//	groups, err := store.CountBy(ctx, duckdb.ByTag("t"), 10, nostr.Filter{Since: &since})
+func (s *Store) CountBy(ctx context.Context, dim Dimension, limit int, filters ...nostr.Filter) ([]Group, error) {
+	query, args := buildCountBy(dim, limit, filters...)
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.Key, &group.Count); err != nil {
+			return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+		groups = append(groups, group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return groups, nil
+}
+
+func buildCountBy(dim Dimension, limit int, filters ...nostr.Filter) (string, []any) {
+	conditions, args := whereAny(filters...)
+
+	var query string
+	if dim.tag != "" {
+		query = "SELECT g.value AS key, COUNT(DISTINCT e.id) AS count FROM events AS e JOIN tags AS g ON g.event_id = e.id AND g.key = ?"
+		args = append([]any{dim.tag}, args...)
+	} else {
+		query = "SELECT " + dim.expr + " AS key, COUNT(*) AS count FROM events AS e"
+	}
+
+	query += conditions + " GROUP BY key ORDER BY count DESC, key ASC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return query, args
+}
+
+// whereAny returns the WHERE clause matching any of the filters, or an empty string if they match all events.
+func whereAny(filters ...nostr.Filter) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, filter := range filters {
+		clause, filterArgs := where(filter)
+		if clause == "" {
+			return "", nil
+		}
+
+		conditions = append(conditions, "("+strings.TrimPrefix(clause, " WHERE ")+")")
+		args = append(args, filterArgs...)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " OR "), args
+}
+
+// ExportParquet writes the events matching any of the filters (all of them if none is provided) to a Parquet file
+// at the provided path, with the columns id, pubkey, created_at, kind, tags (as JSON), content and sig,
+// sorted by created_at. The limits of the filters are ignored.
+func (s *Store) ExportParquet(ctx context.Context, path string, filters ...nostr.Filter) error {
+	conditions, args := whereAny(filters...)
+	statement := "COPY (SELECT " + Columns + " FROM events AS e" + conditions + " ORDER BY e.created_at ASC) TO '" +
+		strings.ReplaceAll(path, "'", "''") + "' (FORMAT PARQUET)"
+
+	if _, err := s.DB.ExecContext(ctx, statement, args...); err != nil {
+		return fmt.Errorf("failed to export to %s: %w", path, err)
+	}
+	return nil
+}
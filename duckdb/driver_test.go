@@ -0,0 +1,6 @@
+//go:build duckdb
+
+package duckdb
+
+// The driver requires CGO, so the tests that use it only run with the duckdb build tag.
+import _ "github.com/duckdb/duckdb-go/v2"
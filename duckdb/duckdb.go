@@ -0,0 +1,423 @@
+// The duckdb package defines a DuckDB store for Nostr events, meant for analytics over a relay's archive:
+// heavy counts, histograms and tag statistics run on DuckDB's columnar engine, see [Store.CountBy].
+//
+// The package uses database/sql and doesn't import a driver, so that it builds without CGO.
+// Programs using it must register the "duckdb" driver, e.g. with
+//
+//	import _ "github.com/duckdb/duckdb-go/v2"
+//
+// The tests run against the driver with the duckdb build tag:
+//
+//	go test -tags duckdb ./duckdb
+package duckdb
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// DriverName is the name of the database/sql driver used to open the database.
+const DriverName = "duckdb"
+
+const schema = `
+	CREATE TABLE IF NOT EXISTS events (
+		id VARCHAR PRIMARY KEY,
+		pubkey VARCHAR NOT NULL,
+		created_at BIGINT NOT NULL,
+		kind INTEGER NOT NULL,
+		tags VARCHAR NOT NULL,
+		content VARCHAR NOT NULL,
+		sig VARCHAR NOT NULL,
+		address VARCHAR
+	);
+
+	CREATE TABLE IF NOT EXISTS tags (
+		event_id VARCHAR NOT NULL,
+		key VARCHAR NOT NULL,
+		value VARCHAR NOT NULL
+	);`
+
+// Columns are the columns of the events table (aliased "e") that are scanned into a [nostr.Event].
+const Columns = "e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig"
+
+// Store of Nostr events that uses a DuckDB database.
+// It embeds the *sql.DB for direct interaction, e.g. to attach other databases or read Parquet files.
+type Store struct {
+	*sql.DB
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before executing queries.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before inserting them into the database.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a DuckDB store of the database at the provided path (or ":memory:"), creating the schema if needed.
+func New(path string, opts ...Option) (*Store, error) {
+	if path == ":memory:" {
+		// the driver opens an in-memory database for the empty data source name
+		path = ""
+	}
+
+	DB, err := sql.Open(DriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database (is the %q driver registered?): %w", DriverName, err)
+	}
+
+	store := &Store{
+		DB:              DB,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			DB.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := DB.Exec(schema); err != nil {
+		DB.Close()
+		return nil, fmt.Errorf("failed to apply the schema: %w", err)
+	}
+	return store, nil
+}
+
+// Save the event in the store. If the event is already stored, nothing happens and nil is returned.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	err := s.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := s.insert(ctx, tx, event)
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction, which is committed if fn returns no error, and rolled back otherwise.
+func (s *Store) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin the transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert the event and its tags, and reports whether it was inserted, which is false if it's already stored.
+func (s *Store) insert(ctx context.Context, tx *sql.Tx, event *nostr.Event) (bool, error) {
+	tags, err := json.Marshal(event.Tags)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal the tags: %w", err)
+	}
+
+	var address sql.NullString
+	if addr, ok := addressOf(event); ok {
+		address = sql.NullString{String: addr, Valid: true}
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig, address)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		event.ID, event.PubKey, int64(event.CreatedAt), event.Kind, string(tags), event.Content, event.Sig, address)
+	if err != nil {
+		return false, err
+	}
+
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		return false, err
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (event_id, key, value) VALUES (?, ?, ?)", event.ID, tag[0], tag[1]); err != nil {
+			return false, fmt.Errorf("failed to insert the tags: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	address, _ := addressOf(event)
+	var replaced bool
+
+	err := s.transaction(ctx, func(tx *sql.Tx) error {
+		var newest int64
+		err := tx.QueryRowContext(ctx, "SELECT created_at FROM events WHERE address = ? ORDER BY created_at DESC LIMIT 1", address).Scan(&newest)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// no event in the same category
+
+		case err != nil:
+			return fmt.Errorf("failed to query the stored event: %w", err)
+
+		case int64(event.CreatedAt) <= newest:
+			return nil
+		}
+
+		if err := remove(ctx, tx, "address = ?", address); err != nil {
+			return fmt.Errorf("failed to delete the older events: %w", err)
+		}
+
+		replaced, err = s.insert(ctx, tx, event)
+		return err
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+	return replaced, nil
+}
+
+// Delete the event with the provided id. If the event is not found, nothing happens and nil is returned.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	err := s.transaction(ctx, func(tx *sql.Tx) error {
+		return remove(ctx, tx, "id = ?", id)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// remove the events matching the condition on the events table, and their tags.
+func remove(ctx context.Context, tx *sql.Tx, condition string, args ...any) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE event_id IN (SELECT id FROM events WHERE "+condition+")", args...); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM events WHERE "+condition, args...)
+	return err
+}
+
+// Query stored events matching the provided filters, sorted by created_at in descending order, and by id
+// in ascending order among events created at the same time. Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+
+		query, args := buildQuery(filter)
+		rows, err := s.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+
+		result, err := scanEvents(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to scan the events: %w", nastro.ErrInternalQuery, err)
+		}
+
+		for _, event := range result {
+			if _, ok := seen[event.ID]; !ok {
+				seen[event.ID] = struct{}{}
+				events = append(events, event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count stored events matching any of the provided filters. Events matching more than one filter are counted once.
+// The limits of the filters are ignored.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if len(filters) == 0 {
+		return 0, nil
+	}
+
+	query, args := buildCount(filters...)
+	var count int64
+	if err := s.DB.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return count, nil
+}
+
+// buildCount returns the query counting the events matching any of the filters.
+func buildCount(filters ...nostr.Filter) (string, []any) {
+	conditions, args := whereAny(filters...)
+	return "SELECT COUNT(*) FROM events AS e" + conditions, args
+}
+
+// buildQuery returns the query of the events matching the filter, up to its limit.
+func buildQuery(filter nostr.Filter) (string, []any) {
+	conditions, args := where(filter)
+	query := "SELECT " + Columns + " FROM events AS e" + conditions + " ORDER BY e.created_at DESC, e.id ASC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return query, args
+}
+
+// where returns the WHERE clause matching the filter, or an empty string if the filter matches all events.
+func where(filter nostr.Filter) (string, []any) {
+	var conditions []string
+	var args []any
+
+	in := func(column string, values []any) {
+		conditions = append(conditions, column+" IN ("+placeholders(len(values))+")")
+		args = append(args, values...)
+	}
+
+	if len(filter.IDs) > 0 {
+		in("e.id", toAny(filter.IDs))
+	}
+
+	if len(filter.Authors) > 0 {
+		in("e.pubkey", toAny(filter.Authors))
+	}
+
+	if len(filter.Kinds) > 0 {
+		in("e.kind", toAny(filter.Kinds))
+	}
+
+	if filter.Since != nil {
+		conditions = append(conditions, "e.created_at >= ?")
+		args = append(args, int64(*filter.Since))
+	}
+
+	if filter.Until != nil {
+		conditions = append(conditions, "e.created_at <= ?")
+		args = append(args, int64(*filter.Until))
+	}
+
+	keys := make([]string, 0, len(filter.Tags))
+	for key := range filter.Tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		values := filter.Tags[key]
+		if len(values) == 0 {
+			continue
+		}
+
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM tags AS t WHERE t.event_id = e.id AND t.key = ? AND t.value IN ("+placeholders(len(values))+"))")
+		args = append(args, key)
+		args = append(args, toAny(values)...)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func toAny[T any](s []T) []any {
+	result := make([]any, len(s))
+	for i, v := range s {
+		result[i] = v
+	}
+	return result
+}
+
+// scanEvents scans the [Columns] of the rows into events, and closes the rows.
+func scanEvents(rows *sql.Rows) ([]nostr.Event, error) {
+	defer rows.Close()
+
+	var events []nostr.Event
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		var tags string
+
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(tags), &event.Tags); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the tags of event ID %s: %w", event.ID, err)
+		}
+
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// addressOf returns the key identifying the category of replaceable and addressable events, and false for other kinds.
+func addressOf(event *nostr.Event) (string, bool) {
+	switch {
+	case nostr.IsReplaceableKind(event.Kind):
+		return fmt.Sprintf("%d:%s:", event.Kind, event.PubKey), true
+
+	case nostr.IsAddressableKind(event.Kind):
+		return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD()), true
+
+	default:
+		return "", false
+	}
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
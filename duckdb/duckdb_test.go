@@ -0,0 +1,169 @@
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func TestBuildQuery(t *testing.T) {
+	since := nostr.Timestamp(100)
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+		query  string
+		args   []any
+	}{
+		{
+			name:   "kinds",
+			filter: nostr.Filter{Kinds: []int{0, 1}, Limit: 10},
+			query:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind IN (?,?) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+			args:   []any{0, 1, 10},
+		},
+		{
+			name:   "authors, since and tags",
+			filter: nostr.Filter{Authors: []string{"alice"}, Since: &since, Tags: nostr.TagMap{"t": {"nostr"}, "e": {"x", "y"}}, Limit: 5},
+			query: "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.pubkey IN (?) AND e.created_at >= ? AND " +
+				"EXISTS (SELECT 1 FROM tags AS t WHERE t.event_id = e.id AND t.key = ? AND t.value IN (?,?)) AND " +
+				"EXISTS (SELECT 1 FROM tags AS t WHERE t.event_id = e.id AND t.key = ? AND t.value IN (?)) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+			args: []any{"alice", int64(100), "e", "x", "y", "t", "nostr", 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args := buildQuery(test.filter)
+			if query != test.query {
+				t.Fatalf("expected query\n%s\ngot\n%s", test.query, query)
+			}
+
+			if !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("expected args %v, got %v", test.args, args)
+			}
+		})
+	}
+}
+
+func TestBuildCountBy(t *testing.T) {
+	query, args := buildCountBy(ByTag("t"), 10, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Authors: []string{"alice"}})
+	expected := "SELECT g.value AS key, COUNT(DISTINCT e.id) AS count FROM events AS e JOIN tags AS g ON g.event_id = e.id AND g.key = ? " +
+		"WHERE (e.kind IN (?)) OR (e.pubkey IN (?)) GROUP BY key ORDER BY count DESC, key ASC LIMIT ?"
+
+	if query != expected {
+		t.Fatalf("expected query\n%s\ngot\n%s", expected, query)
+	}
+
+	if !reflect.DeepEqual(args, []any{"t", 1, "alice", 10}) {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	// a filter matching all events makes the others irrelevant
+	query, args = buildCountBy(ByKind, 0, nostr.Filter{Kinds: []int{1}}, nostr.Filter{})
+	expected = "SELECT CAST(e.kind AS VARCHAR) AS key, COUNT(*) AS count FROM events AS e GROUP BY key ORDER BY count DESC, key ASC"
+	if query != expected || len(args) != 0 {
+		t.Fatalf("expected query %s without args, got %s with %v", expected, query, args)
+	}
+}
+
+func TestBuildCount(t *testing.T) {
+	query, args := buildCount(nostr.Filter{Kinds: []int{1}, Limit: 1}, nostr.Filter{Authors: []string{"alice"}, LimitZero: true})
+	expected := "SELECT COUNT(*) FROM events AS e WHERE (e.kind IN (?)) OR (e.pubkey IN (?))"
+
+	if query != expected {
+		t.Fatalf("expected query\n%s\ngot\n%s", expected, query)
+	}
+
+	if !reflect.DeepEqual(args, []any{1, "alice"}) {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
+
+// newStore returns an in-memory store, skipping the test if the duckdb driver is not registered.
+func newStore(t *testing.T) *Store {
+	if !slices.Contains(sql.Drivers(), DriverName) {
+		t.Skip("the duckdb driver is not registered")
+	}
+
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store { return newStore(t) })
+}
+
+func TestCountBy(t *testing.T) {
+	store := newStore(t)
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1, Tags: nostr.Tags{{"t", "nostr"}, {"t", "go"}}},
+		{ID: "b", PubKey: "bob", Kind: 1, CreatedAt: 2, Tags: nostr.Tags{{"t", "nostr"}}},
+		{ID: "c", PubKey: "bob", Kind: 7, CreatedAt: 3},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := store.CountBy(ctx, ByTag("t"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Group{{Key: "nostr", Count: 2}, {Key: "go", Count: 1}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected groups %v, got %v", expected, groups)
+	}
+
+	groups, err = store.CountBy(ctx, ByPubkey, 1, nostr.Filter{Kinds: []int{1, 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []Group{{Key: "bob", Count: 2}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected groups %v, got %v", expected, groups)
+	}
+}
+
+func TestCount(t *testing.T) {
+	store := newStore(t)
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1, Tags: nostr.Tags{}},
+		{ID: "b", PubKey: "bob", Kind: 1, CreatedAt: 2, Tags: nostr.Tags{}},
+		{ID: "c", PubKey: "bob", Kind: 7, CreatedAt: 3, Tags: nostr.Tags{}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// event b matches both filters
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Authors: []string{"bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 {
+		t.Fatalf("expected count 3, got %d", count)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,236 @@
+// The dump package defines importers of the dumps of other relays into any store,
+// so that operators can switch to nastro-backed relays without custom scripts.
+//
+//	file, err := os.Open("strfry.jsonl") // strfry export > strfry.jsonl
+//	stats, err := dump.Import(ctx, store, dump.Strfry(file))
+//
+//	events, err := dump.NostrRsRelay(ctx, "nostr.db")
+//	stats, err := dump.Import(ctx, store, events)
+//
+// Events are normalized and verified before being written, and the invalid ones are skipped and counted.
+package dump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// ErrMalformed is wrapped by the errors of the events of a dump that can't be decoded,
+// which [Import] skips and counts as invalid.
+var ErrMalformed = errors.New("malformed event")
+
+// maxLineSize is the maximum size of a line of a JSONL dump.
+const maxLineSize = 16 << 20
+
+// Strfry returns the events of the output of `strfry export`, one JSON event per line, read from r.
+// The additional fields of `strfry export --fried` are ignored. It yields an error wrapping [ErrMalformed]
+// for every line that can't be decoded, and stops at the first error reading r.
+func Strfry(r io.Reader) iter.Seq2[*nostr.Event, error] {
+	return func(yield func(*nostr.Event, error) bool) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			event := &nostr.Event{}
+			if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+				if !yield(nil, fmt.Errorf("%w at line %d: %w", ErrMalformed, line, err)) {
+					return
+				}
+				continue
+			}
+
+			if !yield(event, nil) {
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			yield(nil, fmt.Errorf("failed to read line %d: %w", line+1, err))
+		}
+	}
+}
+
+// NostrRsRelay returns the events of the sqlite database of nostr-rs-relay at the path, which is opened read-only.
+// Events hidden by deletions are skipped. The database is closed when the iteration ends.
+// It yields an error wrapping [ErrMalformed] for every event that can't be decoded, and stops at the first database error.
+func NostrRsRelay(ctx context.Context, path string) iter.Seq2[*nostr.Event, error] {
+	return func(yield func(*nostr.Event, error) bool) {
+		db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to open the nostr-rs-relay database: %w", err))
+			return
+		}
+		defer db.Close()
+
+		// nostr-rs-relay stores the JSON of the whole event in the content column
+		rows, err := db.QueryContext(ctx, "SELECT id, content FROM event WHERE hidden != 1 ORDER BY id")
+		if err != nil {
+			yield(nil, fmt.Errorf("failed to query the nostr-rs-relay database: %w", err))
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var data []byte
+			if err := rows.Scan(&id, &data); err != nil {
+				yield(nil, fmt.Errorf("failed to scan the nostr-rs-relay database: %w", err))
+				return
+			}
+
+			event := &nostr.Event{}
+			if err := json.Unmarshal(data, event); err != nil {
+				if !yield(nil, fmt.Errorf("%w at row %d: %w", ErrMalformed, id, err)) {
+					return
+				}
+				continue
+			}
+
+			if !yield(event, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(nil, fmt.Errorf("failed to scan the nostr-rs-relay database: %w", err))
+		}
+	}
+}
+
+// Stats reports the outcome of [Import].
+type Stats struct {
+	Imported int64         // the number of events written to the store
+	Skipped  int64         // the number of events the store already had, or rejected
+	Invalid  int64         // the number of events malformed, with a wrong id or signature, or ephemeral
+	Took     time.Duration // the time it took
+}
+
+type options struct {
+	assumeValid   bool
+	validateEvent nastro.EventPolicy
+}
+
+type Option func(*options)
+
+// WithAssumeValid skips verifying the signatures of the events, which is much faster for trusted dumps.
+// The ids are still checked.
+func WithAssumeValid() Option {
+	return func(o *options) {
+		o.assumeValid = true
+	}
+}
+
+// WithEventPolicy sets a [nastro.EventPolicy] that the events must pass to be imported.
+// The events it rejects are counted as skipped.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(o *options) {
+		o.validateEvent = v
+	}
+}
+
+// Import writes the events to the store, saving them or replacing them if replaceable or addressable,
+// and returns the stats of the import. It stops at the first error of the events that doesn't wrap [ErrMalformed],
+// or at the first error of the store that is not a rejection (see [nastro.Rejection]).
+func Import(ctx context.Context, store nastro.Store, events iter.Seq2[*nostr.Event, error], opts ...Option) (Stats, error) {
+	o := options{validateEvent: func(*nostr.Event) error { return nil }}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	start := time.Now()
+	stats := Stats{}
+
+	for event, err := range events {
+		if err := ctx.Err(); err != nil {
+			stats.Took = time.Since(start)
+			return stats, err
+		}
+
+		switch {
+		case errors.Is(err, ErrMalformed):
+			stats.Invalid++
+			continue
+
+		case err != nil:
+			stats.Took = time.Since(start)
+			return stats, err
+		}
+
+		normalize(event)
+		if !valid(event, o.assumeValid) {
+			stats.Invalid++
+			continue
+		}
+
+		if err := o.validateEvent(event); err != nil {
+			stats.Skipped++
+			continue
+		}
+
+		written, err := write(ctx, store, event)
+		if _, rejected := nastro.Rejection(err); err != nil && !rejected {
+			stats.Took = time.Since(start)
+			return stats, fmt.Errorf("failed to import event ID %s: %w", event.ID, err)
+		}
+
+		if written {
+			stats.Imported++
+		} else {
+			stats.Skipped++
+		}
+	}
+
+	stats.Took = time.Since(start)
+	return stats, nil
+}
+
+// write the event to the store, reporting whether it was written.
+func write(ctx context.Context, store nastro.Store, event *nostr.Event) (bool, error) {
+	if nastro.IsValidReplacement(event.Kind) {
+		return store.Replace(ctx, event)
+	}
+
+	if err := store.Save(ctx, event); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// normalize the fields of the event that dumps encode differently, without changing its id.
+func normalize(event *nostr.Event) {
+	if event.Tags == nil {
+		event.Tags = nostr.Tags{}
+	}
+}
+
+// valid reports whether the event can be stored: its id matches its fields, its signature is valid
+// (unless assumed valid), and it's not ephemeral, as ephemeral events are not meant to be stored.
+func valid(event *nostr.Event, assumeValid bool) bool {
+	if nostr.IsEphemeralKind(event.Kind) || !event.CheckID() {
+		return false
+	}
+
+	if assumeValid {
+		return true
+	}
+
+	ok, err := event.CheckSignature()
+	return ok && err == nil
+}
@@ -0,0 +1,114 @@
+package dump
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+)
+
+var (
+	ctx = context.Background()
+	sk  = nostr.GeneratePrivateKey()
+)
+
+func signed(t *testing.T, kind int, createdAt nostr.Timestamp, content string) *nostr.Event {
+	event := &nostr.Event{Kind: kind, CreatedAt: createdAt, Content: content, Tags: nostr.Tags{}}
+	if err := event.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func newStore(t *testing.T) nastro.Store {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStrfry(t *testing.T) {
+	note := signed(t, 1, 1, "hello")
+	forged := signed(t, 1, 2, "forged")
+	forged.Sig = note.Sig
+
+	lines := []string{
+		note.String(),
+		`{"id": "not json`,
+		forged.String(),
+		signed(t, 20001, 3, "ephemeral").String(),
+		signed(t, 0, 5, "new profile").String(),
+		signed(t, 0, 4, "old profile").String(),
+		"",
+	}
+
+	store := newStore(t)
+	stats, err := Import(ctx, store, Strfry(strings.NewReader(strings.Join(lines, "\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Imported != 2 || stats.Skipped != 1 || stats.Invalid != 3 {
+		t.Fatalf("expected 2 imported, 1 skipped and 3 invalid, got %+v", stats)
+	}
+
+	profiles, err := store.Query(ctx, nostr.Filter{Kinds: []int{0}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(profiles) != 1 || profiles[0].Content != "new profile" {
+		t.Fatalf("expected the newest profile, got %v", profiles)
+	}
+}
+
+func TestNostrRsRelay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nostr.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the relevant columns of the event table of nostr-rs-relay
+	_, err = db.Exec(`CREATE TABLE event (
+		id INTEGER PRIMARY KEY,
+		event_hash BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		hidden INTEGER DEFAULT 0,
+		content TEXT NOT NULL
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*nostr.Event{signed(t, 1, 1, "visible"), signed(t, 1, 2, "deleted")}
+	for i, event := range events {
+		_, err := db.Exec("INSERT INTO event (event_hash, created_at, kind, hidden, content) VALUES (?, ?, ?, ?, ?)",
+			event.ID, event.CreatedAt, event.Kind, i, event.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := newStore(t)
+	stats, err := Import(ctx, store, NostrRsRelay(ctx, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Imported != 1 || stats.Invalid != 0 {
+		t.Fatalf("expected the visible event to be imported, got %+v", stats)
+	}
+
+	if _, err := Import(ctx, store, NostrRsRelay(ctx, filepath.Join(t.TempDir(), "missing.db"))); err == nil {
+		t.Fatal("expected an error for a missing database")
+	}
+}
@@ -0,0 +1,196 @@
+// The encrypt package defines a middleware that encrypts the content of the events with AES-GCM before saving them,
+// and decrypts it when they are queried, for operators storing private events (e.g. DM archives) on untrusted disks.
+//
+//	store, err := encrypt.New(sqliteStore, key, encrypt.WithTags())
+//
+// The fields used by the filters (id, pubkey, kind, created_at and the single-letter tags) are kept in plaintext,
+// so queries work as before, except full-text searches (NIP-50) of the content. The id and the signature are not changed,
+// so the decrypted events are valid. Events stored before the encryption are returned as they are.
+package encrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+const (
+	prefix  = "aes-gcm:" // the prefix of the encrypted values
+	tagName = "aes-gcm"  // the name of the encrypted tags
+)
+
+// Store wraps a [nastro.Store], encrypting the events it saves.
+type Store struct {
+	nastro.Store
+	aead cipher.AEAD
+	tags bool
+}
+
+type Option func(*Store) error
+
+// WithTags encrypts the tags that are not indexed by the stores too, the ones whose name is longer than one letter.
+// Each is replaced by a tag named "aes-gcm" in the same position, so that the order of the tags is preserved.
+func WithTags() Option {
+	return func(s *Store) error {
+		s.tags = true
+		return nil
+	}
+}
+
+// New returns a store that encrypts the events saved in the store with the key, which must be 16, 24 or 32 bytes long
+// to use AES-128, AES-192 or AES-256.
+func New(store nastro.Store, key []byte, opts ...Option) (*Store, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{Store: store, aead: aead}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New].
+// It returns an error if the key or any of the options is invalid.
+func Middleware(key []byte, opts ...Option) (nastro.Middleware, error) {
+	if _, err := New(nil, key, opts...); err != nil {
+		return nil, err
+	}
+
+	return func(store nastro.Store) nastro.Store {
+		s, _ := New(store, key, opts...)
+		return s
+	}, nil
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	encrypted, err := s.encrypt(event)
+	if err != nil {
+		return err
+	}
+	return s.Store.Save(ctx, encrypted)
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	encrypted, err := s.encrypt(event)
+	if err != nil {
+		return false, err
+	}
+	return s.Store.Replace(ctx, encrypted)
+}
+
+// Query the store and decrypt the events.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	events, err := s.Store.Query(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		if err := s.decrypt(&events[i]); err != nil {
+			return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+	}
+	return events, nil
+}
+
+// encrypt returns a copy of the event with the content, and the tags if enabled, encrypted.
+func (s *Store) encrypt(event *nostr.Event) (*nostr.Event, error) {
+	encrypted := *event
+	encrypted.Content = s.seal(event.ID, []byte(event.Content))
+	if !s.tags {
+		return &encrypted, nil
+	}
+
+	encrypted.Tags = make(nostr.Tags, len(event.Tags))
+	for i, tag := range event.Tags {
+		if indexed(tag) {
+			encrypted.Tags[i] = tag
+			continue
+		}
+
+		plain, err := json.Marshal(tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt event ID %s: %w", event.ID, err)
+		}
+		encrypted.Tags[i] = nostr.Tag{tagName, s.seal(event.ID, plain)}
+	}
+	return &encrypted, nil
+}
+
+// decrypt the content and the tags of the event in place.
+func (s *Store) decrypt(event *nostr.Event) error {
+	if strings.HasPrefix(event.Content, prefix) {
+		content, err := s.open(event.ID, event.Content)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt event ID %s: %w", event.ID, err)
+		}
+		event.Content = string(content)
+	}
+
+	for i, tag := range event.Tags {
+		if len(tag) != 2 || tag[0] != tagName {
+			continue
+		}
+
+		plain, err := s.open(event.ID, tag[1])
+		if err != nil {
+			return fmt.Errorf("failed to decrypt event ID %s: %w", event.ID, err)
+		}
+
+		var decrypted nostr.Tag
+		if err := json.Unmarshal(plain, &decrypted); err != nil {
+			return fmt.Errorf("failed to decrypt event ID %s: %w", event.ID, err)
+		}
+		event.Tags[i] = decrypted
+	}
+	return nil
+}
+
+// seal encrypts the plaintext with a random nonce, authenticating the id of the event, so that the ciphertext
+// can't be moved to another event. It returns the prefix followed by the nonce and the ciphertext in base64.
+func (s *Store) seal(id string, plaintext []byte) string {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	rand.Read(nonce)
+
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(id))
+	return prefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// open decrypts the value returned by seal.
+func (s *Store) open(id string, value string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, []byte(id))
+}
+
+// indexed reports whether the tag is indexed by the stores, meaning its name is a single letter.
+func indexed(tag nostr.Tag) bool {
+	return len(tag) > 0 && len(tag[0]) == 1
+}
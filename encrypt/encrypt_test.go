@@ -0,0 +1,134 @@
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var (
+	ctx = context.Background()
+	key = bytes.Repeat([]byte{1}, 32)
+)
+
+func newStore(t *testing.T, opts ...Option) (*Store, nastro.Store) {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(backend, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, _ := newStore(t, WithTags())
+		return store
+	})
+}
+
+func TestEncrypt(t *testing.T) {
+	store, backend := newStore(t, WithTags())
+	event := nostr.Event{
+		ID:        "dm",
+		PubKey:    "alice",
+		Kind:      4,
+		CreatedAt: 1,
+		Content:   "hello bob",
+		Tags:      nostr.Tags{{"p", "bob"}, {"subject", "secret"}, {"e", "root"}},
+	}
+
+	if err := store.Save(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := backend.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"p": {"bob"}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 {
+		t.Fatalf("expected the event to be found by its plaintext tags, got %v", stored)
+	}
+
+	if !strings.HasPrefix(stored[0].Content, prefix) || stored[0].Tags[1][0] != tagName {
+		t.Fatalf("expected the content and the subject to be encrypted, got %v", stored[0])
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || !reflect.DeepEqual(events[0], event) {
+		t.Fatalf("expected %v, got %v", event, events)
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	store, backend := newStore(t)
+	if err := backend.Save(ctx, &nostr.Event{ID: "old", Kind: 1, Content: "stored before the encryption"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Content != "stored before the encryption" {
+		t.Fatalf("expected the plaintext event, got %v", events)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	store, backend := newStore(t)
+	if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1, Content: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := backend.Query(ctx, nostr.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the content moved to another event can't be decrypted
+	if err := backend.Save(ctx, &nostr.Event{ID: "b", Kind: 1, CreatedAt: 1, Content: stored[0].Content}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Limit: 2}); !errors.Is(err, nastro.ErrInternalQuery) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrInternalQuery, err)
+	}
+
+	other, err := New(backend, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.Query(ctx, nostr.Filter{IDs: []string{"a"}, Limit: 1}); err == nil {
+		t.Fatal("expected an error decrypting with another key")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if _, err := New(nil, []byte("short")); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,86 @@
+package ephemeral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Clear removes all the events from the store, including the ones in the ring of [WithEphemeralKinds].
+func (s *Store) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reset(s.capacity)
+	for _, ring := range s.rings() {
+		ring.reset(ring.capacity)
+	}
+}
+
+// Drain moves the stored events that are not expired into dst, oldest created_at first, returning how many were moved.
+// Replaceable and addressable events are moved with [nastro.Store.Replace], the others with [nastro.Store.Save].
+// Events that dst already has are removed as if moved, while the events of ephemeral kinds kept by
+// [WithEphemeralKinds] are never moved.
+//
+// The store is not locked while writing to dst, so events saved in the meantime are left for the next drain.
+// On error, or if the context is cancelled, the events not yet moved are left in the store.
+func (s *Store) Drain(ctx context.Context, dst nastro.Store) (int, error) {
+	s.mu.RLock()
+	now := time.Now()
+	var events []*nostr.Event
+	for _, ring := range s.retained() {
+		for pos, event := range ring.events {
+			if event != nil && !ring.isExpired(pos, now) {
+				events = append(events, event)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(events, func(e1, e2 *nostr.Event) int { return -compare(e1, e2) })
+
+	var moved []*nostr.Event
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, event := range moved {
+			ring := s.ring(event)
+			if pos := ring.ids.first(event.ID); pos != -1 && ring.events[pos] == event {
+				ring.remove(pos)
+			}
+		}
+	}()
+
+	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return len(moved), err
+		}
+
+		if err := move(ctx, dst, event); err != nil {
+			return len(moved), fmt.Errorf("failed to drain event ID %s: %w", event.ID, err)
+		}
+		moved = append(moved, event)
+	}
+	return len(moved), nil
+}
+
+// move saves or replaces the event in dst, ignoring duplicates.
+func move(ctx context.Context, dst nastro.Store, event *nostr.Event) error {
+	var err error
+	if nastro.IsValidReplacement(event.Kind) {
+		_, err = dst.Replace(ctx, event)
+	} else {
+		err = dst.Save(ctx, event)
+	}
+
+	if errors.Is(err, nastro.ErrDuplicate) {
+		return nil
+	}
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/pippellia-btc/nastro"
@@ -18,16 +19,60 @@ var DefaultCapacity int = 1000
 // Ephemeral is an in-memory, thread-safe ring-buffer for storing Nostr events.
 // It maintains a fixed memory footprint, storing up to `capacity` events.
 // When new events are saved and the capacity is full, they overwrite the oldest events
-// in a circular fashion.
+// in a circular fashion, unless another [Eviction] is set.
 //
 // Due to its expected small capacity (e.g. 1000 events) and in-memory nature,
 // it does not impose write or query limits by default.
+//
+// Events are indexed by id, pubkey, kind and address (for replaceable and addressable events),
+// so that queries only check the events of their most selective index.
+//
+// Events with a NIP-40 expiration, or older than the TTL set with [WithTTL], are skipped once expired.
 type Store struct {
 	mu       sync.RWMutex
 	events   []*nostr.Event
-	write    int
+	free     []int // the free positions, possibly including some that have been filled since
+	size     int   // the number of non-nil events
 	capacity int
+	bytes    int // the approximate size of the events, see [WithMaxBytes]
+	maxBytes int
+	sizes    []int // the approximate size of each event
+
+	ttl       time.Duration
+	deadlines []int64 // when each event expires in unix nanoseconds, 0 if never
+	compacted time.Time
+
+	window      time.Duration
+	maxCapacity int
+	saved       []int64 // when each event was saved in unix nanoseconds, see [WithWindow]
+
+	eviction            Eviction
+	protectReplaceables bool
+	duplicates          bool // whether Save returns [nastro.ErrDuplicate] for events already stored
+
+	queueMu  sync.Mutex // guards the eviction queue, which is also updated by queries
+	queue    *queue
+	priority []int64
+	tick     int64
+
+	ids       index[string]
+	pubkeys   index[string]
+	kinds     index[int]
+	addresses index[string]
+
+	snapshotPath string
 
+	ephemeralKinds    bool
+	ephemeralCapacity int
+	ephemerals        *Store // the ring of the events of ephemeral kinds, see [WithEphemeralKinds]
+
+	kindCapacity map[int]int
+	kindRings    map[int]*Store // the rings of the events of specific kinds, see [WithKindCapacity]
+
+	subsMu sync.Mutex
+	subs   map[*subscription]struct{}
+
+	metrics         nastro.Collector
 	validateEvent   nastro.EventPolicy
 	sanitizeFilters nastro.FilterPolicy
 }
@@ -41,7 +86,6 @@ func WithCapacity(n int) Option {
 		}
 
 		s.capacity = n
-		s.events = make([]*nostr.Event, n)
 		return nil
 	}
 }
@@ -64,13 +108,25 @@ func WithEventPolicy(v nastro.EventPolicy) Option {
 	}
 }
 
+// WithDuplicateError makes [Store.Save] return [nastro.ErrDuplicate] when the event is already stored,
+// so that relays can answer with "OK false duplicate:" as per NIP-01.
+// By default, duplicates are silently ignored.
+func WithDuplicateError() Option {
+	return func(s *Store) error {
+		s.duplicates = true
+		return nil
+	}
+}
+
 // New returns an ephemeral store with the provided capacity.
 func New(opts ...Option) (*Store, error) {
 	store := &Store{
-		events:          make([]*nostr.Event, DefaultCapacity),
 		capacity:        DefaultCapacity,
+		maxCapacity:     DefaultMaxCapacity,
+		subs:            make(map[*subscription]struct{}),
+		metrics:         nastro.NoMetrics{},
 		validateEvent:   func(*nostr.Event) error { return nil },
-		sanitizeFilters: func(...nostr.Filter) (nostr.Filters, error) { return nil, nil },
+		sanitizeFilters: func(filters ...nostr.Filter) (nostr.Filters, error) { return filters, nil },
 	}
 
 	for _, opt := range opts {
@@ -78,19 +134,34 @@ func New(opts ...Option) (*Store, error) {
 			return nil, err
 		}
 	}
+
+	store.reset(store.capacity)
+	if store.ephemeralCapacity > 0 {
+		store.ephemerals = store.newRing(store.ephemeralCapacity)
+	}
+
+	store.kindRings = make(map[int]*Store, len(store.kindCapacity))
+	for kind, capacity := range store.kindCapacity {
+		store.kindRings[kind] = store.newRing(capacity)
+	}
+
+	if store.snapshotPath != "" {
+		if err := store.restoreFile(store.snapshotPath); err != nil {
+			return nil, err
+		}
+	}
 	return store, nil
 }
 
-// Size returns the number of events currently stored.
+// Size returns the number of events currently stored, including the expired ones not yet compacted
+// and the ones in the rings of [WithKindCapacity] and [WithEphemeralKinds].
 func (s *Store) Size() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var size int
-	for _, event := range s.events {
-		if event != nil {
-			size++
-		}
+	size := s.size
+	for _, ring := range s.rings() {
+		size += ring.size
 	}
 	return size
 }
@@ -102,143 +173,337 @@ func (s *Store) Capacity() int {
 	return s.capacity
 }
 
-// Resize the ephemeral store with the provided capacity.
-func (s *Store) Resize(capacity int) {
+// Resize the ephemeral store with the provided capacity, keeping the events that are not expired.
+// When shrinking below the number of events, the newest by created_at are kept, in their eviction order.
+// The rings of [WithKindCapacity] and [WithEphemeralKinds] are not resized.
+func (s *Store) Resize(capacity int) error {
+	if capacity < 1 {
+		return fmt.Errorf("failed to resize: capacity must be positive, got %d", capacity)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.write = 0
-	s.capacity = capacity
-	events := make([]*nostr.Event, capacity)
-
-	for _, event := range s.events {
-		if event != nil {
-			events[s.write] = event
-			s.write++
+	positions := s.live(time.Now())
+	if len(positions) > capacity {
+		slices.SortFunc(positions, func(p1, p2 int) int { return compare(s.events[p1], s.events[p2]) })
+		positions = positions[:capacity]
+	}
 
-			if s.write >= capacity {
-				// reached capacity
-				break
-			}
-		}
+	positions = s.evictionOrder(positions)
+	old, deadlines, saved := s.events, s.deadlines, s.saved
+	s.reset(capacity)
+
+	for _, i := range positions {
+		event := old[i]
+		s.makeRoom(approxSize(event))
+		pos := s.slot()
+		s.put(pos, event)
+		s.deadlines[pos] = deadlines[i]
+		s.saved[pos] = saved[i]
 	}
-	s.events = events
+	return nil
 }
 
+// Save the event in the store. If the event is already stored, nothing happens and nil is returned,
+// unless the store uses [WithDuplicateError].
+// The store keeps a copy of the event, so the caller is free to modify it afterwards.
 func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	start := time.Now()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	saved, err := s.save(event)
+	s.observeWrite(nastro.OpSave, start, saved, err)
+	return err
+}
+
+// save a copy of the event, and report whether it was stored.
+func (s *Store) save(event *nostr.Event) (bool, error) {
 	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	event = clone(event)
+
+	now := time.Now()
+	if isExpired(event, now) {
+		return false, nil
+	}
+
+	ring := s.ring(event)
+	if ring == nil {
+		// the event is not stored, only broadcast
+		s.broadcast(event)
+		return false, nil
+	}
+
+	ring.maybeCompact(now)
+	if ring.isDuplicate(event.ID, now) {
+		if s.duplicates {
+			return false, fmt.Errorf("%w: event ID %s", nastro.ErrDuplicate, event.ID)
+		}
+		return false, nil
+	}
+
+	if err := ring.insert(event); err != nil {
+		return false, err
+	}
+
+	s.broadcast(event)
+	return true, nil
+}
+
+// newest returns the position of the newest event with the provided address, or -1 if there are none.
+// Older copies, which can be stored by [Store.Save], are removed along with the expired ones.
+func (s *Store) newest(addr string, now time.Time) int {
+	newest := -1
+	for _, pos := range s.addresses.lookup(addr) {
+		switch {
+		case s.isExpired(pos, now):
+			s.remove(pos)
+			s.metrics.Evict(true)
+
+		case newest == -1:
+			newest = pos
+
+		case compare(s.events[pos], s.events[newest]) < 0:
+			s.remove(newest)
+			newest = pos
+
+		default:
+			s.remove(pos)
+		}
+	}
+	return newest
+}
+
+// isDuplicate returns whether an event with the provided ID is stored and not expired.
+// Expired copies are removed, so that the event can be saved again.
+func (s *Store) isDuplicate(id string, now time.Time) bool {
+	pos := s.ids.first(id)
+	if pos == -1 {
+		return false
+	}
+
+	if s.isExpired(pos, now) {
+		s.remove(pos)
+		s.metrics.Evict(true)
+		return false
+	}
+	return true
+}
+
+// insert the event in a free position, evicting other events if the store is full.
+func (s *Store) insert(event *nostr.Event) error {
+	if err := s.fits(event); err != nil {
 		return err
 	}
 
-	s.events[s.write] = event
-	s.write = (s.write + 1) % s.capacity
+	s.makeRoom(approxSize(event))
+	s.put(s.slot(), event)
 	return nil
 }
 
 func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	start := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced, err := s.replace(event)
+	s.observeWrite(nastro.OpReplace, start, replaced, err)
+	return replaced, err
+}
+
+func (s *Store) replace(event *nostr.Event) (bool, error) {
 	if !nastro.IsValidReplacement(event.Kind) {
 		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if err := s.validateEvent(event); err != nil {
 		return false, err
 	}
 
-	for i, stored := range s.events {
-		if stored == nil {
-			continue
-		}
+	event = clone(event)
 
-		if isReplacementCandidate(event, stored) {
-			if event.CreatedAt > stored.CreatedAt {
-				s.events[i] = event
-				return true, nil
-			}
-			return false, nil
-		}
+	now := time.Now()
+	if isExpired(event, now) {
+		return false, nil
 	}
 
-	// no candidates found, save
-	s.events[s.write] = event
-	s.write = (s.write + 1) % s.capacity
-	return true, nil
-}
+	ring := s.ring(event)
+	ring.maybeCompact(now)
 
-// isReplacementCandidate returns whether e1 and e2 are of the same category (replaceable, addressable), and same kind, author...
-func isReplacementCandidate(e1, e2 *nostr.Event) bool {
-	switch {
-	case nostr.IsReplaceableKind(e1.Kind):
-		return e1.Kind == e2.Kind && e1.PubKey == e2.PubKey
+	addr, _ := address(event)
+	if pos := ring.newest(addr, now); pos != -1 {
+		if event.CreatedAt <= ring.events[pos].CreatedAt {
+			return false, nil
+		}
 
-	case nostr.IsAddressableKind(e1.Kind):
-		d1 := e1.Tags.GetD()
-		d2 := e2.Tags.GetD()
-		return e1.Kind == e2.Kind && e1.PubKey == e2.PubKey && d1 == d2
+		if err := ring.fits(event); err != nil {
+			return false, err
+		}
+		ring.remove(pos)
+	}
 
-	default:
-		return false
+	if err := ring.insert(event); err != nil {
+		return false, err
 	}
+
+	s.broadcast(event)
+	return true, nil
 }
 
 func (s *Store) Delete(ctx context.Context, id string) error {
+	start := time.Now()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	pos := slices.IndexFunc(s.events, func(event *nostr.Event) bool { return event != nil && event.ID == id })
-	if pos == -1 {
-		return nil
+	var deleted bool
+	for _, ring := range append([]*Store{s}, s.rings()...) {
+		if pos := ring.ids.first(id); pos != -1 {
+			ring.remove(pos)
+			deleted = true
+		}
 	}
 
-	s.events[pos] = nil
+	s.observeWrite(nastro.OpDelete, start, deleted, nil)
 	return nil
 }
 
-func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
-	filters, err := s.sanitizeFilters(filters...)
+// Query returns the stored events matching any of the filters, sorted by created_at descending and id ascending.
+// Each filter with a positive Limit contributes at most Limit events, its newest ones,
+// while filters with LimitZero are skipped, as they only make sense for counts and subscriptions.
+// The returned events are deep copies, so modifying them doesn't affect the stored ones.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) (events []nostr.Event, err error) {
+	start := time.Now()
+	defer func() { s.metrics.Observe(nastro.OpQuery, time.Since(start), int64(len(events)), err) }()
+
+	filters, err = s.sanitizeFilters(filters...)
 	if err != nil {
 		return nil, err
 	}
 
-	var events []nostr.Event
-	for _, event := range s.events {
-		if event == nil {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := make(map[string]struct{})
+	for _, filter := range filters {
+		if filter.LimitZero {
+			// the filter only asks for future events, or for a count
 			continue
 		}
 
-		for i := range filters {
-			if filters[i].Matches(event) {
-				events = append(events, *event)
-				break
+		results := s.query(filter)
+		for _, ring := range s.rings() {
+			results = append(results, ring.query(filter)...)
+		}
+
+		if filter.Limit > 0 && len(results) > filter.Limit {
+			// the rings contributed more than the limit together
+			slices.SortFunc(results, func(e1, e2 nostr.Event) int { return compare(&e1, &e2) })
+			results = results[:filter.Limit]
+		}
+
+		for _, event := range results {
+			if _, ok := matched[event.ID]; !ok {
+				matched[event.ID] = struct{}{}
+				events = append(events, event)
 			}
 		}
 	}
 
-	// sort events in descending order by their CreatedAt
-	slices.SortFunc(events, func(e1, e2 nostr.Event) int { return cmp.Compare(e2.CreatedAt, e1.CreatedAt) })
+	slices.SortFunc(events, func(e1, e2 nostr.Event) int { return compare(&e1, &e2) })
 	return events, nil
 }
 
+// query returns the events matching the filter, at most Limit if positive.
+func (s *Store) query(filter nostr.Filter) []nostr.Event {
+	var positions []int
+	s.match(filter, func(pos int) { positions = append(positions, pos) })
+
+	if filter.Limit > 0 && len(positions) > filter.Limit {
+		// only the events within the limit are copied
+		slices.SortFunc(positions, func(p1, p2 int) int { return compare(s.events[p1], s.events[p2]) })
+		positions = positions[:filter.Limit]
+	}
+
+	events := make([]nostr.Event, len(positions))
+	for i, pos := range positions {
+		events[i] = *clone(s.events[pos])
+	}
+
+	s.touch(positions)
+	return events
+}
+
+// clone returns a deep copy of the event. The strings are immutable, so only the tags need copying,
+// which is done with a single backing slice for all their values.
+func clone(event *nostr.Event) *nostr.Event {
+	c := *event
+	if event.Tags == nil {
+		return &c
+	}
+
+	var size int
+	for _, tag := range event.Tags {
+		size += len(tag)
+	}
+
+	values := make([]string, 0, size)
+	c.Tags = make(nostr.Tags, len(event.Tags))
+	for i, tag := range event.Tags {
+		values = append(values, tag...)
+		c.Tags[i] = values[len(values)-len(tag) : len(values) : len(values)]
+	}
+	return &c
+}
+
+// compare sorts events by created_at descending, breaking ties by id ascending.
+func compare(e1, e2 *nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
+
 func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
 	if len(filters) == 0 {
 		return 0, nil
 	}
 
+	start := time.Now()
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var count int
+	defer func() { s.metrics.Observe(nastro.OpCount, time.Since(start), int64(count), nil) }()
+
 	for _, filter := range filters {
-		for _, event := range s.events {
-			if event != nil && filter.Matches(event) {
-				count++
-			}
+		s.match(filter, func(int) { count++ })
+		for _, ring := range s.rings() {
+			ring.match(filter, func(int) { count++ })
 		}
 	}
 	return int64(count), nil
 }
+
+// match calls fn with the position of every non-expired event matching the filter.
+func (s *Store) match(filter nostr.Filter, fn func(pos int)) {
+	now := time.Now()
+	positions, ok := s.candidates(filter)
+	if !ok {
+		for pos, event := range s.events {
+			if event != nil && !s.isExpired(pos, now) && filter.Matches(event) {
+				fn(pos)
+			}
+		}
+		return
+	}
+
+	for _, pos := range positions {
+		if !s.isExpired(pos, now) && filter.Matches(s.events[pos]) {
+			fn(pos)
+		}
+	}
+}
@@ -4,6 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -36,21 +43,23 @@ func TestConcurrency(t *testing.T) {
 
 	expectedSize := atomic.Int64{}
 	errChan := make(chan error, 10)
+	saved := make(chan string, capacity) // the IDs saved, so that every deletion is successful
 
 	// Saver
 	go func() {
 		ticker := time.NewTicker(saveEvery)
-		for {
+		for i := 0; ; i++ {
 			select {
 			case <-ctx.Done():
 				return
 
 			case <-ticker.C:
 				event := utils.RandomEvent()
-				event.ID = "0" // so every deletion is successful
+				event.ID = strconv.Itoa(i)
 
 				store.Save(ctx, event)
 				expectedSize.Add(1)
+				saved <- event.ID
 			}
 		}
 	}()
@@ -64,8 +73,12 @@ func TestConcurrency(t *testing.T) {
 				return
 
 			case <-ticker.C:
-				store.Delete(ctx, "0")
-				expectedSize.Add(-1)
+				select {
+				case id := <-saved:
+					store.Delete(ctx, id)
+					expectedSize.Add(-1)
+				default:
+				}
 			}
 		}
 	}()
@@ -106,6 +119,65 @@ func TestConcurrency(t *testing.T) {
 	}
 }
 
+// Run with `go test -race` to verify that queries are safe while saving
+func TestQueryConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			event := &nostr.Event{ID: strconv.Itoa(i), Kind: i % 3, CreatedAt: nostr.Timestamp(i)}
+			if err := store.Save(ctx, event); err != nil {
+				t.Error(err)
+			}
+
+			if i%10 == 0 {
+				store.Delete(ctx, strconv.Itoa(i-5))
+			}
+		}
+	}()
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				events, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Limit: 10})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !slices.IsSortedFunc(events, func(e1, e2 nostr.Event) int { return compare(&e1, &e2) }) {
+					t.Errorf("events are not sorted: %v", events)
+				}
+
+				if size := store.Size(); size > store.Capacity() {
+					t.Errorf("size %d is above capacity %d", size, store.Capacity())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var size int
+	for _, event := range store.events {
+		if event != nil {
+			size++
+		}
+	}
+
+	if size != store.Size() {
+		t.Fatalf("expected size %d, got %d", size, store.Size())
+	}
+}
+
 func TestReplace(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -115,6 +187,7 @@ func TestReplace(t *testing.T) {
 		saved bool
 		err   error
 		size  int
+		ids   []string // the IDs stored after the replacement, if not nil
 	}{
 		{
 			name:  "regular event, error",
@@ -144,6 +217,30 @@ func TestReplace(t *testing.T) {
 			saved: true,
 			size:  1,
 		},
+		{
+			name:  "interleaved copies, all replaced",
+			setup: Copies(2, 5, 1),
+			event: &nostr.Event{ID: "new", Kind: 3, CreatedAt: 6},
+			saved: true,
+			size:  2,
+			ids:   []string{"new", "other"},
+		},
+		{
+			name:  "interleaved copies, newer than a stale copy but not the newest",
+			setup: Copies(2, 5, 1),
+			event: &nostr.Event{ID: "new", Kind: 3, CreatedAt: 3},
+			saved: false,
+			size:  2,
+			ids:   []string{"c1", "other"},
+		},
+		{
+			name:  "interleaved copies, same created_at",
+			setup: Copies(5, 5),
+			event: &nostr.Event{ID: "new", Kind: 3, CreatedAt: 5},
+			saved: false,
+			size:  2,
+			ids:   []string{"c0", "other"},
+		},
 	}
 
 	for _, test := range tests {
@@ -167,15 +264,1098 @@ func TestReplace(t *testing.T) {
 			if size != test.size {
 				t.Fatalf("expected size %d, got %v", test.size, size)
 			}
+
+			if test.ids != nil {
+				if ids := storedIDs(store); !slices.Equal(ids, test.ids) {
+					t.Fatalf("expected IDs %v, got %v", test.ids, ids)
+				}
+			}
 		})
 	}
 }
 
-func TestInterface(t *testing.T) {
-	var _ nastro.Store = &Store{}
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(3), WithFilterPolicy(All))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1},
+		{ID: "b", PubKey: "bob", Kind: 1, CreatedAt: 2},
+		{ID: "c", PubKey: "alice", Kind: 0, CreatedAt: 3},
+		{ID: "d", PubKey: "bob", Kind: 7, CreatedAt: 4}, // overwrites "a"
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filters  []nostr.Filter
+		expected []string
+	}{
+		{name: "overwritten id", filters: []nostr.Filter{{IDs: []string{"a"}}}, expected: nil},
+		{name: "ids", filters: []nostr.Filter{{IDs: []string{"a", "b", "c"}}}, expected: []string{"c", "b"}},
+		{name: "authors", filters: []nostr.Filter{{Authors: []string{"alice"}}}, expected: []string{"c"}},
+		{name: "kinds", filters: []nostr.Filter{{Kinds: []int{1, 7}}}, expected: []string{"d", "b"}},
+		{name: "authors and kinds", filters: []nostr.Filter{{Authors: []string{"bob"}, Kinds: []int{7}}}, expected: []string{"d"}},
+		{name: "no index", filters: []nostr.Filter{{}}, expected: []string{"d", "c", "b"}},
+		{name: "overlapping filters", filters: []nostr.Filter{{Kinds: []int{1}}, {Authors: []string{"bob"}}}, expected: []string{"d", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := store.Query(ctx, test.filters...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]string, len(res))
+			for i, event := range res {
+				ids[i] = event.ID
+			}
+
+			if !slices.Equal(ids, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		if err := store.Delete(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := store.Count(ctx, nostr.Filter{Authors: []string{"bob"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("expected count 1, got %d", count)
+		}
+	})
 }
 
-func Empty() (*Store, error) { return New(WithCapacity(100)) }
+func TestQueryLimit(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5 {
+		event := &nostr.Event{ID: strconv.Itoa(i), Kind: i % 2, CreatedAt: nostr.Timestamp(i)}
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filters  []nostr.Filter
+		expected []string
+	}{
+		{name: "no limit", filters: []nostr.Filter{{}}, expected: []string{"4", "3", "2", "1", "0"}},
+		{name: "limit", filters: []nostr.Filter{{Limit: 2}}, expected: []string{"4", "3"}},
+		{name: "limit above size", filters: []nostr.Filter{{Limit: 10}}, expected: []string{"4", "3", "2", "1", "0"}},
+		{name: "limit zero", filters: []nostr.Filter{{LimitZero: true}}, expected: nil},
+		{name: "limit per filter", filters: []nostr.Filter{{Kinds: []int{0}, Limit: 1}, {Kinds: []int{1}, Limit: 1}}, expected: []string{"4", "3"}},
+		{name: "limit zero and limit", filters: []nostr.Filter{{LimitZero: true}, {Kinds: []int{1}, Limit: 1}}, expected: []string{"3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := store.Query(ctx, test.filters...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]string, len(res))
+			for i, event := range res {
+				ids[i] = event.ID
+			}
+
+			if !slices.Equal(ids, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+
+	t.Run("count ignores limits", func(t *testing.T) {
+		count, err := store.Count(ctx, nostr.Filter{LimitZero: true}, nostr.Filter{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 10 {
+			t.Fatalf("expected count 10, got %d", count)
+		}
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	ctx := context.Background()
+	const capacity = 100_000
+
+	store, err := New(WithCapacity(capacity), WithFilterPolicy(All))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range capacity {
+		event := &nostr.Event{
+			ID:        strconv.Itoa(i),
+			PubKey:    strconv.Itoa(i % 1000),
+			Kind:      i % 10,
+			CreatedAt: nostr.Timestamp(i),
+			Tags:      nostr.Tags{{"t", strconv.Itoa(i % 100)}},
+		}
+
+		if err := store.Save(ctx, event); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	filters := map[string]nostr.Filter{
+		"ids":     {IDs: []string{"1", "10", "100"}},
+		"authors": {Authors: []string{"1", "2"}},
+		"kinds":   {Kinds: []int{1}},
+		"scan":    {Tags: nostr.TagMap{"t": {"1"}}},
+	}
+
+	for name, filter := range filters {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := store.Query(ctx, filter); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("replace", func(b *testing.B) {
+		event := &nostr.Event{ID: "profile", PubKey: "1", Kind: 0}
+		for b.Loop() {
+			event.CreatedAt++
+			if _, err := store.Replace(ctx, event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		eviction Eviction
+		expected []string
+	}{
+		{eviction: EvictFirstSaved, expected: []string{"b", "c", "d"}},
+		{eviction: EvictLeastRecentlyMatched, expected: []string{"a", "c", "d"}},
+		{eviction: EvictOldest, expected: []string{"a", "b", "d"}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("eviction %d", test.eviction), func(t *testing.T) {
+			ctx := context.Background()
+			store, err := New(WithCapacity(3), WithEviction(test.eviction))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, id := range []string{"a", "b", "c"} {
+				if err := store.Save(ctx, &nostr.Event{ID: id, Kind: 1, CreatedAt: nostr.Timestamp(3 - i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := store.Query(ctx, nostr.Filter{IDs: []string{"a"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Save(ctx, &nostr.Event{ID: "d", Kind: 1, CreatedAt: 4}); err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := storedIDs(store); !slices.Equal(ids, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+
+	t.Run("protected replaceables", func(t *testing.T) {
+		ctx := context.Background()
+		store, err := New(WithCapacity(2), WithProtectedReplaceables())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		steps := []struct {
+			event    *nostr.Event
+			expected []string
+		}{
+			{event: &nostr.Event{ID: "p1", PubKey: "alice", Kind: 0, CreatedAt: 1}, expected: []string{"p1"}},
+			{event: &nostr.Event{ID: "n1", PubKey: "alice", Kind: 1, CreatedAt: 2}, expected: []string{"n1", "p1"}},
+			{event: &nostr.Event{ID: "n2", PubKey: "alice", Kind: 1, CreatedAt: 3}, expected: []string{"n2", "p1"}},
+			{event: &nostr.Event{ID: "p2", PubKey: "alice", Kind: 0, CreatedAt: 4}, expected: []string{"p1", "p2"}},
+			{event: &nostr.Event{ID: "n3", PubKey: "alice", Kind: 1, CreatedAt: 5}, expected: []string{"n3", "p2"}},
+		}
+
+		for _, step := range steps {
+			if err := store.Save(ctx, step.event); err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := storedIDs(store); !slices.Equal(ids, step.expected) {
+				t.Fatalf("after saving %s: expected %v, got %v", step.event.ID, step.expected, ids)
+			}
+		}
+	})
+
+	t.Run("all protected", func(t *testing.T) {
+		ctx := context.Background()
+		store, err := New(WithCapacity(1), WithProtectedReplaceables())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, event := range []*nostr.Event{{ID: "p", Kind: 0}, {ID: "n", Kind: 1}} {
+			if err := store.Save(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if ids := storedIDs(store); !slices.Equal(ids, []string{"n"}) {
+			t.Fatalf("expected [n], got %v", ids)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := New(WithEviction(Eviction(-1))); err == nil {
+			t.Fatal("expected an error for an unknown eviction")
+		}
+	})
+}
+
+func TestMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("x", 100)
+	size := approxSize(&nostr.Event{ID: "a", Content: content})
+
+	store, err := New(WithCapacity(100), WithMaxBytes(2*size+size/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Save(ctx, &nostr.Event{ID: id, Kind: 1, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"b", "c"}
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	if store.Bytes() != 2*size {
+		t.Fatalf("expected %d bytes, got %d", 2*size, store.Bytes())
+	}
+
+	large := &nostr.Event{ID: "d", Kind: 1, Content: strings.Repeat("x", 1000)}
+	if err := store.Save(ctx, large); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected error %v, got %v", ErrTooLarge, err)
+	}
+
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	if err := store.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Bytes() != size {
+		t.Fatalf("expected %d bytes, got %d", size, store.Bytes())
+	}
+
+	t.Run("all protected", func(t *testing.T) {
+		// the store is not full, so the empty positions must not be picked as victims
+		size := approxSize(&nostr.Event{ID: "a", PubKey: "a", Content: content})
+		store, err := New(WithCapacity(100), WithMaxBytes(2*size+size/2), WithProtectedReplaceables())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pubkey := range []string{"a", "b", "c"} {
+			event := &nostr.Event{ID: pubkey, PubKey: pubkey, Kind: 0, CreatedAt: 1, Content: content}
+			if err := store.Save(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []string{"b", "c"}
+		if ids := storedIDs(store); !slices.Equal(ids, expected) {
+			t.Fatalf("expected %v, got %v", expected, ids)
+		}
+
+		if store.Bytes() != 2*size {
+			t.Fatalf("expected %d bytes, got %d", 2*size, store.Bytes())
+		}
+	})
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(10), WithTTL(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	soon := strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10)
+
+	events := []*nostr.Event{
+		{ID: "a", Kind: 1},
+		{ID: "b", Kind: 1, Tags: nostr.Tags{{"expiration", soon}}},
+		{ID: "c", Kind: 1, Tags: nostr.Tags{{"expiration", past}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"a", "b"}
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected no events after the TTL, got %d", count)
+	}
+
+	if store.Size() != 2 {
+		t.Fatalf("expected expired events to be kept until compaction, got size %d", store.Size())
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "d", Kind: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{"d"}
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v after compaction, got %v", expected, ids)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := New(WithCapacity(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, stop := store.Subscribe(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{0}})
+	defer stop()
+
+	saved := []*nostr.Event{
+		{ID: "a", Kind: 1},
+		{ID: "b", Kind: 7},
+		{ID: "c", Kind: 1},
+	}
+
+	for _, event := range saved {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{ID: "d", Kind: 0, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{ID: "e", Kind: 0, CreatedAt: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+	var received []string
+	for event := range events {
+		received = append(received, event.ID)
+	}
+
+	expected := []string{"a", "c", "d"}
+	if !slices.Equal(received, expected) {
+		t.Fatalf("expected %v, got %v", expected, received)
+	}
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, _ := store.Subscribe(ctx, nostr.Filter{})
+		cancel()
+
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Fatal("expected no events")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the channel to be closed")
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Save(ctx, &nostr.Event{ID: id, Kind: 1, Tags: nostr.Tags{{"t", id}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Snapshot(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	restored, err := New(WithCapacity(3), WithSnapshotFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := store.Query(ctx, nostr.Filter{})
+	events, _ := restored.Query(ctx, nostr.Filter{})
+	if !slices.EqualFunc(events, expected, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID && e1.Tags[0][1] == e2.Tags[0][1] }) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+
+	// the eviction order is preserved
+	if err := restored.Save(ctx, &nostr.Event{ID: "d", Kind: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"b", "c", "d"}
+	if stored := storedIDs(restored); !slices.Equal(stored, ids) {
+		t.Fatalf("expected %v, got %v", ids, stored)
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		store, err := New(WithSnapshotFile(filepath.Join(t.TempDir(), "missing.jsonl")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if store.Size() != 0 {
+			t.Fatalf("expected an empty store, got size %d", store.Size())
+		}
+	})
+
+	t.Run("invalid snapshot", func(t *testing.T) {
+		if err := store.Restore(strings.NewReader("not json")); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+func TestDuplicate(t *testing.T) {
+	ctx := context.Background()
+	event := &nostr.Event{ID: "a", Kind: 1}
+
+	store, err := New(WithCapacity(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if store.Size() != 1 {
+		t.Fatalf("expected size 1, got %d", store.Size())
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{IDs: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+
+	t.Run("duplicate error", func(t *testing.T) {
+		store, err := New(WithCapacity(10), WithDuplicateError())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Save(ctx, event); !errors.Is(err, nastro.ErrDuplicate) {
+			t.Fatalf("expected error %v, got %v", nastro.ErrDuplicate, err)
+		}
+	})
+}
+
+func TestEphemeralKinds(t *testing.T) {
+	tests := []struct {
+		capacity int
+		expected []string
+	}{
+		{capacity: 0, expected: []string{"a", "b"}},
+		{capacity: 1, expected: []string{"a", "b", "e2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("capacity %d", test.capacity), func(t *testing.T) {
+			ctx := context.Background()
+			store, err := New(WithCapacity(2), WithEphemeralKinds(test.capacity))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			events, stop := store.Subscribe(ctx, nostr.Filter{})
+			saved := []*nostr.Event{
+				{ID: "a", Kind: 1, CreatedAt: 1},
+				{ID: "e1", Kind: 20001, CreatedAt: 2},
+				{ID: "b", Kind: 1, CreatedAt: 3},
+				{ID: "e2", Kind: 20001, CreatedAt: 4},
+			}
+
+			for _, event := range saved {
+				if err := store.Save(ctx, event); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stop()
+			var received int
+			for range events {
+				received++
+			}
+
+			if received != len(saved) {
+				t.Fatalf("expected %d events broadcast, got %d", len(saved), received)
+			}
+
+			results, err := store.Query(ctx, nostr.Filter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, event := range results {
+				ids = append(ids, event.ID)
+			}
+
+			slices.Sort(ids)
+			if !slices.Equal(ids, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, ids)
+			}
+
+			limited, err := store.Query(ctx, nostr.Filter{Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(limited) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(limited))
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	src, err := New(WithCapacity(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := []*nostr.Event{
+		{ID: "c", Kind: 1, CreatedAt: 3},
+		{ID: "a", Kind: 1, CreatedAt: 1},
+		{ID: "b", Kind: 0, CreatedAt: 2},
+	}
+
+	for _, event := range saved {
+		if err := src.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the destination evicts the first saved, so only the two newest are left if drained oldest first
+	dst, err := New(WithCapacity(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := src.Drain(ctx, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved != 3 {
+		t.Fatalf("expected 3 events moved, got %d", moved)
+	}
+
+	if src.Size() != 0 {
+		t.Fatalf("expected the source to be empty, got size %d", src.Size())
+	}
+
+	expected := []string{"b", "c"}
+	if ids := storedIDs(dst); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	dst.Clear()
+	if dst.Size() != 0 {
+		t.Fatalf("expected the destination to be cleared, got size %d", dst.Size())
+	}
+}
+
+func TestKindCapacity(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(2), WithKindCapacity(map[int]int{0: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5 {
+		note := &nostr.Event{ID: "n" + strconv.Itoa(i), Kind: 1, CreatedAt: nostr.Timestamp(i)}
+		profile := &nostr.Event{ID: "p" + strconv.Itoa(i), PubKey: strconv.Itoa(i), Kind: 0, CreatedAt: nostr.Timestamp(i)}
+
+		if err := store.Save(ctx, note); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.Replace(ctx, profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if store.Size() != 5 {
+		t.Fatalf("expected size 5, got %d", store.Size())
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+
+	expected := []string{"n4", "p4", "n3", "p3", "p2"}
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	if err := store.Delete(ctx, "p4"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected 2 profiles, got %d", count)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	ring, err := New(WithCapacity(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backing, err := New(WithCapacity(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewWriteBehind(ring, backing, WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := range 5 {
+		if err := store.Save(ctx, &nostr.Event{ID: strconv.Itoa(i), Kind: 1, CreatedAt: nostr.Timestamp(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ring only holds the two newest events, but all are returned once flushed
+	if err := store.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"1", "2", "3", "4"}
+	if ids := storedIDs(backing); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+
+	expected = []string{"4", "3", "2"}
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	t.Run("flush errors", func(t *testing.T) {
+		ring, err := New(WithCapacity(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backing, err := New(WithCapacity(10), WithMaxBytes(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var errs []error
+		store, err := NewWriteBehind(ring, backing, WithFlushErrors(func(err error) { errs = append(errs, err) }))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1, Content: strings.Repeat("x", 100)}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(errs) != 1 || !errors.Is(errs[0], ErrTooLarge) {
+			t.Fatalf("expected error %v, got %v", ErrTooLarge, errs)
+		}
+
+		if err := store.Save(ctx, &nostr.Event{ID: "b", Kind: 1}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected error %v, got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestResize(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// saved in a different order than their created_at
+	saved := []*nostr.Event{
+		{ID: "d", Kind: 1, CreatedAt: 4},
+		{ID: "a", Kind: 1, CreatedAt: 1},
+		{ID: "c", Kind: 1, CreatedAt: 3},
+		{ID: "b", Kind: 1, CreatedAt: 2},
+	}
+
+	for _, event := range saved {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, capacity := range []int{0, -1} {
+		if err := store.Resize(capacity); err == nil {
+			t.Fatalf("expected an error resizing to %d, got nil", capacity)
+		}
+	}
+
+	if err := store.Resize(2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"c", "d"}
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected the newest events %v, got %v", expected, ids)
+	}
+
+	// the eviction order is preserved: d was saved before c
+	if err := store.Save(ctx, &nostr.Event{ID: "e", Kind: 1, CreatedAt: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{"c", "e"}
+	if ids := storedIDs(store); !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	if err := store.Resize(10); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Size() != 2 || store.Capacity() != 10 {
+		t.Fatalf("expected size 2 and capacity 10, got %d and %d", store.Size(), store.Capacity())
+	}
+}
+
+// collector is a [nastro.Collector] that records the events of each operation, the evictions and the last occupancy.
+type collector struct {
+	nastro.NoMetrics
+	mu        sync.Mutex
+	events    map[nastro.Operation]int64
+	evictions int
+	occupancy [3]int
+}
+
+func (c *collector) Observe(op nastro.Operation, took time.Duration, events int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events[op] += events
+}
+
+func (c *collector) Evict(expired bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictions++
+}
+
+func (c *collector) Occupancy(size, capacity, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.occupancy = [3]int{size, capacity, bytes}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := &collector{events: make(map[nastro.Operation]int64)}
+	store, err := New(WithCapacity(2), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c", "c"} {
+		if err := store.Save(ctx, &nostr.Event{ID: id, Kind: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{IDs: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{IDs: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Count(ctx, nostr.Filter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[nastro.Operation]int64{nastro.OpSave: 3, nastro.OpQuery: 1, nastro.OpCount: 2, nastro.OpDelete: 1}
+	if !reflect.DeepEqual(metrics.events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, metrics.events)
+	}
+
+	if metrics.evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", metrics.evictions)
+	}
+
+	occupancy := [3]int{1, 2, store.Bytes()}
+	if metrics.occupancy != occupancy {
+		t.Fatalf("expected occupancy %v, got %v", occupancy, metrics.occupancy)
+	}
+}
+
+func TestMutationAfterSave(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(WithCapacity(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &nostr.Event{ID: "a", PubKey: "alice", Kind: 0, CreatedAt: 2, Content: "original", Tags: nostr.Tags{{"t", "original"}}}
+	if _, err := store.Replace(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	event.CreatedAt = 0
+	event.Content = "mutated"
+	event.Tags[0][1] = "mutated"
+	event.Tags = append(event.Tags, nostr.Tag{"t", "appended"})
+
+	events, err := store.Query(ctx, nostr.Filter{IDs: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := events[0]
+	if stored.Content != "original" || len(stored.Tags) != 1 || stored.Tags[0][1] != "original" || stored.CreatedAt != 2 {
+		t.Fatalf("expected the stored event to be unchanged, got %v", stored)
+	}
+
+	// the comparison is against the stored created_at, not the mutated one
+	replaced, err := store.Replace(ctx, &nostr.Event{ID: "b", PubKey: "alice", Kind: 0, CreatedAt: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced {
+		t.Fatal("expected the older event not to replace the stored one")
+	}
+
+	// mutating the tags of a returned event doesn't affect the stored one
+	stored.Tags[0][1] = "mutated"
+	events, err = store.Query(ctx, nostr.Filter{IDs: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if events[0].Tags[0][1] != "original" {
+		t.Fatalf("expected the stored tags to be unchanged, got %v", events[0].Tags)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		capacity int
+		size     int
+	}{
+		{name: "grows", opts: []Option{WithWindow(time.Hour)}, capacity: 8, size: 5},
+		{name: "grows up to max", opts: []Option{WithWindow(time.Hour), WithMaxCapacity(4)}, capacity: 4, size: 4},
+		{name: "outside the window", opts: []Option{WithWindow(time.Nanosecond)}, capacity: 2, size: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := New(append(test.opts, WithCapacity(2))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range 5 {
+				if err := store.Save(ctx, &nostr.Event{ID: strconv.Itoa(i), Kind: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if store.Capacity() != test.capacity {
+				t.Fatalf("expected capacity %d, got %d", test.capacity, store.Capacity())
+			}
+
+			if store.Size() != test.size {
+				t.Fatalf("expected size %d, got %d", test.size, store.Size())
+			}
+
+			// the newest events are always kept
+			count, err := store.Count(ctx, nostr.Filter{IDs: []string{"3", "4"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if count != 2 {
+				t.Fatalf("expected the newest events to be kept, got %d", count)
+			}
+		})
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+	var _ nastro.Store = &WriteBehind{}
+}
+
+func Empty() (*Store, error) { return New(WithCapacity(100)) }
+
+// storedIDs returns the sorted ids of the stored events.
+func storedIDs(s *Store) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for _, event := range s.events {
+		if event != nil {
+			ids = append(ids, event.ID)
+		}
+	}
+
+	slices.Sort(ids)
+	return ids
+}
+
+// All is a filter policy that accepts all filters.
+func All(filters ...nostr.Filter) (nostr.Filters, error) { return filters, nil }
+
+// Copies returns a store with copies of the same follow list saved with the provided created_at,
+// interleaved with an event of another kind.
+func Copies(createdAt ...nostr.Timestamp) func() (*Store, error) {
+	return func() (*Store, error) {
+		store, err := New(WithCapacity(100))
+		if err != nil {
+			return nil, err
+		}
+
+		ctx := context.Background()
+		for i, c := range createdAt {
+			if err := store.Save(ctx, &nostr.Event{ID: "c" + strconv.Itoa(i), Kind: 3, CreatedAt: c}); err != nil {
+				return nil, err
+			}
+
+			if i == 0 {
+				if err := store.Save(ctx, &nostr.Event{ID: "other", Kind: 1}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return store, nil
+	}
+}
 
 func OneEvent(kind int) func() (*Store, error) {
 	return func() (*Store, error) {
@@ -0,0 +1,237 @@
+package ephemeral
+
+import (
+	"container/heap"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Eviction decides which event is overwritten when a new event is saved and the store is full.
+type Eviction int
+
+const (
+	// EvictFirstSaved evicts the event saved the earliest, like a ring buffer. It's the default.
+	EvictFirstSaved Eviction = iota
+
+	// EvictLeastRecentlyMatched evicts the event that went the longest without being returned by a query.
+	// Events never returned count from when they were saved.
+	EvictLeastRecentlyMatched
+
+	// EvictOldest evicts the event with the oldest created_at.
+	EvictOldest
+)
+
+// protectedKinds are the kinds protected by [WithProtectedReplaceables].
+var protectedKinds = []int{nostr.KindProfileMetadata, nostr.KindFollowList, nostr.KindRelayListMetadata}
+
+// WithEviction sets how the store chooses the event to evict when it's full.
+func WithEviction(e Eviction) Option {
+	return func(s *Store) error {
+		if e < EvictFirstSaved || e > EvictOldest {
+			return errors.New("unknown eviction policy")
+		}
+		s.eviction = e
+		return nil
+	}
+}
+
+// WithProtectedReplaceables never evicts the latest profile metadata, follow list and relay list of each pubkey
+// (kinds 0, 3 and 10002), unless all the stored events are protected.
+// Their older versions, if any, are evicted as usual.
+func WithProtectedReplaceables() Option {
+	return func(s *Store) error {
+		s.protectReplaceables = true
+		return nil
+	}
+}
+
+// reset empties the store, allocating the provided capacity.
+func (s *Store) reset(capacity int) {
+	s.capacity = capacity
+	s.events = make([]*nostr.Event, capacity)
+	s.priority = make([]int64, capacity)
+	s.sizes = make([]int, capacity)
+	s.deadlines = make([]int64, capacity)
+	s.saved = make([]int64, capacity)
+	s.bytes = 0
+	s.queue = newQueue(s.priority)
+	s.size = 0
+	s.resetIndexes()
+
+	// the free positions are popped from the end, starting from the first
+	s.free = make([]int, capacity)
+	for i := range s.free {
+		s.free[i] = capacity - 1 - i
+	}
+}
+
+// slot returns the position where to save a new event, evicting an event if the store is full,
+// or growing it if the event to evict is within the window.
+func (s *Store) slot() int {
+	for len(s.free) > 0 {
+		pos := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+
+		if s.events[pos] == nil {
+			return pos
+		}
+	}
+
+	victim := s.victim()
+	if s.inWindow(victim, time.Now()) && s.capacity < s.maxCapacity {
+		s.grow(min(2*s.capacity, s.maxCapacity))
+		return s.slot()
+	}
+
+	s.remove(victim)
+	s.metrics.Evict(false)
+	return s.slot()
+}
+
+// victim returns the position of the next event to evict, or -1 if the store is empty.
+func (s *Store) victim() int {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	if s.queue.Len() > 0 {
+		return s.queue.positions[0]
+	}
+
+	// all events are protected, so the one with the lowest priority is evicted.
+	// Empty positions are skipped, as removing them frees nothing
+	victim := -1
+	for pos, event := range s.events {
+		if event != nil && (victim == -1 || s.priority[pos] < s.priority[victim]) {
+			victim = pos
+		}
+	}
+	return victim
+}
+
+// prioritize sets the priority of the event at the provided position, where lower priorities are evicted first.
+func (s *Store) prioritize(pos int, event *nostr.Event) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	switch s.eviction {
+	case EvictOldest:
+		s.priority[pos] = int64(event.CreatedAt)
+	default:
+		s.tick++
+		s.priority[pos] = s.tick
+	}
+	s.queue.push(pos)
+}
+
+// touch marks the events at the provided positions as just matched, which postpones their eviction
+// with [EvictLeastRecentlyMatched]. It's safe to call while holding only the read lock.
+func (s *Store) touch(positions []int) {
+	if s.eviction != EvictLeastRecentlyMatched {
+		return
+	}
+
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	for _, pos := range positions {
+		s.tick++
+		s.priority[pos] = s.tick
+		s.queue.fix(pos)
+	}
+}
+
+// unqueue removes the position from the eviction queue.
+func (s *Store) unqueue(pos int) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	s.queue.remove(pos)
+}
+
+// protect updates the protection of the events with the provided address, so that only the latest is never evicted.
+func (s *Store) protect(addr string, kind int) {
+	if !s.protectReplaceables || !slices.Contains(protectedKinds, kind) {
+		return
+	}
+
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	latest := -1
+	for pos := range s.addresses[addr] {
+		if latest == -1 || s.events[pos].CreatedAt > s.events[latest].CreatedAt {
+			latest = pos
+		}
+	}
+
+	for pos := range s.addresses[addr] {
+		if pos == latest {
+			s.queue.remove(pos)
+		} else {
+			s.queue.push(pos)
+		}
+	}
+}
+
+// queue is a min-heap of the positions of the evictable events, ordered by their priority.
+type queue struct {
+	positions []int
+	priority  []int64 // the priority of each position, shared with the store
+	index     []int   // the index of each position in the heap, -1 if not in the heap
+}
+
+func newQueue(priority []int64) *queue {
+	q := &queue{priority: priority, index: make([]int, len(priority))}
+	for i := range q.index {
+		q.index[i] = -1
+	}
+	return q
+}
+
+func (q *queue) Len() int           { return len(q.positions) }
+func (q *queue) Less(i, j int) bool { return q.priority[q.positions[i]] < q.priority[q.positions[j]] }
+
+func (q *queue) Swap(i, j int) {
+	q.positions[i], q.positions[j] = q.positions[j], q.positions[i]
+	q.index[q.positions[i]] = i
+	q.index[q.positions[j]] = j
+}
+
+func (q *queue) Push(x any) {
+	pos := x.(int)
+	q.index[pos] = len(q.positions)
+	q.positions = append(q.positions, pos)
+}
+
+func (q *queue) Pop() any {
+	last := len(q.positions) - 1
+	pos := q.positions[last]
+	q.positions = q.positions[:last]
+	q.index[pos] = -1
+	return pos
+}
+
+// push the position in the heap, or fix its place if it's already there.
+func (q *queue) push(pos int) {
+	if q.index[pos] != -1 {
+		heap.Fix(q, q.index[pos])
+		return
+	}
+	heap.Push(q, pos)
+}
+
+// fix the place of the position after its priority changed, if it's in the heap.
+func (q *queue) fix(pos int) {
+	if q.index[pos] != -1 {
+		heap.Fix(q, q.index[pos])
+	}
+}
+
+// remove the position from the heap, if present.
+func (q *queue) remove(pos int) {
+	if q.index[pos] != -1 {
+		heap.Remove(q, q.index[pos])
+	}
+}
@@ -0,0 +1,104 @@
+package ephemeral
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultCompactionInterval is how often expired events are compacted away when the store has no TTL.
+var DefaultCompactionInterval = time.Minute
+
+// WithTTL expires events the provided duration after they are saved, regardless of their created_at.
+// Expired events are never returned by queries or counted, and they are compacted away on writes,
+// at most once per TTL, or explicitly with [Store.Compact].
+func WithTTL(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("TTL must be positive")
+		}
+		s.ttl = d
+		return nil
+	}
+}
+
+// Compact removes all the expired events, either because their TTL has passed or because of their
+// NIP-40 expiration, returning how many were removed.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/40.md
+func (s *Store) Compact() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact(time.Now())
+}
+
+func (s *Store) compact(now time.Time) int {
+	var removed int
+	for pos, event := range s.events {
+		if event != nil && s.isExpired(pos, now) {
+			s.remove(pos)
+			s.metrics.Evict(true)
+			removed++
+		}
+	}
+
+	s.compacted = now
+	return removed
+}
+
+// maybeCompact compacts the store if enough time has passed since the last compaction.
+func (s *Store) maybeCompact(now time.Time) {
+	interval := DefaultCompactionInterval
+	if s.ttl > 0 {
+		interval = s.ttl
+	}
+
+	if now.Sub(s.compacted) >= interval {
+		s.compact(now)
+	}
+}
+
+// setDeadline sets when the event at the provided position expires, based on the TTL and its NIP-40 expiration.
+func (s *Store) setDeadline(pos int, event *nostr.Event, now time.Time) {
+	var deadline int64
+	if s.ttl > 0 {
+		deadline = now.Add(s.ttl).UnixNano()
+	}
+
+	if expiration, ok := expirationOf(event); ok {
+		at := time.Unix(int64(expiration), 0).UnixNano()
+		if deadline == 0 || at < deadline {
+			deadline = at
+		}
+	}
+	s.deadlines[pos] = deadline
+}
+
+// isExpired returns whether the event at the provided position is expired at the provided time.
+func (s *Store) isExpired(pos int, now time.Time) bool {
+	return s.deadlines[pos] != 0 && s.deadlines[pos] <= now.UnixNano()
+}
+
+// expirationOf returns the NIP-40 expiration of the event, if it has a valid one.
+func expirationOf(event *nostr.Event) (nostr.Timestamp, bool) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "expiration" {
+			continue
+		}
+
+		expiration, err := strconv.ParseInt(tag[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return nostr.Timestamp(expiration), true
+	}
+	return 0, false
+}
+
+// isExpired returns whether the event has a NIP-40 expiration that is not after the provided time.
+func isExpired(event *nostr.Event, now time.Time) bool {
+	expiration, ok := expirationOf(event)
+	return ok && int64(expiration) <= now.Unix()
+}
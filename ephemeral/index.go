@@ -0,0 +1,185 @@
+package ephemeral
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// index maps a key to the positions in the ring buffer of the events with that key.
+type index[K comparable] map[K]map[int]struct{}
+
+func (idx index[K]) add(key K, pos int) {
+	positions, ok := idx[key]
+	if !ok {
+		positions = make(map[int]struct{})
+		idx[key] = positions
+	}
+	positions[pos] = struct{}{}
+}
+
+func (idx index[K]) remove(key K, pos int) {
+	positions, ok := idx[key]
+	if !ok {
+		return
+	}
+
+	delete(positions, pos)
+	if len(positions) == 0 {
+		delete(idx, key)
+	}
+}
+
+// size returns the number of positions of the keys, counting twice the positions shared by more keys.
+func (idx index[K]) size(keys ...K) int {
+	var size int
+	for _, key := range keys {
+		size += len(idx[key])
+	}
+	return size
+}
+
+// lookup returns the positions of the keys.
+func (idx index[K]) lookup(keys ...K) []int {
+	positions := make([]int, 0, idx.size(keys...))
+	for _, key := range keys {
+		for pos := range idx[key] {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
+
+// first returns the lowest position of the key, or -1 if there are none.
+func (idx index[K]) first(key K) int {
+	first := -1
+	for pos := range idx[key] {
+		if first == -1 || pos < first {
+			first = pos
+		}
+	}
+	return first
+}
+
+// address returns the key identifying the category of replaceable and addressable events, and false for other kinds.
+func address(event *nostr.Event) (string, bool) {
+	switch {
+	case nostr.IsReplaceableKind(event.Kind):
+		return fmt.Sprintf("%d:%s:", event.Kind, event.PubKey), true
+
+	case nostr.IsAddressableKind(event.Kind):
+		return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD()), true
+
+	default:
+		return "", false
+	}
+}
+
+// put the event at the provided position, overwriting the event that was there, if any.
+func (s *Store) put(pos int, event *nostr.Event) {
+	old := s.unset(pos)
+	s.events[pos] = event
+	s.size++
+	s.sizes[pos] = approxSize(event)
+	s.bytes += s.sizes[pos]
+	now := time.Now()
+	s.setDeadline(pos, event, now)
+	s.saved[pos] = now.UnixNano()
+
+	s.ids.add(event.ID, pos)
+	s.pubkeys.add(event.PubKey, pos)
+	s.kinds.add(event.Kind, pos)
+	s.prioritize(pos, event)
+
+	if addr, ok := address(event); ok {
+		s.addresses.add(addr, pos)
+		s.protect(addr, event.Kind)
+	}
+
+	if old != nil {
+		if addr, ok := address(old); ok {
+			s.protect(addr, old.Kind)
+		}
+	}
+}
+
+// remove the event at the provided position, if any, freeing the position.
+func (s *Store) remove(pos int) {
+	event := s.unset(pos)
+	if event == nil {
+		return
+	}
+
+	s.free = append(s.free, pos)
+	if addr, ok := address(event); ok {
+		s.protect(addr, event.Kind)
+	}
+}
+
+// unset the event at the provided position, if any, removing it from the indexes. It returns the removed event.
+func (s *Store) unset(pos int) *nostr.Event {
+	event := s.events[pos]
+	if event == nil {
+		return nil
+	}
+
+	s.events[pos] = nil
+	s.size--
+	s.bytes -= s.sizes[pos]
+	s.ids.remove(event.ID, pos)
+	s.pubkeys.remove(event.PubKey, pos)
+	s.kinds.remove(event.Kind, pos)
+	s.unqueue(pos)
+	if addr, ok := address(event); ok {
+		s.addresses.remove(addr, pos)
+	}
+	return event
+}
+
+// resetIndexes empties all the indexes.
+func (s *Store) resetIndexes() {
+	s.ids = make(index[string])
+	s.pubkeys = make(index[string])
+	s.kinds = make(index[int])
+	s.addresses = make(index[string])
+}
+
+// candidates returns the positions of the events that might match the filter, using its most selective index.
+// It returns false if the filter has no indexed field, meaning that all the events must be checked.
+func (s *Store) candidates(filter nostr.Filter) ([]int, bool) {
+	const (
+		byID = iota
+		byPubkey
+		byKind
+		none
+	)
+
+	best, size := none, 0
+	consider := func(idx, n int) {
+		if best == none || n < size {
+			best, size = idx, n
+		}
+	}
+
+	if len(filter.IDs) > 0 {
+		consider(byID, s.ids.size(filter.IDs...))
+	}
+	if len(filter.Authors) > 0 {
+		consider(byPubkey, s.pubkeys.size(filter.Authors...))
+	}
+	if len(filter.Kinds) > 0 {
+		consider(byKind, s.kinds.size(filter.Kinds...))
+	}
+
+	switch best {
+	case byID:
+		return s.ids.lookup(filter.IDs...), true
+	case byPubkey:
+		return s.pubkeys.lookup(filter.Authors...), true
+	case byKind:
+		return s.kinds.lookup(filter.Kinds...), true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,42 @@
+package ephemeral
+
+import (
+	"time"
+
+	"github.com/pippellia-btc/nastro"
+)
+
+// WithMetrics sets a [nastro.Collector] on the Store, which receives the latency and events of each operation,
+// the evictions, and the occupancy of the store.
+//
+// The store calls Observe for [nastro.OpSave], [nastro.OpReplace], [nastro.OpDelete], [nastro.OpQuery] and [nastro.OpCount],
+// Evict when an event is removed to make room or because it expired (see [WithTTL]), and Occupancy after each write,
+// including the rings of [WithKindCapacity] and [WithEphemeralKinds].
+// When the store is used as a cache tier, queries returning no events are its misses.
+func WithMetrics(c nastro.Collector) Option {
+	return func(s *Store) error {
+		s.metrics = c
+		return nil
+	}
+}
+
+// observeWrite reports the write operation and the resulting occupancy of the store.
+func (s *Store) observeWrite(op nastro.Operation, start time.Time, written bool, err error) {
+	var events int64
+	if written {
+		events = 1
+	}
+
+	s.metrics.Observe(op, time.Since(start), events, err)
+	s.metrics.Occupancy(s.occupancy())
+}
+
+// occupancy returns the number of events, capacity and bytes of the store and its rings.
+func (s *Store) occupancy() (size, capacity, bytes int) {
+	for _, ring := range append([]*Store{s}, s.rings()...) {
+		size += ring.size
+		capacity += ring.capacity
+		bytes += ring.bytes
+	}
+	return size, capacity, bytes
+}
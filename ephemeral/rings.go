@@ -0,0 +1,88 @@
+package ephemeral
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WithEphemeralKinds treats events of ephemeral kinds (20000-29999) like relays do: they are broadcast to subscribers
+// but never occupy the slots of the store. Instead, the most recent ones are kept in a separate ring of the provided
+// capacity, so that they can still be queried briefly. A capacity of zero doesn't keep them at all.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/01.md#kinds
+func WithEphemeralKinds(capacity int) Option {
+	return func(s *Store) error {
+		if capacity < 0 {
+			return errors.New("ephemeral kinds capacity must not be negative")
+		}
+		s.ephemeralKinds = true
+		s.ephemeralCapacity = capacity
+		return nil
+	}
+}
+
+// WithKindCapacity stores the events of each of the provided kinds in a ring of their own, with the provided capacity,
+// instead of in the slots of the store. For example, {1: 200, 0: 2000} retains at most 200 notes
+// and 2000 profiles, regardless of how many events of other kinds are saved.
+// Queries merge the results of all the rings, while [Store.Resize] only changes the capacity of the store.
+func WithKindCapacity(capacities map[int]int) Option {
+	return func(s *Store) error {
+		for kind, capacity := range capacities {
+			if capacity < 1 {
+				return fmt.Errorf("capacity of kind %d must be positive", kind)
+			}
+		}
+		s.kindCapacity = maps.Clone(capacities)
+		return nil
+	}
+}
+
+// ring returns the store where the event belongs.
+// It returns nil if the event must not be stored at all.
+func (s *Store) ring(event *nostr.Event) *Store {
+	if s.ephemeralKinds && nostr.IsEphemeralKind(event.Kind) {
+		return s.ephemerals
+	}
+
+	if ring, ok := s.kindRings[event.Kind]; ok {
+		return ring
+	}
+	return s
+}
+
+// newRing returns a store of the provided capacity that shares the expiration, eviction and metrics settings of s,
+// and that is only accessed while holding the lock of s.
+func (s *Store) newRing(capacity int) *Store {
+	ring := &Store{
+		ttl:                 s.ttl,
+		eviction:            s.eviction,
+		protectReplaceables: s.protectReplaceables,
+		metrics:             s.metrics,
+		subs:                make(map[*subscription]struct{}),
+	}
+	ring.reset(capacity)
+	return ring
+}
+
+// rings returns the additional rings of the store.
+func (s *Store) rings() []*Store {
+	rings := s.retained()[1:]
+	if s.ephemerals != nil {
+		rings = append(rings, s.ephemerals)
+	}
+	return rings
+}
+
+// retained returns the store and its rings of [WithKindCapacity], which hold the events meant to be retained,
+// unlike the ring of [WithEphemeralKinds].
+func (s *Store) retained() []*Store {
+	stores := []*Store{s}
+	for _, kind := range slices.Sorted(maps.Keys(s.kindRings)) {
+		stores = append(stores, s.kindRings[kind])
+	}
+	return stores
+}
@@ -0,0 +1,73 @@
+package ephemeral
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrTooLarge is returned when saving an event larger than the max bytes of the store.
+var ErrTooLarge = errors.New("event is larger than the store's max bytes")
+
+// eventOverhead is the approximate size in bytes of an event besides its strings.
+const eventOverhead = 64
+
+// WithMaxBytes bounds the approximate size in bytes of the stored events, evicting events until a new one fits.
+// The number of events is still bounded by the capacity, so it should be set high enough for the bytes to be the limit.
+func WithMaxBytes(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("max bytes must be positive")
+		}
+		s.maxBytes = n
+		return nil
+	}
+}
+
+// Bytes returns the approximate size in bytes of the events currently stored.
+func (s *Store) Bytes() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bytes
+}
+
+// fits returns an error if the event can't fit in the store, even after evicting all the other events.
+func (s *Store) fits(event *nostr.Event) error {
+	if s.maxBytes == 0 {
+		return nil
+	}
+
+	if size := approxSize(event); size > s.maxBytes {
+		return fmt.Errorf("%w: event ID %s has %d bytes, max %d", ErrTooLarge, event.ID, size, s.maxBytes)
+	}
+	return nil
+}
+
+// makeRoom evicts events until the provided size fits within the max bytes.
+func (s *Store) makeRoom(size int) {
+	if s.maxBytes == 0 {
+		return
+	}
+
+	for s.size > 0 && s.bytes+size > s.maxBytes {
+		victim := s.victim()
+		if victim == -1 || s.events[victim] == nil {
+			return
+		}
+
+		s.remove(victim)
+		s.metrics.Evict(false)
+	}
+}
+
+// approxSize returns the approximate size in bytes of the event, as the sum of its strings plus a fixed overhead.
+func approxSize(event *nostr.Event) int {
+	size := eventOverhead + len(event.ID) + len(event.PubKey) + len(event.Sig) + len(event.Content)
+	for _, tag := range event.Tags {
+		for _, s := range tag {
+			size += len(s)
+		}
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package ephemeral
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WithSnapshotFile restores the store from the snapshot file at the provided path when it's created,
+// if the file exists. The file is expected to be written with [Store.Snapshot].
+func WithSnapshotFile(path string) Option {
+	return func(s *Store) error {
+		if path == "" {
+			return errors.New("snapshot file path must not be empty")
+		}
+		s.snapshotPath = path
+		return nil
+	}
+}
+
+// Snapshot writes all the stored events that are not expired to w as JSON lines,
+// in the order they would be evicted, so that [Store.Restore] reproduces the same eviction order.
+// The events of ephemeral kinds kept by [WithEphemeralKinds] are not included.
+func (s *Store) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+
+	for _, ring := range s.retained() {
+		for _, pos := range ring.evictionOrder(ring.live(now)) {
+			event := ring.events[pos]
+			if err := encoder.Encode(event); err != nil {
+				return fmt.Errorf("failed to write event ID %s: %w", event.ID, err)
+			}
+		}
+	}
+
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write the snapshot: %w", err)
+	}
+	return nil
+}
+
+// live returns the positions of the events that are not expired.
+func (s *Store) live(now time.Time) []int {
+	positions := make([]int, 0, s.size)
+	for pos, event := range s.events {
+		if event != nil && !s.isExpired(pos, now) {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
+
+// evictionOrder sorts the positions in the order their events would be evicted.
+func (s *Store) evictionOrder(positions []int) []int {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	slices.SortFunc(positions, func(p1, p2 int) int { return cmp.Compare(s.priority[p1], s.priority[p2]) })
+	return positions
+}
+
+// Restore saves the events of a snapshot written by [Store.Snapshot] into the store, on top of the events already stored.
+// Events rejected by the event policy, too large, expired or already stored are skipped, and subscribers are not notified.
+// The TTL of the restored events, if any, starts from when they are restored.
+func (s *Store) Restore(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		event := &nostr.Event{}
+		err := decoder.Decode(event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read the snapshot: %w", err)
+		}
+
+		if err := s.validateEvent(event); err != nil || isExpired(event, now) {
+			continue
+		}
+
+		ring := s.ring(event)
+		if ring == nil || ring.fits(event) != nil || ring.isDuplicate(event.ID, now) {
+			continue
+		}
+		ring.insert(event)
+	}
+}
+
+// restoreFile restores the store from the snapshot file at the provided path, if it exists.
+func (s *Store) restoreFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to open the snapshot file: %w", err)
+	}
+	defer file.Close()
+	return s.Restore(file)
+}
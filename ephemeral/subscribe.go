@@ -0,0 +1,68 @@
+package ephemeral
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultSubscriptionBuffer is the number of events a subscription can buffer before new events are dropped.
+var DefaultSubscriptionBuffer = 100
+
+type subscription struct {
+	filters nostr.Filters
+	events  chan nostr.Event
+}
+
+// Subscribe returns a channel of the events accepted by [Store.Save] and [Store.Replace] from now on
+// that match any of the filters, and a function to stop the subscription.
+// The subscription is also stopped when the context is cancelled, after which the channel is closed.
+//
+// Events are never blocked on slow subscribers: if the channel buffer is full, new events are dropped for that subscriber.
+func (s *Store) Subscribe(ctx context.Context, filters ...nostr.Filter) (<-chan nostr.Event, func()) {
+	sub := &subscription{
+		filters: filters,
+		events:  make(chan nostr.Event, DefaultSubscriptionBuffer),
+	}
+
+	s.subsMu.Lock()
+	s.subs[sub] = struct{}{}
+	s.subsMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			s.subsMu.Lock()
+			delete(s.subs, sub)
+			close(sub.events)
+			s.subsMu.Unlock()
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return sub.events, stop
+}
+
+// broadcast sends a copy of the event to all the subscriptions whose filters match it.
+func (s *Store) broadcast(event *nostr.Event) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	for sub := range s.subs {
+		if !sub.filters.Match(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- *clone(event):
+		default:
+			// the subscriber is too slow, drop the event
+		}
+	}
+}
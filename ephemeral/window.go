@@ -0,0 +1,66 @@
+package ephemeral
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultMaxCapacity is the default capacity up to which a store with [WithWindow] can grow.
+var DefaultMaxCapacity = 1_000_000
+
+// WithWindow retains all the events saved within the provided duration, regardless of the capacity.
+// When the store is full and the event to evict was saved within the window, the capacity is doubled instead,
+// up to the max set with [WithMaxCapacity]. Events saved before the window are evicted as usual.
+//
+// The window is measured from when events are saved, not from their created_at.
+// The max bytes set with [WithMaxBytes], if any, are still enforced.
+func WithWindow(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("window must be positive")
+		}
+		s.window = d
+		return nil
+	}
+}
+
+// WithMaxCapacity sets the capacity up to which a store with [WithWindow] can grow.
+func WithMaxCapacity(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("max capacity must be positive")
+		}
+		s.maxCapacity = n
+		return nil
+	}
+}
+
+// inWindow returns whether the event at the provided position was saved within the window.
+func (s *Store) inWindow(pos int, now time.Time) bool {
+	return s.window > 0 && now.UnixNano()-s.saved[pos] < int64(s.window)
+}
+
+// grow the capacity of the store to the provided one, keeping all the events where they are.
+func (s *Store) grow(capacity int) {
+	added := capacity - s.capacity
+	s.events = append(s.events, make([]*nostr.Event, added)...)
+	s.sizes = append(s.sizes, make([]int, added)...)
+	s.deadlines = append(s.deadlines, make([]int64, added)...)
+	s.saved = append(s.saved, make([]int64, added)...)
+
+	s.queueMu.Lock()
+	s.priority = append(s.priority, make([]int64, added)...)
+	s.queue.priority = s.priority
+	for range added {
+		s.queue.index = append(s.queue.index, -1)
+	}
+	s.queueMu.Unlock()
+
+	// the free positions are popped from the end, starting from the first
+	for pos := capacity - 1; pos >= s.capacity; pos-- {
+		s.free = append(s.free, pos)
+	}
+	s.capacity = capacity
+}
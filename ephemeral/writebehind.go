@@ -0,0 +1,337 @@
+package ephemeral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var (
+	// DefaultPendingLimit is the default maximum number of writes waiting to be flushed by a [WriteBehind].
+	DefaultPendingLimit = 10_000
+
+	// DefaultFlushSize is the default maximum number of writes flushed at once by a [WriteBehind].
+	DefaultFlushSize = 1000
+
+	// DefaultFlushInterval is the default maximum time a [WriteBehind] holds writes before flushing them.
+	DefaultFlushInterval = time.Second
+
+	// ErrClosed is returned when writing to a [WriteBehind] after it has been closed.
+	ErrClosed = errors.New("write-behind store is closed")
+)
+
+// WriteBehind is a [nastro.Store] that writes to an ephemeral store immediately, and to a persistent store asynchronously,
+// giving the low write latency of the former with the durability of the latter.
+//
+// Writes are flushed in order to the persistent store in batches, either when enough of them are pending
+// or periodically. When too many writes are pending, new ones block until there is room, which applies backpressure
+// to the writers instead of growing without bounds.
+// Failed writes are not retried, but reported to the handler set with [WithFlushErrors].
+type WriteBehind struct {
+	ring    *Store
+	backing nastro.Store
+
+	mu     sync.RWMutex // guards closed, so that no write is sent after the pending channel is closed
+	closed bool
+
+	pending       chan write
+	flushSize     int
+	flushInterval time.Duration
+	onError       func(error)
+	exited        chan struct{}
+}
+
+// write is a pending write of a [WriteBehind], or a request to flush the pending writes if done is not nil.
+type write struct {
+	op    op
+	event *nostr.Event
+	id    string
+	done  chan struct{}
+}
+
+type op int
+
+const (
+	opSave op = iota
+	opReplace
+	opDelete
+)
+
+type WriteBehindOption func(*WriteBehind) error
+
+// WithPendingLimit sets the maximum number of writes waiting to be flushed, after which new writes block.
+func WithPendingLimit(n int) WriteBehindOption {
+	return func(w *WriteBehind) error {
+		if n < 1 {
+			return errors.New("pending limit must be positive")
+		}
+		w.pending = make(chan write, n)
+		return nil
+	}
+}
+
+// WithFlushSize sets the maximum number of writes flushed at once.
+func WithFlushSize(n int) WriteBehindOption {
+	return func(w *WriteBehind) error {
+		if n < 1 {
+			return errors.New("flush size must be positive")
+		}
+		w.flushSize = n
+		return nil
+	}
+}
+
+// WithFlushInterval sets the maximum time writes are held before being flushed.
+func WithFlushInterval(d time.Duration) WriteBehindOption {
+	return func(w *WriteBehind) error {
+		if d <= 0 {
+			return errors.New("flush interval must be positive")
+		}
+		w.flushInterval = d
+		return nil
+	}
+}
+
+// WithFlushErrors sets the function called with the error of every write that failed to be flushed.
+// It's called by the flushing goroutine, so it should not block for long.
+func WithFlushErrors(handler func(error)) WriteBehindOption {
+	return func(w *WriteBehind) error {
+		if handler == nil {
+			return errors.New("flush error handler must not be nil")
+		}
+		w.onError = handler
+		return nil
+	}
+}
+
+// NewWriteBehind returns a [WriteBehind] that writes to the ring immediately, and to the backing store asynchronously.
+// It must be closed with [WriteBehind.Close] to flush the pending writes.
+func NewWriteBehind(ring *Store, backing nastro.Store, opts ...WriteBehindOption) (*WriteBehind, error) {
+	w := &WriteBehind{
+		ring:          ring,
+		backing:       backing,
+		pending:       make(chan write, DefaultPendingLimit),
+		flushSize:     DefaultFlushSize,
+		flushInterval: DefaultFlushInterval,
+		onError:       func(error) {},
+		exited:        make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Save the event in the ring, and schedule it to be saved in the backing store.
+// Events of ephemeral kinds are not persisted if the ring uses [WithEphemeralKinds].
+func (w *WriteBehind) Save(ctx context.Context, event *nostr.Event) error {
+	if err := w.ring.Save(ctx, event); err != nil {
+		return err
+	}
+
+	if w.ring.ephemeralKinds && nostr.IsEphemeralKind(event.Kind) {
+		return nil
+	}
+	return w.schedule(ctx, write{op: opSave, event: clone(event)})
+}
+
+// Replace the event in the ring, and schedule it to be replaced in the backing store if it was saved.
+func (w *WriteBehind) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	saved, err := w.ring.Replace(ctx, event)
+	if err != nil || !saved {
+		return saved, err
+	}
+	return true, w.schedule(ctx, write{op: opReplace, event: clone(event)})
+}
+
+// Delete the event from the ring, and schedule it to be deleted from the backing store.
+func (w *WriteBehind) Delete(ctx context.Context, id string) error {
+	if err := w.ring.Delete(ctx, id); err != nil {
+		return err
+	}
+	return w.schedule(ctx, write{op: opDelete, id: id})
+}
+
+// Query returns the events matching the filters from both the ring and the backing store,
+// so that events not yet flushed are included. Each filter contributes at most Limit events if positive.
+func (w *WriteBehind) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	var events []nostr.Event
+	matched := make(map[string]struct{})
+
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+
+		recent, err := w.ring.Query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		persisted, err := w.backing.Query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		results := merge(recent, persisted)
+		if filter.Limit > 0 && len(results) > filter.Limit {
+			results = results[:filter.Limit]
+		}
+
+		for _, event := range results {
+			if _, ok := matched[event.ID]; !ok {
+				matched[event.ID] = struct{}{}
+				events = append(events, event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, func(e1, e2 nostr.Event) int { return compare(&e1, &e2) })
+	return events, nil
+}
+
+// Count the events matching the filters in the backing store. Events not yet flushed are not counted.
+func (w *WriteBehind) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	return w.backing.Count(ctx, filters...)
+}
+
+// Flush blocks until all the writes scheduled before the call have been flushed, or the context is cancelled.
+func (w *WriteBehind) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	if err := w.schedule(ctx, write{done: done}); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting writes and blocks until all the pending writes have been flushed.
+func (w *WriteBehind) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+
+	w.closed = true
+	close(w.pending)
+	w.mu.Unlock()
+
+	<-w.exited
+	return nil
+}
+
+// schedule the write, blocking until there is room for it or the context is cancelled.
+func (w *WriteBehind) schedule(ctx context.Context, wr write) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	select {
+	case w.pending <- wr:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run flushes the pending writes in batches, until the pending channel is closed.
+func (w *WriteBehind) run() {
+	defer close(w.exited)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]write, 0, w.flushSize)
+	for {
+		select {
+		case wr, ok := <-w.pending:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+
+			if wr.done != nil {
+				w.flush(batch)
+				batch = batch[:0]
+				close(wr.done)
+				continue
+			}
+
+			batch = append(batch, wr)
+			if len(batch) >= w.flushSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush applies the writes to the backing store in order, reporting the failed ones.
+func (w *WriteBehind) flush(batch []write) {
+	ctx := context.Background()
+	for _, wr := range batch {
+		var err error
+		switch wr.op {
+		case opSave:
+			err = w.backing.Save(ctx, wr.event)
+			if errors.Is(err, nastro.ErrDuplicate) {
+				err = nil
+			}
+
+		case opReplace:
+			_, err = w.backing.Replace(ctx, wr.event)
+
+		case opDelete:
+			err = w.backing.Delete(ctx, wr.id)
+		}
+
+		if err != nil {
+			w.onError(fmt.Errorf("failed to flush %s: %w", wr, err))
+		}
+	}
+}
+
+func (wr write) String() string {
+	switch wr.op {
+	case opSave:
+		return "save of event ID " + wr.event.ID
+	case opReplace:
+		return "replacement of event ID " + wr.event.ID
+	default:
+		return "deletion of event ID " + wr.id
+	}
+}
+
+// merge the two lists of events into one sorted by [compare], without duplicates.
+func merge(l1, l2 []nostr.Event) []nostr.Event {
+	merged := make([]nostr.Event, 0, len(l1)+len(l2))
+	merged = append(merged, l1...)
+	merged = append(merged, l2...)
+
+	slices.SortFunc(merged, func(e1, e2 nostr.Event) int { return compare(&e1, &e2) })
+	return slices.CompactFunc(merged, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID })
+}
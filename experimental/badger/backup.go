@@ -0,0 +1,68 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// maxPendingWrites is the number of pending writes allowed by [Store.Restore] before it waits for them to complete.
+const maxPendingWrites = 256
+
+// Backup writes a snapshot of all the keys written at or after the version since to w, without blocking reads or writes.
+// It returns the version to be used as since in the next backup, so that consecutive backups are incremental.
+// A since of zero takes a full backup.
+//
+// Cancelling the context interrupts the backup, leaving w with a partial snapshot that must be discarded.
+func (s *Store) Backup(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	next, err := s.DB.Backup(ctxWriter{ctx: ctx, w: w}, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to backup since version %d: %w", since, err)
+	}
+	return next, nil
+}
+
+// Restore loads a backup produced by [Store.Backup] into the store. Incremental backups must be restored
+// in the order they were taken, after the full backup they are based on.
+// The store should not be serving writes while the restore is in progress.
+//
+// Cancelling the context interrupts the restore, leaving the store with part of the backup.
+func (s *Store) Restore(ctx context.Context, r io.Reader) error {
+	if err := s.DB.Load(ctxReader{ctx: ctx, r: r}, maxPendingWrites); err != nil {
+		return fmt.Errorf("failed to restore the backup: %w", err)
+	}
+
+	if s.managed {
+		// the restored keys keep their versions, which might be newer than the latest write
+		s.commitMu.Lock()
+		s.clock.Store(max(s.Version(), s.DB.MaxVersion()))
+		s.commitMu.Unlock()
+	}
+	return nil
+}
+
+// ctxWriter is an [io.Writer] that fails once the context is cancelled.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// ctxReader is an [io.Reader] that fails once the context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -1,30 +1,63 @@
 // Package badger implements a badger DB based event store for nostr.
+//
+// The package is experimental: its API is close to the other stores, but the key layout described in keys.go
+// may change between versions without a migration, so stored data should be treated as rebuildable.
 package badger
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/pippellia-btc/nastro"
-	"github.com/templexxx/xhex"
-	"lol.mleku.dev/chk"
-	"next.orly.dev/pkg/crypto/ec/schnorr"
-	"next.orly.dev/pkg/crypto/sha256"
-	"next.orly.dev/pkg/database"
-	"next.orly.dev/pkg/encoders/event"
-	"next.orly.dev/pkg/encoders/filter"
-	"next.orly.dev/pkg/encoders/kind"
-	"next.orly.dev/pkg/encoders/tag"
-	"next.orly.dev/pkg/encoders/timestamp"
-	"next.orly.dev/pkg/utils/values"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
 )
 
+// DefaultCountWorkers is the default number of filters counted concurrently by [Store.Count].
+const DefaultCountWorkers = 4
+
+// DefaultQueryWorkers is the default number of filters queried concurrently by [Store.Query].
+const DefaultQueryWorkers = 4
+
+// maxRetries is the number of times a write transaction is attempted when it conflicts with a concurrent one.
+const maxRetries = 10
+
+// Store is a nostr event store backed by badger, using the key layout described in keys.go.
 type Store struct {
-	*database.D
+	*badger.DB
+	options badger.Options
+
+	countWorkers  int
+	queryWorkers  int
+	gcInterval    time.Duration         // how often the value log is garbage collected. Zero disables the GC job
+	sweepInterval time.Duration         // how often the expired events are purged. Zero disables the sweep job
+	retention     map[int]time.Duration // how long the events of each kind are kept, see [WithRetention]
+	search        bool                  // whether the words of the content are indexed, see [WithSearch]
+	managed       bool                  // whether badger is in managed mode, see [WithManagedMode]
+	indexedTags   map[string]struct{}   // the tag keys with an index. Nil means all single-letter keys
+
+	tombstoneRetention time.Duration // how long tombstones are kept. Zero keeps them forever
+
+	batchSize     int
+	flushInterval time.Duration
+
+	clock    atomic.Uint64 // the version of the latest write in managed mode
+	commitMu sync.Mutex    // serializes the commits in managed mode
+
+	done      chan struct{}
+	closeOnce sync.Once
+
 	validateEvent   nastro.EventPolicy
 	sanitizeFilters nastro.FilterPolicy
 }
@@ -49,311 +82,841 @@ func WithEventPolicy(v nastro.EventPolicy) Option {
 	}
 }
 
-// New returns a badger-based store located at the provided path,
-// after applying the provided options.
-func New(ctx context.Context, path string, opts ...Option) (
-	s *Store, err error,
-) {
-	var db *database.D
-	if db, err = database.New(ctx, func() {}, path, "info"); chk.E(err) {
-		return
+// WithCountWorkers sets the maximum number of filters counted concurrently by [Store.Count].
+func WithCountWorkers(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("count workers must be positive")
+		}
+		s.countWorkers = n
+		return nil
+	}
+}
+
+// WithQueryWorkers sets the maximum number of filters queried concurrently by [Store.Query].
+func WithQueryWorkers(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("query workers must be positive")
+		}
+		s.queryWorkers = n
+		return nil
+	}
+}
+
+// WithBadgerOptions modifies the [badger.Options] used to open the database, for the settings
+// not covered by the other options. The options start from [badger.DefaultOptions] of the store's path.
+func WithBadgerOptions(modify func(*badger.Options)) Option {
+	return func(s *Store) error {
+		modify(&s.options)
+		return nil
+	}
+}
+
+// WithValueLogMaxSize sets the maximum size in bytes of each value log file.
+func WithValueLogMaxSize(size int64) Option {
+	return func(s *Store) error {
+		if size < 1<<20 || size >= 2<<30 {
+			return fmt.Errorf("value log max size must be in the range [1MB, 2GB), got %d", size)
+		}
+		s.options = s.options.WithValueLogFileSize(size)
+		return nil
 	}
-	s = &Store{
-		D:               db,
+}
+
+// WithCompression sets the compression of the data blocks, e.g. [options.ZSTD] or [options.None].
+func WithCompression(c options.CompressionType) Option {
+	return func(s *Store) error {
+		s.options = s.options.WithCompression(c)
+		return nil
+	}
+}
+
+// WithBlockCacheSize sets the size in bytes of the cache of data blocks. A size of zero disables the cache,
+// which is only advisable when compression is disabled too.
+func WithBlockCacheSize(size int64) Option {
+	return func(s *Store) error {
+		if size < 0 {
+			return fmt.Errorf("block cache size must be non-negative, got %d", size)
+		}
+		s.options = s.options.WithBlockCacheSize(size)
+		return nil
+	}
+}
+
+// WithInMemory keeps the whole database in memory, ignoring the path. Everything is lost when the store is closed.
+func WithInMemory() Option {
+	return func(s *Store) error {
+		s.options = s.options.WithInMemory(true).WithDir("").WithValueDir("")
+		return nil
+	}
+}
+
+// WithLogger sets the logger used by badger, which by default logs warnings and errors to stderr.
+// A nil logger disables logging. Use [SlogLogger] to send the logs to a [slog.Logger].
+func WithLogger(l badger.Logger) Option {
+	return func(s *Store) error {
+		s.options = s.options.WithLogger(l)
+		return nil
+	}
+}
+
+// SlogLogger adapts a [slog.Logger] to the logger of badger, see [WithLogger].
+func SlogLogger(l *slog.Logger) badger.Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	*slog.Logger
+}
+
+func (l slogLogger) Errorf(format string, args ...any) {
+	l.Error(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (l slogLogger) Warningf(format string, args ...any) {
+	l.Warn(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (l slogLogger) Infof(format string, args ...any) {
+	l.Info(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (l slogLogger) Debugf(format string, args ...any) {
+	l.Debug(strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+// WithGCInterval starts a background job that calls [Store.RunGC] every interval with [DefaultGCDiscardRatio].
+// The job is stopped by [Store.Close].
+func WithGCInterval(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("GC interval must be positive")
+		}
+		s.gcInterval = d
+		return nil
+	}
+}
+
+// New returns a badger-based store located at the provided path, after applying the provided options.
+// The store is closed when the context is cancelled.
+func New(ctx context.Context, path string, opts ...Option) (*Store, error) {
+	store := &Store{
+		options:         badger.DefaultOptions(path).WithLoggingLevel(badger.WARNING),
+		countWorkers:    DefaultCountWorkers,
+		queryWorkers:    DefaultQueryWorkers,
+		batchSize:       DefaultBatchSize,
+		flushInterval:   DefaultFlushInterval,
+		done:            make(chan struct{}),
 		validateEvent:   func(*nostr.Event) error { return nil },
 		sanitizeFilters: nastro.DefaultFilterPolicy,
 	}
 
 	for _, opt := range opts {
-		if err = opt(s); err != nil {
-			s = nil
-			return
+		if err := opt(store); err != nil {
+			return nil, err
 		}
 	}
-	// close the store when the context is cancelled
+
+	if err := store.open(); err != nil {
+		return nil, fmt.Errorf("failed to open badger at %s: %w", path, err)
+	}
+
 	go func() {
-		<-ctx.Done()
-		chk.E(s.Close())
+		select {
+		case <-ctx.Done():
+			store.Close()
+		case <-store.done:
+		}
 	}()
-	return
-}
-
-func GoNostrToOrly(ev *nostr.Event) (
-	orly *event.E, err error,
-) {
-	if ev == nil {
-		err = errors.New("event is nil")
-		return
-	}
-	// decode the id, pubkey, and sig from hex strings
-	id := make([]byte, sha256.Size)
-	pk := make([]byte, schnorr.PubKeyBytesLen)
-	sig := make([]byte, schnorr.SignatureSize)
-	if err = xhex.Decode(id, []byte(ev.ID)); chk.E(err) {
-		orly = nil
-		return
-	}
-	if err = xhex.Decode(pk, []byte(ev.PubKey)); chk.E(err) {
-		orly = nil
-		return
-	}
-	if err = xhex.Decode(sig, []byte(ev.Sig)); chk.E(err) {
-		orly = nil
-		return
-	}
-	// convert the tags to the type required for orly.Event
-	ts := make([]*tag.T, 0, len(ev.Tags))
-	for i := range ev.Tags {
-		var t [][]byte
-		for j := range ev.Tags[i] {
-			t = append(t, []byte(ev.Tags[i][j]))
-		}
-		ts = append(ts, tag.NewFromBytesSlice(t...))
-	}
-	orly = &event.E{
-		ID:        id,
-		Pubkey:    pk,
-		CreatedAt: int64(ev.CreatedAt),
-		Kind:      uint16(ev.Kind),
-		Content:   []byte(ev.Content),
-		Tags:      tag.NewS(ts...),
-		Sig:       sig,
-	}
-	return
-}
-
-func OrlyToGoNostr(orly *event.E) (ev *nostr.Event, err error) {
-	// encode the id, pubkey, and sig as hex strings
-	id := make([]byte, sha256.Size*2)
-	xhex.Encode(id, orly.ID)
-	pk := make([]byte, schnorr.PubKeyBytesLen*2)
-	xhex.Encode(pk, orly.Pubkey)
-	sig := make([]byte, schnorr.SignatureSize*2)
-	xhex.Encode(sig, orly.Sig)
-	// convert the tags to the type required for nostr.Event
-	ts := orly.Tags.ToSliceOfSliceOfStrings()
-	tags := make([]nostr.Tag, len(ts))
-	for i := range ts {
-		tags[i] = make(nostr.Tag, len(ts[i]))
-		copy(tags[i], ts[i])
-	}
-	ev = &nostr.Event{
-		ID:        string(id),
-		PubKey:    string(pk),
-		CreatedAt: nostr.Timestamp(orly.CreatedAt),
-		Kind:      int(orly.Kind),
-		Tags:      tags,
-		Content:   string(orly.Content),
-		Sig:       string(sig),
-	}
-	return
-}
-
-func (s *Store) Save(ctx context.Context, ev *nostr.Event) (err error) {
-	if err = s.validateEvent(ev); err != nil {
-		return
-	}
-	var evo *event.E
-	if evo, err = GoNostrToOrly(ev); chk.E(err) {
-		return
-	}
-	if _, err = s.D.SaveEvent(ctx, evo); chk.E(err) {
-		return
-	}
-	return
-}
-
-func (s *Store) Delete(ctx context.Context, id string) (err error) {
-	idBytes := make([]byte, sha256.Size)
-	if err = xhex.Decode(idBytes, []byte(id)); err != nil {
-		return
-	}
-	return s.DeleteEvent(ctx, idBytes)
-}
-
-func (s *Store) Replace(ctx context.Context, ev *nostr.Event) (
-	replaced bool, err error,
-) {
-	if !(kind.IsReplaceable(uint16(ev.Kind)) ||
-		kind.IsParameterizedReplaceable(uint16(ev.Kind))) {
-		err = nastro.ErrInvalidReplacement
-		return
-	}
-	var evo *event.E
-	if evo, err = GoNostrToOrly(ev); err != nil {
-		return
-	}
-	// save the event (if it replaces, it replaces)
-	if replaced, err = s.D.SaveEvent(ctx, evo); err != nil {
-		// If the error indicates the event is blocked (older than existing),
-		// return false without error as this is expected behavior
-		if strings.Contains(err.Error(), "blocked:") {
-			err = nil
-			replaced = false
-			return
-		}
-		return
-	}
-	return
-}
-
-// Query executes multiple nostr filters concurrently and returns matching
-// events. When multiple filters are provided, the results are concatenated in a
-// non-deterministic order due to concurrent execution. Each filter is processed
-// in a separate goroutine, and the final event slice contains events from all
-// filters without any guaranteed ordering between filters' results. The method
-// returns an error if any filter query fails. The results of multiple filters,
-// the individual result groups are still in the same order as the individual
-// filter produced.
-func (s *Store) Query(
-	ctx context.Context, filters ...nostr.Filter,
-) (evs []nostr.Event, err error) {
-	// Simple non-concurrent version to debug
-	var oevs event.S
-	for _, filter := range filters {
-		ff, err := GoNostrFilterToOrly(&filter)
+
+	if store.gcInterval > 0 {
+		go store.gcEvery(store.gcInterval)
+	}
+
+	if store.sweepInterval > 0 {
+		go store.sweepEvery(store.sweepInterval)
+	}
+	return store, nil
+}
+
+// Close stops the background jobs and closes the database.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.DB.Close()
+}
+
+// update runs the read-write transaction, retrying it when it conflicts with a concurrent one.
+func (s *Store) update(fn func(txn *badger.Txn) error) error {
+	var err error
+	for range maxRetries {
+		err = s.commit(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("failed after %d attempts: %w", maxRetries, err)
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	err := s.update(func(txn *badger.Txn) error {
+		_, err := s.insert(txn, event)
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save event with ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// insert the event and its index keys within the transaction, reporting whether the event was inserted.
+// If the event was already present, or it's past its retention or NIP-40 expiration, nothing is written.
+// If the event was deleted by its author, [nastro.ErrDeleted] is returned.
+func (s *Store) insert(txn *badger.Txn, event *nostr.Event) (bool, error) {
+	expiresAt := s.expiresAt(event)
+	if expiresAt != 0 && expiresAt <= uint64(time.Now().Unix()) {
+		return false, nil
+	}
+
+	if isExpired(event, time.Now()) {
+		return false, nil
+	}
+
+	value, err := encodeEvent(nil, event)
+	if err != nil {
+		return false, err
+	}
+
+	id := value[:idSize]
+	pubkey := value[idSize : idSize+pubkeySize]
+	key := eventKey(id)
+
+	_, err = txn.Get(key)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return false, err
+	}
+
+	deleted, err := isDeleted(txn, id, pubkey)
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		return false, fmt.Errorf("%w: event ID %s", nastro.ErrDeleted, event.ID)
+	}
+
+	if err := set(txn, key, value, expiresAt); err != nil {
+		return false, err
+	}
+
+	for _, index := range s.indexKeys(event, id, pubkey) {
+		if err := set(txn, index, nil, expiresAt); err != nil {
+			return false, err
+		}
+	}
+
+	if err := addCounter(txn, counterKey(pubkey, event.Kind, expiresAt), AuthorStats{Count: 1, Bytes: int64(len(value))}); err != nil {
+		return false, err
+	}
+
+	if nastro.IsValidReplacement(event.Kind) {
+		// keep the address pointing to the latest event of the category
+		address := kvcodec.AddressOf(event, pubkey)
+		latest, err := s.latest(txn, address)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		var es event.S
-		if es, err = s.QueryEvents(ctx, ff); err != nil {
-			return nil, err
+
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			if err := set(txn, address, bytes.Clone(id), expiresAt); err != nil {
+				return false, err
+			}
 		}
-		oevs = append(oevs, es...)
 	}
-	for _, ev := range oevs {
-		var oe *nostr.Event
-		if oe, err = OrlyToGoNostr(ev); err != nil {
-			return nil, err
+	return true, nil
+}
+
+// latest returns the event the address key points to, or nil if there is none.
+func (s *Store) latest(txn *badger.Txn, address []byte) (*nostr.Event, error) {
+	item, err := txn.Get(address)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(txn, id)
+}
+
+// get returns the event with the provided id, or nil if it's not stored.
+func (s *Store) get(txn *badger.Txn, id []byte) (*nostr.Event, error) {
+	item, err := txn.Get(eventKey(id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := &nostr.Event{}
+	err = item.Value(func(value []byte) error {
+		return decodeEvent(value, event)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode event with ID %x: %w", id, err)
+	}
+	return event, nil
+}
+
+// remove the event and its index keys within the transaction.
+// The address key is removed only if it points to the event.
+func (s *Store) remove(txn *badger.Txn, event *nostr.Event) error {
+	id := make([]byte, idSize)
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(id, event.ID); err != nil {
+		return fmt.Errorf("invalid id: %w", err)
+	}
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	// the event is counted under its expiration, which depends on the retention at the time it was saved
+	var expiresAt uint64
+	item, err := txn.Get(eventKey(id))
+	switch {
+	case err == nil:
+		expiresAt = item.ExpiresAt()
+
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+
+	if err := txn.Delete(eventKey(id)); err != nil {
+		return err
+	}
+
+	for _, index := range s.indexKeys(event, id, pubkey) {
+		if err := txn.Delete(index); err != nil {
+			return err
+		}
+	}
+
+	if err := addCounter(txn, counterKey(pubkey, event.Kind, expiresAt), AuthorStats{Count: -1, Bytes: -int64(encodedSize(event))}); err != nil {
+		return err
+	}
+
+	if !nastro.IsValidReplacement(event.Kind) {
+		return nil
+	}
+
+	address := kvcodec.AddressOf(event, pubkey)
+	item, err = txn.Get(address)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	latest, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(latest, id) {
+		return txn.Delete(address)
+	}
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	key := make([]byte, idSize)
+	if err := kvcodec.DecodeHex(key, id); err != nil {
+		// no event can be stored under an invalid id
+		return nil
+	}
+
+	err := s.update(func(txn *badger.Txn) error {
+		event, err := s.get(txn, key)
+		if err != nil || event == nil {
+			return err
 		}
-		evs = append(evs, *oe)
+		return s.remove(txn, event)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to delete event with ID %s: %w", id, err)
 	}
-	return evs, nil
+	return nil
 }
 
-// Count returns the number of events matching the provided filters. If multiple
-// filters are provided, the results are concatenated in a non-deterministic
-// order due to concurrent execution. Each filter is processed in a separate
-// goroutine, and the final count is the sum of the individual filter counts.
-// The method returns an error if any filter query fails. The results of
-// multiple filters, the individual result groups are still in the same order as
-// the individual filter produced. Note that it can return a count and an error
-// at the same time, with multiple filters.
-func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (
-	count int64, err error,
-) {
-	var counter atomic.Int64
-	var wg sync.WaitGroup
-	for _, f := range filters {
-		wg.Add(1)
-		go func(filter nostr.Filter) {
-			defer wg.Done()
-			ff, err := GoNostrFilterToOrly(&filter)
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return false, fmt.Errorf("failed to replace event with ID %s: invalid pubkey: %w", event.ID, err)
+	}
+
+	var replaced bool
+	err := s.update(func(txn *badger.Txn) error {
+		replaced = false
+		old, err := s.latest(txn, kvcodec.AddressOf(event, pubkey))
+		if err != nil {
+			return err
+		}
+
+		if old != nil {
+			if old.CreatedAt >= event.CreatedAt {
+				return nil
+			}
+
+			if err := s.remove(txn, old); err != nil {
+				return err
+			}
+		}
+
+		replaced, err = s.insert(txn, event)
+		return err
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event with ID %s: %w", event.ID, err)
+	}
+	return replaced, nil
+}
+
+// Query stored events matching the provided filters, sorted by created_at in descending order, and by id
+// in ascending order among events created at the same time. Events matching more than one filter are returned once.
+//
+// Each filter returns at most its Limit events, the first ones in the order above, and filters with LimitZero return none.
+// A Limit of zero without LimitZero means no limit, which is only possible with a permissive [nastro.FilterPolicy].
+//
+// Filters are queried concurrently, up to the workers set with [WithQueryWorkers],
+// within the same read transaction, so that they all see the same snapshot of the store.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+	return s.queryAll(ctx, s.view, filters)
+}
+
+// queryAll executes the sanitized filters in a single read transaction opened with view, merging their results as described in [Store.Query].
+func (s *Store) queryAll(ctx context.Context, view func(func(*badger.Txn) error) error, filters nostr.Filters) ([]nostr.Event, error) {
+	results := make([][]nostr.Event, len(filters))
+	err := view(func(txn *badger.Txn) error {
+		return parallel(len(filters), s.queryWorkers, func(i int) error {
+			events, err := s.query(ctx, txn, filters[i])
 			if err != nil {
-				return
+				return fmt.Errorf("failed to query filter %d: %w", i, err)
 			}
-			var c int
-			if c, _, err = s.CountEvents(ctx, ff); err != nil {
-				return
+
+			results[i] = events
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+
+	// merging in the order of the filters keeps the result independent of the scheduling
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for _, result := range results {
+		for _, event := range result {
+			if _, ok := seen[event.ID]; ok {
+				continue
 			}
-			counter.Add(int64(c))
-		}(f)
+
+			seen[event.ID] = struct{}{}
+			events = append(events, event)
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count stored events matching the provided filters, returning the sum of the counts of each filter.
+// The limits of the filters are ignored.
+//
+// Filters are counted concurrently, at most [WithCountWorkers] at a time, each in its own read transaction.
+// If any filter fails, the errors of all failed filters are joined and returned.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var total atomic.Int64
+	err := parallel(len(filters), s.countWorkers, func(i int) error {
+		count, err := s.count(ctx, filters[i])
+		if err != nil {
+			return fmt.Errorf("failed to count filter %d: %w", i, err)
+		}
+
+		total.Add(count)
+		return nil
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return total.Load(), nil
+}
+
+// parallel calls fn for every index in [0, n), with at most the provided number of concurrent calls.
+// It returns the errors of all the calls, joined.
+func parallel(n, workers int, fn func(i int) error) error {
+	if n == 1 {
+		return fn(0)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	sem := make(chan struct{}, workers)
+
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(i)
+		}()
 	}
+
 	wg.Wait()
-	count = counter.Load()
-	return
+	return errors.Join(errs...)
 }
 
-func GoNostrFilterToOrly(gf *nostr.Filter) (f *filter.F, err error) {
-	f = &filter.F{}
-	var ids [][]byte
-	for _, id := range gf.IDs {
-		idb := make([]byte, sha256.Size)
-		if err = xhex.Decode(idb, []byte(id)); err != nil {
-			return
+// count the events matching the filter, ignoring its limit.
+// When the index scanned for the filter covers all its conditions, the index keys are counted without reading the events.
+// Otherwise, the events are decoded to check the conditions the index doesn't cover.
+func (s *Store) count(ctx context.Context, filter nostr.Filter) (int64, error) {
+	filter.Limit, filter.LimitZero = 0, false
+
+	var count int64
+	err := s.view(func(txn *badger.Txn) error {
+		if len(filter.IDs) > 0 || !s.covers(filter) {
+			matches, err := s.query(ctx, txn, filter)
+			if err != nil {
+				return err
+			}
+
+			count = int64(len(matches))
+			return nil
+		}
+
+		expired, err := expiredIDs(ctx, txn, time.Now())
+		if err != nil {
+			return err
+		}
+
+		prefixes := s.plan(filter)
+		var seen map[string]struct{}
+		if len(prefixes) > 1 {
+			// an event can be found under more than one prefix, e.g. when it has more than one of the tag values
+			seen = make(map[string]struct{})
+		}
+
+		for _, prefix := range prefixes {
+			n, err := countKeys(ctx, txn, prefix, filter, expired, seen)
+			if err != nil {
+				return err
+			}
+			count += n
 		}
-		ids = append(ids, idb)
+		return nil
+	})
+	return count, err
+}
+
+// covers returns whether the index scanned by [Store.plan] guarantees all the conditions of the filter,
+// except its time range which is checked on the index keys, so that its events can be counted without decoding them.
+func (s *Store) covers(filter nostr.Filter) bool {
+	if filter.Search != "" {
+		return false
 	}
-	f.Ids = tag.NewFromBytesSlice(ids...)
-	var kinds kind.S
-	for _, k := range gf.Kinds {
-		kinds.K = append(kinds.K, &kind.K{K: uint16(k)})
+
+	conditions := len(filter.Tags)
+	if len(filter.Authors) > 0 {
+		conditions++
 	}
-	f.Kinds = &kinds
-	var authors [][]byte
-	for _, pk := range gf.Authors {
-		pkb := make([]byte, schnorr.PubKeyBytesLen)
-		if err = xhex.Decode(pkb, []byte(pk)); err != nil {
-			return
+	if len(filter.Kinds) > 0 {
+		conditions++
+	}
+
+	switch {
+	case conditions > 1:
+		return false
+
+	case len(filter.Tags) == 1:
+		for key, values := range filter.Tags {
+			if len(values) == 0 || slices.ContainsFunc(values, func(value string) bool { return !s.isIndexed(key, value) }) {
+				return false
+			}
 		}
-		authors = append(authors, pkb)
 	}
-	f.Authors = tag.NewFromBytesSlice(authors...)
-	var ts []*tag.T
-	for key, val := range gf.Tags {
-		var tbs [][]byte
-		tbs = append(tbs, []byte(key))
-		for _, v := range val {
-			tbs = append(tbs, []byte(v))
+	return true
+}
+
+// countKeys counts the index keys with the prefix within the filter's time range, using a key-only iteration.
+// The ids in expired and, if not nil, in seen are skipped, and the counted ids are added to seen.
+func countKeys(ctx context.Context, txn *badger.Txn, prefix []byte, filter nostr.Filter, expired, seen map[string]struct{}) (int64, error) {
+	var since, until uint64 = 0, maxCreatedAt
+	if filter.Since != nil {
+		since = kvcodec.Timestamp(*filter.Since)
+	}
+	if filter.Until != nil {
+		until = kvcodec.Timestamp(*filter.Until)
+	}
+
+	options := badger.DefaultIteratorOptions
+	options.PrefetchValues = false
+	options.Reverse = true
+	options.Prefix = prefix
+
+	it := txn.NewIterator(options)
+	defer it.Close()
+
+	var count int64
+	for it.Seek(kvcodec.SeekKey(prefix, until)); it.ValidForPrefix(prefix); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		createdAt, id := kvcodec.ParseSuffix(it.Item().Key())
+		if createdAt < since {
+			break
+		}
+
+		if _, ok := expired[string(id)]; ok {
+			continue
 		}
-		t := tag.NewFromBytesSlice(tbs...)
-		ts = append(ts, t)
+
+		if seen != nil {
+			if _, ok := seen[string(id)]; ok {
+				continue
+			}
+			seen[string(id)] = struct{}{}
+		}
+		count++
 	}
-	f.Tags = tag.NewS(ts...)
-	if gf.Since != nil {
-		f.Since = timestamp.FromUnix(gf.Since.Time().Unix())
+	return count, nil
+}
+
+// expiredIDs returns the ids of the events that are past their NIP-40 expiration at the provided time,
+// but have not been purged yet, using the expiry keys.
+func expiredIDs(ctx context.Context, txn *badger.Txn, now time.Time) (map[string]struct{}, error) {
+	options := badger.DefaultIteratorOptions
+	options.PrefetchValues = false
+	options.Prefix = []byte{prefixExpiry}
+
+	it := txn.NewIterator(options)
+	defer it.Close()
+
+	expired := make(map[string]struct{})
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		expiration, id := kvcodec.ParseSuffix(it.Item().Key())
+		if expiration > kvcodec.Timestamp(nostr.Timestamp(now.Unix())) {
+			break
+		}
+		expired[string(id)] = struct{}{}
 	}
-	if gf.Until != nil {
-		f.Until = timestamp.FromUnix(gf.Until.Time().Unix())
+	return expired, nil
+}
+
+// query returns the events matching the filter, sorted with [compare] and truncated to the filter's limit.
+// A limit of zero means no limit, unless LimitZero is set.
+func (s *Store) query(ctx context.Context, txn *badger.Txn, filter nostr.Filter) ([]nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
 	}
-	if gf.Search != "" {
-		f.Search = []byte(gf.Search)
+
+	var events []nostr.Event
+
+	if len(filter.IDs) > 0 {
+		for _, ID := range filter.IDs {
+			id := make([]byte, idSize)
+			if err := kvcodec.DecodeHex(id, ID); err != nil {
+				continue
+			}
+
+			event, err := s.get(txn, id)
+			if err != nil {
+				return nil, err
+			}
+
+			if event != nil && matches(filter, event) {
+				events = append(events, *event)
+			}
+		}
+	} else {
+		for _, prefix := range s.plan(filter) {
+			matches, err := s.scan(ctx, txn, prefix, filter)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, matches...)
+		}
 	}
-	if gf.Limit > 0 && !gf.LimitZero {
-		f.Limit = values.ToUintPointer(uint(gf.Limit))
+
+	slices.SortFunc(events, compare)
+	events = slices.CompactFunc(events, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID })
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
 	}
-	return
+	return events, nil
 }
 
-func OrlyFilterToGoNostr(f *filter.F) (gf *nostr.Filter) {
-	gf = &nostr.Filter{}
-	for _, id := range f.Ids.T {
-		idh := make([]byte, sha256.Size*2)
-		xhex.Encode(idh, id)
-		gf.IDs = append(gf.IDs, string(idh))
+// scan the index keys with the prefix from the newest to the oldest within the filter's time range,
+// and returns the events matching the filter, up to the filter's limit.
+func (s *Store) scan(ctx context.Context, txn *badger.Txn, prefix []byte, filter nostr.Filter) ([]nostr.Event, error) {
+	var since, until uint64 = 0, maxCreatedAt
+	if filter.Since != nil {
+		since = kvcodec.Timestamp(*filter.Since)
 	}
-	for _, k := range f.Kinds.K {
-		gf.Kinds = append(gf.Kinds, int(k.K))
+	if filter.Until != nil {
+		until = kvcodec.Timestamp(*filter.Until)
 	}
-	for _, aut := range f.Authors.T {
-		idh := make([]byte, schnorr.PubKeyBytesLen*2)
-		xhex.Encode(idh, aut)
-		gf.Authors = append(gf.Authors, string(idh))
+
+	options := badger.DefaultIteratorOptions
+	options.PrefetchValues = false
+	options.Reverse = true
+	options.Prefix = prefix
+
+	it := txn.NewIterator(options)
+	defer it.Close()
+
+	var events []nostr.Event
+	for it.Seek(kvcodec.SeekKey(prefix, until)); it.ValidForPrefix(prefix); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		createdAt, id := kvcodec.ParseSuffix(it.Item().Key())
+		if createdAt < since {
+			break
+		}
+
+		event, err := s.get(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if event == nil || !matches(filter, event) {
+			continue
+		}
+
+		events = append(events, *event)
+		if filter.Limit > 0 && len(events) >= filter.Limit {
+			// the remaining events with the same created_at might sort before the last one by id
+			last := event.CreatedAt
+			for it.Next(); it.ValidForPrefix(prefix); it.Next() {
+				createdAt, id := kvcodec.ParseSuffix(it.Item().Key())
+				if createdAt != kvcodec.Timestamp(last) {
+					break
+				}
+
+				event, err := s.get(txn, id)
+				if err != nil {
+					return nil, err
+				}
+
+				if event != nil && matches(filter, event) {
+					events = append(events, *event)
+				}
+			}
+			break
+		}
 	}
-	gf.Tags = make(nostr.TagMap)
-	if f.Tags != nil {
-		for _, t := range f.Tags.ToSliceOfSliceOfStrings() {
-			if len(t) > 0 {
-				gf.Tags[t[0]] = t[1:]
+	return events, nil
+}
+
+// plan returns the prefixes of the index keys to scan for the filter, using the most selective index available.
+// Authors are preferred, followed by search tokens, tags with the fewest values, kinds, and lastly the time index.
+// The other conditions of the filter are checked on the events.
+func (s *Store) plan(filter nostr.Filter) [][]byte {
+	if len(filter.Authors) > 0 {
+		prefixes := make([][]byte, 0, len(filter.Authors))
+		for _, author := range filter.Authors {
+			pubkey := make([]byte, pubkeySize)
+			if err := kvcodec.DecodeHex(pubkey, author); err != nil {
+				// no event can match an invalid pubkey
+				continue
 			}
+			prefixes = append(prefixes, kvcodec.PubkeyPrefix(pubkey))
 		}
+		return prefixes
 	}
-	if f.Since != nil {
-		ts := nostr.Timestamp(f.Since.I64())
-		gf.Since = &ts
+
+	if tokens := searchTokens(filter.Search); len(tokens) > 0 {
+		// all tokens must be in the content, so scanning the longest is enough
+		longest := slices.MaxFunc(tokens, func(t1, t2 string) int { return cmp.Compare(len(t1), len(t2)) })
+		return [][]byte{tokenPrefix(longest)}
 	}
-	if f.Until != nil {
-		ts := nostr.Timestamp(f.Until.I64())
-		gf.Until = &ts
+
+	var key string
+	var values []string
+	for k, v := range filter.Tags {
+		if len(v) == 0 || slices.ContainsFunc(v, func(value string) bool { return !s.isIndexed(k, value) }) {
+			// events matching a value that isn't indexed would be missed
+			continue
+		}
+
+		if values == nil || len(v) < len(values) || (len(v) == len(values) && k < key) {
+			key, values = k, v
+		}
 	}
-	if len(f.Search) > 0 {
-		gf.Search = string(f.Search)
+
+	if values != nil {
+		prefixes := make([][]byte, 0, len(values))
+		for _, value := range values {
+			prefixes = append(prefixes, kvcodec.TagPrefix(key, value))
+		}
+		return prefixes
 	}
-	if f.Limit != nil {
-		gf.Limit = int(*f.Limit)
-		if gf.Limit == 0 {
-			gf.LimitZero = true
+
+	if len(filter.Kinds) > 0 {
+		prefixes := make([][]byte, 0, len(filter.Kinds))
+		for _, kind := range filter.Kinds {
+			if kind >= 0 && kind <= maxKind {
+				prefixes = append(prefixes, kvcodec.KindPrefix(kind))
+			}
 		}
+		return prefixes
+	}
+
+	return [][]byte{{prefixTime}}
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
 	}
-	return
+	return cmp.Compare(e1.ID, e2.ID)
 }
@@ -1,15 +1,26 @@
 package badger
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/storetest"
 )
 
 // helper: random bytes of length n
@@ -106,10 +117,9 @@ func TestReplace(t *testing.T) {
 			expectedStored: false,
 		},
 		{
-			name:   "valid replace (event is newer)",
-			stored: eventOld,
-			newEvt: eventNew,
-			// NOTE: current badger.Replace does not report replacement; expect false
+			name:           "valid replace (event is newer)",
+			stored:         eventOld,
+			newEvt:         eventNew,
 			expectedStored: true,
 		},
 	}
@@ -136,7 +146,7 @@ func TestReplace(t *testing.T) {
 				t.Fatalf("expected stored %v, got %v", test.expectedStored, storedFlag)
 			}
 
-			res, err := store.Query(ctx, nostr.Filter{Authors: []string{test.stored.PubKey}, Kinds: []int{int(test.stored.Kind)}, Tags: nostr.TagMap{"d": []string{"test-tag"}}})
+			res, err := store.Query(ctx, nostr.Filter{Authors: []string{test.stored.PubKey}, Kinds: []int{int(test.stored.Kind)}, Tags: nostr.TagMap{"d": []string{"test-tag"}}, Limit: 1})
 			if err != nil {
 				t.Fatalf("failed to query: %v", err)
 			}
@@ -145,9 +155,6 @@ func TestReplace(t *testing.T) {
 				t.Errorf("expected one event, got %d", len(res))
 			}
 
-			// Since badger Replace always returns false, verify the correct event is in the store
-			// For the "no replace" case: newer event should remain
-			// For the "valid replace" case: the replacement should have occurred
 			if test.name == "no replace (event is not newer)" {
 				// Should still have the newer event (stored first)
 				if !reflect.DeepEqual(res[0], test.stored) {
@@ -167,78 +174,1458 @@ func TestInterface(t *testing.T) {
 	var _ nastro.Store = &Store{}
 }
 
-// ---- Conversion round-trip tests ----
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, err := New(context.Background(), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
 
-func TestEventConversionRoundTripJSON(t *testing.T) {
-	// random go-nostr event
-	ev1 := nostr.Event{
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubkey := randHex(32)
+	events := make([]nostr.Event, 5)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].PubKey = pubkey
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		events[i].Tags = nostr.Tags{{"t", "nostr"}}
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := makeHexEvent()
+	if err := store.Save(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	since := nostr.Timestamp(101)
+	until := nostr.Timestamp(103)
+
+	tests := []struct {
+		name     string
+		filters  []nostr.Filter
+		expected []nostr.Event
+	}{
+		{
+			name:     "authors",
+			filters:  []nostr.Filter{{Authors: []string{pubkey}, Limit: 2}},
+			expected: []nostr.Event{events[4], events[3]},
+		},
+		{
+			name:     "kinds and time range",
+			filters:  []nostr.Filter{{Kinds: []int{1}, Since: &since, Until: &until, Limit: 10}},
+			expected: []nostr.Event{events[3], events[2], events[1]},
+		},
+		{
+			name:     "tags",
+			filters:  []nostr.Filter{{Tags: nostr.TagMap{"t": {"nostr"}}, Limit: 1}},
+			expected: []nostr.Event{events[4]},
+		},
+		{
+			name:     "no index",
+			filters:  []nostr.Filter{{Until: &since, Limit: 10}},
+			expected: []nostr.Event{events[1], events[0]},
+		},
+		{
+			name: "overlapping filters",
+			filters: []nostr.Filter{
+				{IDs: []string{events[0].ID, other.ID}, Limit: 10},
+				{Authors: []string{pubkey}, Until: &since, Limit: 10},
+			},
+			expected: []nostr.Event{other, events[1], events[0]},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := store.Query(ctx, test.filters...)
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, res)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := makeHexEvent()
+	if err := store.Save(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, event.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{event.Kind}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected no events after the deletion, got %d", count)
+	}
+
+	// the address is free again, so an older event is a valid replacement
+	older := event
+	older.ID = randHex(32)
+	older.CreatedAt--
+
+	replaced, err := store.Replace(ctx, &older)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !replaced {
+		t.Fatalf("expected the replacement to happen after the deletion")
+	}
+}
+
+func TestCodec(t *testing.T) {
+	event := nostr.Event{
 		ID:        randHex(32),
 		PubKey:    randHex(32),
 		CreatedAt: nostr.Timestamp(time.Now().Unix()),
 		Kind:      1,
-		Tags:      nostr.Tags{{"e", randHex(32)}, {"p", randHex(32)}, {"d", "topic"}},
+		Tags:      nostr.Tags{{"e", randHex(32)}, {"p", randHex(32), "wss://relay.example.com"}, {"d", ""}, {}},
 		Content:   "hello world",
 		Sig:       randHex(64),
 	}
 
-	orly1, err := GoNostrToOrly(&ev1)
+	data, err := encodeEvent(nil, &event)
 	if err != nil {
-		t.Fatalf("GoNostrToOrly failed: %v", err)
+		t.Fatal(err)
+	}
+
+	var decoded nostr.Event
+	if err := decodeEvent(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, event) {
+		t.Fatalf("expected %v, got %v", event, decoded)
+	}
+
+	for i := range data {
+		if err := decodeEvent(data[:i], &decoded); err == nil {
+			t.Fatalf("expected an error decoding %d of %d bytes", i, len(data))
+		}
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	events := make([]nostr.Event, 10_000)
+	encoded := make([][]byte, len(events))
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].Content = "a nostr note of reasonable length, with a few words in it"
+		events[i].Tags = append(events[i].Tags, nostr.Tag{"e", randHex(32)}, nostr.Tag{"p", randHex(32), "wss://relay.example.com"})
+
+		var err error
+		encoded[i], err = encodeEvent(nil, &events[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for i := range events {
+				if _, err := encodeEvent(nil, &events[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			for _, data := range encoded {
+				var event nostr.Event
+				if err := decodeEvent(data, &event); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	ctx := context.Background()
+	store, err := New(ctx, b.TempDir(), WithFilterPolicy(func(filters ...nostr.Filter) (nostr.Filters, error) { return filters, nil }))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	events := make([]*nostr.Event, 10_000)
+	for i := range events {
+		event := makeHexEvent()
+		event.Kind = 1
+		event.CreatedAt = nostr.Timestamp(i)
+		events[i] = &event
+	}
+
+	if _, err := store.SaveMany(ctx, slices.Values(events)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		res, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}, Limit: len(events)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(res) != len(events) {
+			b.Fatalf("expected %d events, got %d", len(events), len(res))
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("in memory", func(t *testing.T) {
+		store, err := New(ctx, "", WithInMemory(), WithCompression(options.ZSTD), WithBlockCacheSize(1<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !store.Opts().InMemory {
+			t.Fatalf("expected the store to be in memory")
+		}
+
+		event := makeHexEvent()
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("badger options", func(t *testing.T) {
+		store, err := New(ctx, t.TempDir(), WithBadgerOptions(func(o *badger.Options) { o.NumVersionsToKeep = 2 }))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if store.Opts().NumVersionsToKeep != 2 {
+			t.Fatalf("expected NumVersionsToKeep 2, got %d", store.Opts().NumVersionsToKeep)
+		}
+	})
+
+	t.Run("invalid value log size", func(t *testing.T) {
+		if _, err := New(ctx, t.TempDir(), WithValueLogMaxSize(1)); err == nil {
+			t.Fatalf("expected an error for a value log size of 1 byte")
+		}
+	})
+}
+
+func TestCount(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithCountWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 10 {
+		event := makeHexEvent()
+		event.Kind = 1
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := make([]nostr.Filter, 8)
+	for i := range filters {
+		filters[i] = nostr.Filter{Kinds: []int{1}}
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		// meant to be run with -race, counting while events are being saved
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				event := makeHexEvent()
+				if err := store.Save(ctx, &event); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			go func() {
+				defer wg.Done()
+				count, err := store.Count(ctx, filters...)
+				if err != nil {
+					t.Error(err)
+				}
+
+				if count != 80 {
+					t.Errorf("expected count 80, got %d", count)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := store.Count(cancelled, filters...)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+
+		if !errors.Is(err, nastro.ErrInternalQuery) {
+			t.Fatalf("expected error %v, got %v", nastro.ErrInternalQuery, err)
+		}
+	})
+
+	t.Run("invalid workers", func(t *testing.T) {
+		if _, err := New(ctx, t.TempDir(), WithCountWorkers(0)); err == nil {
+			t.Fatalf("expected an error for zero count workers")
+		}
+	})
+}
+
+func TestCountKeys(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
 	}
-	// back to go-nostr
-	ev2, err := OrlyToGoNostr(orly1)
+
+	pubkey := randHex(32)
+	events := make([]nostr.Event, 4)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].PubKey = pubkey
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		events[i].Tags = nostr.Tags{{"t", "a"}}
+	}
+
+	events[1].Tags = append(events[1].Tags, nostr.Tag{"t", "b"})
+	events[2].Kind = 7
+	expiration := time.Now().Unix() + 1
+	events[3].Tags = append(events[3].Tags, nostr.Tag{"expiration", strconv.FormatInt(expiration, 10)})
+
+	for _, event := range events {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last event expires, but it's not purged
+	time.Sleep(2 * time.Second)
+	since, until := nostr.Timestamp(101), nostr.Timestamp(101)
+
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		expected int64
+	}{
+		{name: "time", filter: nostr.Filter{}, expected: 3},
+		{name: "time range", filter: nostr.Filter{Since: &since, Until: &until}, expected: 1},
+		{name: "author", filter: nostr.Filter{Authors: []string{pubkey, pubkey}}, expected: 3},
+		{name: "kind", filter: nostr.Filter{Kinds: []int{1}}, expected: 2},
+		{name: "tag values", filter: nostr.Filter{Tags: nostr.TagMap{"t": {"a", "b"}}}, expected: 3},
+		{name: "post-filter", filter: nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"t": {"b"}}}, expected: 1},
+		{name: "empty tag values", filter: nostr.Filter{Tags: nostr.TagMap{"t": {}}}, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, err := store.Count(ctx, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if count != test.expected {
+				t.Fatalf("expected count %d, got %d", test.expected, count)
+			}
+		})
+	}
+}
+
+func TestQueryWorkers(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithQueryWorkers(2))
 	if err != nil {
-		t.Fatalf("OrlyToGoNostr failed: %v", err)
+		t.Fatal(err)
 	}
-	// and again to orly
-	orly2, err := GoNostrToOrly(ev2)
+
+	events := make([]nostr.Event, 20)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].Kind = i % 4
+		events[i].CreatedAt = nostr.Timestamp(100 + i/2) // pairs with the same created_at
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// overlapping filters, so that events are deduplicated across them
+	filters := []nostr.Filter{
+		{Kinds: []int{0}, Limit: 100},
+		{Kinds: []int{1}, Limit: 100},
+		{Kinds: []int{0, 1}, Limit: 100},
+		{Kinds: []int{2, 3}, Limit: 100},
+		{Limit: 3},
+	}
+
+	expected := slices.Clone(events)
+	slices.SortFunc(expected, compare)
+
+	t.Run("concurrent", func(t *testing.T) {
+		// meant to be run with -race, querying while other events are being saved
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				event := makeHexEvent()
+				event.Kind = 10
+				event.CreatedAt = 1 // older than all events, so it doesn't change the results
+				if err := store.Save(ctx, &event); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			go func() {
+				defer wg.Done()
+				res, err := store.Query(ctx, filters...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !reflect.DeepEqual(res, expected) {
+					t.Errorf("expected %v, got %v", expected, res)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := store.Query(cancelled, filters...)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+
+		if !errors.Is(err, nastro.ErrInternalQuery) {
+			t.Fatalf("expected error %v, got %v", nastro.ErrInternalQuery, err)
+		}
+	})
+
+	t.Run("invalid workers", func(t *testing.T) {
+		if _, err := New(ctx, t.TempDir(), WithQueryWorkers(0)); err == nil {
+			t.Fatalf("expected an error for zero query workers")
+		}
+	})
+}
+
+func TestQueryLimit(t *testing.T) {
+	ctx := context.Background()
+	permissive := func(filters ...nostr.Filter) (nostr.Filters, error) { return filters, nil }
+
+	store, err := New(ctx, t.TempDir(), WithFilterPolicy(permissive))
 	if err != nil {
-		t.Fatalf("GoNostrToOrly(again) failed: %v", err)
+		t.Fatal(err)
+	}
+
+	// events created at the same time are sorted by id
+	events := make([]nostr.Event, 5)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].Kind = 1
+		events[i].CreatedAt = 100
+		events[i].ID = strings.Repeat(strconv.Itoa(i), 64)
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	b1 := orly1.Marshal(nil)
-	b2 := orly2.Marshal(nil)
-	if !reflect.DeepEqual(b1, b2) {
-		t.Fatalf("orly event JSON mismatch after round-trip\n first:  %s\n second: %s", string(b1), string(b2))
+	latest := makeHexEvent()
+	latest.Kind = 1
+	latest.CreatedAt = 200
+	if err := store.Save(ctx, &latest); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filters  []nostr.Filter
+		expected []nostr.Event
+	}{
+		{
+			name:     "limit within the same created_at",
+			filters:  []nostr.Filter{{Kinds: []int{1}, Limit: 3}},
+			expected: []nostr.Event{latest, events[0], events[1]},
+		},
+		{
+			name:     "no limit",
+			filters:  []nostr.Filter{{Kinds: []int{1}}},
+			expected: append([]nostr.Event{latest}, events...),
+		},
+		{
+			name:     "limit zero",
+			filters:  []nostr.Filter{{Kinds: []int{1}, LimitZero: true}},
+			expected: nil,
+		},
+		{
+			name: "limit per filter",
+			filters: []nostr.Filter{
+				{IDs: []string{events[4].ID}, Limit: 1},
+				{Kinds: []int{1}, Limit: 1},
+				{Kinds: []int{1}, LimitZero: true},
+			},
+			expected: []nostr.Event{latest, events[4]},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := store.Query(ctx, test.filters...)
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, res)
+			}
+		})
 	}
 }
 
-func randomFilter() nostr.Filter {
-	f := nostr.Filter{}
-	// randomize some fields
-	f.IDs = []string{randHex(32), randHex(32)}
-	f.Kinds = []int{1, 7, 30000}
-	f.Authors = []string{randHex(32)}
-	f.Tags = nostr.TagMap{
-		"e": {randHex(32), randHex(32)},
-		"p": {randHex(32)},
-		"d": {"topic"},
+func TestQueryStream(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]nostr.Event, 6)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		events[i].Tags = nostr.Tags{{"t", "a"}, {"t", "b"}}
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
-	since := nostr.Timestamp(time.Now().Add(-time.Hour).Unix())
-	until := nostr.Timestamp(time.Now().Add(time.Hour).Unix())
-	f.Since = &since
-	f.Until = &until
-	f.Search = "find me"
-	f.Limit = 42
-	return f
+
+	t.Run("limit", func(t *testing.T) {
+		var res []nostr.Event
+		filter := nostr.Filter{Tags: nostr.TagMap{"t": {"a", "b"}}, Limit: 3}
+
+		for event, err := range store.QueryStream(ctx, filter) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, event)
+		}
+
+		expected := []nostr.Event{events[5], events[4], events[3]}
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("expected %v, got %v", expected, res)
+		}
+	})
+
+	t.Run("break", func(t *testing.T) {
+		var res []nostr.Event
+		for event, err := range store.QueryStream(ctx, nostr.Filter{Kinds: []int{1}, Limit: 10}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res = append(res, event)
+			if len(res) == 2 {
+				break
+			}
+		}
+
+		expected := []nostr.Event{events[5], events[4]}
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("expected %v, got %v", expected, res)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		var err error
+		for _, err = range store.QueryStream(cancelled, nostr.Filter{Kinds: []int{1}, Limit: 10}) {
+		}
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected error %v, got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		var err error
+		for _, err = range store.QueryStream(ctx, nostr.Filter{Kinds: []int{1}}) {
+		}
+
+		if !errors.Is(err, nastro.ErrUnspecifiedLimit) {
+			t.Fatalf("expected error %v, got %v", nastro.ErrUnspecifiedLimit, err)
+		}
+	})
 }
 
-func TestFilterConversionRoundTripJSON(t *testing.T) {
-	gf1 := randomFilter()
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := func(n int) {
+		for range n {
+			event := makeHexEvent()
+			event.Kind = 1
+			if err := store.Save(ctx, &event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	save(3)
+	var full, incremental bytes.Buffer
+	since, err := store.Backup(ctx, &full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save(2)
+	if _, err := store.Backup(ctx, &incremental, since); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restored.Restore(ctx, &full); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(ctx, &incremental); err != nil {
+		t.Fatal(err)
+	}
 
-	orly1, err := GoNostrFilterToOrly(&gf1)
+	filter := nostr.Filter{Kinds: []int{1}, Limit: 10}
+	expected, err := store.Query(ctx, filter)
 	if err != nil {
-		t.Fatalf("GoNostrFilterToOrly failed: %v", err)
+		t.Fatal(err)
 	}
-	gf2 := OrlyFilterToGoNostr(orly1)
-	orly2, err := GoNostrFilterToOrly(gf2)
+
+	res, err := restored.Query(ctx, filter)
 	if err != nil {
-		t.Fatalf("GoNostrFilterToOrly(again) failed: %v", err)
+		t.Fatal(err)
+	}
+
+	if len(res) != 5 || !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := store.Backup(cancelled, io.Discard, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRunGC(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithGCInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	event := makeHexEvent()
+	if err := store.Save(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, event.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RunGC(ctx, 0.5); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := store.RunGC(ctx, 1); err == nil {
+		t.Fatalf("expected an error for a discard ratio of 1")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := store.RunGC(cancelled, 0.5); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error %v, got %v", context.Canceled, err)
+	}
+
+	if _, err := New(ctx, t.TempDir(), WithGCInterval(0)); err == nil {
+		t.Fatalf("expected an error for a GC interval of zero")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithRetention(map[int]time.Duration{1: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := makeHexEvent()
+	old.Kind = 1
+	old.CreatedAt = nostr.Timestamp(now.Add(-2 * time.Hour).Unix())
+
+	recent := makeHexEvent()
+	recent.Kind = 1
+	recent.CreatedAt = nostr.Timestamp(now.Unix())
+
+	forever := makeHexEvent()
+	forever.CreatedAt = old.CreatedAt
+
+	for _, event := range []*nostr.Event{&old, &recent, &forever} {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []nostr.Event{recent, forever}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	err = store.View(func(txn *badger.Txn) error {
+		id, _ := hex.DecodeString(recent.ID)
+		item, err := txn.Get(eventKey(id))
+		if err != nil {
+			return err
+		}
+
+		if item.ExpiresAt() != uint64(recent.CreatedAt)+3600 {
+			t.Errorf("expected the event to expire at %d, got %d", recent.CreatedAt+3600, item.ExpiresAt())
+		}
+
+		// the counter of the event expires with it
+		pubkey, _ := hex.DecodeString(recent.PubKey)
+		item, err = txn.Get(counterKey(pubkey, recent.Kind, item.ExpiresAt()))
+		if err != nil {
+			return err
+		}
+
+		if item.ExpiresAt() != uint64(recent.CreatedAt)+3600 {
+			t.Errorf("expected the counter to expire at %d, got %d", recent.CreatedAt+3600, item.ExpiresAt())
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.AuthorStats(ctx, recent.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Count != 1 {
+		t.Fatalf("expected 1 event of the author, got %d", stats.Count)
+	}
+
+	if err := store.Delete(ctx, recent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats, err = store.AuthorStats(ctx, recent.PubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (AuthorStats{}) {
+		t.Fatalf("expected no events of the author after the deletion, got %v", stats)
+	}
+
+	if _, err := New(ctx, t.TempDir(), WithRetention(map[int]time.Duration{1: 0})); err == nil {
+		t.Fatalf("expected an error for a retention of zero")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithSearch())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{
+		"Hello Nostr, hello world!",
+		"nostr is a protocol",
+		"the world is big",
+	}
+
+	events := make([]nostr.Event, len(contents))
+	for i, content := range contents {
+		events[i] = makeHexEvent()
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		events[i].Content = content
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filters  []nostr.Filter
+		expected []nostr.Event
+	}{
+		{
+			name:     "single word",
+			filters:  []nostr.Filter{{Search: "NOSTR", Limit: 10}},
+			expected: []nostr.Event{events[1], events[0]},
+		},
+		{
+			name:     "all words",
+			filters:  []nostr.Filter{{Search: "world hello", Limit: 10}},
+			expected: []nostr.Event{events[0]},
+		},
+		{
+			name:     "extensions are ignored",
+			filters:  []nostr.Filter{{Search: "big language:en", Limit: 10}},
+			expected: []nostr.Event{events[2]},
+		},
+		{
+			name:     "with other conditions",
+			filters:  []nostr.Filter{{Search: "world", Authors: []string{events[2].PubKey}, Limit: 10}},
+			expected: []nostr.Event{events[2]},
+		},
+		{
+			name:     "no match",
+			filters:  []nostr.Filter{{Search: "bitcoin", Limit: 10}},
+			expected: nil,
+		},
+		{
+			name:     "without search",
+			filters:  []nostr.Filter{{Kinds: []int{1}, Limit: 1}},
+			expected: []nostr.Event{events[2]},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := store.Search(ctx, test.filters...)
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, res)
+			}
+		})
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		if err := store.Delete(ctx, events[1].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := store.Search(ctx, nostr.Filter{Search: "protocol", Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 0 {
+			t.Fatalf("expected no events, got %v", res)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		store, err := New(ctx, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var _ nastro.Searcher = store
+		if _, err := store.Search(ctx, nostr.Filter{Search: "nostr", Limit: 10}); !errors.Is(err, nastro.ErrUnsupportedSearch) {
+			t.Fatalf("expected error %v, got %v", nastro.ErrUnsupportedSearch, err)
+		}
+	})
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{text: "", expected: []string{}},
+		{text: "Hello, hello WORLD!", expected: []string{"hello", "world"}},
+		{text: "café #nostr 2024", expected: []string{"café", "nostr", "2024"}},
+		{text: strings.Repeat("a", maxTokenLength+1) + " ok", expected: []string{"ok"}},
+	}
+
+	for _, test := range tests {
+		if tokens := tokenize(test.text); !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("tokenize(%q): expected %v, got %v", test.text, test.expected, tokens)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := makeHexEvent() // addressable, with a d tag
+	if err := store.Save(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{"event": 1, "time": 1, "kind": 1, "pubkey": 1, "tag": 1, "address": 1, "token": 0}
+	for keyspace, count := range expected {
+		if stats.Keys[keyspace] != count {
+			t.Errorf("expected %d keys in keyspace %s, got %d", count, keyspace, stats.Keys[keyspace])
+		}
+	}
+}
+
+func TestSaveMany(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithBatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := makeHexEvent()
+	if err := store.Save(ctx, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	older, newer := makeReplaceableEventPair()
+	invalid := makeHexEvent()
+	invalid.ID = "not hex"
+
+	events := []*nostr.Event{&newer, &stored, &older, &invalid, &newer}
+	stats, err := store.SaveMany(ctx, slices.Values(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Imported != 2 || stats.Skipped != 3 {
+		t.Fatalf("expected 2 imported and 3 skipped, got %+v", stats)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Authors: []string{newer.PubKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected both versions to be stored, got %d", count)
+	}
+
+	// the address points to the newest version, so an intermediate one is not a replacement
+	middle := newer
+	middle.ID = randHex(32)
+	middle.CreatedAt = 50
+
+	replaced, err := store.Replace(ctx, &middle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced {
+		t.Fatalf("expected the replacement not to happen")
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	ctx := context.Background()
+	events := make([]*nostr.Event, 10_000)
+	for i := range events {
+		event := makeHexEvent()
+		event.Kind = 1
+		events[i] = &event
+	}
+
+	b.Run("Save", func(b *testing.B) {
+		for b.Loop() {
+			store, err := New(ctx, b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, event := range events {
+				if err := store.Save(ctx, event); err != nil {
+					b.Fatal(err)
+				}
+			}
+			store.Close()
+		}
+	})
+
+	b.Run("SaveMany", func(b *testing.B) {
+		for b.Loop() {
+			store, err := New(ctx, b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := store.SaveMany(ctx, slices.Values(events)); err != nil {
+				b.Fatal(err)
+			}
+			store.Close()
+		}
+	})
+}
+
+func TestHandleDeletion(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note := makeHexEvent()
+	note.Kind = 1
+
+	stranger := makeHexEvent()
+	stranger.Kind = 1
+
+	older, newer := makeReplaceableEventPair()
+	for _, event := range []*nostr.Event{&note, &stranger, &older, &newer} {
+		event.PubKey = older.PubKey
+		if event == &stranger {
+			event.PubKey = randHex(32)
+		}
+
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deletion := makeHexEvent()
+	deletion.Kind = nostr.KindDeletion
+	deletion.PubKey = older.PubKey
+	deletion.CreatedAt = 50
+	deletion.Tags = nostr.Tags{
+		{"e", note.ID},
+		{"e", stranger.ID},
+		{"a", fmt.Sprintf("%d:%s:%s", older.Kind, older.PubKey, "test-tag")},
+	}
+
+	if err := store.HandleDeletion(ctx, &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stranger's event is not deleted, and the address is only deleted up to the deletion's created_at
+	expected := []nostr.Event{stranger, newer}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	if err := store.Save(ctx, &note); !errors.Is(err, nastro.ErrDeleted) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrDeleted, err)
+	}
+
+	if err := store.Delete(ctx, stranger.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &stranger); err != nil {
+		t.Fatalf("expected the event of another author to be saved again, got %v", err)
+	}
+
+	if err := store.HandleDeletion(ctx, &note); err == nil {
+		t.Fatalf("expected an error handling a kind %d event", note.Kind)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	store, err := New(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]nostr.Event, 3)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		events[i].Content = "hello nostr"
+		events[i].Tags = nostr.Tags{{"t", "nostr"}, {"client", "nastro"}}
+
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = New(ctx, path, WithIndexedTags("client"), WithSearch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{"event": 3, "time": 3, "tag": 3, "token": 6}
+	for keyspace, count := range expected {
+		if stats.Keys[keyspace] != count {
+			t.Errorf("expected %d keys in keyspace %s, got %d", count, keyspace, stats.Keys[keyspace])
+		}
+	}
+
+	filters := []nostr.Filter{
+		{Tags: nostr.TagMap{"client": {"nastro"}}, Limit: 10},
+		{Tags: nostr.TagMap{"t": {"nostr"}}, Limit: 10},
+		{Search: "hello", Limit: 10},
+	}
+
+	want := []nostr.Event{events[2], events[1], events[0]}
+	for _, filter := range filters {
+		got, err := store.Search(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("filter %v: expected %v, got %v", filter, want, got)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	events := make([]nostr.Event, 4) // expired, soon, later, never
+	for i, expiration := range []time.Time{now.Add(-time.Hour), now.Add(time.Second), now.Add(time.Hour)} {
+		events[i] = makeHexEvent()
+		events[i].Kind = 1
+		events[i].Tags = nostr.Tags{{"expiration", strconv.FormatInt(expiration.Unix(), 10)}}
+	}
+
+	events[3] = makeHexEvent()
+	events[3].Kind = 1
+
+	for i := range events {
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+		if err := store.Save(ctx, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []nostr.Event{events[3], events[2], events[1]}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	// wait for the second event to expire
+	time.Sleep(time.Until(time.Unix(now.Unix()+2, 0)))
+
+	res, err = store.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []nostr.Event{events[3], events[2]}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+
+	purged, err := store.PurgeExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 purged event, got %d", purged)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys["event"] != 2 || stats.Keys["expiry"] != 1 {
+		t.Fatalf("expected 2 events and 1 expiry key, got %v", stats.Keys)
+	}
+
+	if _, err := New(ctx, t.TempDir(), WithExpirationSweep(0)); err == nil {
+		t.Fatalf("expected an error for a sweep interval of zero")
+	}
+}
+
+func TestAuthorStats(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubkey := randHex(32)
+	events := make([]nostr.Event, 4)
+	for i := range events {
+		events[i] = makeHexEvent()
+		events[i].PubKey = pubkey
+		events[i].Kind = 1
+		events[i].CreatedAt = nostr.Timestamp(100 + i)
+	}
+	events[3].Kind = 7
+
+	for _, event := range events[:2] {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.SaveMany(ctx, slices.Values([]*nostr.Event{&events[1], &events[2], &events[3]})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, events[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	size := func(events ...nostr.Event) int64 {
+		var size int64
+		for _, event := range events {
+			size += int64(encodedSize(&event))
+		}
+		return size
+	}
+
+	tests := []struct {
+		name     string
+		pubkey   string
+		kinds    []int
+		expected AuthorStats
+	}{
+		{name: "all kinds", pubkey: pubkey, expected: AuthorStats{Count: 3, Bytes: size(events[1:]...)}},
+		{name: "one kind", pubkey: pubkey, kinds: []int{1}, expected: AuthorStats{Count: 2, Bytes: size(events[1:3]...)}},
+		{name: "missing kind", pubkey: pubkey, kinds: []int{0}, expected: AuthorStats{}},
+		{name: "other pubkey", pubkey: randHex(32), expected: AuthorStats{}},
+	}
+
+	check := func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				stats, err := store.AuthorStats(ctx, test.pubkey, test.kinds...)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if stats != test.expected {
+					t.Fatalf("expected %v, got %v", test.expected, stats)
+				}
+			})
+		}
+	}
+
+	check(t)
+
+	if err := store.Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	check(t)
+
+	if _, err := store.AuthorStats(ctx, "invalid"); err == nil {
+		t.Fatalf("expected an error for an invalid pubkey")
+	}
+}
+
+func TestAuthorStatsExpiration(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithRetention(map[int]time.Duration{1: 2 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := makeHexEvent()
+	event.Kind = 1
+	event.CreatedAt = nostr.Now()
+
+	if err := store.Save(ctx, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.AuthorStats(ctx, event.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Count != 1 {
+		t.Fatalf("expected 1 event before the expiration, got %d", stats.Count)
+	}
+
+	time.Sleep(3 * time.Second)
+	if stats, err = store.AuthorStats(ctx, event.PubKey, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (AuthorStats{}) {
+		t.Fatalf("expected no events after the expiration, got %v", stats)
+	}
+}
+
+func TestQueryAt(t *testing.T) {
+	ctx := context.Background()
+	store, err := New(ctx, t.TempDir(), WithManagedMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older, newer := makeReplaceableEventPair()
+	if _, err := store.Replace(ctx, &older); err != nil {
+		t.Fatal(err)
+	}
+
+	before := store.Version()
+	if _, err := store.Replace(ctx, &newer); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent writes, meant to be run with -race
+	events := make([]*nostr.Event, 10)
+	var wg sync.WaitGroup
+	for i := range events {
+		event := makeHexEvent()
+		event.Kind = 1
+		events[i] = &event
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Save(ctx, &event); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := store.SaveMany(ctx, slices.Values(events)); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := nostr.Filter{Kinds: []int{older.Kind}, Limit: 10}
+	res, err := store.QueryAt(ctx, before, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, []nostr.Event{older}) {
+		t.Fatalf("expected %v at version %d, got %v", older, before, res)
+	}
+
+	res, err = store.QueryAt(ctx, store.Version(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, []nostr.Event{newer}) {
+		t.Fatalf("expected %v at the latest version, got %v", newer, res)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(len(events)) {
+		t.Fatalf("expected count %d, got %d", len(events), count)
+	}
+
+	if _, err := store.QueryAt(ctx, store.Version()+1, filter); err == nil {
+		t.Fatalf("expected an error for a future version")
+	}
+
+	unmanaged, err := New(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	b1 := orly1.Marshal(nil)
-	b2 := orly2.Marshal(nil)
-	if !reflect.DeepEqual(b1, b2) {
-		t.Fatalf("orly filter JSON mismatch after round-trip\n first:  %s\n second: %s", string(b1), string(b2))
+	if _, err := unmanaged.QueryAt(ctx, 0, filter); !errors.Is(err, ErrUnmanaged) {
+		t.Fatalf("expected error %v, got %v", ErrUnmanaged, err)
 	}
 }
@@ -0,0 +1,247 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of events written at once by [Store.SaveMany].
+	DefaultBatchSize = 1000
+
+	// DefaultFlushInterval is the default maximum time [Store.SaveMany] holds events before writing them.
+	DefaultFlushInterval = time.Second
+)
+
+// WithBatchSize sets the maximum number of events written at once by [Store.SaveMany].
+func WithBatchSize(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("batch size must be positive")
+		}
+		s.batchSize = n
+		return nil
+	}
+}
+
+// WithFlushInterval sets the maximum time [Store.SaveMany] holds events before writing them,
+// which matters when the events are produced slowly, e.g. when streamed from the network.
+func WithFlushInterval(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("flush interval must be positive")
+		}
+		s.flushInterval = d
+		return nil
+	}
+}
+
+// ImportStats reports the outcome of [Store.SaveMany].
+type ImportStats struct {
+	Imported int64         // the number of events newly stored
+	Skipped  int64         // the number of events rejected by the event policy, invalid, expired, duplicated or deleted
+	Took     time.Duration // the time it took
+}
+
+// Rate returns the number of events processed per second.
+func (s ImportStats) Rate() float64 {
+	if s.Took <= 0 {
+		return 0
+	}
+	return float64(s.Imported+s.Skipped) / s.Took.Seconds()
+}
+
+// SaveMany saves the events with badger write batches, which is much faster than calling [Store.Save]
+// for each one, and it's meant for seeding the store from a dump or another relay.
+// A batch is written when it's full or, as the next event arrives, when it's older than the flush interval.
+//
+// Events are validated with the event policy, and the ones that fail are skipped, as are invalid ones.
+// Like [Store.Save], replaceable and addressable events don't replace older ones, but are all stored.
+// Batches are not transactions, so concurrent writes to the same events might leave stale index keys.
+func (s *Store) SaveMany(ctx context.Context, events iter.Seq[*nostr.Event]) (ImportStats, error) {
+	start := time.Now()
+	stats := ImportStats{}
+
+	batch := make([]*nostr.Event, 0, s.batchSize)
+	flushed := time.Now()
+	var err error
+
+	for event := range events {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		if err := s.validateEvent(event); err != nil {
+			stats.Skipped++
+			continue
+		}
+
+		batch = append(batch, event)
+		if len(batch) < s.batchSize && time.Since(flushed) < s.flushInterval {
+			continue
+		}
+
+		if err = s.writeBatch(batch, &stats); err != nil {
+			break
+		}
+
+		batch = batch[:0]
+		flushed = time.Now()
+	}
+
+	if err == nil && len(batch) > 0 {
+		err = s.writeBatch(batch, &stats)
+	}
+
+	stats.Took = time.Since(start)
+	return stats, err
+}
+
+// pendingEvent is an event of a batch, already encoded.
+type pendingEvent struct {
+	event     *nostr.Event
+	value     []byte
+	expiresAt uint64
+}
+
+func (p pendingEvent) id() []byte     { return p.value[:idSize] }
+func (p pendingEvent) pubkey() []byte { return p.value[idSize : idSize+pubkeySize] }
+
+// writeBatch writes the events with a single write batch, updating the import stats on success.
+// The events already stored are read first, to skip them and to update the address keys.
+func (s *Store) writeBatch(events []*nostr.Event, stats *ImportStats) error {
+	var pending []pendingEvent
+	var skipped int64
+
+	// the latest event of each address, and whether it's part of the batch
+	latest := make(map[string]*nostr.Event)
+	updated := make(map[string]pendingEvent)
+
+	err := s.view(func(txn *badger.Txn) error {
+		seen := make(map[string]struct{}, len(events))
+		now := uint64(time.Now().Unix())
+
+		for _, event := range events {
+			expiresAt := s.expiresAt(event)
+			if (expiresAt != 0 && expiresAt <= now) || isExpired(event, time.Now()) {
+				skipped++
+				continue
+			}
+
+			value, err := encodeEvent(nil, event)
+			if err != nil {
+				skipped++
+				continue
+			}
+
+			p := pendingEvent{event: event, value: value, expiresAt: expiresAt}
+			if _, ok := seen[string(p.id())]; ok {
+				skipped++
+				continue
+			}
+			seen[string(p.id())] = struct{}{}
+
+			_, err = txn.Get(eventKey(p.id()))
+			if err == nil {
+				skipped++
+				continue
+			}
+			if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+
+			deleted, err := isDeleted(txn, p.id(), p.pubkey())
+			if err != nil {
+				return err
+			}
+			if deleted {
+				skipped++
+				continue
+			}
+
+			pending = append(pending, p)
+			if !nastro.IsValidReplacement(event.Kind) {
+				continue
+			}
+
+			address := string(kvcodec.AddressOf(event, p.pubkey()))
+			current, ok := latest[address]
+			if !ok {
+				current, err = s.latest(txn, []byte(address))
+				if err != nil {
+					return err
+				}
+			}
+
+			if current == nil || event.CreatedAt > current.CreatedAt {
+				latest[address] = event
+				updated[address] = p
+			} else {
+				latest[address] = current
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to read the batch: %w", err)
+	}
+
+	err = s.batch(func(wb *badger.WriteBatch) error {
+		for _, p := range pending {
+			if err := wb.SetEntry(newEntry(eventKey(p.id()), p.value, p.expiresAt)); err != nil {
+				return fmt.Errorf("failed to write event with ID %s: %w", p.event.ID, err)
+			}
+
+			for _, index := range s.indexKeys(p.event, p.id(), p.pubkey()) {
+				if err := wb.SetEntry(newEntry(index, nil, p.expiresAt)); err != nil {
+					return fmt.Errorf("failed to write event with ID %s: %w", p.event.ID, err)
+				}
+			}
+		}
+
+		for address, p := range updated {
+			if err := wb.SetEntry(newEntry([]byte(address), bytes.Clone(p.id()), p.expiresAt)); err != nil {
+				return fmt.Errorf("failed to write the address of event with ID %s: %w", p.event.ID, err)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to flush the batch: %w", err)
+	}
+
+	// counters are read-modify-write, so they are updated in a transaction to not race with concurrent saves
+	deltas := make(map[string]AuthorStats)
+	for _, p := range pending {
+		key := string(counterKey(p.pubkey(), p.event.Kind, p.expiresAt))
+		deltas[key] = deltas[key].add(AuthorStats{Count: 1, Bytes: int64(len(p.value))})
+	}
+
+	err = s.update(func(txn *badger.Txn) error {
+		for key, delta := range deltas {
+			if err := addCounter(txn, []byte(key), delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to update the counters of the batch: %w", err)
+	}
+
+	stats.Imported += int64(len(pending))
+	stats.Skipped += skipped
+	return nil
+}
@@ -0,0 +1,219 @@
+package badger
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+var errMalformed = errors.New("malformed event encoding")
+
+// hexSize is the size of the id, pubkey and signature at the start of the encoding, which are stored as bytes.
+const hexSize = idSize + pubkeySize + sigSize
+
+// maxPooledSize is the capacity above which a scratch buffer is not returned to the pool,
+// so that a few large events don't keep the pool memory high.
+const maxPooledSize = 64 << 10
+
+// scratchPool holds the buffers used by [decodeEvent] to build the strings of the event.
+var scratchPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
+}
+
+// encodeEvent appends the binary encoding of the event to buf:
+//
+//	id (32) | pubkey (32) | sig (64) | created_at (8) | kind (2) | content | tags
+//
+// where the content is a uvarint length followed by its bytes, and the tags are a uvarint count
+// followed by each tag, itself a uvarint count followed by its length-prefixed strings.
+func encodeEvent(buf []byte, e *nostr.Event) ([]byte, error) {
+	if e.Kind < 0 || e.Kind > maxKind {
+		return nil, fmt.Errorf("kind %d is out of range [0, %d]", e.Kind, maxKind)
+	}
+
+	buf = slices.Grow(buf, encodedSize(e))
+	start := len(buf)
+	buf = buf[:start+hexSize]
+	fixed := buf[start:]
+
+	if err := kvcodec.DecodeHex(fixed[:idSize], e.ID); err != nil {
+		return nil, fmt.Errorf("invalid id: %w", err)
+	}
+	if err := kvcodec.DecodeHex(fixed[idSize:idSize+pubkeySize], e.PubKey); err != nil {
+		return nil, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	if err := kvcodec.DecodeHex(fixed[idSize+pubkeySize:], e.Sig); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.CreatedAt))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(e.Kind))
+	buf = appendString(buf, e.Content)
+
+	buf = binary.AppendUvarint(buf, uint64(len(e.Tags)))
+	for _, tag := range e.Tags {
+		buf = binary.AppendUvarint(buf, uint64(len(tag)))
+		for _, s := range tag {
+			buf = appendString(buf, s)
+		}
+	}
+	return buf, nil
+}
+
+// encodedSize returns the size of the encoding of the event, so that it can be allocated at once.
+func encodedSize(e *nostr.Event) int {
+	size := hexSize + 8 + 2 + uvarintSize(len(e.Content)) + len(e.Content) + uvarintSize(len(e.Tags))
+	for _, tag := range e.Tags {
+		size += uvarintSize(len(tag))
+		for _, s := range tag {
+			size += uvarintSize(len(s)) + len(s)
+		}
+	}
+	return size
+}
+
+func uvarintSize(n int) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decodeEvent decodes the binary encoding produced by [encodeEvent] into the event.
+// The data is not retained, so it can be a value only valid within a badger transaction.
+//
+// To limit allocations, the hex of the id, pubkey and signature and the rest of the data are converted
+// to a single string, of which all the strings of the event are substrings, and all the tags share the same backing array.
+func decodeEvent(data []byte, e *nostr.Event) error {
+	if len(data) < hexSize {
+		return errMalformed
+	}
+
+	scratch := scratchPool.Get().(*[]byte)
+	buf := hex.AppendEncode((*scratch)[:0], data[:hexSize])
+	buf = append(buf, data[hexSize:]...)
+	text := string(buf)
+
+	if cap(buf) <= maxPooledSize {
+		*scratch = buf[:0]
+		scratchPool.Put(scratch)
+	}
+
+	d := decoder{data: data[hexSize:], text: text[2*hexSize:]}
+	e.ID = text[:2*idSize]
+	e.PubKey = text[2*idSize : 2*(idSize+pubkeySize)]
+	e.Sig = text[2*(idSize+pubkeySize) : 2*hexSize]
+	e.CreatedAt = nostr.Timestamp(binary.BigEndian.Uint64(d.bytes(8)))
+	e.Kind = int(binary.BigEndian.Uint16(d.bytes(2)))
+	e.Content = d.string()
+
+	count := d.uvarint()
+	if count > uint64(len(d.data)) {
+		// every tag takes at least one byte
+		return errMalformed
+	}
+
+	// each string takes at least one byte
+	values := make([]string, 0, min(len(d.data), 4*int(count)))
+	sizes := make([]int, count)
+	for i := range sizes {
+		size := d.uvarint()
+		if size > uint64(len(d.data)) {
+			return errMalformed
+		}
+
+		sizes[i] = int(size)
+		for range size {
+			values = append(values, d.string())
+		}
+	}
+
+	e.Tags = make(nostr.Tags, count)
+	offset := 0
+	for i, size := range sizes {
+		e.Tags[i] = values[offset : offset+size : offset+size]
+		offset += size
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", errMalformed, len(d.data))
+	}
+	return nil
+}
+
+// decoder consumes the data, recording the first error encountered.
+// The text holds the same bytes as the data, and is the one strings are sliced from.
+// After an error, all methods return zero values.
+type decoder struct {
+	data []byte
+	text string
+	err  error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.fail()
+		return make([]byte, n)
+	}
+
+	b := d.data[:n]
+	d.skip(n)
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.skip(n)
+	return v
+}
+
+func (d *decoder) string() string {
+	size := d.uvarint()
+	if d.err != nil || size > uint64(len(d.data)) {
+		d.fail()
+		return ""
+	}
+
+	s := d.text[:size]
+	d.skip(int(size))
+	return s
+}
+
+func (d *decoder) skip(n int) {
+	d.data = d.data[n:]
+	d.text = d.text[n:]
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	d.data = nil
+	d.text = ""
+}
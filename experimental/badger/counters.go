@@ -0,0 +1,136 @@
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// AuthorStats summarizes the events stored by a pubkey.
+// Bytes is the size of the events in the store's encoding.
+type AuthorStats struct {
+	Count int64
+	Bytes int64
+}
+
+func (a AuthorStats) add(b AuthorStats) AuthorStats {
+	return AuthorStats{Count: a.Count + b.Count, Bytes: a.Bytes + b.Bytes}
+}
+
+// AuthorStats returns the number and size of the events of the pubkey, optionally restricted to the provided kinds.
+// Stats are maintained by counter keys in the write path, so this is a lookup that doesn't scan the events,
+// making it suitable for quota enforcement.
+//
+// Events removed by the badger TTLs of [WithRetention] are no longer counted, as their counter keys expire with them.
+// Stores whose counters were written before they were split by expiration must be migrated with [Store.Reindex].
+func (s *Store) AuthorStats(ctx context.Context, pubkey string, kinds ...int) (AuthorStats, error) {
+	pk := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(pk, pubkey); err != nil {
+		return AuthorStats{}, fmt.Errorf("failed to fetch stats of pubkey %s: %w", pubkey, err)
+	}
+
+	prefixes := [][]byte{append([]byte{prefixCounter}, pk...)}
+	if len(kinds) > 0 {
+		prefixes = prefixes[:0]
+		for _, kind := range kinds {
+			if kind >= 0 && kind <= maxKind {
+				prefixes = append(prefixes, counterPrefix(pk, kind))
+			}
+		}
+	}
+
+	var stats AuthorStats
+	err := s.view(func(txn *badger.Txn) error {
+		for _, prefix := range prefixes {
+			counter, err := sumCounters(ctx, txn, prefix)
+			if err != nil {
+				return err
+			}
+			stats = stats.add(counter)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return AuthorStats{}, fmt.Errorf("failed to fetch stats of pubkey %s: %w", pubkey, err)
+	}
+	return stats, nil
+}
+
+// sumCounters returns the sum of the counter keys with the prefix. Expired counters are skipped by badger.
+func sumCounters(ctx context.Context, txn *badger.Txn, prefix []byte) (AuthorStats, error) {
+	options := badger.DefaultIteratorOptions
+	options.Prefix = prefix
+
+	it := txn.NewIterator(options)
+	defer it.Close()
+
+	var stats AuthorStats
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return AuthorStats{}, err
+		}
+
+		counter, err := parseCounter(it.Item())
+		if err != nil {
+			return AuthorStats{}, err
+		}
+		stats = stats.add(counter)
+	}
+	return stats, nil
+}
+
+// addCounter adds the delta to the counter key within the transaction, deleting the key once it reaches zero.
+// The key is written with the expiration it encodes, so that it expires with the events it counts.
+func addCounter(txn *badger.Txn, key []byte, delta AuthorStats) error {
+	counter, err := getCounter(txn, key)
+	if err != nil {
+		return err
+	}
+
+	counter = counter.add(delta)
+	if counter.Count <= 0 {
+		return txn.Delete(key)
+	}
+	return set(txn, key, encodeCounter(counter), counterExpiresAt(key))
+}
+
+// counterExpiresAt returns the expiration encoded at the end of the counter key.
+func counterExpiresAt(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// getCounter returns the value of the counter key, which is zero if the key is missing.
+func getCounter(txn *badger.Txn, key []byte) (AuthorStats, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return AuthorStats{}, nil
+	}
+	if err != nil {
+		return AuthorStats{}, err
+	}
+	return parseCounter(item)
+}
+
+func parseCounter(item *badger.Item) (AuthorStats, error) {
+	var counter AuthorStats
+	err := item.Value(func(value []byte) error {
+		if len(value) != 16 {
+			return fmt.Errorf("counter with key %x has %d bytes instead of 16", item.Key(), len(value))
+		}
+
+		counter.Count = int64(binary.BigEndian.Uint64(value[:8]))
+		counter.Bytes = int64(binary.BigEndian.Uint64(value[8:]))
+		return nil
+	})
+	return counter, err
+}
+
+func encodeCounter(counter AuthorStats) []byte {
+	value := binary.BigEndian.AppendUint64(make([]byte, 0, 16), uint64(counter.Count))
+	return binary.BigEndian.AppendUint64(value, uint64(counter.Bytes))
+}
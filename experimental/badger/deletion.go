@@ -0,0 +1,145 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// WithTombstoneRetention writes the tombstones of [Store.HandleDeletion] with a badger TTL,
+// so that they are removed after the provided retention. After a tombstone is removed,
+// the event it refers to can be saved again. By default, tombstones are kept forever.
+func WithTombstoneRetention(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("tombstone retention must be positive")
+		}
+		s.tombstoneRetention = d
+		return nil
+	}
+}
+
+// HandleDeletion applies the NIP-09 deletion request, deleting the events it references that
+// have been published by the same author. It doesn't save the deletion request itself.
+//
+// Every event referenced with an "e" tag gets a tombstone, so that [Store.Save] refuses to store it again
+// with [nastro.ErrDeleted], even if it arrives after the deletion.
+// Addressable or replaceable events referenced with an "a" tag are deleted up to the deletion's created_at.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/09.md
+func (s *Store) HandleDeletion(ctx context.Context, deletion *nostr.Event) error {
+	if deletion.Kind != nostr.KindDeletion {
+		return fmt.Errorf("event ID %s is not a deletion request: kind %d", deletion.ID, deletion.Kind)
+	}
+
+	author := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(author, deletion.PubKey); err != nil {
+		return fmt.Errorf("failed to handle deletion request %s: invalid pubkey: %w", deletion.ID, err)
+	}
+
+	var expiresAt uint64
+	if s.tombstoneRetention > 0 {
+		expiresAt = uint64(time.Now().Add(s.tombstoneRetention).Unix())
+	}
+
+	err := s.update(func(txn *badger.Txn) error {
+		for _, tag := range deletion.Tags {
+			if len(tag) < 2 {
+				continue
+			}
+
+			switch tag[0] {
+			case "e":
+				id := make([]byte, idSize)
+				if err := kvcodec.DecodeHex(id, tag[1]); err != nil {
+					// no event can be stored under an invalid id
+					continue
+				}
+
+				if err := set(txn, tombstoneKey(id), author, expiresAt); err != nil {
+					return fmt.Errorf("failed to save the tombstone of event ID %s: %w", tag[1], err)
+				}
+
+				event, err := s.get(txn, id)
+				if err != nil {
+					return err
+				}
+
+				if event != nil && event.PubKey == deletion.PubKey {
+					if err := s.remove(txn, event); err != nil {
+						return fmt.Errorf("failed to delete event ID %s: %w", tag[1], err)
+					}
+				}
+
+			case "a":
+				kind, pubkey, d, ok := parseAddress(tag[1])
+				if !ok || pubkey != deletion.PubKey || !nastro.IsValidReplacement(kind) {
+					continue
+				}
+
+				filter := nostr.Filter{Kinds: []int{kind}, Until: &deletion.CreatedAt}
+				events, err := s.scan(ctx, txn, kvcodec.PubkeyPrefix(author), filter)
+				if err != nil {
+					return err
+				}
+
+				for _, event := range events {
+					if nostr.IsAddressableKind(kind) && event.Tags.GetD() != d {
+						continue
+					}
+
+					if err := s.remove(txn, &event); err != nil {
+						return fmt.Errorf("failed to delete the events of address %s: %w", tag[1], err)
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to handle deletion request %s: %w", deletion.ID, err)
+	}
+	return nil
+}
+
+// isDeleted returns whether the event with the provided id has a tombstone from its author.
+func isDeleted(txn *badger.Txn, id, pubkey []byte) (bool, error) {
+	item, err := txn.Get(tombstoneKey(id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var deleted bool
+	err = item.Value(func(author []byte) error {
+		deleted = bytes.Equal(author, pubkey)
+		return nil
+	})
+	return deleted, err
+}
+
+// parseAddress parses an address of the form <kind>:<pubkey>:<d-tag>.
+func parseAddress(address string) (kind int, pubkey, d string, ok bool) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", "", false
+	}
+	return kind, parts[1], parts[2], true
+}
@@ -0,0 +1,144 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// WithExpirationSweep starts a background job that calls [Store.PurgeExpired] every interval.
+// The job is stopped by [Store.Close].
+//
+// Expired events are never returned by queries, so the sweep only reclaims their space.
+func WithExpirationSweep(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("expiration sweep interval must be positive")
+		}
+		s.sweepInterval = d
+		return nil
+	}
+}
+
+// PurgeExpired deletes all the events whose NIP-40 expiration is in the past, returning how many were deleted.
+// The events are deleted in transactions of at most the batch size of [Store.SaveMany], so cancelling the context
+// interrupts the purge without undoing the deletions already committed.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/40.md
+func (s *Store) PurgeExpired(ctx context.Context) (int, error) {
+	var purged int
+	for {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+
+		keys, err := s.expiredKeys(time.Now(), s.batchSize)
+		if err != nil {
+			return purged, fmt.Errorf("failed to find the expired events: %w", err)
+		}
+
+		if len(keys) == 0 {
+			return purged, nil
+		}
+
+		var deleted int
+		err = s.update(func(txn *badger.Txn) error {
+			deleted = 0
+			for _, key := range keys {
+				_, id := kvcodec.ParseSuffix(key)
+				event, err := s.get(txn, id)
+				if err != nil {
+					return err
+				}
+
+				if event == nil {
+					// the event is already gone, only the expiry key is left
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if err := s.remove(txn, event); err != nil {
+					return fmt.Errorf("failed to delete event ID %s: %w", event.ID, err)
+				}
+				deleted++
+			}
+			return nil
+		})
+
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge the expired events: %w", err)
+		}
+		purged += deleted
+	}
+}
+
+// expiredKeys returns up to limit expiry keys of the events that are expired at the provided time, oldest first.
+func (s *Store) expiredKeys(now time.Time, limit int) ([][]byte, error) {
+	var keys [][]byte
+	err := s.view(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Prefix = []byte{prefixExpiry}
+
+		it := txn.NewIterator(options)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid() && len(keys) < limit; it.Next() {
+			key := it.Item().KeyCopy(nil)
+			expiration, _ := kvcodec.ParseSuffix(key)
+			if expiration > kvcodec.Timestamp(nostr.Timestamp(now.Unix())) {
+				break
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// sweepEvery calls [Store.PurgeExpired] every interval, until the store is closed.
+// Errors are ignored, as the purge will be attempted again at the next tick.
+func (s *Store) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-ticker.C:
+			s.PurgeExpired(context.Background())
+		}
+	}
+}
+
+// expirationOf returns the NIP-40 expiration of the event, if it has a valid one.
+func expirationOf(event *nostr.Event) (nostr.Timestamp, bool) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "expiration" {
+			continue
+		}
+
+		expiration, err := strconv.ParseInt(tag[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return nostr.Timestamp(expiration), true
+	}
+	return 0, false
+}
+
+// isExpired returns whether the event has a NIP-40 expiration that is not after the provided time.
+func isExpired(event *nostr.Event, now time.Time) bool {
+	expiration, ok := expirationOf(event)
+	return ok && int64(expiration) <= now.Unix()
+}
@@ -0,0 +1,64 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultGCDiscardRatio is the discard ratio used by the GC job started with [WithGCInterval].
+const DefaultGCDiscardRatio = 0.5
+
+// RunGC garbage collects the value log, rewriting the files in which at least discardRatio of the space
+// is taken by deleted or replaced events, until there are none left or the context is cancelled.
+// Lower ratios reclaim more space, at the cost of more rewriting.
+//
+// If a garbage collection is already running, or the store is in memory, RunGC returns immediately without errors.
+func (s *Store) RunGC(ctx context.Context, discardRatio float64) error {
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return fmt.Errorf("discard ratio must be in the range (0, 1), got %v", discardRatio)
+	}
+
+	if s.options.InMemory {
+		// there is no value log
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := s.DB.RunValueLogGC(discardRatio)
+		switch {
+		case err == nil:
+			// a file was rewritten, there might be more
+
+		case errors.Is(err, badger.ErrNoRewrite), errors.Is(err, badger.ErrRejected):
+			return nil
+
+		default:
+			return fmt.Errorf("failed to garbage collect the value log: %w", err)
+		}
+	}
+}
+
+// gcEvery calls [Store.RunGC] every interval, until the store is closed.
+// Errors are ignored, as the garbage collection will be attempted again at the next tick.
+func (s *Store) gcEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-ticker.C:
+			s.RunGC(context.Background(), DefaultGCDiscardRatio)
+		}
+	}
+}
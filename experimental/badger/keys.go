@@ -0,0 +1,107 @@
+package badger
+
+import (
+	"encoding/binary"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// The store keeps each event under its id, together with a set of empty index keys pointing to it.
+// The time, kind, pubkey, tag and address keys are shared with the other key-value stores, see the kvcodec package.
+//
+//	event     'e' | id (32)                                                -> encoded event
+//	time      't' | created_at (8) | id (32)
+//	kind      'k' | kind (2) | created_at (8) | id (32)
+//	pubkey    'p' | pubkey (32) | created_at (8) | id (32)
+//	tag       'g' | len(key) (1) | key | len(value) (2) | value | created_at (8) | id (32)
+//	address   'a' | kind (2) | pubkey (32) | d-tag                         -> id (32)
+//	token     'w' | len(token) (1) | token | created_at (8) | id (32)
+//	tombstone 'x' | id (32)                                                -> pubkey (32) of the deletion's author
+//	expiry    'y' | expiration (8) | id (32)
+//	counter   'c' | pubkey (32) | kind (2) | expires_at (8)                -> count (8) | bytes (8)
+//
+// The address key points to the latest replaceable or addressable event of its category.
+// Token keys index the words of the content, and are only written by stores with [WithSearch].
+// Expiry keys index the NIP-40 expiration of the events that have one, sorted by expiration.
+// Counter keys hold the number and encoded size of the events of each pubkey and kind, see [Store.AuthorStats].
+// Events expiring at the same time by [WithRetention] are counted in their own key, which expires with them.
+const (
+	prefixEvent   byte = 'e'
+	prefixTime         = kvcodec.PrefixTime
+	prefixKind         = kvcodec.PrefixKind
+	prefixPubkey       = kvcodec.PrefixPubkey
+	prefixTag          = kvcodec.PrefixTag
+	prefixAddress      = kvcodec.PrefixAddress
+	prefixToken   byte = 'w'
+	prefixDeleted byte = 'x'
+	prefixExpiry  byte = 'y'
+	prefixCounter byte = 'c'
+)
+
+const (
+	idSize     = kvcodec.IDSize
+	pubkeySize = kvcodec.PubkeySize
+	sigSize    = 64
+	suffixSize = kvcodec.SuffixSize
+
+	maxKind         = kvcodec.MaxKind
+	maxIndexedKey   = kvcodec.MaxIndexedKey
+	maxIndexedValue = kvcodec.MaxIndexedValue
+	maxCreatedAt    = kvcodec.MaxCreatedAt
+)
+
+func eventKey(id []byte) []byte {
+	return append([]byte{prefixEvent}, id...)
+}
+
+func tokenPrefix(token string) []byte {
+	prefix := make([]byte, 0, 2+len(token))
+	prefix = append(prefix, prefixToken, byte(len(token)))
+	return append(prefix, token...)
+}
+
+func tombstoneKey(id []byte) []byte {
+	return append([]byte{prefixDeleted}, id...)
+}
+
+func counterPrefix(pubkey []byte, kind int) []byte {
+	key := append([]byte{prefixCounter}, pubkey...)
+	return binary.BigEndian.AppendUint16(key, uint16(kind))
+}
+
+// counterKey returns the key counting the events of the pubkey and kind that expire at the provided time,
+// which is zero for the events kept forever.
+func counterKey(pubkey []byte, kind int, expiresAt uint64) []byte {
+	return binary.BigEndian.AppendUint64(counterPrefix(pubkey, kind), expiresAt)
+}
+
+// isIndexed returns whether the tag value with the provided key is indexed.
+// By default, following NIP-01, only single-letter tags are indexed, see [WithIndexedTags].
+func (s *Store) isIndexed(key, value string) bool {
+	if len(value) > maxIndexedValue {
+		return false
+	}
+
+	if s.indexedTags == nil {
+		return len(key) == 1
+	}
+
+	_, ok := s.indexedTags[key]
+	return ok
+}
+
+// indexKeys returns all the index keys of the event, whose id and pubkey are already decoded.
+func (s *Store) indexKeys(e *nostr.Event, id, pubkey []byte) [][]byte {
+	keys := kvcodec.IndexKeys(e, id, pubkey, s.isIndexed)
+	if expiration, ok := expirationOf(e); ok {
+		keys = append(keys, kvcodec.IndexKey([]byte{prefixExpiry}, expiration, id))
+	}
+
+	if s.search {
+		for _, token := range tokenize(e.Content) {
+			keys = append(keys, kvcodec.IndexKey(tokenPrefix(token), e.CreatedAt, id))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,141 @@
+package badger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrUnmanaged is returned by [Store.QueryAt] when the store was created without [WithManagedMode].
+var ErrUnmanaged = errors.New("point-in-time queries require WithManagedMode")
+
+// WithManagedMode opens badger in managed mode, where the store assigns a version to every write,
+// and keeps the previous versions of the keys so that [Store.QueryAt] can read the store as it was.
+//
+// Old versions are only discarded after calling [badger.DB.SetDiscardTs] on the embedded DB,
+// so without it the store keeps growing with every replacement and deletion.
+// A store created in managed mode must always be opened in managed mode.
+func WithManagedMode() Option {
+	return func(s *Store) error {
+		s.managed = true
+		return nil
+	}
+}
+
+// Version returns the version of the latest write, which can be passed to [Store.QueryAt] to read
+// the store as it is now. It's always zero for stores created without [WithManagedMode].
+func (s *Store) Version() uint64 {
+	return s.clock.Load()
+}
+
+// QueryAt works like [Store.Query], but reads the store as it was at the provided version,
+// as returned by [Store.Version]. The store must have been created with [WithManagedMode],
+// otherwise [ErrUnmanaged] is returned.
+func (s *Store) QueryAt(ctx context.Context, version uint64, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if !s.managed {
+		return nil, ErrUnmanaged
+	}
+
+	if version > s.Version() {
+		return nil, fmt.Errorf("version %d is newer than the latest version %d", version, s.Version())
+	}
+
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	view := func(fn func(txn *badger.Txn) error) error { return s.viewAt(version, fn) }
+	return s.queryAll(ctx, view, filters)
+}
+
+// open the database according to the mode of the store.
+func (s *Store) open() (err error) {
+	if !s.managed {
+		s.DB, err = badger.Open(s.options)
+		return err
+	}
+
+	s.DB, err = badger.OpenManaged(s.options)
+	if err != nil {
+		return err
+	}
+
+	s.clock.Store(s.DB.MaxVersion())
+	return nil
+}
+
+// view runs the read-only transaction on the latest version of the store.
+func (s *Store) view(fn func(txn *badger.Txn) error) error {
+	if !s.managed {
+		return s.DB.View(fn)
+	}
+	return s.viewAt(s.Version(), fn)
+}
+
+// viewAt runs the read-only transaction on the provided version of a managed store.
+func (s *Store) viewAt(version uint64, fn func(txn *badger.Txn) error) error {
+	txn := s.DB.NewTransactionAt(version, false)
+	defer txn.Discard()
+	return fn(txn)
+}
+
+// commit runs the read-write transaction once. In managed mode, commits are serialized
+// so that the versions become visible in order, and a reader never skips a write.
+func (s *Store) commit(fn func(txn *badger.Txn) error) error {
+	if !s.managed {
+		return s.DB.Update(fn)
+	}
+
+	txn := s.DB.NewTransactionAt(s.Version(), true)
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	version := s.Version() + 1
+	if err := txn.CommitAt(version, nil); err != nil {
+		return err
+	}
+
+	s.clock.Store(version)
+	return nil
+}
+
+// batch fills a write batch with fn, and flushes it. In managed mode, all of its writes share the same version.
+func (s *Store) batch(fn func(wb *badger.WriteBatch) error) error {
+	if !s.managed {
+		wb := s.DB.NewWriteBatch()
+		defer wb.Cancel()
+
+		if err := fn(wb); err != nil {
+			return err
+		}
+		return wb.Flush()
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	version := s.Version() + 1
+	wb := s.DB.NewWriteBatchAt(version)
+	defer wb.Cancel()
+
+	if err := fn(wb); err != nil {
+		return err
+	}
+
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	s.clock.Store(version)
+	return nil
+}
@@ -0,0 +1,71 @@
+// The prometheus package exports the [badger.Stats] of the badger store as Prometheus metrics.
+//
+//	store, err := badger.New(ctx, path)
+//	registry.MustRegister(prometheus.New("relay", store))
+package prometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/pippellia-btc/nastro/experimental/badger"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTimeout is the maximum time spent computing the stats of the store on each scrape.
+const DefaultTimeout = 10 * time.Second
+
+// Collector is a [prom.Collector] that computes the [badger.Stats] of the store on each scrape.
+// Since counting the keys iterates over all of them, the scrape interval should be generous on large stores.
+type Collector struct {
+	store *badger.Store
+
+	lsm        *prom.Desc
+	valueLog   *prom.Desc
+	keys       *prom.Desc
+	blockCache *prom.Desc
+	indexCache *prom.Desc
+}
+
+// New returns a [Collector] of the store whose metrics are prefixed by the namespace, e.g. "relay_badger_keys".
+func New(namespace string, store *badger.Store) *Collector {
+	name := func(n string) string { return prom.BuildFQName(namespace, "badger", n) }
+	return &Collector{
+		store:      store,
+		lsm:        prom.NewDesc(name("lsm_size_bytes"), "The size of the LSM tree.", nil, nil),
+		valueLog:   prom.NewDesc(name("value_log_size_bytes"), "The size of the value log.", nil, nil),
+		keys:       prom.NewDesc(name("keys"), "The number of keys in each keyspace.", []string{"keyspace"}, nil),
+		blockCache: prom.NewDesc(name("block_cache_hit_ratio"), "The hit ratio of the block cache.", nil, nil),
+		indexCache: prom.NewDesc(name("index_cache_hit_ratio"), "The hit ratio of the index cache.", nil, nil),
+	}
+}
+
+// Describe implements [prom.Collector].
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.lsm
+	ch <- c.valueLog
+	ch <- c.keys
+	ch <- c.blockCache
+	ch <- c.indexCache
+}
+
+// Collect implements [prom.Collector].
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	stats, err := c.store.Stats(ctx)
+	if err != nil {
+		ch <- prom.NewInvalidMetric(c.keys, err)
+		return
+	}
+
+	ch <- prom.MustNewConstMetric(c.lsm, prom.GaugeValue, float64(stats.LSMSize))
+	ch <- prom.MustNewConstMetric(c.valueLog, prom.GaugeValue, float64(stats.ValueLogSize))
+	ch <- prom.MustNewConstMetric(c.blockCache, prom.GaugeValue, stats.BlockCacheHitRatio)
+	ch <- prom.MustNewConstMetric(c.indexCache, prom.GaugeValue, stats.IndexCacheHitRatio)
+
+	for keyspace, count := range stats.Keys {
+		ch <- prom.MustNewConstMetric(c.keys, prom.GaugeValue, float64(count), keyspace)
+	}
+}
@@ -0,0 +1,98 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WithIndexedTags sets the tag keys whose values are indexed, replacing the default of all single-letter keys.
+// Indexing fewer keys reduces the writes of each event, at the cost of scanning more events
+// for filters on the keys left out, which are still matched correctly.
+//
+// Changing the keys of an existing store requires a [Store.Reindex].
+func WithIndexedTags(keys ...string) Option {
+	return func(s *Store) error {
+		s.indexedTags = make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			if len(key) == 0 || len(key) > maxIndexedKey {
+				return fmt.Errorf("indexed tag key must be between 1 and %d bytes, got %q", maxIndexedKey, key)
+			}
+			s.indexedTags[key] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// Reindex rebuilds the tag and search indexes of all stored events, according to the current [WithIndexedTags]
+// and [WithSearch] options, and recomputes the counters of [Store.AuthorStats].
+// The indexes are dropped first, so queries are slower while the rebuild is in progress,
+// and the store should not be serving writes, as the index keys of events saved meanwhile might be lost.
+func (s *Store) Reindex(ctx context.Context) error {
+	if err := s.DB.DropPrefix([]byte{prefixTag}, []byte{prefixToken}, []byte{prefixCounter}); err != nil {
+		return fmt.Errorf("failed to drop the indexes: %w", err)
+	}
+
+	err := s.batch(func(wb *badger.WriteBatch) error {
+		counters := make(map[string]AuthorStats)
+		err := s.view(func(txn *badger.Txn) error {
+			options := badger.DefaultIteratorOptions
+			options.Prefix = []byte{prefixEvent}
+
+			it := txn.NewIterator(options)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				item := it.Item()
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				var event nostr.Event
+				if err := decodeEvent(value, &event); err != nil {
+					return fmt.Errorf("failed to decode event with key %x: %w", item.Key(), err)
+				}
+
+				id := value[:idSize]
+				pubkey := value[idSize : idSize+pubkeySize]
+
+				counter := string(counterKey(pubkey, event.Kind, item.ExpiresAt()))
+				counters[counter] = counters[counter].add(AuthorStats{Count: 1, Bytes: int64(len(value))})
+
+				for _, key := range s.indexKeys(&event, id, pubkey) {
+					if key[0] != prefixTag && key[0] != prefixToken {
+						continue
+					}
+
+					if err := wb.SetEntry(newEntry(key, nil, item.ExpiresAt())); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for key, counter := range counters {
+			if err := wb.SetEntry(newEntry([]byte(key), encodeCounter(counter), counterExpiresAt([]byte(key)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to rebuild the indexes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// WithRetention sets how long the events of each kind are kept after their created_at.
+// The event and all its keys are written with a badger TTL, so they stop surfacing in queries
+// once expired, and their space is reclaimed by compactions without a separate sweeper.
+// Events of kinds not in the map are kept forever, and events already past their retention are not saved.
+//
+// The retention applies to events saved after the option is set, not to the ones already stored.
+func WithRetention(retention map[int]time.Duration) Option {
+	return func(s *Store) error {
+		for kind, d := range retention {
+			if d <= 0 {
+				return fmt.Errorf("retention of kind %d must be positive, got %v", kind, d)
+			}
+		}
+
+		if len(retention) == 0 {
+			return errors.New("retention must specify at least one kind")
+		}
+
+		s.retention = maps.Clone(retention)
+		return nil
+	}
+}
+
+// expiresAt returns the unix time at which the event expires according to the retention of its kind,
+// or zero if the event never expires.
+func (s *Store) expiresAt(event *nostr.Event) uint64 {
+	d, ok := s.retention[event.Kind]
+	if !ok {
+		return 0
+	}
+	return kvcodec.Timestamp(event.CreatedAt) + uint64(d.Seconds())
+}
+
+// set the key within the transaction, with the expiration time if non-zero.
+func set(txn *badger.Txn, key, value []byte, expiresAt uint64) error {
+	return txn.SetEntry(newEntry(key, value, expiresAt))
+}
+
+// newEntry returns the entry of the key, with the expiration time if non-zero.
+func newEntry(key, value []byte, expiresAt uint64) *badger.Entry {
+	entry := badger.NewEntry(key, value)
+	entry.ExpiresAt = expiresAt
+	return entry
+}
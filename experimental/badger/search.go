@@ -0,0 +1,102 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// maxTokenLength is the maximum length in bytes of an indexed word. Longer words are not indexed.
+const maxTokenLength = 64
+
+// WithSearch indexes the words of the content of the events, enabling NIP-50 search with [Store.Search].
+// Only events saved after the option is set are indexed.
+func WithSearch() Option {
+	return func(s *Store) error {
+		s.search = true
+		return nil
+	}
+}
+
+// Search stored events matching the provided filters, like [Store.Query], with the addition that filters
+// with a Search field only match events whose content contains all of its words, ignoring case.
+// NIP-50 extensions (key:value words) are ignored.
+//
+// Unlike what NIP-50 suggests, results are not sorted by relevance, but in the same order as [Store.Query].
+// The store must have been created with [WithSearch], otherwise [nastro.ErrUnsupportedSearch] is returned.
+func (s *Store) Search(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if !s.search {
+		return nil, fmt.Errorf("%w: the store was created without WithSearch", nastro.ErrUnsupportedSearch)
+	}
+
+	sanitized := make(nostr.Filters, 0, len(filters))
+	for _, filter := range filters {
+		// the filter policy is applied without the search, as it might reject it
+		search := filter.Search
+		filter.Search = ""
+
+		result, err := s.sanitizeFilters(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range result {
+			f.Search = search
+			sanitized = append(sanitized, f)
+		}
+	}
+	return s.queryAll(ctx, s.view, sanitized)
+}
+
+// matches returns whether the event matches the filter, including its search.
+// Events past their NIP-40 expiration never match, even if they haven't been purged yet.
+func matches(filter nostr.Filter, event *nostr.Event) bool {
+	if !filter.Matches(event) || isExpired(event, time.Now()) {
+		return false
+	}
+
+	tokens := searchTokens(filter.Search)
+	if len(tokens) == 0 {
+		return true
+	}
+
+	content := tokenize(event.Content)
+	for _, token := range tokens {
+		if !slices.Contains(content, token) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits the text into its unique lowercase words, made of letters and digits.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) <= maxTokenLength && !slices.Contains(tokens, word) {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// searchTokens returns the tokens of the search, skipping the NIP-50 extensions.
+func searchTokens(search string) []string {
+	if search == "" {
+		return nil
+	}
+
+	words := strings.Fields(search)
+	words = slices.DeleteFunc(words, func(word string) bool { return strings.Contains(word, ":") })
+	return tokenize(strings.Join(words, " "))
+}
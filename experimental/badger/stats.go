@@ -0,0 +1,75 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// keyspaces maps the prefix of each keyspace to its name in [Stats.Keys].
+var keyspaces = map[byte]string{
+	prefixEvent:   "event",
+	prefixTime:    "time",
+	prefixKind:    "kind",
+	prefixPubkey:  "pubkey",
+	prefixTag:     "tag",
+	prefixAddress: "address",
+	prefixToken:   "token",
+	prefixDeleted: "tombstone",
+	prefixExpiry:  "expiry",
+	prefixCounter: "counter",
+}
+
+// Stats reports the size of the store, for capacity planning.
+type Stats struct {
+	LSMSize      int64 // the size in bytes of the LSM tree, holding the keys and the small values
+	ValueLogSize int64 // the size in bytes of the value log, holding the large values
+
+	// Keys is the number of keys in each keyspace, e.g. "event" is the number of events,
+	// and "tag" the number of indexed tag values across all events.
+	Keys map[string]int64
+
+	BlockCacheHitRatio float64 // the hit ratio of the cache of data blocks, zero if disabled
+	IndexCacheHitRatio float64 // the hit ratio of the cache of table indexes, zero if disabled
+}
+
+// Stats returns the size of the store and its keyspaces. The sizes are the ones last computed by badger,
+// which refreshes them periodically, while the keys are counted by iterating over all of them,
+// which takes a while on large stores.
+func (s *Store) Stats(ctx context.Context) (Stats, error) {
+	stats := Stats{
+		Keys:               make(map[string]int64, len(keyspaces)),
+		BlockCacheHitRatio: s.DB.BlockCacheMetrics().Ratio(),
+		IndexCacheHitRatio: s.DB.IndexCacheMetrics().Ratio(),
+	}
+	stats.LSMSize, stats.ValueLogSize = s.DB.Size()
+
+	for _, name := range keyspaces {
+		stats.Keys[name] = 0
+	}
+
+	err := s.view(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+
+		it := txn.NewIterator(options)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if name, ok := keyspaces[it.Item().Key()[0]]; ok {
+				stats.Keys[name]++
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to count the keys: %w", err)
+	}
+	return stats, nil
+}
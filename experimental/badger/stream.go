@@ -0,0 +1,148 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// QueryStream returns an iterator over the events matching the filter, from the newest to the oldest.
+// Events are read from the database as the iteration advances, which stops as soon as the filter's limit is reached,
+// the context is cancelled, or the caller stops the iteration. Errors are yielded as the last element.
+//
+// Unlike [Store.Query], events created at the same time are not sorted by id.
+// The read transaction stays open until the iteration stops, so long iterations hold on to old versions of the data.
+func (s *Store) QueryStream(ctx context.Context, filter nostr.Filter) iter.Seq2[nostr.Event, error] {
+	return func(yield func(nostr.Event, error) bool) {
+		filters, err := s.sanitizeFilters(filter)
+		if err != nil {
+			yield(nostr.Event{}, err)
+			return
+		}
+
+		if len(filters) == 0 || filters[0].LimitZero {
+			return
+		}
+
+		filter := filters[0]
+		err = s.view(func(txn *badger.Txn) error {
+			if len(filter.IDs) > 0 {
+				// ids are few, so they are fetched all at once
+				events, err := s.query(ctx, txn, filter)
+				if err != nil {
+					return err
+				}
+
+				for _, event := range events {
+					if !yield(event, nil) {
+						return nil
+					}
+				}
+				return nil
+			}
+			return s.stream(ctx, txn, filter, yield)
+		})
+
+		if err != nil {
+			yield(nostr.Event{}, err)
+		}
+	}
+}
+
+// cursor is an iterator over the index keys with a prefix, from the newest to the oldest.
+type cursor struct {
+	prefix []byte
+	it     *badger.Iterator
+}
+
+func (c *cursor) valid(since uint64) bool {
+	if !c.it.ValidForPrefix(c.prefix) {
+		return false
+	}
+
+	createdAt, _ := kvcodec.ParseSuffix(c.it.Item().Key())
+	return createdAt >= since
+}
+
+// suffix returns the created_at and id of the current index key.
+func (c *cursor) suffix() []byte {
+	key := c.it.Item().Key()
+	return key[len(key)-suffixSize:]
+}
+
+// stream merges the cursors over the prefixes planned for the filter, yielding the matching events
+// from the newest to the oldest, until the filter's limit is reached or yield returns false.
+func (s *Store) stream(ctx context.Context, txn *badger.Txn, filter nostr.Filter, yield func(nostr.Event, error) bool) error {
+	var since, until uint64 = 0, maxCreatedAt
+	if filter.Since != nil {
+		since = kvcodec.Timestamp(*filter.Since)
+	}
+	if filter.Until != nil {
+		until = kvcodec.Timestamp(*filter.Until)
+	}
+
+	prefixes := s.plan(filter)
+	cursors := make([]*cursor, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Reverse = true
+		options.Prefix = prefix
+
+		c := &cursor{prefix: prefix, it: txn.NewIterator(options)}
+		defer c.it.Close()
+
+		c.it.Seek(kvcodec.SeekKey(prefix, until))
+		cursors = append(cursors, c)
+	}
+
+	var yielded int
+	seen := make(map[string]struct{})
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cursors = slices.DeleteFunc(cursors, func(c *cursor) bool { return !c.valid(since) })
+		if len(cursors) == 0 {
+			return nil
+		}
+
+		// the next index key is the one with the greatest suffix, as it starts with the created_at
+		next := slices.MaxFunc(cursors, func(c1, c2 *cursor) int { return bytes.Compare(c1.suffix(), c2.suffix()) })
+
+		_, key := kvcodec.ParseSuffix(next.it.Item().Key())
+		id := string(key)
+		next.it.Next()
+
+		if _, ok := seen[id]; ok {
+			// the event has multiple index keys with the planned prefixes, e.g. multiple tags
+			continue
+		}
+		seen[id] = struct{}{}
+
+		event, err := s.get(txn, []byte(id))
+		if err != nil {
+			return err
+		}
+
+		if event == nil || !matches(filter, event) {
+			continue
+		}
+
+		if !yield(*event, nil) {
+			return nil
+		}
+
+		yielded++
+		if filter.Limit > 0 && yielded >= filter.Limit {
+			return nil
+		}
+	}
+}
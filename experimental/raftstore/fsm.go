@@ -0,0 +1,137 @@
+package raftstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// scanBatchSize is the number of events queried at a time when taking or restoring a snapshot.
+const scanBatchSize = 1000
+
+const (
+	opSave    = "save"
+	opReplace = "replace"
+	opDelete  = "delete"
+)
+
+// command is a write, encoded in an entry of the raft log.
+type command struct {
+	Op    string       `json:"op"`
+	Event *nostr.Event `json:"event,omitempty"`
+	ID    string       `json:"id,omitempty"`
+}
+
+// result of applying a command to the backend.
+type result struct {
+	replaced bool
+	err      error
+}
+
+// fsm is the raft state machine, which applies the committed commands to the backend.
+type fsm struct {
+	backend nastro.Store
+}
+
+func (f *fsm) Apply(entry *raft.Log) any {
+	var cmd command
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return result{err: fmt.Errorf("failed to decode the command at index %d: %w", entry.Index, err)}
+	}
+
+	ctx := context.Background()
+	switch cmd.Op {
+	case opSave:
+		return result{err: f.backend.Save(ctx, cmd.Event)}
+
+	case opReplace:
+		replaced, err := f.backend.Replace(ctx, cmd.Event)
+		return result{replaced: replaced, err: err}
+
+	case opDelete:
+		return result{err: f.backend.Delete(ctx, cmd.ID)}
+
+	default:
+		return result{err: fmt.Errorf("unknown operation %q at index %d", cmd.Op, entry.Index)}
+	}
+}
+
+// Snapshot returns the events of the backend, which are read in memory since the backend
+// can't be read at a point in time while raft keeps applying commands.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	var events []nostr.Event
+	err := nastro.Scan(context.Background(), f.backend, nostr.Filter{}, scanBatchSize, func(event nostr.Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the events: %w", err)
+	}
+	return &snapshot{events: events}, nil
+}
+
+// Restore replaces the events of the backend with the ones of the snapshot.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	ctx := context.Background()
+
+	var stale []string
+	err := nastro.Scan(ctx, f.backend, nostr.Filter{}, scanBatchSize, func(event nostr.Event) error {
+		stale = append(stale, event.ID)
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to read the events: %w", err)
+	}
+
+	for _, id := range stale {
+		if err := f.backend.Delete(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for decoder.More() {
+		var event nostr.Event
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode the snapshot: %w", err)
+		}
+
+		if err := f.backend.Save(ctx, &event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot is the JSONL encoding of the events, from the newest to the oldest.
+type snapshot struct {
+	events []nostr.Event
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	encoder := json.NewEncoder(w)
+	for _, event := range s.events {
+		if err := encoder.Encode(event); err != nil {
+			sink.Cancel()
+			return fmt.Errorf("failed to encode event ID %s: %w", event.ID, err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
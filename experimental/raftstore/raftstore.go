@@ -0,0 +1,327 @@
+// The raftstore package defines a store that replicates its writes to a cluster of nodes with the raft
+// consensus algorithm, using hashicorp/raft, so that a few small relays (e.g. three) keep an identical and
+// strongly-consistent set of events, and survive the failure of a minority of them.
+//
+// Every node wraps its own backend, which must be deterministic: applying the same writes in the same order
+// must produce the same events and the same results on all nodes. The stores of nastro are, as long as
+// their policies and options are the same on all nodes.
+//
+// Writes must be sent to the leader, and return [raft.ErrNotLeader] on the other nodes.
+// Queries and counts are served by the local backend.
+//
+// The package is experimental: the encoding of the log and of the snapshots may change between versions.
+package raftstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// DefaultApplyTimeout is the maximum time a write waits to be committed by the cluster.
+var DefaultApplyTimeout = 10 * time.Second
+
+// Store of Nostr events that replicates the writes to its backend with raft.
+type Store struct {
+	raft    *raft.Raft
+	fsm     *fsm
+	config  *raft.Config
+	logs    raft.LogStore
+	stable  raft.StableStore
+	snaps   raft.SnapshotStore
+	timeout time.Duration
+
+	// consistent makes the node verify it's the leader before serving reads
+	consistent bool
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithConfig sets the raft configuration of the node, whose LocalID is overwritten by the id passed to [New].
+// The default is [raft.DefaultConfig].
+func WithConfig(c *raft.Config) Option {
+	return func(s *Store) error {
+		if c == nil {
+			return errors.New("raft config must not be nil")
+		}
+		s.config = c
+		return nil
+	}
+}
+
+// WithLogStore sets where the node stores the raft log and its metadata, e.g. raft-boltdb or raft-wal.
+// The default is in memory, which loses the state of the node when it restarts, so that it has to
+// catch up from the other nodes.
+func WithLogStore(logs raft.LogStore, stable raft.StableStore) Option {
+	return func(s *Store) error {
+		if logs == nil || stable == nil {
+			return errors.New("log and stable stores must not be nil")
+		}
+		s.logs = logs
+		s.stable = stable
+		return nil
+	}
+}
+
+// WithSnapshotStore sets where the node stores the snapshots of the events, e.g. [raft.NewFileSnapshotStore].
+// The default is in memory.
+func WithSnapshotStore(snaps raft.SnapshotStore) Option {
+	return func(s *Store) error {
+		if snaps == nil {
+			return errors.New("snapshot store must not be nil")
+		}
+		s.snaps = snaps
+		return nil
+	}
+}
+
+// WithApplyTimeout sets the maximum time a write waits to be committed by the cluster.
+func WithApplyTimeout(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("apply timeout must be positive")
+		}
+		s.timeout = d
+		return nil
+	}
+}
+
+// WithConsistentReads makes queries and counts succeed only on the leader, after it verified with
+// a quorum that it's still the leader, so that they observe all the committed writes.
+// Without it, the reads of the followers might miss the latest writes.
+func WithConsistentReads() Option {
+	return func(s *Store) error {
+		s.consistent = true
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before querying the backend.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before replicating them.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns the node with the provided id of a cluster replicating the writes to the backend,
+// which communicates with the other nodes with the transport, e.g. [raft.NewTCPTransport].
+//
+// The backend must be empty, or contain the events of the last snapshot of the node: on startup,
+// raft restores the last snapshot and reapplies the writes of the log that follow it.
+// A new cluster must be bootstrapped with [Store.Bootstrap] on one of its nodes.
+func New(backend nastro.Store, id string, transport raft.Transport, opts ...Option) (*Store, error) {
+	if backend == nil {
+		return nil, errors.New("backend must not be nil")
+	}
+
+	if transport == nil {
+		return nil, errors.New("transport must not be nil")
+	}
+
+	store := &Store{
+		fsm:             &fsm{backend: backend},
+		config:          raft.DefaultConfig(),
+		timeout:         DefaultApplyTimeout,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.logs == nil {
+		logs := raft.NewInmemStore()
+		store.logs, store.stable = logs, logs
+	}
+
+	if store.snaps == nil {
+		store.snaps = raft.NewInmemSnapshotStore()
+	}
+
+	config := *store.config
+	config.LocalID = raft.ServerID(id)
+	store.config = &config
+
+	var err error
+	store.raft, err = raft.NewRaft(store.config, store.fsm, store.logs, store.stable, store.snaps, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft: %w", err)
+	}
+	return store, nil
+}
+
+// Bootstrap a new cluster with the provided servers, which should include this node.
+// It must be called on a single node, and only once: it returns [raft.ErrCantBootstrap]
+// if the node already has a state.
+func (s *Store) Bootstrap(servers ...raft.Server) error {
+	if err := s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		return fmt.Errorf("failed to bootstrap the cluster: %w", err)
+	}
+	return nil
+}
+
+// Join adds the node with the provided id and address to the cluster as a voter.
+// It must be called on the leader.
+func (s *Store) Join(id, address string) error {
+	if err := s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, s.timeout).Error(); err != nil {
+		return fmt.Errorf("failed to add node %s: %w", id, err)
+	}
+	return nil
+}
+
+// Leave removes the node with the provided id from the cluster. It must be called on the leader.
+func (s *Store) Leave(id string) error {
+	if err := s.raft.RemoveServer(raft.ServerID(id), 0, s.timeout).Error(); err != nil {
+		return fmt.Errorf("failed to remove node %s: %w", id, err)
+	}
+	return nil
+}
+
+// Leader returns the id and address of the current leader, which are empty if there is no leader.
+// Writes sent to other nodes should be forwarded to it.
+func (s *Store) Leader() (id, address string) {
+	addr, ID := s.raft.LeaderWithID()
+	return string(ID), string(addr)
+}
+
+// IsLeader returns whether this node is the leader of the cluster.
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// Raft returns the underlying raft node, for example to take snapshots or inspect its stats.
+func (s *Store) Raft() *raft.Raft {
+	return s.raft
+}
+
+// Close shuts down the node and closes the backend if it implements [io.Closer].
+func (s *Store) Close() error {
+	errs := []error{s.raft.Shutdown().Error()}
+	if closer, ok := s.fsm.backend.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Save the event on all the nodes of the cluster. It returns the error of the backend of the leader, if any.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	if _, err := s.apply(ctx, command{Op: opSave, Event: event}); err != nil {
+		return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	replaced, err := s.apply(ctx, command{Op: opReplace, Event: event})
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+	return replaced, nil
+}
+
+// Delete the event with the provided id on all the nodes of the cluster.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if _, err := s.apply(ctx, command{Op: opDelete, ID: id}); err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// Query the local backend for the events matching the provided filters, see [WithConsistentReads].
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.verify(); err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return s.fsm.backend.Query(ctx, filters...)
+}
+
+// Count the events of the local backend matching the provided filters, see [WithConsistentReads].
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if err := s.verify(); err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return s.fsm.backend.Count(ctx, filters...)
+}
+
+// verify that the node is still the leader and has applied all the committed writes,
+// if the store has consistent reads.
+func (s *Store) verify() error {
+	if !s.consistent {
+		return nil
+	}
+
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	return s.raft.Barrier(s.timeout).Error()
+}
+
+// apply the command on the cluster, returning the result of the backend of this node.
+func (s *Store) apply(ctx context.Context, cmd command) (bool, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode the command: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	timeout := s.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+		if timeout <= 0 {
+			return false, context.DeadlineExceeded
+		}
+	}
+
+	future := s.raft.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+
+	res := future.Response().(result)
+	return res.replaced, res.err
+}
@@ -0,0 +1,208 @@
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newBackend(t *testing.T) *ephemeral.Store {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func testConfig() *raft.Config {
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+	return config
+}
+
+// newCluster returns n nodes connected with in-memory transports, the first of which is the leader.
+func newCluster(t *testing.T, n int, opts ...Option) []*Store {
+	transports := make([]*raft.InmemTransport, n)
+	servers := make([]raft.Server, n)
+	for i := range n {
+		_, transports[i] = raft.NewInmemTransport("")
+		servers[i] = raft.Server{ID: raft.ServerID(strconv.Itoa(i)), Address: transports[i].LocalAddr()}
+	}
+
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	nodes := make([]*Store, n)
+	for i := range n {
+		node, err := New(newBackend(t), strconv.Itoa(i), transports[i], append([]Option{WithConfig(testConfig())}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { node.Close() })
+		nodes[i] = node
+	}
+
+	// the cluster starts with the first node alone, so that it's the leader, and the others join it
+	if err := nodes[0].Bootstrap(servers[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, nodes[0].IsLeader)
+	for _, server := range servers[1:] {
+		if err := nodes[0].Join(string(server.ID), string(server.Address)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before the deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func ids(t *testing.T, store nastro.Store) []string {
+	events, err := store.Query(ctx, nostr.Filter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return newCluster(t, 1)[0]
+	})
+}
+
+func TestReplication(t *testing.T) {
+	nodes := newCluster(t, 3)
+	leader := nodes[0]
+
+	if err := leader.Save(ctx, &nostr.Event{ID: "a", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range []*nostr.Event{
+		{ID: "b", PubKey: "alice", Kind: 0, CreatedAt: 2},
+		{ID: "c", PubKey: "alice", Kind: 0, CreatedAt: 3},
+	} {
+		if _, err := leader.Replace(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the result of the replacement is the one of the backend of the leader
+	replaced, err := leader.Replace(ctx, &nostr.Event{ID: "old", PubKey: "alice", Kind: 0, CreatedAt: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced {
+		t.Fatal("expected the older event not to replace the newer one")
+	}
+
+	expected := []string{"c", "a"}
+	for i, node := range nodes {
+		waitFor(t, func() bool { return reflect.DeepEqual(ids(t, node), expected) })
+
+		if id, _ := node.Leader(); id != "0" {
+			t.Fatalf("node %d: expected leader 0, got %q", i, id)
+		}
+	}
+
+	if err := nodes[1].Save(ctx, &nostr.Event{ID: "d", Kind: 1, CreatedAt: 4}); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected error %v, got %v", raft.ErrNotLeader, err)
+	}
+}
+
+func TestConsistentReads(t *testing.T) {
+	nodes := newCluster(t, 3, WithConsistentReads())
+	if err := nodes[0].Save(ctx, &nostr.Event{ID: "a", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ids(t, nodes[0]); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("expected event a, got %v", got)
+	}
+
+	if _, err := nodes[1].Count(ctx, nostr.Filter{}); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected error %v, got %v", raft.ErrNotLeader, err)
+	}
+}
+
+// sink is a [raft.SnapshotSink] that writes to a buffer.
+type sink struct {
+	bytes.Buffer
+}
+
+func (s *sink) ID() string    { return "test" }
+func (s *sink) Cancel() error { return nil }
+func (s *sink) Close() error  { return nil }
+
+func TestSnapshot(t *testing.T) {
+	source := &fsm{backend: newBackend(t)}
+	for _, event := range []*nostr.Event{{ID: "a", Kind: 1, CreatedAt: 1}, {ID: "b", Kind: 1, CreatedAt: 2}} {
+		if err := source.backend.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s sink
+	if err := snap.Persist(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &fsm{backend: newBackend(t)}
+	if err := target.backend.Save(ctx, &nostr.Event{ID: "stale", Kind: 1, CreatedAt: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := target.Restore(io.NopCloser(&s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ids(t, target.backend); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Fatalf("expected events b and a, got %v", got)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
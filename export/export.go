@@ -0,0 +1,102 @@
+// The export package defines writers of Nostr events to portable file formats, JSONL and Parquet,
+// so that archives plug directly into analytics tools like DuckDB, Spark or pandas without a custom loader.
+// Both writers are pure Go, and don't require CGO.
+//
+//	file, err := os.Create("notes.parquet")
+//	n, err := export.Export(ctx, store, file, export.Parquet, nostr.Filter{Kinds: []int{1}})
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Format of the exported file.
+type Format string
+
+const (
+	JSONL   Format = "jsonl"   // one JSON event per line, as in NIP-01
+	Parquet Format = "parquet" // the columns of [ParquetWriter]
+)
+
+// DefaultBatchSize is the number of events queried at a time by [Export].
+var DefaultBatchSize = 1000
+
+// Writer writes events to a file format. Close must be called to complete the file,
+// but it doesn't close the underlying writer.
+type Writer interface {
+	Write(event *nostr.Event) error
+	Close() error
+}
+
+// NewWriter returns a writer of events to w in the provided format.
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	switch format {
+	case JSONL:
+		return NewJSONLWriter(w), nil
+	case Parquet:
+		return NewParquetWriter(w, DefaultRowGroupSize), nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// Export writes the events of the store matching the filter to w in the provided format,
+// from the newest to the oldest, and returns how many were written. The limit of the filter is ignored.
+// The store is queried [DefaultBatchSize] events at a time, see [nastro.Scan].
+func Export(ctx context.Context, store nastro.Store, w io.Writer, format Format, filter nostr.Filter) (int, error) {
+	writer, err := NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = nastro.Scan(ctx, store, filter, DefaultBatchSize, func(event nostr.Event) error {
+		if err := writer.Write(&event); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+
+	if err != nil {
+		return n, fmt.Errorf("failed to export: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return n, fmt.Errorf("failed to export: %w", err)
+	}
+	return n, nil
+}
+
+// JSONLWriter writes one JSON event per line.
+type JSONLWriter struct {
+	w *bufio.Writer
+}
+
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{w: bufio.NewWriter(w)}
+}
+
+func (j *JSONLWriter) Write(event *nostr.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event ID %s: %w", event.ID, err)
+	}
+
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close flushes the buffered events.
+func (j *JSONLWriter) Close() error {
+	return j.w.Flush()
+}
@@ -0,0 +1,201 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/ephemeral"
+)
+
+var ctx = context.Background()
+
+var events = []*nostr.Event{
+	{ID: "c", PubKey: "alice", CreatedAt: 3, Kind: 1, Tags: nostr.Tags{{"t", "nostr"}}, Content: "hello", Sig: "s3"},
+	{ID: "b", PubKey: "bob", CreatedAt: 2, Kind: 7, Content: "+", Sig: "s2"},
+	{ID: "a", PubKey: "alice", CreatedAt: 1, Kind: 30023, Tags: nostr.Tags{{"d", "post"}}, Content: "", Sig: "s1"},
+}
+
+func newStore(t *testing.T) *ephemeral.Store {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestExportJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Export(ctx, newStore(t), &buf, JSONL, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(events) {
+		t.Fatalf("expected %d events, got %d", len(events), n)
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	for i := 0; scanner.Scan(); i++ {
+		var event nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if event.ID != events[i].ID {
+			t.Fatalf("expected event ID %s at line %d, got %s", events[i].ID, i, event.ID)
+		}
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewParquetWriter(&buf, 2)
+	for _, event := range events {
+		if err := writer.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := buf.Bytes()
+	if string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		t.Fatalf("expected the file to start and end with %s", parquetMagic)
+	}
+
+	length := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	metadata := readStruct(t, bytes.NewReader(file[len(file)-8-length:len(file)-8]))
+
+	if rows := metadata[3]; rows != int64(len(events)) {
+		t.Fatalf("expected %d rows, got %v", len(events), rows)
+	}
+
+	var names []string
+	for _, element := range metadata[2].([]any)[1:] {
+		names = append(names, string(element.(map[int16]any)[4].([]byte)))
+	}
+
+	expected := []string{"id", "pubkey", "created_at", "kind", "tags", "content", "sig"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected columns %v, got %v", expected, names)
+	}
+
+	groups := metadata[4].([]any)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 row groups, got %d", len(groups))
+	}
+
+	// the values of the tags column, read from the pages of each row group
+	var tags []string
+	for _, group := range groups {
+		columns := group.(map[int16]any)[1].([]any)
+		meta := columns[4].(map[int16]any)[3].(map[int16]any)
+		offset := meta[9].(int64)
+
+		page := bytes.NewReader(file[offset:])
+		header := readStruct(t, page)
+		data := make([]byte, header[3].(int64))
+		io.ReadFull(page, data)
+
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for len(values) > 0 {
+			n := binary.LittleEndian.Uint32(values)
+			tags = append(tags, string(values[4:4+n]))
+			values = values[4+n:]
+		}
+	}
+
+	expected = []string{`[["t","nostr"]]`, `[]`, `[["d","post"]]`}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected tags %v, got %v", expected, tags)
+	}
+}
+
+// readStruct decodes a struct of the thrift compact protocol into its fields by id.
+// Integers are decoded as int64, binaries as []byte, lists as []any and structs as map[int16]any.
+func readStruct(t *testing.T, r *bytes.Reader) map[int16]any {
+	fields := make(map[int16]any)
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b == 0 {
+			return fields
+		}
+
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, _ := binary.ReadUvarint(r)
+			id = int16(unzigzag(v))
+		}
+
+		fields[id] = readValue(t, r, b&0x0F)
+		last = id
+	}
+}
+
+func readValue(t *testing.T, r *bytes.Reader, typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		v, _ := binary.ReadUvarint(r)
+		return unzigzag(v)
+
+	case thriftBinary:
+		n, _ := binary.ReadUvarint(r)
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return b
+
+	case thriftList:
+		header, _ := r.ReadByte()
+		n := uint64(header >> 4)
+		if n == 15 {
+			n, _ = binary.ReadUvarint(r)
+		}
+
+		list := make([]any, n)
+		for i := range list {
+			list[i] = readValue(t, r, header&0x0F)
+		}
+		return list
+
+	case thriftStruct:
+		return readStruct(t, r)
+
+	default:
+		t.Fatalf("unexpected thrift type %d", typ)
+		return nil
+	}
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
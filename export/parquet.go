@@ -0,0 +1,290 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultRowGroupSize is the number of events of each row group of the Parquet files, which are buffered in memory.
+var DefaultRowGroupSize = 100_000
+
+// The values of the Parquet format used by the writer.
+// More info here: https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift
+const (
+	parquetMagic = "PAR1"
+
+	typeInt32     int32 = 1
+	typeInt64     int32 = 2
+	typeByteArray int32 = 6
+
+	repetitionRequired int32 = 0
+	convertedUTF8      int32 = 0
+	convertedJSON      int32 = 19
+
+	encodingPlain int32 = 0
+	encodingRLE   int32 = 3
+	codecGzip     int32 = 2
+	pageData      int32 = 0
+)
+
+// column of a Parquet file, with the plain encoded values of the current row group.
+type column struct {
+	name      string
+	typ       int32
+	converted int32 // the converted (logical) type, or -1 if none
+	values    []byte
+}
+
+// chunk is the metadata of a column in a row group.
+type chunk struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type rowGroup struct {
+	chunks []chunk
+	rows   int64
+	bytes  int64
+}
+
+// ParquetWriter writes events to a Parquet file with the columns:
+//
+//	id          string (UTF8)
+//	pubkey      string (UTF8)
+//	created_at  int64
+//	kind        int32
+//	tags        string (JSON)
+//	content     string (UTF8)
+//	sig         string (UTF8)
+//
+// Values are plain encoded and gzip compressed, in row groups of the provided size.
+type ParquetWriter struct {
+	w       *counter
+	size    int
+	rows    int // the rows of the current row group
+	columns []*column
+	groups  []rowGroup
+	closed  bool
+}
+
+// NewParquetWriter returns a writer of a Parquet file to w, with row groups of the provided number of events.
+func NewParquetWriter(w io.Writer, rowGroupSize int) *ParquetWriter {
+	return &ParquetWriter{
+		w:    &counter{w: w},
+		size: max(rowGroupSize, 1),
+		columns: []*column{
+			{name: "id", typ: typeByteArray, converted: convertedUTF8},
+			{name: "pubkey", typ: typeByteArray, converted: convertedUTF8},
+			{name: "created_at", typ: typeInt64, converted: -1},
+			{name: "kind", typ: typeInt32, converted: -1},
+			{name: "tags", typ: typeByteArray, converted: convertedJSON},
+			{name: "content", typ: typeByteArray, converted: convertedUTF8},
+			{name: "sig", typ: typeByteArray, converted: convertedUTF8},
+		},
+	}
+}
+
+func (p *ParquetWriter) Write(event *nostr.Event) error {
+	if p.closed {
+		return errors.New("the parquet writer is closed")
+	}
+
+	tags := event.Tags
+	if tags == nil {
+		tags = nostr.Tags{}
+	}
+
+	encoded, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("failed to encode the tags of event ID %s: %w", event.ID, err)
+	}
+
+	appendBytes(p.columns[0], []byte(event.ID))
+	appendBytes(p.columns[1], []byte(event.PubKey))
+	p.columns[2].values = binary.LittleEndian.AppendUint64(p.columns[2].values, uint64(event.CreatedAt))
+	p.columns[3].values = binary.LittleEndian.AppendUint32(p.columns[3].values, uint32(int32(event.Kind)))
+	appendBytes(p.columns[4], encoded)
+	appendBytes(p.columns[5], []byte(event.Content))
+	appendBytes(p.columns[6], []byte(event.Sig))
+
+	p.rows++
+	if p.rows >= p.size {
+		return p.flush()
+	}
+	return nil
+}
+
+// appendBytes appends the plain encoding of a byte array, which is prefixed by its length.
+func appendBytes(c *column, b []byte) {
+	c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(b)))
+	c.values = append(c.values, b...)
+}
+
+// flush writes the current row group, with one data page per column.
+func (p *ParquetWriter) flush() error {
+	if err := p.start(); err != nil {
+		return err
+	}
+
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := rowGroup{rows: int64(p.rows)}
+	for _, c := range p.columns {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(c.values); err != nil {
+			return err
+		}
+
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		var header compact
+		header.begin()
+		header.i32(1, pageData)
+		header.i32(2, int32(len(c.values)))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.end()
+		header.end()
+
+		ch := chunk{
+			offset:       p.w.n,
+			uncompressed: int64(len(header.buf) + len(c.values)),
+			compressed:   int64(len(header.buf) + compressed.Len()),
+		}
+
+		if _, err := p.w.Write(header.buf); err != nil {
+			return err
+		}
+
+		if _, err := p.w.Write(compressed.Bytes()); err != nil {
+			return err
+		}
+
+		group.chunks = append(group.chunks, ch)
+		group.bytes += ch.uncompressed
+		c.values = c.values[:0]
+	}
+
+	p.groups = append(p.groups, group)
+	p.rows = 0
+	return nil
+}
+
+// start writes the magic number at the beginning of the file, if not done already.
+func (p *ParquetWriter) start() error {
+	if p.w.n > 0 {
+		return nil
+	}
+
+	_, err := p.w.Write([]byte(parquetMagic))
+	return err
+}
+
+// Close writes the buffered events and the metadata of the file.
+func (p *ParquetWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	p.closed = true
+	footer := p.metadata()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, parquetMagic...)
+
+	_, err := p.w.Write(footer)
+	return err
+}
+
+// metadata returns the thrift encoding of the FileMetaData of the file.
+func (p *ParquetWriter) metadata() []byte {
+	var rows int64
+	for _, g := range p.groups {
+		rows += g.rows
+	}
+
+	var m compact
+	m.begin()
+	m.i32(1, 1) // version
+
+	m.list(2, thriftStruct, len(p.columns)+1)
+	m.begin()
+	m.string(4, "schema")
+	m.i32(5, int32(len(p.columns)))
+	m.end()
+
+	for _, c := range p.columns {
+		m.begin()
+		m.i32(1, c.typ)
+		m.i32(3, repetitionRequired)
+		m.string(4, c.name)
+		if c.converted >= 0 {
+			m.i32(6, c.converted)
+		}
+		m.end()
+	}
+
+	m.i64(3, rows)
+	m.list(4, thriftStruct, len(p.groups))
+	for _, g := range p.groups {
+		m.begin()
+		m.list(1, thriftStruct, len(g.chunks))
+		for i, ch := range g.chunks {
+			m.begin()
+			m.i64(2, ch.offset)
+			m.beginStruct(3)
+			m.i32(1, p.columns[i].typ)
+			m.list(2, thriftI32, 2)
+			m.i32Elem(encodingPlain)
+			m.i32Elem(encodingRLE)
+			m.list(3, thriftBinary, 1)
+			m.stringElem(p.columns[i].name)
+			m.i32(4, codecGzip)
+			m.i64(5, g.rows)
+			m.i64(6, ch.uncompressed)
+			m.i64(7, ch.compressed)
+			m.i64(9, ch.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, g.bytes)
+		m.i64(3, g.rows)
+		m.end()
+	}
+
+	m.string(6, "nastro")
+	m.end()
+	return m.buf
+}
+
+// counter counts the bytes written to w.
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,90 @@
+package export
+
+import "encoding/binary"
+
+// The types of the thrift compact protocol, which encodes the metadata of Parquet files.
+// More info here: https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// compact is an encoder of the thrift compact protocol.
+type compact struct {
+	buf  []byte
+	last []int16 // the id of the last field of each struct being encoded
+}
+
+// begin a struct that is the root or an element of a list, whose fields start from zero.
+func (c *compact) begin() {
+	c.last = append(c.last, 0)
+}
+
+// end the current struct.
+func (c *compact) end() {
+	c.buf = append(c.buf, 0)
+	c.last = c.last[:len(c.last)-1]
+}
+
+func (c *compact) field(id int16, typ byte) {
+	last := &c.last[len(c.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.buf = append(c.buf, byte(delta)<<4|typ)
+	} else {
+		c.buf = append(c.buf, typ)
+		c.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (c *compact) varint(v uint64) {
+	c.buf = binary.AppendUvarint(c.buf, v)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, thriftI32)
+	c.varint(zigzag(int64(v)))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, thriftI64)
+	c.varint(zigzag(v))
+}
+
+func (c *compact) string(id int16, s string) {
+	c.field(id, thriftBinary)
+	c.stringElem(s)
+}
+
+// beginStruct begins a struct that is the field of the current struct.
+func (c *compact) beginStruct(id int16) {
+	c.field(id, thriftStruct)
+	c.begin()
+}
+
+// list writes the header of a list of n elements of the type, which must be followed by the elements.
+func (c *compact) list(id int16, elem byte, n int) {
+	c.field(id, thriftList)
+	if n < 15 {
+		c.buf = append(c.buf, byte(n)<<4|elem)
+	} else {
+		c.buf = append(c.buf, 0xF0|elem)
+		c.varint(uint64(n))
+	}
+}
+
+func (c *compact) i32Elem(v int32) {
+	c.varint(zigzag(int64(v)))
+}
+
+func (c *compact) stringElem(s string) {
+	c.varint(uint64(len(s)))
+	c.buf = append(c.buf, s...)
+}
@@ -0,0 +1,570 @@
+// The fsstore package defines a store of Nostr events in plain JSONL files, for archival crawlers
+// and air-gapped backups where a database is overkill.
+//
+// Events are appended to one file per day of their created_at (UTC), e.g. "2025-10-16.jsonl", one JSON event per line.
+// The ids of the deleted and replaced events are appended to "deleted.txt", one per line. Files are never rewritten,
+// so they can be copied, compressed or synced with any tool.
+//
+// At startup the store reads all the files to rebuild an in-memory index of the events, keeping their position
+// in the files and the fields needed to select them, but not their content, which is read from the files by queries.
+package fsstore
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+const deletedName = "deleted.txt"
+
+// entry is the position and the indexed fields of an event.
+type entry struct {
+	id        string
+	pubkey    string
+	kind      int
+	createdAt nostr.Timestamp
+	address   string // empty for kinds that are neither replaceable nor addressable
+
+	file   string
+	offset int64
+	length int
+}
+
+// Store of Nostr events in a directory of JSONL files.
+type Store struct {
+	dir  string
+	sync bool
+
+	mu        sync.RWMutex
+	files     map[string]*os.File // the open partitions, by file name
+	deleted   *os.File
+	entries   []*entry // sorted with [compareEntries]
+	ids       map[string]*entry
+	pubkeys   map[string][]*entry // sorted with [compareEntries]
+	addresses map[string]*entry   // the latest event of each address
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithSync makes every write call fsync before returning, trading throughput for durability.
+func WithSync() Option {
+	return func(s *Store) error {
+		s.sync = true
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before executing queries.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before appending them to the files.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store of the JSONL files in the directory, creating it if needed, and indexes the events of its files.
+// A partial line at the end of a file, left by a crash during a write, is discarded.
+func New(dir string, opts ...Option) (*Store, error) {
+	store := &Store{
+		dir:             dir,
+		files:           make(map[string]*os.File),
+		ids:             make(map[string]*entry),
+		pubkeys:         make(map[string][]*entry),
+		addresses:       make(map[string]*entry),
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the directory: %w", err)
+	}
+
+	if err := store.load(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close the files of the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.Close())
+	}
+
+	if s.deleted != nil {
+		errs = append(errs, s.deleted.Close())
+	}
+
+	s.files = make(map[string]*os.File)
+	s.deleted = nil
+	return errors.Join(errs...)
+}
+
+// load indexes the events of the partitions, and then removes the deleted ones.
+func (s *Store) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range names {
+		if err := s.loadPartition(filepath.Base(path)); err != nil {
+			return fmt.Errorf("failed to load %s: %w", path, err)
+		}
+	}
+
+	slices.SortFunc(s.entries, compareEntries)
+	for _, entries := range s.pubkeys {
+		slices.SortFunc(entries, compareEntries)
+	}
+
+	s.deleted, err = os.OpenFile(filepath.Join(s.dir, deletedName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", deletedName, err)
+	}
+
+	scanner := bufio.NewScanner(s.deleted)
+	for scanner.Scan() {
+		if e, ok := s.ids[scanner.Text()]; ok {
+			s.unindex(e)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Store) loadPartition(name string) error {
+	file, err := s.partition(name)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// a partial write, which is truncated so that the next append starts on a new line
+				return file.Truncate(offset)
+			}
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var event nostr.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("invalid event at offset %d: %w", offset, err)
+		}
+
+		s.index(newEntry(&event, name, offset, len(line)), true)
+		offset += int64(len(line))
+	}
+}
+
+// partition returns the open file of the partition with the provided name, opening it if needed.
+func (s *Store) partition(name string) (*os.File, error) {
+	if f, ok := s.files[name]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.files[name] = f
+	return f, nil
+}
+
+// partitionOf returns the name of the file of the event, from the day of its created_at.
+func partitionOf(event *nostr.Event) string {
+	return time.Unix(int64(event.CreatedAt), 0).UTC().Format(time.DateOnly) + ".jsonl"
+}
+
+func newEntry(event *nostr.Event, file string, offset int64, length int) *entry {
+	e := &entry{
+		id:        event.ID,
+		pubkey:    event.PubKey,
+		kind:      event.Kind,
+		createdAt: event.CreatedAt,
+		file:      file,
+		offset:    offset,
+		length:    length,
+	}
+
+	switch {
+	case nostr.IsReplaceableKind(event.Kind):
+		e.address = fmt.Sprintf("%d:%s:", event.Kind, event.PubKey)
+	case nostr.IsAddressableKind(event.Kind):
+		e.address = fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+	}
+	return e
+}
+
+// index adds the entry to the indexes. The caller must hold the lock.
+// While loading, entries are appended and sorted once all the files are read, see [Store.load].
+func (s *Store) index(e *entry, loading bool) {
+	if _, ok := s.ids[e.id]; ok {
+		return
+	}
+
+	s.ids[e.id] = e
+	if loading {
+		s.entries = append(s.entries, e)
+		s.pubkeys[e.pubkey] = append(s.pubkeys[e.pubkey], e)
+	} else {
+		s.entries = insert(s.entries, e)
+		s.pubkeys[e.pubkey] = insert(s.pubkeys[e.pubkey], e)
+	}
+
+	if e.address != "" {
+		if latest, ok := s.addresses[e.address]; !ok || e.createdAt > latest.createdAt {
+			s.addresses[e.address] = e
+		}
+	}
+}
+
+// unindex removes the entry from the indexes. The caller must hold the lock.
+func (s *Store) unindex(e *entry) {
+	delete(s.ids, e.id)
+	s.entries = remove(s.entries, e)
+	s.pubkeys[e.pubkey] = remove(s.pubkeys[e.pubkey], e)
+	if len(s.pubkeys[e.pubkey]) == 0 {
+		delete(s.pubkeys, e.pubkey)
+	}
+
+	if e.address != "" && s.addresses[e.address] == e {
+		delete(s.addresses, e.address)
+		// another event of the same address might be left, e.g. saved with Save instead of Replace
+		for _, other := range s.pubkeys[e.pubkey] {
+			if other.address == e.address {
+				s.addresses[e.address] = other
+				break
+			}
+		}
+	}
+}
+
+func insert(entries []*entry, e *entry) []*entry {
+	i, _ := slices.BinarySearchFunc(entries, e, compareEntries)
+	return slices.Insert(entries, i, e)
+}
+
+func remove(entries []*entry, e *entry) []*entry {
+	if i, found := slices.BinarySearchFunc(entries, e, compareEntries); found {
+		return slices.Delete(entries, i, i+1)
+	}
+	return entries
+}
+
+// compareEntries sorts entries by created_at in descending order, and by id in ascending order.
+func compareEntries(e1, e2 *entry) int {
+	if c := cmp.Compare(e2.createdAt, e1.createdAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.id, e2.id)
+}
+
+// Save the event by appending it to the file of its day. If the event is already stored, nothing happens and nil is returned.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(event); err != nil {
+		return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// append the event to its partition and indexes it. The caller must hold the lock.
+func (s *Store) append(event *nostr.Event) error {
+	if _, ok := s.ids[event.ID]; ok {
+		return nil
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the event: %w", err)
+	}
+	line = append(line, '\n')
+
+	name := partitionOf(event)
+	file, err := s.partition(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(line); err != nil {
+		return err
+	}
+
+	if s.sync {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.index(newEntry(event, name, info.Size(), len(line)), false)
+	return nil
+}
+
+// Delete the event with the provided id, by appending its id to the deleted file.
+// If the event is not found, nothing happens and nil is returned.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.delete(id); err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// delete the event with the provided id. The caller must hold the lock.
+func (s *Store) delete(id string) error {
+	e, ok := s.ids[id]
+	if !ok {
+		return nil
+	}
+
+	if _, err := s.deleted.WriteString(id + "\n"); err != nil {
+		return err
+	}
+
+	if s.sync {
+		if err := s.deleted.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.unindex(e)
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := newEntry(event, "", 0, 0).address
+	if latest, ok := s.addresses[address]; ok {
+		if latest.createdAt >= event.CreatedAt {
+			return false, nil
+		}
+
+		if err := s.delete(latest.id); err != nil {
+			return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+		}
+	}
+
+	if err := s.append(event); err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+	return true, nil
+}
+
+// Query stored events matching the provided filters, sorted by created_at in descending order, and by id
+// in ascending order among events created at the same time. Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for i, filter := range filters {
+		result, err := s.query(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to query filter %d: %w", nastro.ErrInternalQuery, i, err)
+		}
+
+		for _, event := range result {
+			if _, ok := seen[event.ID]; !ok {
+				seen[event.ID] = struct{}{}
+				events = append(events, event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count stored events matching the provided filters, returning the sum of the counts of each filter.
+// The limits of the filters are ignored.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for i, filter := range filters {
+		filter.Limit = 0
+		filter.LimitZero = false
+
+		events, err := s.query(ctx, filter)
+		if err != nil {
+			return 0, fmt.Errorf("%w: failed to count filter %d: %w", nastro.ErrInternalQuery, i, err)
+		}
+		total += int64(len(events))
+	}
+	return total, nil
+}
+
+// query returns the events matching the filter, in the order of the entries and up to the filter's limit.
+// A limit of zero means no limit, unless LimitZero is set. The caller must hold the read lock.
+func (s *Store) query(ctx context.Context, filter nostr.Filter) ([]nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
+	}
+
+	var candidates []*entry
+	switch {
+	case len(filter.IDs) > 0:
+		for _, id := range filter.IDs {
+			if e, ok := s.ids[id]; ok {
+				candidates = append(candidates, e)
+			}
+		}
+		slices.SortFunc(candidates, compareEntries)
+
+	case len(filter.Authors) > 0:
+		for _, author := range filter.Authors {
+			candidates = append(candidates, s.pubkeys[author]...)
+		}
+		slices.SortFunc(candidates, compareEntries)
+
+	default:
+		candidates = s.entries
+	}
+
+	var events []nostr.Event
+	for _, e := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if !mightMatch(filter, e) {
+			continue
+		}
+
+		event, err := s.read(e)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter.Matches(event) {
+			events = append(events, *event)
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				break
+			}
+		}
+	}
+	return events, nil
+}
+
+// mightMatch returns whether the event of the entry might match the filter, judging by its indexed fields.
+func mightMatch(filter nostr.Filter, e *entry) bool {
+	if filter.Since != nil && e.createdAt < *filter.Since {
+		return false
+	}
+
+	if filter.Until != nil && e.createdAt > *filter.Until {
+		return false
+	}
+
+	if len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, e.kind) {
+		return false
+	}
+
+	if len(filter.Authors) > 0 && !slices.Contains(filter.Authors, e.pubkey) {
+		return false
+	}
+	return true
+}
+
+// read the event of the entry from its file.
+func (s *Store) read(e *entry) (*nostr.Event, error) {
+	file, ok := s.files[e.file]
+	if !ok {
+		return nil, fmt.Errorf("partition %s is not open", e.file)
+	}
+
+	line := make([]byte, e.length)
+	if _, err := file.ReadAt(line, e.offset); err != nil {
+		return nil, fmt.Errorf("failed to read event ID %s: %w", e.id, err)
+	}
+
+	event := &nostr.Event{}
+	if err := json.Unmarshal(line, event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event ID %s: %w", e.id, err)
+	}
+	return event, nil
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
@@ -0,0 +1,105 @@
+package fsstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newStore(t *testing.T, dir string) *Store {
+	store, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store { return newStore(t, t.TempDir()) })
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	store := newStore(t, dir)
+
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1},
+		{ID: "b", PubKey: "alice", Kind: 0, CreatedAt: 86400},
+		{ID: "c", PubKey: "alice", Kind: 0, CreatedAt: 2 * 86400},
+		{ID: "d", PubKey: "bob", Kind: 1, CreatedAt: 3},
+	}
+
+	if err := store.Save(ctx, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events[1:3] {
+		if _, err := store.Replace(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Save(ctx, events[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	partitions, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(partitions) != 3 {
+		t.Fatalf("expected 3 partitions, got %v", partitions)
+	}
+
+	// a partial write is discarded
+	f, err := os.OpenFile(filepath.Join(dir, "1970-01-01.jsonl"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"partial`)
+	f.Close()
+
+	reopened := newStore(t, dir)
+	results, err := reopened.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != "c" || results[1].ID != "a" {
+		t.Fatalf("expected events c and a, got %v", results)
+	}
+
+	if err := reopened.Save(ctx, &nostr.Event{ID: "e", Kind: 1, CreatedAt: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := reopened.Count(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected count 2, got %d", count)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
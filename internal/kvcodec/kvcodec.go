@@ -0,0 +1,150 @@
+// The kvcodec package defines the keys shared by the key-value stores (badger and lmdb),
+// so that every key-value backend indexes and queries events identically.
+//
+// Each event has a set of empty index keys pointing to it. Integers are big-endian,
+// so that index keys sharing the same prefix are sorted by created_at.
+//
+//	time      't' | created_at (8) | id (32)
+//	kind      'k' | kind (2) | created_at (8) | id (32)
+//	pubkey    'p' | pubkey (32) | created_at (8) | id (32)
+//	tag       'g' | len(key) (1) | key | len(value) (2) | value | created_at (8) | id (32)
+//	address   'a' | kind (2) | pubkey (32) | d-tag                         -> id (32)
+//
+// The address key points to the latest replaceable or addressable event of its category.
+// Backends are free to add their own keys, as long as their prefixes don't collide with these.
+package kvcodec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	PrefixTime    byte = 't'
+	PrefixKind    byte = 'k'
+	PrefixPubkey  byte = 'p'
+	PrefixTag     byte = 'g'
+	PrefixAddress byte = 'a'
+)
+
+const (
+	IDSize     = 32
+	PubkeySize = 32
+
+	// SuffixSize is the size of the created_at and id at the end of every index key.
+	SuffixSize = 8 + IDSize
+
+	MaxKind         = 1<<16 - 1
+	MaxIndexedKey   = 1<<8 - 1
+	MaxIndexedValue = 1<<16 - 1
+	MaxCreatedAt    = 1<<64 - 1
+)
+
+func TimePrefix() []byte {
+	return []byte{PrefixTime}
+}
+
+func KindPrefix(kind int) []byte {
+	return binary.BigEndian.AppendUint16([]byte{PrefixKind}, uint16(kind))
+}
+
+func PubkeyPrefix(pubkey []byte) []byte {
+	return append([]byte{PrefixPubkey}, pubkey...)
+}
+
+func TagPrefix(key, value string) []byte {
+	prefix := make([]byte, 0, 4+len(key)+len(value))
+	prefix = append(prefix, PrefixTag, byte(len(key)))
+	prefix = append(prefix, key...)
+	prefix = binary.BigEndian.AppendUint16(prefix, uint16(len(value)))
+	return append(prefix, value...)
+}
+
+func AddressKey(kind int, pubkey []byte, d string) []byte {
+	key := binary.BigEndian.AppendUint16([]byte{PrefixAddress}, uint16(kind))
+	key = append(key, pubkey...)
+	return append(key, d...)
+}
+
+// AddressOf returns the address key of the event, which must be replaceable or addressable.
+func AddressOf(e *nostr.Event, pubkey []byte) []byte {
+	if nostr.IsAddressableKind(e.Kind) {
+		return AddressKey(e.Kind, pubkey, e.Tags.GetD())
+	}
+	return AddressKey(e.Kind, pubkey, "")
+}
+
+// IndexKey appends the created_at and id of the event to the prefix.
+func IndexKey(prefix []byte, createdAt nostr.Timestamp, id []byte) []byte {
+	key := make([]byte, 0, len(prefix)+SuffixSize)
+	key = append(key, prefix...)
+	key = binary.BigEndian.AppendUint64(key, Timestamp(createdAt))
+	return append(key, id...)
+}
+
+// ParseSuffix returns the created_at and id at the end of the index key.
+func ParseSuffix(key []byte) (createdAt uint64, id []byte) {
+	suffix := key[len(key)-SuffixSize:]
+	return binary.BigEndian.Uint64(suffix[:8]), suffix[8:]
+}
+
+// SeekKey returns the key to seek in a reverse iteration over the prefix, so that the first
+// index key found at or before it is the one of the latest event created at or before until.
+func SeekKey(prefix []byte, until uint64) []byte {
+	key := make([]byte, 0, len(prefix)+SuffixSize)
+	key = append(key, prefix...)
+	key = binary.BigEndian.AppendUint64(key, until)
+	return append(key, bytes.Repeat([]byte{0xff}, IDSize)...)
+}
+
+// IndexKeys returns the time, kind, pubkey and tag keys of the event, whose id and pubkey are already decoded.
+// Only the tags for which isIndexed returns true are indexed, and each tag value is indexed once.
+func IndexKeys(e *nostr.Event, id, pubkey []byte, isIndexed func(key, value string) bool) [][]byte {
+	keys := make([][]byte, 0, 3+len(e.Tags))
+	keys = append(keys,
+		IndexKey(TimePrefix(), e.CreatedAt, id),
+		IndexKey(KindPrefix(e.Kind), e.CreatedAt, id),
+		IndexKey(PubkeyPrefix(pubkey), e.CreatedAt, id),
+	)
+
+	seen := make(map[string]struct{}, len(e.Tags))
+	for _, tag := range e.Tags {
+		if len(tag) < 2 || len(tag[0]) > MaxIndexedKey || len(tag[1]) > MaxIndexedValue || !isIndexed(tag[0], tag[1]) {
+			continue
+		}
+
+		prefix := TagPrefix(tag[0], tag[1])
+		if _, ok := seen[string(prefix)]; ok {
+			continue
+		}
+
+		seen[string(prefix)] = struct{}{}
+		keys = append(keys, IndexKey(prefix, e.CreatedAt, id))
+	}
+	return keys
+}
+
+// IsSingleLetter reports whether the tag key is a single letter, which are the tags indexed by default following NIP-01.
+func IsSingleLetter(key, value string) bool {
+	return len(key) == 1
+}
+
+// Timestamp converts created_at to its position in the index keys. Negative timestamps come first.
+func Timestamp(createdAt nostr.Timestamp) uint64 {
+	if createdAt < 0 {
+		return 0
+	}
+	return uint64(createdAt)
+}
+
+// DecodeHex decodes the hex string into dst, which must be exactly as long as the decoded string.
+func DecodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) {
+		return hex.ErrLength
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
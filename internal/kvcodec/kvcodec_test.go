@@ -0,0 +1,180 @@
+package kvcodec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestSuffixRoundTrip(t *testing.T) {
+	prefixes := [][]byte{
+		TimePrefix(),
+		KindPrefix(0),
+		KindPrefix(MaxKind),
+		PubkeyPrefix(randBytes(PubkeySize)),
+		TagPrefix("e", "xxx"),
+		TagPrefix("t", ""),
+	}
+
+	timestamps := []nostr.Timestamp{0, 1, 1700000000, math.MaxInt64}
+	for _, prefix := range prefixes {
+		for _, createdAt := range timestamps {
+			id := randBytes(IDSize)
+			key := IndexKey(prefix, createdAt, id)
+
+			if !bytes.HasPrefix(key, prefix) {
+				t.Fatalf("expected key %x to have prefix %x", key, prefix)
+			}
+
+			ts, parsed := ParseSuffix(key)
+			if ts != uint64(createdAt) || !bytes.Equal(parsed, id) {
+				t.Fatalf("expected created_at %d and id %x, got %d and %x", createdAt, id, ts, parsed)
+			}
+		}
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	prefix := KindPrefix(1)
+	timestamps := []nostr.Timestamp{0, 1, 255, 256, 1 << 32, math.MaxInt64}
+
+	keys := make([][]byte, len(timestamps))
+	for i, createdAt := range timestamps {
+		keys[i] = IndexKey(prefix, createdAt, randBytes(IDSize))
+	}
+
+	if !slices.IsSortedFunc(keys, bytes.Compare) {
+		t.Fatalf("expected the keys to be sorted by created_at")
+	}
+
+	// negative timestamps come first
+	if Timestamp(-10) != 0 {
+		t.Fatalf("expected negative timestamps to be mapped to 0, got %d", Timestamp(-10))
+	}
+
+	// the seek key of until sorts after all the keys created at or before until, and before the later ones
+	for i, until := range timestamps {
+		seek := SeekKey(prefix, Timestamp(until))
+		for j, key := range keys {
+			after := bytes.Compare(key, seek) > 0
+			if after != (Timestamp(timestamps[j]) > Timestamp(timestamps[i])) {
+				t.Fatalf("seek key of until %d: key of created_at %d has the wrong position", until, timestamps[j])
+			}
+		}
+	}
+}
+
+func TestPrefixesAreDistinct(t *testing.T) {
+	pubkey := randBytes(PubkeySize)
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{name: "tag key and value boundary", a: TagPrefix("ab", "c"), b: TagPrefix("a", "bc")},
+		{name: "tag value is a prefix of another", a: TagPrefix("e", "abc"), b: TagPrefix("e", "ab")},
+		{name: "kinds", a: KindPrefix(1), b: KindPrefix(256)},
+		{name: "address kinds", a: AddressKey(30023, pubkey, ""), b: AddressKey(30024, pubkey, "")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bytes.HasPrefix(test.a, test.b) || bytes.HasPrefix(test.b, test.a) {
+				t.Fatalf("expected %x and %x not to be prefixes of each other", test.a, test.b)
+			}
+		})
+	}
+}
+
+func TestAddressOf(t *testing.T) {
+	pubkey := randBytes(PubkeySize)
+	tests := []struct {
+		name     string
+		event    nostr.Event
+		expected []byte
+	}{
+		{
+			name:     "replaceable",
+			event:    nostr.Event{Kind: 0, Tags: nostr.Tags{{"d", "ignored"}}},
+			expected: AddressKey(0, pubkey, ""),
+		},
+		{
+			name:     "addressable",
+			event:    nostr.Event{Kind: 30023, Tags: nostr.Tags{{"d", "post"}}},
+			expected: AddressKey(30023, pubkey, "post"),
+		},
+		{
+			name:     "addressable without d-tag",
+			event:    nostr.Event{Kind: 30023},
+			expected: AddressKey(30023, pubkey, ""),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := AddressOf(&test.event, pubkey)
+			if !bytes.Equal(key, test.expected) {
+				t.Fatalf("expected key %x, got %x", test.expected, key)
+			}
+		})
+	}
+}
+
+func TestIndexKeys(t *testing.T) {
+	id, pubkey := randBytes(IDSize), randBytes(PubkeySize)
+	event := &nostr.Event{
+		Kind:      1,
+		CreatedAt: 100,
+		Tags: nostr.Tags{
+			{"e", "xxx"},
+			{"e", "xxx"},
+			{"p", "yyy"},
+			{"title", "not indexed"},
+			{"t"},
+		},
+	}
+
+	keys := IndexKeys(event, id, pubkey, IsSingleLetter)
+	expected := [][]byte{
+		IndexKey(TimePrefix(), 100, id),
+		IndexKey(KindPrefix(1), 100, id),
+		IndexKey(PubkeyPrefix(pubkey), 100, id),
+		IndexKey(TagPrefix("e", "xxx"), 100, id),
+		IndexKey(TagPrefix("p", "yyy"), 100, id),
+	}
+
+	if !slices.EqualFunc(keys, expected, bytes.Equal) {
+		t.Fatalf("expected keys %x, got %x", expected, keys)
+	}
+}
+
+func TestDecodeHex(t *testing.T) {
+	id := randBytes(IDSize)
+	dst := make([]byte, IDSize)
+	if err := DecodeHex(dst, hex.EncodeToString(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dst, id) {
+		t.Fatalf("expected %x, got %x", id, dst)
+	}
+
+	if err := DecodeHex(dst, "abc"); !errors.Is(err, hex.ErrLength) {
+		t.Fatalf("expected error %v, got %v", hex.ErrLength, err)
+	}
+
+	if err := DecodeHex(dst, string(bytes.Repeat([]byte("z"), 2*IDSize))); err == nil {
+		t.Fatalf("expected an error for an invalid hex string")
+	}
+}
@@ -0,0 +1,362 @@
+package nastro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Errors returned by [QueryLimits]. Their messages are prefixed according to NIP-01,
+// so that relays can use them directly as the reason of a CLOSED message.
+var (
+	ErrTooManyFilters   = errors.New("invalid: too many filters")
+	ErrTooManyIDs       = errors.New("invalid: too many ids in filter")
+	ErrTooManyAuthors   = errors.New("invalid: too many authors in filter")
+	ErrTooManyKinds     = errors.New("invalid: too many kinds in filter")
+	ErrTooManyTagValues = errors.New("invalid: too many tag values in filter")
+	ErrTimeRangeTooWide = errors.New("invalid: filter time range is too wide")
+	ErrLimitTooHigh     = errors.New("invalid: filter limit is too high")
+	ErrEmptyFilter      = errors.New("invalid: filter must have at least one condition")
+)
+
+// QueryLimits constrains the filters of a query. A zero field means no limit on that dimension,
+// except for AllowEmptyFilter.
+type QueryLimits struct {
+	MaxFilters   int // the maximum number of filters in a query
+	MaxIDs       int // the maximum number of ids in a filter
+	MaxAuthors   int // the maximum number of authors in a filter
+	MaxKinds     int // the maximum number of kinds in a filter
+	MaxTagValues int // the maximum number of tag values in a filter, summed over all tag keys
+
+	// MaxTimeRange is the maximum distance between since and until (or now, if until is not specified).
+	// Filters without since are not constrained.
+	MaxTimeRange time.Duration
+
+	// MaxLimit is the maximum limit of a filter. Higher limits are clamped to it (see RejectOverLimit),
+	// and it's used as the limit of filters that don't specify one.
+	MaxLimit int
+
+	// RejectOverLimit rejects filters whose limit exceeds MaxLimit with [ErrLimitTooHigh], instead of clamping it.
+	// Most relays clamp, as rejecting fails the whole REQ of clients that ask for more than they can get.
+	RejectOverLimit bool
+
+	// AllowEmptyFilter accepts filters without ids, authors, kinds, tags, since or until,
+	// which match all events up to their limit. If false, they are rejected with [ErrEmptyFilter].
+	AllowEmptyFilter bool
+
+	// Observe, if not nil, is called every time a filter is rejected or clamped, with the name of the limit
+	// (e.g. "MaxKinds") and whether the filter was clamped. It's useful to tune the limits on real traffic.
+	Observe func(limit string, clamped bool)
+}
+
+// Validate is a [FilterPolicy] that enforces the limits, in addition to the rules of [DefaultFilterPolicy].
+// Filters that exceed a limit are rejected with the corresponding error, except for the limit, which is clamped
+// unless RejectOverLimit is set.
+// It can be passed to the stores, e.g. sqlite.WithFilterPolicy(limits.Validate).
+func (l QueryLimits) Validate(filters ...nostr.Filter) (nostr.Filters, error) {
+	filters, err := l.validate(filters...)
+
+	var v Violation
+	if l.Observe != nil && errors.As(err, &v) {
+		l.Observe(v.Limit(), false)
+	}
+	return filters, err
+}
+
+func (l QueryLimits) validate(filters ...nostr.Filter) (nostr.Filters, error) {
+	if l.MaxFilters > 0 && len(filters) > l.MaxFilters {
+		return nil, violation(ErrTooManyFilters, "MaxFilters", len(filters), l.MaxFilters)
+	}
+
+	result := make([]nostr.Filter, 0, len(filters))
+	for _, f := range filters {
+		if f.LimitZero {
+			continue
+		}
+
+		if f.Search != "" {
+			return nil, ErrUnsupportedSearch
+		}
+
+		if !l.AllowEmptyFilter && IsEmptyFilter(f) {
+			return nil, violation(ErrEmptyFilter, "AllowEmptyFilter", f, nil)
+		}
+
+		if err := l.check(f); err != nil {
+			return nil, err
+		}
+
+		if f.Limit < 1 {
+			if l.MaxLimit < 1 {
+				return nil, ErrUnspecifiedLimit
+			}
+			f.Limit = l.MaxLimit
+		}
+
+		if l.MaxLimit > 0 && f.Limit > l.MaxLimit {
+			if l.RejectOverLimit {
+				return nil, violation(ErrLimitTooHigh, "MaxLimit", f.Limit, l.MaxLimit)
+			}
+
+			f.Limit = l.MaxLimit
+			if l.Observe != nil {
+				l.Observe("MaxLimit", true)
+			}
+		}
+
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// ValidateCount enforces the limits that apply to counts, which are the number of filters and the size of each filter.
+// Counts ignore the limits of the filters, so filters without a limit, with LimitZero or without conditions are accepted,
+// and the filters are never modified.
+func (l QueryLimits) ValidateCount(filters ...nostr.Filter) error {
+	err := l.validateCount(filters...)
+
+	var v Violation
+	if l.Observe != nil && errors.As(err, &v) {
+		l.Observe(v.Limit(), false)
+	}
+	return err
+}
+
+func (l QueryLimits) validateCount(filters ...nostr.Filter) error {
+	if l.MaxFilters > 0 && len(filters) > l.MaxFilters {
+		return violation(ErrTooManyFilters, "MaxFilters", len(filters), l.MaxFilters)
+	}
+
+	for _, f := range filters {
+		if f.Search != "" {
+			return ErrUnsupportedSearch
+		}
+
+		if err := l.check(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns an error if the filter exceeds any of the limits, ignoring its limit.
+func (l QueryLimits) check(f nostr.Filter) error {
+	if l.MaxIDs > 0 && len(f.IDs) > l.MaxIDs {
+		return violation(ErrTooManyIDs, "MaxIDs", len(f.IDs), l.MaxIDs)
+	}
+
+	if l.MaxAuthors > 0 && len(f.Authors) > l.MaxAuthors {
+		return violation(ErrTooManyAuthors, "MaxAuthors", len(f.Authors), l.MaxAuthors)
+	}
+
+	if l.MaxKinds > 0 && len(f.Kinds) > l.MaxKinds {
+		return violation(ErrTooManyKinds, "MaxKinds", len(f.Kinds), l.MaxKinds)
+	}
+
+	if l.MaxTagValues > 0 {
+		values := 0
+		for _, vals := range f.Tags {
+			values += len(vals)
+		}
+
+		if values > l.MaxTagValues {
+			return violation(ErrTooManyTagValues, "MaxTagValues", values, l.MaxTagValues)
+		}
+	}
+
+	if l.MaxTimeRange > 0 && f.Since != nil {
+		until := nostr.Now()
+		if f.Until != nil {
+			until = *f.Until
+		}
+
+		width := until.Time().Sub(f.Since.Time())
+		if width > l.MaxTimeRange {
+			return violation(ErrTimeRangeTooWide, "MaxTimeRange", width, l.MaxTimeRange)
+		}
+	}
+	return nil
+}
+
+// Errors returned by [WriteLimits]. Their messages are prefixed according to NIP-01,
+// so that relays can use them directly as the reason of an OK message.
+var (
+	ErrCreatedAtInFuture = errors.New("invalid: created_at is too far in the future")
+	ErrCreatedAtInPast   = errors.New("invalid: created_at is too far in the past")
+	ErrTooManyTags       = errors.New("invalid: too many tags")
+	ErrTagTooLong        = errors.New("invalid: tag has too many elements")
+	ErrContentTooLarge   = errors.New("invalid: content is too large")
+	ErrBannedKind        = errors.New("blocked: kind is not accepted")
+	ErrInvalidID         = errors.New("invalid: event id does not match the event")
+	ErrInvalidSignature  = errors.New("invalid: signature verification failed")
+)
+
+// WriteLimits constrains the events written to a store. A zero field means no limit on that dimension.
+type WriteLimits struct {
+	MaxFutureDrift  time.Duration // the maximum distance of created_at in the future from now
+	MaxPastDrift    time.Duration // the maximum distance of created_at in the past from now
+	MaxTags         int           // the maximum number of tags
+	MaxTagLength    int           // the maximum number of elements of a tag, including the key
+	MaxContentBytes int           // the maximum size of the content in bytes
+	BannedKinds     []int         // the kinds that are refused
+
+	// VerifySignature checks the id and the signature of the event, which is expensive
+	// and only required if the events have not been verified before reaching the store.
+	VerifySignature bool
+}
+
+// Validate is an [EventPolicy] that rejects events exceeding any of the limits with the corresponding error.
+// It can be passed to the stores, e.g. sqlite.WithEventPolicy(limits.Validate).
+func (l WriteLimits) Validate(e *nostr.Event) error {
+	if slices.Contains(l.BannedKinds, e.Kind) {
+		return violation(ErrBannedKind, "BannedKinds", e.Kind, nil)
+	}
+
+	if l.MaxFutureDrift > 0 || l.MaxPastDrift > 0 {
+		drift := time.Until(e.CreatedAt.Time())
+		if l.MaxFutureDrift > 0 && drift > l.MaxFutureDrift {
+			return violation(ErrCreatedAtInFuture, "MaxFutureDrift", drift, l.MaxFutureDrift)
+		}
+
+		if l.MaxPastDrift > 0 && -drift > l.MaxPastDrift {
+			return violation(ErrCreatedAtInPast, "MaxPastDrift", -drift, l.MaxPastDrift)
+		}
+	}
+
+	if l.MaxTags > 0 && len(e.Tags) > l.MaxTags {
+		return violation(ErrTooManyTags, "MaxTags", len(e.Tags), l.MaxTags)
+	}
+
+	if l.MaxTagLength > 0 {
+		for _, tag := range e.Tags {
+			if len(tag) > l.MaxTagLength {
+				return violation(ErrTagTooLong, "MaxTagLength", len(tag), l.MaxTagLength)
+			}
+		}
+	}
+
+	if l.MaxContentBytes > 0 && len(e.Content) > l.MaxContentBytes {
+		return violation(ErrContentTooLarge, "MaxContentBytes", len(e.Content), l.MaxContentBytes)
+	}
+
+	if l.VerifySignature {
+		if !e.CheckID() {
+			return violation(ErrInvalidID, "VerifySignature", e.ID, nil)
+		}
+
+		valid, err := e.CheckSignature()
+		if err != nil {
+			return fmt.Errorf("%w: %w", violation(ErrInvalidSignature, "VerifySignature", e.ID, nil), err)
+		}
+
+		if !valid {
+			return violation(ErrInvalidSignature, "VerifySignature", e.ID, nil)
+		}
+	}
+	return nil
+}
+
+// IsEmptyFilter reports whether the filter has no conditions, meaning it matches all events.
+// The limit and the search are not conditions.
+func IsEmptyFilter(f nostr.Filter) bool {
+	if len(f.IDs) > 0 || len(f.Authors) > 0 || len(f.Kinds) > 0 || f.Since != nil || f.Until != nil {
+		return false
+	}
+
+	for _, vals := range f.Tags {
+		if len(vals) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WithLimits returns a [Store] that enforces the limits before calling the store, so that
+// backends without limits of their own get the same protection.
+// Filters are validated with [QueryLimits.Validate], or [QueryLimits.ValidateCount] when counting,
+// and events with [WriteLimits.Validate].
+func WithLimits(store Store, queries QueryLimits, writes WriteLimits) Store {
+	return limited{Store: store, queries: queries, writes: writes}
+}
+
+type limited struct {
+	Store
+	queries QueryLimits
+	writes  WriteLimits
+}
+
+func (l limited) Save(ctx context.Context, event *nostr.Event) error {
+	if err := l.writes.Validate(event); err != nil {
+		return err
+	}
+	return l.Store.Save(ctx, event)
+}
+
+func (l limited) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if err := l.writes.Validate(event); err != nil {
+		return false, err
+	}
+	return l.Store.Replace(ctx, event)
+}
+
+func (l limited) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := l.queries.Validate(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return l.Store.Query(ctx, filters...)
+}
+
+func (l limited) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if err := l.queries.ValidateCount(filters...); err != nil {
+		return 0, err
+	}
+	return l.Store.Count(ctx, filters...)
+}
+
+// Violation is implemented by the errors of [QueryLimits] and [WriteLimits], so that relays can build
+// machine-readable rejections with errors.As. Each violation also wraps one of the sentinel errors, e.g. [ErrTooManyKinds].
+type Violation interface {
+	error
+
+	// Limit is the name of the violated field of [QueryLimits] or [WriteLimits], e.g. "MaxKinds".
+	Limit() string
+
+	// Value is the offending value, e.g. the number of kinds of the filter.
+	Value() any
+
+	// Max is the configured limit, or nil for limits that are not a maximum (e.g. "BannedKinds").
+	Max() any
+}
+
+type limitError struct {
+	err   error
+	limit string
+	value any
+	max   any
+}
+
+// violation returns a [Violation] of the limit that wraps the sentinel error.
+func violation(err error, limit string, value, max any) error {
+	return &limitError{err: err, limit: limit, value: value, max: max}
+}
+
+func (e *limitError) Limit() string { return e.limit }
+func (e *limitError) Value() any    { return e.value }
+func (e *limitError) Max() any      { return e.max }
+func (e *limitError) Unwrap() error { return e.err }
+
+func (e *limitError) Error() string {
+	if e.max == nil {
+		return fmt.Sprintf("%v: %v", e.err, e.value)
+	}
+	return fmt.Sprintf("%v: %v, max is %v", e.err, e.value, e.max)
+}
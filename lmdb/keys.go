@@ -0,0 +1,47 @@
+package lmdb
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// The store keeps each event in the events database, and a set of empty index keys pointing to it
+// in the indexes database. The time, kind, pubkey, tag and address keys are shared with the other
+// key-value stores, see the kvcodec package.
+//
+//	time      't' | created_at (8) | id (32)
+//	kind      'k' | kind (2) | created_at (8) | id (32)
+//	pubkey    'p' | pubkey (32) | created_at (8) | id (32)
+//	tag       'g' | len(key) (1) | key | len(value) (2) | value | created_at (8) | id (32)
+//	address   'a' | kind (2) | pubkey (32) | d-tag                         -> id (32)
+//	meta      'm' | name                                                   -> value
+//
+// The address key points to the latest replaceable or addressable event of its category.
+// Meta keys hold the state of the store, such as the progress of [Store.Sync] in the strfry layout.
+const (
+	prefixTime      = kvcodec.PrefixTime
+	prefixMeta byte = 'm'
+)
+
+const (
+	idSize     = kvcodec.IDSize
+	pubkeySize = kvcodec.PubkeySize
+
+	maxKind      = kvcodec.MaxKind
+	maxCreatedAt = kvcodec.MaxCreatedAt
+)
+
+func metaKey(name string) []byte {
+	return append([]byte{prefixMeta}, name...)
+}
+
+// isIndexed returns whether the tag value with the provided key is indexed.
+// Following NIP-01, only single-letter tags are indexed.
+func isIndexed(key, value string) bool {
+	return len(key) == 1 && len(value) <= kvcodec.MaxIndexedValue
+}
+
+// indexKeys returns all the index keys of the event, whose id and pubkey are already decoded.
+func indexKeys(e *nostr.Event, id, pubkey []byte) [][]byte {
+	return kvcodec.IndexKeys(e, id, pubkey, isIndexed)
+}
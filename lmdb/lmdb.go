@@ -0,0 +1,665 @@
+// The lmdb package defines an event store for Nostr built on LMDB, a memory-mapped B+tree database.
+//
+// LMDB allows a single writer and many lock-free readers, also across processes, which makes it a good fit
+// for relays where many processes (e.g. a relay and its tooling) share the same database on one machine.
+// The key layout is described in keys.go. With [WithStrfryLayout], the store reads the events of a strfry database instead,
+// see strfry.go.
+package lmdb
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// DefaultMapSize is the default maximum size of the database in bytes. LMDB reserves the address space up front,
+// but the file only grows as data is written, so the map size can be much larger than the disk.
+const DefaultMapSize int64 = 1 << 36
+
+// maxDBs is the number of named databases of the environment, see [Store.open].
+const maxDBs = 4
+
+// Store of Nostr events that uses an LMDB environment.
+// It embeds the *lmdb.Env for direct interaction, e.g. to call Close or Stat.
+type Store struct {
+	*lmdb.Env
+
+	mapSize    int64
+	maxReaders int
+	flags      uint
+	strfry     bool // whether the store reads a strfry database, see [WithStrfryLayout]
+
+	events  lmdb.DBI // id -> event JSON, or levId -> strfry payload in the strfry layout
+	ids     lmdb.DBI // id -> levId, only in the strfry layout
+	indexes lmdb.DBI // the index keys described in keys.go
+
+	validateEvent   nastro.EventPolicy
+	sanitizeFilters nastro.FilterPolicy
+}
+
+type Option func(*Store) error
+
+// WithMapSize sets the maximum size of the database in bytes, which defaults to [DefaultMapSize].
+// Writes fail with MDB_MAP_FULL once the database reaches it.
+func WithMapSize(size int64) Option {
+	return func(s *Store) error {
+		if size < 1<<20 {
+			return fmt.Errorf("map size must be at least 1MB, got %d", size)
+		}
+		s.mapSize = size
+		return nil
+	}
+}
+
+// WithMaxReaders sets the maximum number of concurrent read transactions, across all processes.
+// It only has effect if the store is the first process to open the environment.
+func WithMaxReaders(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("max readers must be positive")
+		}
+		s.maxReaders = n
+		return nil
+	}
+}
+
+// WithNoSync doesn't flush the data to disk after every write transaction.
+// Writes are much faster, but the last transactions might be lost if the system crashes.
+func WithNoSync() Option {
+	return func(s *Store) error {
+		s.flags |= lmdb.NoSync
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before executing queries.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before inserting them into the database.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns an LMDB store located in the directory at the provided path, which is created if needed.
+func New(path string, opts ...Option) (*Store, error) {
+	store := &Store{
+		mapSize:         DefaultMapSize,
+		validateEvent:   func(*nostr.Event) error { return nil },
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := store.open(path); err != nil {
+		return nil, fmt.Errorf("failed to open lmdb at %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// open the environment at the path and the named databases of the layout.
+func (s *Store) open(path string) error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+
+	if err := env.SetMaxDBs(maxDBs); err != nil {
+		env.Close()
+		return err
+	}
+
+	if err := env.SetMapSize(s.mapSize); err != nil {
+		env.Close()
+		return err
+	}
+
+	if s.maxReaders > 0 {
+		if err := env.SetMaxReaders(s.maxReaders); err != nil {
+			env.Close()
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		env.Close()
+		return err
+	}
+
+	if err := env.Open(path, s.flags, 0o644); err != nil {
+		env.Close()
+		return err
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		if s.strfry {
+			return s.openStrfry(txn)
+		}
+
+		if s.events, err = txn.OpenDBI("events", lmdb.Create); err != nil {
+			return err
+		}
+		s.indexes, err = txn.OpenDBI("indexes", lmdb.Create)
+		return err
+	})
+
+	if err != nil {
+		env.Close()
+		return err
+	}
+
+	s.Env = env
+	return nil
+}
+
+// Save the event in the store. If the event is already stored, nothing happens and nil is returned.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if s.strfry {
+		return ErrReadOnly
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	err := s.Env.Update(func(txn *lmdb.Txn) error {
+		_, err := s.insert(txn, event)
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save event with ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// insert the event and its index keys within the transaction, reporting whether the event was inserted.
+// If the event was already present, or it's past its NIP-40 expiration, nothing is written.
+func (s *Store) insert(txn *lmdb.Txn, event *nostr.Event) (bool, error) {
+	if isExpired(event, time.Now()) {
+		return false, nil
+	}
+
+	id := make([]byte, idSize)
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(id, event.ID); err != nil {
+		return false, fmt.Errorf("invalid id: %w", err)
+	}
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return false, fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	_, err := txn.Get(s.events, id)
+	if err == nil {
+		return false, nil
+	}
+	if !lmdb.IsNotFound(err) {
+		return false, err
+	}
+
+	value, err := event.MarshalJSON()
+	if err != nil {
+		return false, err
+	}
+
+	if err := txn.Put(s.events, id, value, 0); err != nil {
+		return false, err
+	}
+
+	if err := s.index(txn, event, id, pubkey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// index writes the index keys of the event, and points its address to it if it's the latest of its category.
+func (s *Store) index(txn *lmdb.Txn, event *nostr.Event, id, pubkey []byte) error {
+	for _, key := range indexKeys(event, id, pubkey) {
+		if err := txn.Put(s.indexes, key, nil, 0); err != nil {
+			return err
+		}
+	}
+
+	if !nastro.IsValidReplacement(event.Kind) {
+		return nil
+	}
+
+	address := kvcodec.AddressOf(event, pubkey)
+	latest, err := s.latest(txn, address)
+	if err != nil {
+		return err
+	}
+
+	if latest == nil || event.CreatedAt > latest.CreatedAt {
+		return txn.Put(s.indexes, address, id, 0)
+	}
+	return nil
+}
+
+// latest returns the event the address key points to, or nil if there is none.
+func (s *Store) latest(txn *lmdb.Txn, address []byte) (*nostr.Event, error) {
+	id, err := txn.Get(s.indexes, address)
+	if lmdb.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.get(txn, id)
+}
+
+// get returns the event with the provided id, or nil if it's not stored.
+func (s *Store) get(txn *lmdb.Txn, id []byte) (*nostr.Event, error) {
+	key := id
+	if s.strfry {
+		levID, err := txn.Get(s.ids, id)
+		if lmdb.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = levID
+	}
+
+	value, err := txn.Get(s.events, key)
+	if lmdb.IsNotFound(err) {
+		// in the strfry layout, the event might have been deleted by strfry
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.strfry {
+		if value, err = payloadJSON(value); err != nil {
+			return nil, fmt.Errorf("event with ID %x: %w", id, err)
+		}
+	}
+
+	event := &nostr.Event{}
+	if err := event.UnmarshalJSON(value); err != nil {
+		return nil, fmt.Errorf("failed to decode event with ID %x: %w", id, err)
+	}
+	return event, nil
+}
+
+// remove the event and its index keys within the transaction.
+// The address key is removed only if it points to the event.
+func (s *Store) remove(txn *lmdb.Txn, event *nostr.Event) error {
+	id := make([]byte, idSize)
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(id, event.ID); err != nil {
+		return fmt.Errorf("invalid id: %w", err)
+	}
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	if err := del(txn, s.events, id); err != nil {
+		return err
+	}
+
+	for _, key := range indexKeys(event, id, pubkey) {
+		if err := del(txn, s.indexes, key); err != nil {
+			return err
+		}
+	}
+
+	if !nastro.IsValidReplacement(event.Kind) {
+		return nil
+	}
+
+	address := kvcodec.AddressOf(event, pubkey)
+	latest, err := txn.Get(s.indexes, address)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(latest, id) {
+		return del(txn, s.indexes, address)
+	}
+	return nil
+}
+
+// del removes the key from the database, ignoring whether it was there.
+func del(txn *lmdb.Txn, dbi lmdb.DBI, key []byte) error {
+	if err := txn.Del(dbi, key, nil); err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Delete the event with the provided id. If the event is not found, nothing happens and nil is returned.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if s.strfry {
+		return ErrReadOnly
+	}
+
+	key := make([]byte, idSize)
+	if err := kvcodec.DecodeHex(key, id); err != nil {
+		// no event can be stored under an invalid id
+		return nil
+	}
+
+	err := s.Env.Update(func(txn *lmdb.Txn) error {
+		event, err := s.get(txn, key)
+		if err != nil || event == nil {
+			return err
+		}
+		return s.remove(txn, event)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to delete event with ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+// LMDB serializes write transactions, so concurrent replacements of the same category are safe, also across processes.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if s.strfry {
+		return false, ErrReadOnly
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return false, fmt.Errorf("failed to replace event with ID %s: invalid pubkey: %w", event.ID, err)
+	}
+
+	var replaced bool
+	err := s.Env.Update(func(txn *lmdb.Txn) error {
+		old, err := s.latest(txn, kvcodec.AddressOf(event, pubkey))
+		if err != nil {
+			return err
+		}
+
+		if old != nil {
+			if old.CreatedAt >= event.CreatedAt {
+				return nil
+			}
+
+			if err := s.remove(txn, old); err != nil {
+				return err
+			}
+		}
+
+		replaced, err = s.insert(txn, event)
+		return err
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event with ID %s: %w", event.ID, err)
+	}
+	return replaced, nil
+}
+
+// Query stored events matching the provided filters, sorted by created_at descending and id ascending.
+// Events matching more than one filter are returned once.
+// All the filters are executed in the same read transaction, so they see the same snapshot of the store.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []nostr.Event
+	err = s.Env.View(func(txn *lmdb.Txn) error {
+		for i, filter := range filters {
+			result, err := s.query(ctx, txn, filter)
+			if err != nil {
+				return fmt.Errorf("failed to query filter %d: %w", i, err)
+			}
+			events = append(events, result...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+
+	slices.SortFunc(events, compare)
+	return slices.CompactFunc(events, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID }), nil
+}
+
+// Count stored events matching the provided filters, returning the sum of the counts of each filter.
+// The limits of the filters are ignored.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var count int64
+	err := s.Env.View(func(txn *lmdb.Txn) error {
+		for i, filter := range filters {
+			filter.Limit, filter.LimitZero = 0, false
+			matches, err := s.query(ctx, txn, filter)
+			if err != nil {
+				return fmt.Errorf("failed to count filter %d: %w", i, err)
+			}
+			count += int64(len(matches))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return count, nil
+}
+
+// query returns the events matching the filter, sorted with [compare] and truncated to the filter's limit.
+// A limit of zero means no limit, unless LimitZero is set.
+func (s *Store) query(ctx context.Context, txn *lmdb.Txn, filter nostr.Filter) ([]nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
+	}
+
+	var events []nostr.Event
+
+	if len(filter.IDs) > 0 {
+		for _, ID := range filter.IDs {
+			id := make([]byte, idSize)
+			if err := kvcodec.DecodeHex(id, ID); err != nil {
+				continue
+			}
+
+			event, err := s.get(txn, id)
+			if err != nil {
+				return nil, err
+			}
+
+			if event != nil && matches(filter, event) {
+				events = append(events, *event)
+			}
+		}
+	} else {
+		for _, prefix := range plan(filter) {
+			matches, err := s.scan(ctx, txn, prefix, filter)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, matches...)
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	events = slices.CompactFunc(events, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID })
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// scan the index keys with the prefix from the newest to the oldest within the filter's time range,
+// and returns the events matching the filter, up to the filter's limit.
+func (s *Store) scan(ctx context.Context, txn *lmdb.Txn, prefix []byte, filter nostr.Filter) ([]nostr.Event, error) {
+	var since, until uint64 = 0, maxCreatedAt
+	if filter.Since != nil {
+		since = kvcodec.Timestamp(*filter.Since)
+	}
+	if filter.Until != nil {
+		until = kvcodec.Timestamp(*filter.Until)
+	}
+
+	cursor, err := txn.OpenCursor(s.indexes)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	// position the cursor on the first key after the range, and walk backwards from there
+	key, _, err := cursor.Get(kvcodec.SeekKey(prefix, until), nil, lmdb.SetRange)
+	switch {
+	case lmdb.IsNotFound(err):
+		key, _, err = cursor.Get(nil, nil, lmdb.Last)
+	case err == nil:
+		key, _, err = cursor.Get(nil, nil, lmdb.Prev)
+	}
+
+	var events []nostr.Event
+	var full bool   // whether the limit has been reached
+	var last uint64 // the created_at of the event that reached the limit
+
+	for ; err == nil && bytes.HasPrefix(key, prefix); key, _, err = cursor.Get(nil, nil, lmdb.Prev) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		createdAt, id := kvcodec.ParseSuffix(key)
+		if createdAt < since || (full && createdAt != last) {
+			// the remaining events with the same created_at might sort before the last one by id, so they are included
+			break
+		}
+
+		event, err := s.get(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if event == nil || !matches(filter, event) {
+			continue
+		}
+
+		events = append(events, *event)
+		if filter.Limit > 0 && len(events) >= filter.Limit && !full {
+			full, last = true, createdAt
+		}
+	}
+
+	if err != nil && !lmdb.IsNotFound(err) {
+		return nil, err
+	}
+	return events, nil
+}
+
+// plan returns the prefixes of the index keys to scan for the filter, using the most selective index available.
+// Authors are preferred, followed by tags with the fewest values, kinds, and lastly the time index.
+// The other conditions of the filter are checked on the events.
+func plan(filter nostr.Filter) [][]byte {
+	if len(filter.Authors) > 0 {
+		prefixes := make([][]byte, 0, len(filter.Authors))
+		for _, author := range filter.Authors {
+			pubkey := make([]byte, pubkeySize)
+			if err := kvcodec.DecodeHex(pubkey, author); err != nil {
+				// no event can match an invalid pubkey
+				continue
+			}
+			prefixes = append(prefixes, kvcodec.PubkeyPrefix(pubkey))
+		}
+		return prefixes
+	}
+
+	var key string
+	var values []string
+	for k, v := range filter.Tags {
+		if len(v) == 0 || slices.ContainsFunc(v, func(value string) bool { return !isIndexed(k, value) }) {
+			// events matching a value that isn't indexed would be missed
+			continue
+		}
+
+		if values == nil || len(v) < len(values) || (len(v) == len(values) && k < key) {
+			key, values = k, v
+		}
+	}
+
+	if values != nil {
+		prefixes := make([][]byte, 0, len(values))
+		for _, value := range values {
+			prefixes = append(prefixes, kvcodec.TagPrefix(key, value))
+		}
+		return prefixes
+	}
+
+	if len(filter.Kinds) > 0 {
+		prefixes := make([][]byte, 0, len(filter.Kinds))
+		for _, kind := range filter.Kinds {
+			if kind >= 0 && kind <= maxKind {
+				prefixes = append(prefixes, kvcodec.KindPrefix(kind))
+			}
+		}
+		return prefixes
+	}
+
+	return [][]byte{{prefixTime}}
+}
+
+// matches returns whether the event matches the filter.
+// Events past their NIP-40 expiration never match.
+func matches(filter nostr.Filter, event *nostr.Event) bool {
+	return filter.Matches(event) && !isExpired(event, time.Now())
+}
+
+// isExpired returns whether the event has a NIP-40 expiration that is not after the provided time.
+func isExpired(event *nostr.Event, now time.Time) bool {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "expiration" {
+			continue
+		}
+
+		expiration, err := strconv.ParseInt(tag[1], 10, 64)
+		return err == nil && expiration <= now.Unix()
+	}
+	return false
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
@@ -0,0 +1,246 @@
+package lmdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var ctx = context.Background()
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newEvent(pubkey string, kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	return &nostr.Event{
+		ID:        randHex(32),
+		PubKey:    pubkey,
+		Kind:      kind,
+		CreatedAt: createdAt,
+		Tags:      tags,
+		Content:   "hello",
+		Sig:       randHex(64),
+	}
+}
+
+func newStore(t *testing.T, opts ...Option) *Store {
+	store, err := New(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
+
+func TestSaveAndQuery(t *testing.T) {
+	store := newStore(t)
+	alice, bob := randHex(32), randHex(32)
+	events := []*nostr.Event{
+		newEvent(alice, 1, 1, nostr.Tag{"e", "xxx"}),
+		newEvent(bob, 1, 2, nostr.Tag{"p", "xxx"}),
+		newEvent(bob, 7, 3),
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// saving twice is a no-op
+	if err := store.Save(ctx, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"e": {"xxx"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || !reflect.DeepEqual(results[0], *events[0]) {
+		t.Fatalf("expected event %v, got %v", events[0], results)
+	}
+
+	results, err = store.Query(ctx, nostr.Filter{Authors: []string{bob}, Limit: 10}, nostr.Filter{Kinds: []int{7}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != events[2].ID || results[1].ID != events[1].ID {
+		t.Fatalf("expected the events of bob, got %v", results)
+	}
+
+	results, err = store.Query(ctx, nostr.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].ID != events[2].ID {
+		t.Fatalf("expected the latest event, got %v", results)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Authors: []string{bob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Fatalf("expected count 4, got %d", count)
+	}
+
+	if err := store.Delete(ctx, events[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err = store.Count(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected count 2 after the deletion, got %d", count)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	store := newStore(t)
+	alice := randHex(32)
+
+	steps := []struct {
+		event    *nostr.Event
+		replaced bool
+	}{
+		{event: newEvent(alice, 0, 2), replaced: true},
+		{event: newEvent(alice, 0, 1), replaced: false},
+		{event: newEvent(alice, 0, 3), replaced: true},
+		{event: newEvent(alice, 30023, 1, nostr.Tag{"d", "post"}), replaced: true},
+	}
+
+	for _, step := range steps {
+		replaced, err := store.Replace(ctx, step.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if replaced != step.replaced {
+			t.Fatalf("event %s: expected replaced %v, got %v", step.event.ID, step.replaced, replaced)
+		}
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Authors: []string{alice}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != steps[2].event.ID || results[1].ID != steps[3].event.ID {
+		t.Fatalf("expected the latest profile and the post, got %v", results)
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{Kind: 1}); !errors.Is(err, nastro.ErrInvalidReplacement) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrInvalidReplacement, err)
+	}
+}
+
+func TestStrfryLayout(t *testing.T) {
+	path := t.TempDir()
+	alice := randHex(32)
+	events := []*nostr.Event{
+		newEvent(alice, 1, 1),
+		newEvent(alice, 1, 2),
+		newEvent(alice, 1, 3),
+	}
+
+	// write the payloads the way strfry does, before opening the store,
+	// as an environment must not be opened twice by the same process
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.SetMaxDBs(maxDBs)
+	if err := env.Open(path, 0, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.OpenDBI(payloadDB, lmdb.Create|lmdb.IntegerKey)
+		if err != nil {
+			return err
+		}
+
+		for i, event := range events[:2] {
+			data, _ := event.MarshalJSON()
+			if err := txn.Put(dbi, levKey(uint64(i+1)), append([]byte{payloadRaw}, data...), 0); err != nil {
+				return err
+			}
+		}
+		return txn.Put(dbi, levKey(3), []byte{payloadCompressed, 0, 0, 0, 1}, 0)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Close()
+
+	store, err := New(path, WithStrfryLayout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	stats, err := store.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := SyncStats{Indexed: 2, Compressed: 1, LastLevID: 3}
+	if stats != expected {
+		t.Fatalf("expected stats %v, got %v", expected, stats)
+	}
+
+	// strfry keeps writing while the store is open
+	data, _ := events[2].MarshalJSON()
+	err = store.Update(func(txn *lmdb.Txn) error {
+		return txn.Put(store.events, levKey(4), append([]byte{payloadRaw}, data...), 0)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats, err = store.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Indexed != 1 || stats.LastLevID != 4 {
+		t.Fatalf("expected to index the new event, got %v", stats)
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Authors: []string{alice}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 3 || results[0].ID != events[2].ID || results[2].ID != events[0].ID {
+		t.Fatalf("expected the events of alice, got %v", results)
+	}
+
+	if err := store.Save(ctx, newEvent(alice, 1, 4)); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected error %v, got %v", ErrReadOnly, err)
+	}
+}
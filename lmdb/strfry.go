@@ -0,0 +1,222 @@
+package lmdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro/internal/kvcodec"
+)
+
+// strfry keeps the JSON of every event in the EventPayload database, under a sequential 64-bit levId
+// in native byte order. The first byte of a payload tells how the rest is encoded:
+//
+//	0x00 | JSON
+//	0x01 | dictionary id (4) | zstd-compressed JSON
+//
+// strfry's own indexes use custom LMDB comparators that can't be registered from Go, so the store
+// doesn't read them. Instead, [Store.Sync] builds the nastro indexes of the events in their own databases,
+// next to strfry's in the same environment:
+//
+//	nastro_ids      id (32) -> levId (8)
+//	nastro_indexes  the index keys described in keys.go
+const (
+	payloadDB = "EventPayload"
+	idsDB     = "nastro_ids"
+	indexesDB = "nastro_indexes"
+
+	payloadRaw        byte = 0x00
+	payloadCompressed byte = 0x01
+)
+
+// syncBatchSize is the number of payloads indexed in each write transaction of [Store.Sync],
+// so that strfry is not blocked from writing for too long.
+const syncBatchSize = 10_000
+
+var (
+	ErrReadOnly   = errors.New("the store uses the strfry layout, which is only written by strfry")
+	ErrCompressed = errors.New("the strfry payload is zstd-compressed, which is not supported")
+)
+
+// WithStrfryLayout opens the strfry database at the path (e.g. "./strfry-db"), instead of a nastro one.
+// The store can query the events written by strfry once they have been indexed with [Store.Sync],
+// while strfry keeps running on the same database, e.g. to migrate from strfry or to run nastro-based tooling on its data.
+//
+// strfry remains the only writer of the events, so Save, Replace and Delete return [ErrReadOnly].
+// Events compressed with "strfry compact" are not supported and are skipped by [Store.Sync].
+func WithStrfryLayout() Option {
+	return func(s *Store) error {
+		s.strfry = true
+		return nil
+	}
+}
+
+// openStrfry opens strfry's payload database, which must exist, and creates the nastro indexes next to it.
+func (s *Store) openStrfry(txn *lmdb.Txn) (err error) {
+	if s.events, err = txn.OpenDBI(payloadDB, lmdb.IntegerKey); err != nil {
+		return fmt.Errorf("failed to open strfry's %s: %w", payloadDB, err)
+	}
+
+	if s.ids, err = txn.OpenDBI(idsDB, lmdb.Create); err != nil {
+		return err
+	}
+	s.indexes, err = txn.OpenDBI(indexesDB, lmdb.Create)
+	return err
+}
+
+// SyncStats summarizes a call to [Store.Sync].
+type SyncStats struct {
+	Indexed    int    // the number of events indexed
+	Compressed int    // the number of compressed payloads that were skipped
+	LastLevID  uint64 // the levId of the last payload synced, after which the next sync starts
+}
+
+// Sync indexes the events strfry wrote since the previous sync, so that the store can query them.
+// It's safe to call while strfry is running, and it should be called periodically to follow strfry's writes.
+// Events deleted or replaced by strfry are not returned by queries, even before the next sync.
+//
+// Sync must only be called on stores opened with [WithStrfryLayout].
+func (s *Store) Sync(ctx context.Context) (SyncStats, error) {
+	if !s.strfry {
+		return SyncStats{}, errors.New("sync requires the strfry layout")
+	}
+
+	var stats SyncStats
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		var done bool
+		err := s.Env.Update(func(txn *lmdb.Txn) (err error) {
+			done, err = s.syncBatch(txn, &stats)
+			return err
+		})
+
+		if err != nil {
+			return stats, fmt.Errorf("failed to sync strfry's events: %w", err)
+		}
+
+		if done {
+			return stats, nil
+		}
+	}
+}
+
+// syncBatch indexes up to [syncBatchSize] payloads after the last synced levId, reporting whether there are no more.
+func (s *Store) syncBatch(txn *lmdb.Txn, stats *SyncStats) (bool, error) {
+	last, err := s.lastLevID(txn)
+	if err != nil {
+		return false, err
+	}
+
+	cursor, err := txn.OpenCursor(s.events)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+
+	key, value, err := cursor.Get(levKey(last+1), nil, lmdb.SetRange)
+	for n := 0; n < syncBatchSize; n++ {
+		if lmdb.IsNotFound(err) {
+			return true, s.setLastLevID(txn, last)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		last = binary.NativeEndian.Uint64(key)
+		stats.LastLevID = last
+
+		indexed, syncErr := s.syncPayload(txn, key, value)
+		switch {
+		case errors.Is(syncErr, ErrCompressed):
+			stats.Compressed++
+
+		case syncErr != nil:
+			return false, fmt.Errorf("levId %d: %w", last, syncErr)
+
+		case indexed:
+			stats.Indexed++
+		}
+
+		key, value, err = cursor.Get(nil, nil, lmdb.Next)
+	}
+	return false, s.setLastLevID(txn, last)
+}
+
+// syncPayload indexes the event of the payload stored under the levId, unless it's already indexed.
+func (s *Store) syncPayload(txn *lmdb.Txn, levID, payload []byte) (bool, error) {
+	data, err := payloadJSON(payload)
+	if err != nil {
+		return false, err
+	}
+
+	event := &nostr.Event{}
+	if err := event.UnmarshalJSON(data); err != nil {
+		return false, fmt.Errorf("failed to decode the payload: %w", err)
+	}
+
+	id := make([]byte, idSize)
+	pubkey := make([]byte, pubkeySize)
+	if err := kvcodec.DecodeHex(id, event.ID); err != nil {
+		return false, fmt.Errorf("invalid id: %w", err)
+	}
+	if err := kvcodec.DecodeHex(pubkey, event.PubKey); err != nil {
+		return false, fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	_, err = txn.Get(s.ids, id)
+	if err == nil {
+		return false, nil
+	}
+	if !lmdb.IsNotFound(err) {
+		return false, err
+	}
+
+	if err := txn.Put(s.ids, id, levID, 0); err != nil {
+		return false, err
+	}
+	return true, s.index(txn, event, id, pubkey)
+}
+
+func (s *Store) lastLevID(txn *lmdb.Txn) (uint64, error) {
+	value, err := txn.Get(s.indexes, metaKey("levId"))
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func (s *Store) setLastLevID(txn *lmdb.Txn, levID uint64) error {
+	return txn.Put(s.indexes, metaKey("levId"), binary.BigEndian.AppendUint64(nil, levID), 0)
+}
+
+// levKey returns the key of the levId in strfry's payload database.
+func levKey(levID uint64) []byte {
+	return binary.NativeEndian.AppendUint64(nil, levID)
+}
+
+// payloadJSON returns the JSON of the event in the strfry payload.
+func payloadJSON(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty strfry payload")
+	}
+
+	switch payload[0] {
+	case payloadRaw:
+		return payload[1:], nil
+
+	case payloadCompressed:
+		return nil, ErrCompressed
+
+	default:
+		return nil, fmt.Errorf("unknown strfry payload encoding %#x", payload[0])
+	}
+}
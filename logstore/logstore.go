@@ -0,0 +1,233 @@
+// The logstore package defines a middleware that logs the operations of a store with a [slog.Logger],
+// with their duration, a summary of their filters and the class of their errors.
+//
+//	store := nastro.Chain(sqliteStore, logstore.Middleware(slog.Default(), logstore.WithSlowThreshold(time.Second)))
+//
+// Errors are classified as:
+//   - "rejected": the operation was refused by the policies of the store, see [nastro.Rejection]
+//   - "canceled": the context of the operation was canceled or its deadline exceeded
+//   - "internal": any other failure of the store
+package logstore
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Classes of the errors of the operations.
+const (
+	ClassRejected = "rejected"
+	ClassCanceled = "canceled"
+	ClassInternal = "internal"
+)
+
+// Store wraps a [nastro.Store], logging its operations.
+type Store struct {
+	nastro.Store
+	logger *slog.Logger
+
+	levels map[nastro.Operation]slog.Level // the level of the successful operations
+	errors map[string]slog.Level           // the level of the failed operations, by class
+	slow   time.Duration
+}
+
+type Option func(*Store)
+
+// WithLevel sets the level of the successful operations of the kind. The default is [slog.LevelDebug].
+func WithLevel(op nastro.Operation, level slog.Level) Option {
+	return func(s *Store) {
+		s.levels[op] = level
+	}
+}
+
+// WithErrorLevel sets the level of the failed operations whose error has the class, e.g. [ClassRejected].
+// The defaults are [slog.LevelInfo] for rejected and canceled operations, and [slog.LevelError] for internal errors.
+func WithErrorLevel(class string, level slog.Level) Option {
+	return func(s *Store) {
+		s.errors[class] = level
+	}
+}
+
+// WithSlowThreshold logs the successful operations that take longer than d at [slog.LevelWarn] at least,
+// so that slow queries are visible without logging every operation.
+func WithSlowThreshold(d time.Duration) Option {
+	return func(s *Store) {
+		s.slow = d
+	}
+}
+
+// New returns a store that logs the operations of the store with the logger.
+func New(store nastro.Store, logger *slog.Logger, opts ...Option) *Store {
+	s := &Store{
+		Store:  store,
+		logger: logger,
+		levels: make(map[nastro.Operation]slog.Level),
+		errors: map[string]slog.Level{
+			ClassRejected: slog.LevelInfo,
+			ClassCanceled: slog.LevelInfo,
+			ClassInternal: slog.LevelError,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New].
+func Middleware(logger *slog.Logger, opts ...Option) nastro.Middleware {
+	return func(store nastro.Store) nastro.Store {
+		return New(store, logger, opts...)
+	}
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	start := time.Now()
+	err := s.Store.Save(ctx, event)
+	s.log(ctx, nastro.OpSave, start, err, eventAttrs(event)...)
+	return err
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	start := time.Now()
+	replaced, err := s.Store.Replace(ctx, event)
+	s.log(ctx, nastro.OpReplace, start, err, append(eventAttrs(event), slog.Bool("replaced", replaced))...)
+	return replaced, err
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.Store.Delete(ctx, id)
+	s.log(ctx, nastro.OpDelete, start, err, slog.String("id", id))
+	return err
+}
+
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	start := time.Now()
+	events, err := s.Store.Query(ctx, filters...)
+	s.log(ctx, nastro.OpQuery, start, err, slog.String("filters", Summary(filters...)), slog.Int("events", len(events)))
+	return events, err
+}
+
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	start := time.Now()
+	count, err := s.Store.Count(ctx, filters...)
+	s.log(ctx, nastro.OpCount, start, err, slog.String("filters", Summary(filters...)), slog.Int64("count", count))
+	return count, err
+}
+
+func (s *Store) log(ctx context.Context, op nastro.Operation, start time.Time, err error, attrs ...slog.Attr) {
+	took := time.Since(start)
+	level, ok := s.levels[op]
+	if !ok {
+		level = slog.LevelDebug
+	}
+
+	if err == nil && s.slow > 0 && took > s.slow {
+		level = max(level, slog.LevelWarn)
+	}
+
+	if err != nil {
+		class := Classify(err)
+		level = s.errors[class]
+		attrs = append(attrs, slog.String("error", err.Error()), slog.String("class", class))
+	}
+
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs = append(attrs, slog.Duration("took", took))
+	s.logger.LogAttrs(ctx, level, "nastro "+string(op), attrs...)
+}
+
+// Classify returns the class of the error of an operation: [ClassRejected], [ClassCanceled] or [ClassInternal].
+func Classify(err error) string {
+	if _, ok := nastro.Rejection(err); ok {
+		return ClassRejected
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassCanceled
+	}
+	return ClassInternal
+}
+
+func eventAttrs(event *nostr.Event) []slog.Attr {
+	return []slog.Attr{
+		slog.String("id", event.ID),
+		slog.Int("kind", event.Kind),
+		slog.String("pubkey", event.PubKey),
+	}
+}
+
+// Summary returns a short description of the filters, with the kinds, the limit and the time range,
+// but only the number of ids, authors and tag values, which might be many.
+//
+//	{kinds:[1 7] authors:3 #e:2 since:1700000000 limit:50}, {ids:1 limit:1}
+func Summary(filters ...nostr.Filter) string {
+	var b strings.Builder
+	for i, f := range filters {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+
+		var fields []string
+		if len(f.Kinds) > 0 {
+			kinds := make([]string, len(f.Kinds))
+			for i, k := range f.Kinds {
+				kinds[i] = strconv.Itoa(k)
+			}
+			fields = append(fields, "kinds:["+strings.Join(kinds, " ")+"]")
+		}
+
+		if len(f.IDs) > 0 {
+			fields = append(fields, "ids:"+strconv.Itoa(len(f.IDs)))
+		}
+
+		if len(f.Authors) > 0 {
+			fields = append(fields, "authors:"+strconv.Itoa(len(f.Authors)))
+		}
+
+		keys := make([]string, 0, len(f.Tags))
+		for key := range f.Tags {
+			keys = append(keys, key)
+		}
+
+		slices.Sort(keys)
+		for _, key := range keys {
+			fields = append(fields, "#"+key+":"+strconv.Itoa(len(f.Tags[key])))
+		}
+
+		if f.Since != nil {
+			fields = append(fields, "since:"+strconv.FormatInt(int64(*f.Since), 10))
+		}
+
+		if f.Until != nil {
+			fields = append(fields, "until:"+strconv.FormatInt(int64(*f.Until), 10))
+		}
+
+		if f.Search != "" {
+			fields = append(fields, "search")
+		}
+
+		switch {
+		case f.LimitZero:
+			fields = append(fields, "limit:0")
+		case f.Limit > 0:
+			fields = append(fields, "limit:"+strconv.Itoa(f.Limit))
+		}
+
+		b.WriteString("{" + strings.Join(fields, " ") + "}")
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package logstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newBackend(t *testing.T) *ephemeral.Store {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return New(newBackend(t), slog.New(slog.DiscardHandler))
+	})
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	store := nastro.Chain(newBackend(t),
+		Middleware(logger, WithLevel(nastro.OpSave, slog.LevelInfo)),
+		nastro.Validation(nastro.DefaultFilterPolicy, nil),
+	)
+
+	if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// successful queries are logged at debug level, so they are discarded
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}, Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}}); err == nil {
+		t.Fatal("expected an error for a filter without limit")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %v", lines)
+	}
+
+	for i, expected := range []string{
+		`level=INFO msg="nastro save" id=a kind=1`,
+		`level=INFO msg="nastro query" filters={kinds:[1]} events=0 error="unspecified filter's limit" class=rejected`,
+	} {
+		if !strings.Contains(lines[i], expected) {
+			t.Fatalf("expected line %d to contain %q, got %q", i, expected, lines[i])
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{err: nastro.ErrUnspecifiedLimit, class: ClassRejected},
+		{err: nastro.ErrDeleted, class: ClassRejected},
+		{err: fmt.Errorf("%w: %w", nastro.ErrInternalQuery, context.DeadlineExceeded), class: ClassCanceled},
+		{err: errors.New("disk I/O error"), class: ClassInternal},
+	}
+
+	for _, test := range tests {
+		if class := Classify(test.err); class != test.class {
+			t.Fatalf("%v: expected class %s, got %s", test.err, test.class, class)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	since := nostr.Timestamp(1700000000)
+	filters := nostr.Filters{
+		{Kinds: []int{1, 7}, Authors: []string{"a", "b", "c"}, Tags: nostr.TagMap{"p": {"x"}, "e": {"y", "z"}}, Since: &since, Limit: 50},
+		{IDs: []string{"a"}, Limit: 1},
+		{LimitZero: true},
+	}
+
+	expected := "{kinds:[1 7] authors:3 #e:2 #p:1 since:1700000000 limit:50}, {ids:1 limit:1}, {limit:0}"
+	if summary := Summary(filters...); summary != expected {
+		t.Fatalf("expected summary %q, got %q", expected, summary)
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	store := New(newBackend(t), logger, WithSlowThreshold(time.Nanosecond))
+
+	if _, err := store.Count(ctx, nostr.Filter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `level=WARN msg="nastro count"`) {
+		t.Fatalf("expected the slow count to be logged, got %q", buf.String())
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
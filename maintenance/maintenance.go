@@ -0,0 +1,213 @@
+// The maintenance package defines a runner of periodic jobs, like purging expired events, checkpointing the WAL,
+// collecting garbage or taking backups, so that operators configure one runner instead of a goroutine per job.
+//
+//	runner, err := maintenance.New([]maintenance.Job{
+//		{Name: "purge-expired", Every: time.Hour, Run: maintenance.Discard(store.PurgeExpired)},
+//		{Name: "checkpoint", Every: 5 * time.Minute, Run: func(ctx context.Context) error {
+//			return store.Checkpoint(ctx, sqlite.CheckpointTruncate)
+//		}},
+//	})
+//	go runner.Run(ctx)
+//
+// Each job runs in its own goroutine, never overlapping with itself, at intervals with a random jitter,
+// so that jobs with the same interval, or the same job on many relays, don't run at the same time.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// DefaultJitter is the fraction of the interval of a job by which each run is randomly delayed or anticipated.
+var DefaultJitter = 0.1
+
+// Job is a periodic maintenance task.
+type Job struct {
+	Name  string
+	Every time.Duration // the wait between the end of a run and the start of the next
+	Run   func(ctx context.Context) error
+
+	// Jitter is the fraction of the interval by which each run is randomly delayed or anticipated,
+	// [DefaultJitter] if zero, and no jitter if negative.
+	Jitter float64
+
+	// Timeout, if positive, cancels the context of a run that takes longer.
+	Timeout time.Duration
+
+	// Immediate runs the job when the runner starts, instead of after the first interval.
+	Immediate bool
+}
+
+// Discard adapts a maintenance function that returns a result, like the number of events purged,
+// to the Run function of a [Job].
+func Discard[T any](fn func(ctx context.Context) (T, error)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := fn(ctx)
+		return err
+	}
+}
+
+// Stats of a job since the runner started.
+type Stats struct {
+	Runs         int64
+	Failures     int64
+	LastRun      time.Time     // the start of the last run
+	LastDuration time.Duration // the duration of the last run
+	LastError    error         // the error of the last run, nil if it succeeded
+}
+
+// Runner of periodic jobs.
+type Runner struct {
+	jobs    []Job
+	observe func(job string, took time.Duration, err error)
+
+	mu    sync.Mutex
+	stats map[string]Stats
+}
+
+type Option func(*Runner) error
+
+// WithObserver sets a function called after each run of a job, with the time it took and its error,
+// for example to export metrics.
+func WithObserver(fn func(job string, took time.Duration, err error)) Option {
+	return func(r *Runner) error {
+		r.observe = fn
+		return nil
+	}
+}
+
+// New returns a runner of the jobs. Job names must be unique.
+func New(jobs []Job, opts ...Option) (*Runner, error) {
+	names := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		switch {
+		case job.Name == "":
+			return nil, errors.New("job name must not be empty")
+		case names[job.Name]:
+			return nil, fmt.Errorf("job name %q is duplicated", job.Name)
+		case job.Every <= 0:
+			return nil, fmt.Errorf("job %q: interval must be positive", job.Name)
+		case job.Run == nil:
+			return nil, fmt.Errorf("job %q: run function must not be nil", job.Name)
+		case job.Jitter >= 1:
+			return nil, fmt.Errorf("job %q: jitter must be less than 1", job.Name)
+		}
+		names[job.Name] = true
+	}
+
+	r := &Runner{
+		jobs:    jobs,
+		observe: func(string, time.Duration, error) {},
+		stats:   make(map[string]Stats, len(jobs)),
+	}
+
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Run the jobs until the context is cancelled, which also cancels the runs in progress.
+// It returns after all the runs have returned, with the error of the context.
+func (r *Runner) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, job := range r.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.loop(ctx, job)
+		}()
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Stats returns the stats of each job, by name.
+func (r *Runner) Stats() map[string]Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]Stats, len(r.stats))
+	for name, s := range r.stats {
+		stats[name] = s
+	}
+	return stats
+}
+
+// loop runs the job periodically until the context is cancelled.
+func (r *Runner) loop(ctx context.Context, job Job) {
+	if job.Immediate {
+		r.run(ctx, job)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval(job)):
+			r.run(ctx, job)
+		}
+	}
+}
+
+// run the job once, recording its stats.
+func (r *Runner) run(ctx context.Context, job Job) {
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := safely(ctx, job.Run)
+	took := time.Since(start)
+
+	r.mu.Lock()
+	s := r.stats[job.Name]
+	s.Runs++
+	if err != nil {
+		s.Failures++
+	}
+	s.LastRun = start
+	s.LastDuration = took
+	s.LastError = err
+	r.stats[job.Name] = s
+	r.mu.Unlock()
+
+	r.observe(job.Name, took, err)
+}
+
+// safely calls fn, returning its panic as an error, so that a failing job doesn't stop the others.
+func safely(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return fn(ctx)
+}
+
+// interval returns the wait before the next run of the job, with jitter.
+func interval(job Job) time.Duration {
+	jitter := job.Jitter
+	if jitter == 0 {
+		jitter = DefaultJitter
+	}
+
+	if jitter <= 0 {
+		return job.Every
+	}
+
+	spread := time.Duration(jitter * float64(job.Every))
+	if spread <= 0 {
+		return job.Every
+	}
+	return job.Every - spread + rand.N(2*spread)
+}
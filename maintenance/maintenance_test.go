@@ -0,0 +1,117 @@
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+func TestRun(t *testing.T) {
+	var purged atomic.Int64
+	purge := func(ctx context.Context) (int64, error) {
+		purged.Add(1)
+		return 10, nil
+	}
+
+	var observed atomic.Int64
+	runner, err := New([]Job{
+		{Name: "purge", Every: 5 * time.Millisecond, Run: Discard(purge), Immediate: true},
+		{Name: "failing", Every: time.Hour, Run: func(context.Context) error { return errFailed }, Immediate: true},
+		{Name: "panicky", Every: time.Hour, Run: func(context.Context) error { panic("boom") }, Immediate: true},
+		{Name: "blocked", Every: time.Hour, Run: func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }, Immediate: true},
+	}, WithObserver(func(string, time.Duration, error) { observed.Add(1) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := runner.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	stats := runner.Stats()
+	if stats["purge"].Runs < 2 || stats["purge"].Runs != purged.Load() || stats["purge"].Failures != 0 {
+		t.Fatalf("expected the purge to run many times, got %+v", stats["purge"])
+	}
+
+	if s := stats["failing"]; s.Runs != 1 || s.Failures != 1 || !errors.Is(s.LastError, errFailed) {
+		t.Fatalf("expected the failing job to fail once, got %+v", s)
+	}
+
+	if s := stats["panicky"]; s.Failures != 1 || s.LastError == nil {
+		t.Fatalf("expected the panic to be recorded, got %+v", s)
+	}
+
+	if s := stats["blocked"]; s.Runs != 1 || !errors.Is(s.LastError, context.DeadlineExceeded) {
+		t.Fatalf("expected the blocked job to be cancelled, got %+v", s)
+	}
+
+	var runs int64
+	for _, s := range stats {
+		runs += s.Runs
+	}
+
+	if observed.Load() != runs {
+		t.Fatalf("expected %d runs observed, got %d", runs, observed.Load())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	runner, err := New([]Job{{
+		Name:      "slow",
+		Every:     time.Hour,
+		Timeout:   time.Millisecond,
+		Immediate: true,
+		Run:       func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	runner.Run(ctx)
+
+	if s := runner.Stats()["slow"]; !errors.Is(s.LastError, context.DeadlineExceeded) || s.LastDuration >= 20*time.Millisecond {
+		t.Fatalf("expected the run to time out, got %+v", s)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	job := Job{Every: time.Minute, Jitter: 0.5}
+	for range 100 {
+		if d := interval(job); d < 30*time.Second || d >= 90*time.Second {
+			t.Fatalf("expected an interval within 50%% of a minute, got %v", d)
+		}
+	}
+
+	if d := interval(Job{Every: time.Minute, Jitter: -1}); d != time.Minute {
+		t.Fatalf("expected no jitter, got %v", d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	run := func(context.Context) error { return nil }
+	tests := []struct {
+		name string
+		jobs []Job
+	}{
+		{name: "empty name", jobs: []Job{{Every: time.Hour, Run: run}}},
+		{name: "duplicated name", jobs: []Job{{Name: "a", Every: time.Hour, Run: run}, {Name: "a", Every: time.Hour, Run: run}}},
+		{name: "no interval", jobs: []Job{{Name: "a", Run: run}}},
+		{name: "no run", jobs: []Job{{Name: "a", Every: time.Hour}}},
+		{name: "jitter too large", jobs: []Job{{Name: "a", Every: time.Hour, Run: run, Jitter: 1}}},
+	}
+
+	for _, test := range tests {
+		if _, err := New(test.jobs); err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+	}
+}
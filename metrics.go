@@ -0,0 +1,57 @@
+package nastro
+
+import (
+	"time"
+)
+
+// Operation is the name of a store operation reported to a [Collector].
+type Operation string
+
+const (
+	OpSave     Operation = "save"
+	OpReplace  Operation = "replace"
+	OpDelete   Operation = "delete"
+	OpUndelete Operation = "undelete"
+	OpDeletion Operation = "deletion" // the handling of a NIP-09 deletion request
+	OpQuery    Operation = "query"
+	OpCount    Operation = "count"
+	OpPurge    Operation = "purge" // the removal of expired or deleted events
+	OpImport   Operation = "import"
+)
+
+// Collector receives the metrics of a store. Each store documents which of the methods it calls,
+// and the others are never called, so implementations can embed [NoMetrics] and only implement the ones they need.
+// The methods are called synchronously by the store, so they must be fast and safe for concurrent use.
+type Collector interface {
+	// Observe is called after each operation with the time it took, the number of events returned
+	// or written (the count for [OpCount]) and the error of the operation, if any.
+	Observe(op Operation, took time.Duration, events int64, err error)
+
+	// Retry is called every time an operation is retried because of a transient error, e.g. the database is locked.
+	Retry(op Operation)
+
+	// Conflict is called when an operation fails because the error is still there after all the retries,
+	// e.g. the database is still locked, meaning the transaction lost against concurrent writers.
+	Conflict(op Operation)
+
+	// Limit is called every time a filter is rejected or clamped by the [QueryLimits] of the store,
+	// with the name of the limit (e.g. "MaxKinds") and whether the filter was clamped.
+	Limit(limit string, clamped bool)
+
+	// Evict is called every time an event is removed to make room for new ones, or because it expired.
+	Evict(expired bool)
+
+	// Occupancy is called after each write with the number of events stored, their capacity
+	// and their approximate size in bytes.
+	Occupancy(size, capacity, bytes int)
+}
+
+// NoMetrics is a [Collector] that discards everything. It's the default of the stores.
+type NoMetrics struct{}
+
+func (NoMetrics) Observe(Operation, time.Duration, int64, error) {}
+func (NoMetrics) Retry(Operation)                                {}
+func (NoMetrics) Conflict(Operation)                             {}
+func (NoMetrics) Limit(string, bool)                             {}
+func (NoMetrics) Evict(bool)                                     {}
+func (NoMetrics) Occupancy(int, int, int)                        {}
@@ -0,0 +1,180 @@
+package nastro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrPanic is returned by the stores decorated with [Recovery] when the store panics.
+var ErrPanic = errors.New("error: the store panicked")
+
+// Middleware decorates a [Store] with a behaviour shared by all the stores, like logging or metrics,
+// so that it doesn't need to be implemented inside each of them.
+type Middleware func(Store) Store
+
+// Chain returns the store decorated with the middlewares. The first middleware is the outermost,
+// so that in Chain(store, Recovery(), Metrics(c)) the panics of the metrics collector are recovered too.
+func Chain(store Store, middlewares ...Middleware) Store {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		store = middlewares[i](store)
+	}
+	return store
+}
+
+// Logging returns a [Middleware] that logs every operation with logf (e.g. log.Printf), with its duration,
+// the number of events returned or written, and the error if any.
+func Logging(logf func(format string, args ...any)) Middleware {
+	return func(store Store) Store {
+		return hooked{Store: store, hook: func(ctx context.Context, op Operation, call func() (int64, error)) error {
+			start := time.Now()
+			n, err := call()
+			if err != nil {
+				logf("nastro: %s failed after %v: %v", op, time.Since(start), err)
+				return err
+			}
+
+			logf("nastro: %s of %d events took %v", op, n, time.Since(start))
+			return nil
+		}}
+	}
+}
+
+// Metrics returns a [Middleware] that reports every operation to the [Collector] with [Collector.Observe],
+// for stores that don't report metrics of their own.
+func Metrics(c Collector) Middleware {
+	return func(store Store) Store {
+		return hooked{Store: store, hook: func(ctx context.Context, op Operation, call func() (int64, error)) error {
+			start := time.Now()
+			n, err := call()
+			c.Observe(op, time.Since(start), n, err)
+			return err
+		}}
+	}
+}
+
+// Recovery returns a [Middleware] that recovers the panics of the store, returning [ErrPanic] instead,
+// which for queries and counts also wraps [ErrInternalQuery].
+func Recovery() Middleware {
+	return func(store Store) Store {
+		return hooked{Store: store, hook: func(ctx context.Context, op Operation, call func() (int64, error)) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%w: %s: %v", ErrPanic, op, r)
+					if op == OpQuery || op == OpCount {
+						err = fmt.Errorf("%w: %w", ErrInternalQuery, err)
+					}
+				}
+			}()
+
+			_, err = call()
+			return err
+		}}
+	}
+}
+
+// Validation returns a [Middleware] that validates the events with the [EventPolicy] before writing them,
+// and the filters of the queries with the [FilterPolicy], like the options of the stores do.
+// Counts are not validated, since filter policies usually require a limit. A nil policy is skipped.
+func Validation(filters FilterPolicy, events EventPolicy) Middleware {
+	return func(store Store) Store {
+		return validated{Store: store, filters: filters, events: events}
+	}
+}
+
+type validated struct {
+	Store
+	filters FilterPolicy
+	events  EventPolicy
+}
+
+func (v validated) Save(ctx context.Context, event *nostr.Event) error {
+	if v.events != nil {
+		if err := v.events(event); err != nil {
+			return err
+		}
+	}
+	return v.Store.Save(ctx, event)
+}
+
+func (v validated) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if v.events != nil {
+		if err := v.events(event); err != nil {
+			return false, err
+		}
+	}
+	return v.Store.Replace(ctx, event)
+}
+
+func (v validated) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if v.filters != nil {
+		var err error
+		filters, err = v.filters(filters...)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(filters) == 0 {
+			return nil, nil
+		}
+	}
+	return v.Store.Query(ctx, filters...)
+}
+
+// hooked is a [Store] that calls the hook around every operation of the store. The call of the hook
+// returns the number of events returned or written (the count for [OpCount]) and the error of the operation.
+type hooked struct {
+	Store
+	hook func(ctx context.Context, op Operation, call func() (int64, error)) error
+}
+
+func (h hooked) Save(ctx context.Context, event *nostr.Event) error {
+	return h.hook(ctx, OpSave, func() (int64, error) {
+		if err := h.Store.Save(ctx, event); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
+
+func (h hooked) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	var replaced bool
+	err := h.hook(ctx, OpReplace, func() (int64, error) {
+		var err error
+		replaced, err = h.Store.Replace(ctx, event)
+		if !replaced {
+			return 0, err
+		}
+		return 1, err
+	})
+	return replaced, err
+}
+
+func (h hooked) Delete(ctx context.Context, id string) error {
+	return h.hook(ctx, OpDelete, func() (int64, error) {
+		return 0, h.Store.Delete(ctx, id)
+	})
+}
+
+func (h hooked) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	var events []nostr.Event
+	err := h.hook(ctx, OpQuery, func() (int64, error) {
+		var err error
+		events, err = h.Store.Query(ctx, filters...)
+		return int64(len(events)), err
+	})
+	return events, err
+}
+
+func (h hooked) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var count int64
+	err := h.hook(ctx, OpCount, func() (int64, error) {
+		var err error
+		count, err = h.Store.Count(ctx, filters...)
+		return count, err
+	})
+	return count, err
+}
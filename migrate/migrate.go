@@ -0,0 +1,325 @@
+// The migrate package defines a store for migrating a relay to a new backend while it runs.
+// Writes go to both the old and the new store, and reads go to one of them depending on the [Mode],
+// which can be changed at any time to cut over, or back.
+//
+//	store, err := migrate.New(sqliteStore, postgresStore, migrate.WithDiffHandler(report))
+//	n, err := migrate.Backfill(ctx, sqliteStore, postgresStore, nostr.Filter{}, 1000)
+//	store.SetMode(migrate.Shadow) // compare the results until there are no more diffs
+//	store.SetMode(migrate.ReadNew)
+//
+// The writes to the store read from must succeed, and their result is returned. The writes to the other store
+// are reported to the error handler when they fail, so that a failing migration doesn't affect the relay.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Mode decides which store the reads go to.
+type Mode int32
+
+const (
+	ReadOld Mode = iota // reads go to the old store
+	Shadow              // reads go to the old store and the new store, and their results are compared
+	ReadNew             // reads go to the new store
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ReadOld:
+		return "read-old"
+	case Shadow:
+		return "shadow"
+	case ReadNew:
+		return "read-new"
+	default:
+		return fmt.Sprintf("mode(%d)", int32(m))
+	}
+}
+
+// Diff between the results of the old and the new store for the same read, reported in [Shadow] mode.
+type Diff struct {
+	Op       nastro.Operation
+	Filters  []nostr.Filter
+	Missing  []string // the IDs of the events returned by the old store but not by the new
+	Extra    []string // the IDs of the events returned by the new store but not by the old
+	OldCount int64    // the number of events returned or counted by the old store
+	NewCount int64    // the number of events returned or counted by the new store
+}
+
+// Store of Nostr events that writes to the old and new stores, and reads from one of them.
+type Store struct {
+	old, new nastro.Store
+	mode     atomic.Int32
+	onDiff   func(Diff)
+	onError  func(err error)
+}
+
+type Option func(*Store) error
+
+// WithMode sets the initial mode of the store, which defaults to [ReadOld].
+func WithMode(m Mode) Option {
+	return func(s *Store) error {
+		if m < ReadOld || m > ReadNew {
+			return fmt.Errorf("invalid mode %v", m)
+		}
+		s.mode.Store(int32(m))
+		return nil
+	}
+}
+
+// WithDiffHandler sets the function called with the differences found in [Shadow] mode.
+func WithDiffHandler(fn func(Diff)) Option {
+	return func(s *Store) error {
+		s.onDiff = fn
+		return nil
+	}
+}
+
+// WithErrorHandler sets the function called with the errors of the store not read from,
+// which are not returned. Duplicates are not reported, as they are expected while backfilling.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(s *Store) error {
+		s.onError = fn
+		return nil
+	}
+}
+
+// New returns a store that writes to the old and the new store, reading from the old until the mode is changed.
+func New(old, new nastro.Store, opts ...Option) (*Store, error) {
+	if old == nil || new == nil {
+		return nil, errors.New("old and new stores must not be nil")
+	}
+
+	store := &Store{
+		old:     old,
+		new:     new,
+		onDiff:  func(Diff) {},
+		onError: func(error) {},
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Mode returns the current mode of the store.
+func (s *Store) Mode() Mode {
+	return Mode(s.mode.Load())
+}
+
+// SetMode changes the mode of the store, which takes effect for the operations that start after it.
+func (s *Store) SetMode(m Mode) error {
+	if m < ReadOld || m > ReadNew {
+		return fmt.Errorf("invalid mode %v", m)
+	}
+	s.mode.Store(int32(m))
+	return nil
+}
+
+// Close the old and the new stores that implement [io.Closer], returning their errors joined.
+func (s *Store) Close() error {
+	var errs []error
+	for _, store := range []nastro.Store{s.old, s.new} {
+		if closer, ok := store.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stores returns the store read from, whose writes must succeed, and the other.
+func (s *Store) stores() (primary, secondary nastro.Store) {
+	if s.Mode() == ReadNew {
+		return s.new, s.old
+	}
+	return s.old, s.new
+}
+
+// report the error of the secondary store to the error handler, unless it's nil or a duplicate.
+func (s *Store) report(err error) {
+	if err != nil && !errors.Is(err, nastro.ErrDuplicate) {
+		s.onError(err)
+	}
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	primary, secondary := s.stores()
+	if err := primary.Save(ctx, event); err != nil {
+		return err
+	}
+
+	s.report(secondary.Save(ctx, event))
+	return nil
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	primary, secondary := s.stores()
+	replaced, err := primary.Replace(ctx, event)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = secondary.Replace(ctx, event)
+	s.report(err)
+	return replaced, nil
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	primary, secondary := s.stores()
+	if err := primary.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	s.report(secondary.Delete(ctx, id))
+	return nil
+}
+
+// Query the store read from. In [Shadow] mode, the new store is queried concurrently, and the differences
+// with the result of the old store are reported to the diff handler.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	switch s.Mode() {
+	case ReadOld:
+		return s.old.Query(ctx, filters...)
+	case ReadNew:
+		return s.new.Query(ctx, filters...)
+	}
+
+	var shadow []nostr.Event
+	var shadowErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shadow, shadowErr = s.new.Query(ctx, filters...)
+	}()
+
+	events, err := s.old.Query(ctx, filters...)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	if shadowErr != nil {
+		s.report(shadowErr)
+		return events, nil
+	}
+
+	missing, extra := difference(ids(events), ids(shadow))
+	if len(missing) > 0 || len(extra) > 0 {
+		s.onDiff(Diff{
+			Op:       nastro.OpQuery,
+			Filters:  slices.Clone(filters),
+			Missing:  missing,
+			Extra:    extra,
+			OldCount: int64(len(events)),
+			NewCount: int64(len(shadow)),
+		})
+	}
+	return events, nil
+}
+
+// Count in the store read from. In [Shadow] mode, the new store counts concurrently, and different counts
+// are reported to the diff handler.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	switch s.Mode() {
+	case ReadOld:
+		return s.old.Count(ctx, filters...)
+	case ReadNew:
+		return s.new.Count(ctx, filters...)
+	}
+
+	var shadow int64
+	var shadowErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shadow, shadowErr = s.new.Count(ctx, filters...)
+	}()
+
+	count, err := s.old.Count(ctx, filters...)
+	wg.Wait()
+	if err != nil {
+		return 0, err
+	}
+
+	if shadowErr != nil {
+		s.report(shadowErr)
+		return count, nil
+	}
+
+	if count != shadow {
+		s.onDiff(Diff{Op: nastro.OpCount, Filters: slices.Clone(filters), OldCount: count, NewCount: shadow})
+	}
+	return count, nil
+}
+
+func ids(events []nostr.Event) []string {
+	result := make([]string, len(events))
+	for i, event := range events {
+		result[i] = event.ID
+	}
+	return result
+}
+
+// difference returns the IDs in old but not in new, and the IDs in new but not in old.
+func difference(old, new []string) (missing, extra []string) {
+	for _, id := range old {
+		if !slices.Contains(new, id) {
+			missing = append(missing, id)
+		}
+	}
+
+	for _, id := range new {
+		if !slices.Contains(old, id) {
+			extra = append(extra, id)
+		}
+	}
+	return missing, extra
+}
+
+// Backfill copies the events of the old store matching the filter to the new store, from the newest to the oldest,
+// and returns how many were copied. Events already in the new store are skipped, and not counted if the new store
+// reports them as duplicates, so it can be run while the [Store] writes to both, and resumed after a failure. The limit of the filter is ignored,
+// and the old store is queried batchSize events at a time, see [nastro.Scan].
+func Backfill(ctx context.Context, old, new nastro.Store, filter nostr.Filter, batchSize int) (int, error) {
+	var n int
+	err := nastro.Scan(ctx, old, filter, batchSize, func(event nostr.Event) error {
+		if nastro.IsValidReplacement(event.Kind) {
+			replaced, err := new.Replace(ctx, &event)
+			if err != nil {
+				return fmt.Errorf("failed to backfill event ID %s: %w", event.ID, err)
+			}
+
+			if replaced {
+				n++
+			}
+			return nil
+		}
+
+		err := new.Save(ctx, &event)
+		switch {
+		case errors.Is(err, nastro.ErrDuplicate):
+			return nil
+		case err != nil:
+			return fmt.Errorf("failed to backfill event ID %s: %w", event.ID, err)
+		default:
+			n++
+			return nil
+		}
+	})
+	return n, err
+}
@@ -0,0 +1,145 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var (
+	ctx     = context.Background()
+	errDown = errors.New("connection refused")
+)
+
+// broken is a store whose writes fail.
+type broken struct {
+	nastro.Store
+}
+
+func (broken) Save(context.Context, *nostr.Event) error { return errDown }
+
+func newEphemeral(t *testing.T) nastro.Store {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func query(t *testing.T, store nastro.Store) []string {
+	events, err := store.Query(ctx, nostr.Filter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids(events)
+}
+
+func TestConformance(t *testing.T) {
+	for _, mode := range []Mode{ReadOld, Shadow, ReadNew} {
+		t.Run(mode.String(), func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) nastro.Store {
+				store, err := New(newEphemeral(t), newEphemeral(t), WithMode(mode))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			})
+		})
+	}
+}
+
+func TestMigration(t *testing.T) {
+	old, new := newEphemeral(t), newEphemeral(t)
+	for _, id := range []string{"a", "b"} {
+		if err := old.Save(ctx, &nostr.Event{ID: id, Kind: 1, CreatedAt: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var diffs []Diff
+	store, err := New(old, new, WithDiffHandler(func(d Diff) { diffs = append(diffs, d) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "c", Kind: 1, CreatedAt: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetMode(Shadow); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := query(t, store); len(got) != 3 {
+		t.Fatalf("expected the events of the old store, got %v", got)
+	}
+
+	if len(diffs) != 1 || len(diffs[0].Missing) != 2 || len(diffs[0].Extra) != 0 {
+		t.Fatalf("expected the events not backfilled to be missing, got %v", diffs)
+	}
+
+	n, err := Backfill(ctx, old, new, nostr.Filter{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ephemeral store doesn't report duplicates, so the event already copied is counted
+	if n != 3 {
+		t.Fatalf("expected 3 events backfilled, got %d", n)
+	}
+
+	diffs = nil
+	if _, err := store.Count(ctx, nostr.Filter{}); err != nil {
+		t.Fatal(err)
+	}
+	query(t, store)
+
+	if len(diffs) != 0 {
+		t.Fatalf("expected no diffs after the backfill, got %v", diffs)
+	}
+
+	if err := store.SetMode(ReadNew); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := query(t, old); len(got) != 2 {
+		t.Fatalf("expected the deletion in the old store, got %v", got)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	var errs []error
+	store, err := New(newEphemeral(t), broken{newEphemeral(t)}, WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1}); err != nil {
+		t.Fatalf("expected the error of the new store not to be returned, got %v", err)
+	}
+
+	if len(errs) != 1 || !errors.Is(errs[0], errDown) {
+		t.Fatalf("expected the error of the new store to be reported, got %v", errs)
+	}
+
+	if err := store.SetMode(ReadNew); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "b", Kind: 1}); !errors.Is(err, errDown) {
+		t.Fatalf("expected error %v, got %v", errDown, err)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
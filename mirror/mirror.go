@@ -0,0 +1,383 @@
+// The mirror package defines a service that subscribes to upstream relays and persists their events into a store,
+// turning nastro into an archiving and aggregation component.
+//
+//	m, err := mirror.New(sqliteStore, []string{"wss://relay.damus.io", "wss://nos.lol"},
+//		nostr.Filters{{Kinds: []int{0, 1, 3}}},
+//		mirror.WithCheckpoint(mirror.FileCheckpoint("mirror.json")),
+//	)
+//	err = m.Run(ctx)
+//
+// Each relay is mirrored independently: lost connections are re-established with exponential backoff,
+// and the subscription resumes from the checkpoint of the relay, the created_at of the newest event persisted.
+// The checkpoint only advances after the relay sent all its stored events (EOSE), so that events missed because
+// of a failure are requested again. Events are verified, checked with the event policy, and then saved, or replaced
+// if they are replaceable or addressable.
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var (
+	// DefaultMinBackoff is the wait before the first reconnection to a relay, which doubles at every failure.
+	DefaultMinBackoff = time.Second
+
+	// DefaultMaxBackoff is the maximum wait before reconnecting to a relay.
+	DefaultMaxBackoff = 5 * time.Minute
+
+	// DefaultCheckpointInterval is how often the checkpoints of the live events are saved.
+	DefaultCheckpointInterval = 10 * time.Second
+)
+
+// Checkpoint keeps the progress of the mirror of each relay: the created_at of the newest event persisted.
+// If the filters of the mirror change, the checkpoint should be reset, as it doesn't apply to the new filters.
+type Checkpoint interface {
+	// Load returns the checkpoint of the relay, or zero if there is none.
+	Load(ctx context.Context, relay string) (nostr.Timestamp, error)
+	Save(ctx context.Context, relay string, at nostr.Timestamp) error
+}
+
+// MemoryCheckpoint keeps the checkpoints in memory, so the mirror starts over after a restart.
+// It's the default of the mirror.
+type MemoryCheckpoint struct {
+	mu          sync.Mutex
+	checkpoints map[string]nostr.Timestamp
+}
+
+func (m *MemoryCheckpoint) Load(_ context.Context, relay string) (nostr.Timestamp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoints[relay], nil
+}
+
+func (m *MemoryCheckpoint) Save(_ context.Context, relay string, at nostr.Timestamp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.checkpoints == nil {
+		m.checkpoints = make(map[string]nostr.Timestamp)
+	}
+	m.checkpoints[relay] = at
+	return nil
+}
+
+// FileCheckpoint keeps the checkpoints in a JSON file at its path, mapping the URL of the relays to their checkpoint.
+// The file is written atomically, by renaming a temporary file.
+type FileCheckpoint string
+
+func (f FileCheckpoint) Load(_ context.Context, relay string) (nostr.Timestamp, error) {
+	checkpoints, err := f.read()
+	if err != nil {
+		return 0, err
+	}
+	return checkpoints[relay], nil
+}
+
+func (f FileCheckpoint) Save(_ context.Context, relay string, at nostr.Timestamp) error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	checkpoints, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	checkpoints[relay] = at
+	data, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := string(f) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save the checkpoint: %w", err)
+	}
+	return os.Rename(tmp, string(f))
+}
+
+// fileMu serializes the saves of the file checkpoints, as the relays are mirrored concurrently.
+var fileMu sync.Mutex
+
+func (f FileCheckpoint) read() (map[string]nostr.Timestamp, error) {
+	checkpoints := make(map[string]nostr.Timestamp)
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoints, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the checkpoint: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, fmt.Errorf("failed to load the checkpoint: %w", err)
+	}
+	return checkpoints, nil
+}
+
+// Mirror of the events of upstream relays into a store.
+type Mirror struct {
+	store   nastro.Store
+	relays  []string
+	filters nostr.Filters
+
+	checkpoint         Checkpoint
+	checkpointInterval time.Duration
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
+	assumeValid        bool
+	onError            func(relay string, err error)
+
+	validateEvent nastro.EventPolicy
+}
+
+type Option func(*Mirror) error
+
+// WithCheckpoint sets where the progress of the mirror is kept, which defaults to a [MemoryCheckpoint].
+func WithCheckpoint(c Checkpoint) Option {
+	return func(m *Mirror) error {
+		if c == nil {
+			return errors.New("checkpoint must not be nil")
+		}
+		m.checkpoint = c
+		return nil
+	}
+}
+
+// WithCheckpointInterval sets how often the checkpoints of the live events are saved,
+// which defaults to [DefaultCheckpointInterval].
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(m *Mirror) error {
+		if d <= 0 {
+			return errors.New("checkpoint interval must be positive")
+		}
+		m.checkpointInterval = d
+		return nil
+	}
+}
+
+// WithBackoff sets the wait before the first reconnection to a relay, which doubles at every failure up to max.
+// Each wait has a random jitter of up to a quarter of it, so that relays recovering together are not hit at once.
+func WithBackoff(min, max time.Duration) Option {
+	return func(m *Mirror) error {
+		if min <= 0 || max < min {
+			return errors.New("backoff must be positive, and the max at least the min")
+		}
+		m.minBackoff = min
+		m.maxBackoff = max
+		return nil
+	}
+}
+
+// WithAssumeValid skips verifying the signatures of the events received from the relays, which must be trusted.
+func WithAssumeValid() Option {
+	return func(m *Mirror) error {
+		m.assumeValid = true
+		return nil
+	}
+}
+
+// WithErrorHandler sets the function called with the errors of the relays, e.g. lost connections,
+// and the errors of the store that are not rejections.
+func WithErrorHandler(fn func(relay string, err error)) Option {
+	return func(m *Mirror) error {
+		m.onError = fn
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Mirror.
+// The events it rejects are not persisted.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(m *Mirror) error {
+		m.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a mirror of the events of the relays matching the filters into the store.
+// The limits of the filters are ignored.
+func New(store nastro.Store, relays []string, filters nostr.Filters, opts ...Option) (*Mirror, error) {
+	if len(relays) == 0 {
+		return nil, errors.New("at least one relay is required")
+	}
+
+	if len(filters) == 0 {
+		return nil, errors.New("at least one filter is required")
+	}
+
+	m := &Mirror{
+		store:              store,
+		relays:             slices.Clone(relays),
+		filters:            slices.Clone(filters),
+		checkpoint:         &MemoryCheckpoint{},
+		checkpointInterval: DefaultCheckpointInterval,
+		minBackoff:         DefaultMinBackoff,
+		maxBackoff:         DefaultMaxBackoff,
+		onError:            func(string, error) {},
+		validateEvent:      func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Run mirrors the relays until the context is cancelled, and returns its error.
+func (m *Mirror) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, url := range m.relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.run(ctx, url)
+		}()
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// run mirrors the relay, reconnecting with backoff, until the context is cancelled.
+func (m *Mirror) run(ctx context.Context, url string) {
+	backoff := m.minBackoff
+	for {
+		persisted, err := m.mirror(ctx, url)
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.onError(url, err)
+		if persisted {
+			backoff = m.minBackoff
+		}
+
+		wait := backoff + rand.N(backoff/4+1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, m.maxBackoff)
+	}
+}
+
+// mirror subscribes to the relay from its checkpoint, and persists its events until the subscription ends.
+// It reports whether any event was persisted, and always returns an error explaining why the subscription ended.
+func (m *Mirror) mirror(ctx context.Context, url string) (persisted bool, err error) {
+	since, err := m.checkpoint.Load(ctx, url)
+	if err != nil {
+		return false, err
+	}
+
+	relay := nostr.NewRelay(ctx, url)
+	relay.AssumeValid = m.assumeValid
+	if err := relay.Connect(ctx); err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer relay.Close()
+
+	sub, err := relay.Subscribe(ctx, m.filtersSince(since))
+	if err != nil {
+		return false, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	defer sub.Unsub()
+
+	// newest is the created_at of the newest event persisted, which becomes the checkpoint after the EOSE
+	newest := since
+	stored := sub.EndOfStoredEvents
+	ticker := time.NewTicker(m.checkpointInterval)
+	defer ticker.Stop()
+
+	// saves the checkpoint if it advanced; the events persisted are requested again if this fails
+	save := func() {
+		if stored == nil && newest > since {
+			if err := m.checkpoint.Save(context.WithoutCancel(ctx), url, newest); err != nil {
+				m.onError(url, err)
+				return
+			}
+			since = newest
+		}
+	}
+	defer save()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return persisted, ctx.Err()
+
+		case <-stored:
+			stored = nil
+			save()
+
+		case <-ticker.C:
+			save()
+
+		case reason := <-sub.ClosedReason:
+			return persisted, fmt.Errorf("subscription closed by the relay: %s", reason)
+
+		case <-sub.Context.Done():
+			return persisted, fmt.Errorf("subscription ended: %w", context.Cause(sub.Context))
+
+		case event, ok := <-sub.Events:
+			if !ok {
+				return persisted, errors.New("subscription ended")
+			}
+
+			if err := m.persist(ctx, event); err != nil {
+				return persisted, err
+			}
+
+			persisted = true
+			newest = max(newest, event.CreatedAt)
+		}
+	}
+}
+
+// persist the event in the store, returning the errors that are not rejections.
+func (m *Mirror) persist(ctx context.Context, event *nostr.Event) error {
+	if err := m.validateEvent(event); err != nil {
+		return nil
+	}
+
+	var err error
+	if nastro.IsValidReplacement(event.Kind) {
+		_, err = m.store.Replace(ctx, event)
+	} else {
+		err = m.store.Save(ctx, event)
+	}
+
+	if _, rejected := nastro.Rejection(err); err != nil && !rejected {
+		return fmt.Errorf("failed to persist event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// filtersSince returns the filters of the mirror starting from the checkpoint, without limits.
+// Events created at the checkpoint are requested again, as more might have been created in the same second.
+func (m *Mirror) filtersSince(since nostr.Timestamp) nostr.Filters {
+	filters := make(nostr.Filters, len(m.filters))
+	for i, filter := range m.filters {
+		filter.Limit = 0
+		filter.LimitZero = false
+		if since > 0 && (filter.Since == nil || *filter.Since < since) {
+			filter.Since = &since
+		}
+		filters[i] = filter
+	}
+	return filters
+}
@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+)
+
+var ctx = context.Background()
+
+// upstream is a minimal relay that sends the stored events matching a REQ, followed by EOSE, and then drops
+// the connection, recording the filters of the REQs it received.
+type upstream struct {
+	store nastro.Store
+
+	mu   sync.Mutex
+	reqs []nostr.Filters
+}
+
+func newUpstream(t *testing.T, events ...nostr.Event) (*upstream, string) {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := &upstream{store: store}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+
+			env, ok := nostr.ParseMessage(string(data)).(*nostr.ReqEnvelope)
+			if !ok {
+				continue
+			}
+
+			u.mu.Lock()
+			u.reqs = append(u.reqs, env.Filters)
+			u.mu.Unlock()
+
+			events, _ := store.Query(ctx, env.Filters...)
+			var responses []nostr.Envelope
+			for _, event := range events {
+				responses = append(responses, &nostr.EventEnvelope{SubscriptionID: &env.SubscriptionID, Event: event})
+			}
+			eose := nostr.EOSEEnvelope(env.SubscriptionID)
+			responses = append(responses, &eose)
+
+			for _, response := range responses {
+				data, _ := response.MarshalJSON()
+				if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+					return
+				}
+			}
+
+			// give the client the time to process the EOSE before dropping the connection
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+	}))
+
+	t.Cleanup(server.Close)
+	return u, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func (u *upstream) requests() []nostr.Filters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return slices.Clone(u.reqs)
+}
+
+func TestMirror(t *testing.T) {
+	upstream, url := newUpstream(t,
+		nostr.Event{ID: "a", Kind: 1, CreatedAt: 10},
+		nostr.Event{ID: "b", Kind: 1, CreatedAt: 20},
+		nostr.Event{ID: "reaction", Kind: 7, CreatedAt: 30},
+		nostr.Event{ID: "profile", Kind: 0, CreatedAt: 15},
+	)
+
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint := FileCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	m, err := New(store, []string{url}, nostr.Filters{{Kinds: []int{0, 1}, Limit: 1}},
+		WithCheckpoint(checkpoint),
+		WithBackoff(10*time.Millisecond, 10*time.Millisecond),
+		WithAssumeValid(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	// wait for the mirror to reconnect after the first connection was dropped
+	deadline := time.Now().Add(5 * time.Second)
+	for len(upstream.requests()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the mirror to reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	events, err := store.Query(context.Background(), nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected the notes and the profile to be mirrored, got %v", events)
+	}
+
+	at, err := checkpoint.Load(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if at != 20 {
+		t.Fatalf("expected the checkpoint at 20, got %d", at)
+	}
+
+	resumed := upstream.requests()[1][0]
+	if resumed.Since == nil || *resumed.Since != 20 || resumed.Limit != 0 {
+		t.Fatalf("expected the mirror to resume from the checkpoint without limit, got %v", resumed)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil, nil, nostr.Filters{{}}); err == nil {
+		t.Fatal("expected an error without relays")
+	}
+
+	if _, err := New(nil, []string{"wss://relay.example.com"}, nil); err == nil {
+		t.Fatal("expected an error without filters")
+	}
+}
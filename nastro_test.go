@@ -0,0 +1,693 @@
+package nastro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryLimits(t *testing.T) {
+	limits := QueryLimits{
+		MaxFilters:   2,
+		MaxIDs:       2,
+		MaxAuthors:   2,
+		MaxKinds:     2,
+		MaxTagValues: 2,
+		MaxTimeRange: time.Hour,
+		MaxLimit:     100,
+	}
+
+	since := nostr.Timestamp(1000)
+	tooEarly := nostr.Timestamp(0)
+	until := nostr.Timestamp(1000 + 3600)
+
+	tests := []struct {
+		name     string
+		filters  nostr.Filters
+		expected nostr.Filters
+		err      error
+	}{
+		{
+			name:     "valid",
+			filters:  nostr.Filters{{Kinds: []int{1}, Limit: 10}},
+			expected: nostr.Filters{{Kinds: []int{1}, Limit: 10}},
+		},
+		{
+			name:     "limit zero is removed",
+			filters:  nostr.Filters{{Kinds: []int{1}, LimitZero: true}, {Kinds: []int{7}, Limit: 10}},
+			expected: nostr.Filters{{Kinds: []int{7}, Limit: 10}},
+		},
+		{
+			name:     "limit is clamped",
+			filters:  nostr.Filters{{Kinds: []int{1}, Limit: 1000}},
+			expected: nostr.Filters{{Kinds: []int{1}, Limit: 100}},
+		},
+		{
+			name:     "unspecified limit",
+			filters:  nostr.Filters{{Kinds: []int{1}}},
+			expected: nostr.Filters{{Kinds: []int{1}, Limit: 100}},
+		},
+		{
+			name:     "time range within limit",
+			filters:  nostr.Filters{{Since: &since, Until: &until, Limit: 10}},
+			expected: nostr.Filters{{Since: &since, Until: &until, Limit: 10}},
+		},
+		{
+			name:    "too many filters",
+			filters: nostr.Filters{{Limit: 1}, {Limit: 1}, {Limit: 1}},
+			err:     ErrTooManyFilters,
+		},
+		{
+			name:    "too many ids",
+			filters: nostr.Filters{{IDs: []string{"a", "b", "c"}, Limit: 1}},
+			err:     ErrTooManyIDs,
+		},
+		{
+			name:    "too many authors",
+			filters: nostr.Filters{{Authors: []string{"a", "b", "c"}, Limit: 1}},
+			err:     ErrTooManyAuthors,
+		},
+		{
+			name:    "too many kinds",
+			filters: nostr.Filters{{Kinds: []int{1, 2, 3}, Limit: 1}},
+			err:     ErrTooManyKinds,
+		},
+		{
+			name:    "too many tag values",
+			filters: nostr.Filters{{Tags: nostr.TagMap{"e": {"a", "b"}, "p": {"c"}}, Limit: 1}},
+			err:     ErrTooManyTagValues,
+		},
+		{
+			name:    "time range too wide",
+			filters: nostr.Filters{{Since: &tooEarly, Until: &until, Limit: 1}},
+			err:     ErrTimeRangeTooWide,
+		},
+		{
+			name:    "empty filter",
+			filters: nostr.Filters{{Limit: 1}},
+			err:     ErrEmptyFilter,
+		},
+		{
+			name:    "empty tags are not conditions",
+			filters: nostr.Filters{{Tags: nostr.TagMap{"e": {}}, Limit: 1}},
+			err:     ErrEmptyFilter,
+		},
+		{
+			name:    "search",
+			filters: nostr.Filters{{Search: "nostr", Limit: 1}},
+			err:     ErrUnsupportedSearch,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters, err := limits.Validate(test.filters...)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if err == nil && !reflect.DeepEqual(filters, test.expected) {
+				t.Fatalf("expected filters %v, got %v", test.expected, filters)
+			}
+		})
+	}
+}
+
+func TestQueryLimitsReject(t *testing.T) {
+	limits := QueryLimits{MaxLimit: 100, RejectOverLimit: true, AllowEmptyFilter: true}
+
+	if _, err := limits.Validate(nostr.Filter{Limit: 1000}); !errors.Is(err, ErrLimitTooHigh) {
+		t.Fatalf("expected error %v, got %v", ErrLimitTooHigh, err)
+	}
+
+	filters, err := limits.Validate(nostr.Filter{})
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if filters[0].Limit != 100 {
+		t.Fatalf("expected the unspecified limit to default to 100, got %d", filters[0].Limit)
+	}
+}
+
+func TestViolation(t *testing.T) {
+	limits := QueryLimits{MaxKinds: 2}
+	_, err := limits.Validate(nostr.Filter{Kinds: []int{1, 2, 3}, Limit: 1})
+
+	var v Violation
+	if !errors.As(err, &v) {
+		t.Fatalf("expected a violation, got %v", err)
+	}
+
+	if v.Limit() != "MaxKinds" || v.Value() != 3 || v.Max() != 2 {
+		t.Fatalf("expected MaxKinds 3 > 2, got %s %v > %v", v.Limit(), v.Value(), v.Max())
+	}
+
+	expected := "invalid: too many kinds in filter: 3, max is 2"
+	if err.Error() != expected {
+		t.Fatalf("expected message %q, got %q", expected, err.Error())
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	limits := WriteLimits{
+		MaxFutureDrift:  time.Hour,
+		MaxPastDrift:    24 * time.Hour,
+		MaxTags:         2,
+		MaxTagLength:    3,
+		MaxContentBytes: 10,
+		BannedKinds:     []int{4},
+		VerifySignature: true,
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	signed := func(e nostr.Event) *nostr.Event {
+		if err := e.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		return &e
+	}
+
+	now := nostr.Now()
+	tests := []struct {
+		name  string
+		event *nostr.Event
+		err   error
+	}{
+		{
+			name:  "valid",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"e", "a", "b"}}, Content: "hello"}),
+		},
+		{
+			name:  "banned kind",
+			event: signed(nostr.Event{Kind: 4, CreatedAt: now}),
+			err:   ErrBannedKind,
+		},
+		{
+			name:  "created_at in the future",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now + 2*3600}),
+			err:   ErrCreatedAtInFuture,
+		},
+		{
+			name:  "created_at in the past",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now - 2*24*3600}),
+			err:   ErrCreatedAtInPast,
+		},
+		{
+			name:  "too many tags",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"t", "a"}, {"t", "b"}, {"t", "c"}}}),
+			err:   ErrTooManyTags,
+		},
+		{
+			name:  "tag too long",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"e", "a", "b", "c"}}}),
+			err:   ErrTagTooLong,
+		},
+		{
+			name:  "content too large",
+			event: signed(nostr.Event{Kind: 1, CreatedAt: now, Content: "hello world"}),
+			err:   ErrContentTooLarge,
+		},
+		{
+			name:  "invalid id",
+			event: &nostr.Event{ID: "xxx", Kind: 1, CreatedAt: now},
+			err:   ErrInvalidID,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := limits.Validate(test.event); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	tampered := signed(nostr.Event{Kind: 1, CreatedAt: now})
+	tampered.Sig = signed(nostr.Event{Kind: 1, CreatedAt: now - 1}).Sig
+	if err := limits.Validate(tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidSignature, err)
+	}
+}
+
+func TestNormalizeFilters(t *testing.T) {
+	filters := nostr.Filters{
+		{Kinds: []int{7, 1, 1}, Tags: nostr.TagMap{"e": {"b", "a", "b"}, "p": {}}, Limit: 10},
+		{Kinds: []int{1, 7}, Tags: nostr.TagMap{"e": {"a", "b"}}, Limit: 50},
+		{Authors: []string{"key"}, LimitZero: true},
+		{Authors: []string{"key"}, Limit: 5},
+	}
+
+	expected := nostr.Filters{
+		{Kinds: []int{1, 7}, Tags: nostr.TagMap{"e": {"a", "b"}}, Limit: 50},
+		{Authors: []string{"key"}, Limit: 5},
+	}
+
+	normalized := NormalizeFilters(filters...)
+	if !reflect.DeepEqual(normalized, expected) {
+		t.Fatalf("expected filters %v, got %v", expected, normalized)
+	}
+
+	if len(filters[0].Kinds) != 3 {
+		t.Fatalf("expected the original filter to be unchanged, got %v", filters[0])
+	}
+}
+
+func TestMergeFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		filters  nostr.Filters
+		expected nostr.Filters
+	}{
+		{
+			name:     "highest limit",
+			filters:  nostr.Filters{{Kinds: []int{1}, Limit: 10}, {Kinds: []int{1}, Limit: 50}},
+			expected: nostr.Filters{{Kinds: []int{1}, Limit: 50}},
+		},
+		{
+			name:     "no limit wins",
+			filters:  nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{1}, Limit: 10}},
+			expected: nostr.Filters{{Kinds: []int{1}}},
+		},
+		{
+			name:     "no limit wins, reversed",
+			filters:  nostr.Filters{{Kinds: []int{1}, Limit: 10}, {Kinds: []int{1}}},
+			expected: nostr.Filters{{Kinds: []int{1}}},
+		},
+		{
+			name:     "limit zero is not merged",
+			filters:  nostr.Filters{{Kinds: []int{1}, LimitZero: true}, {Kinds: []int{1}, Limit: 10}},
+			expected: nostr.Filters{{Kinds: []int{1}, LimitZero: true}, {Kinds: []int{1}, Limit: 10}},
+		},
+		{
+			name:     "different filters",
+			filters:  nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{7}, Limit: 10}},
+			expected: nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{7}, Limit: 10}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := MergeFilters(test.filters...)
+			if !reflect.DeepEqual(merged, test.expected) {
+				t.Fatalf("expected filters %v, got %v", test.expected, merged)
+			}
+		})
+	}
+}
+
+func TestSubsumes(t *testing.T) {
+	since := nostr.Timestamp(100)
+	later := nostr.Timestamp(200)
+
+	tests := []struct {
+		name     string
+		a, b     nostr.Filter
+		expected bool
+	}{
+		{
+			name:     "empty subsumes everything",
+			a:        nostr.Filter{},
+			b:        nostr.Filter{Kinds: []int{1}, Authors: []string{"key"}},
+			expected: true,
+		},
+		{
+			name:     "nothing but empty subsumes empty",
+			a:        nostr.Filter{Kinds: []int{1}},
+			b:        nostr.Filter{},
+			expected: false,
+		},
+		{
+			name:     "subset of kinds",
+			a:        nostr.Filter{Kinds: []int{1, 7}},
+			b:        nostr.Filter{Kinds: []int{1}, Authors: []string{"key"}},
+			expected: true,
+		},
+		{
+			name:     "superset of kinds",
+			a:        nostr.Filter{Kinds: []int{1}},
+			b:        nostr.Filter{Kinds: []int{1, 7}},
+			expected: false,
+		},
+		{
+			name:     "tags",
+			a:        nostr.Filter{Tags: nostr.TagMap{"e": {"a", "b"}}},
+			b:        nostr.Filter{Tags: nostr.TagMap{"e": {"a"}, "p": {"c"}}},
+			expected: true,
+		},
+		{
+			name:     "missing tag",
+			a:        nostr.Filter{Tags: nostr.TagMap{"e": {"a"}}},
+			b:        nostr.Filter{Tags: nostr.TagMap{"p": {"a"}}},
+			expected: false,
+		},
+		{
+			name:     "narrower time window",
+			a:        nostr.Filter{Since: &since},
+			b:        nostr.Filter{Since: &later},
+			expected: true,
+		},
+		{
+			name:     "wider time window",
+			a:        nostr.Filter{Since: &later},
+			b:        nostr.Filter{Since: &since},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Subsumes(test.a, test.b); got != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+// recorder is a [Store] that records the calls it receives.
+type recorder struct {
+	saved   []string
+	queried nostr.Filters
+}
+
+func (r *recorder) Save(ctx context.Context, e *nostr.Event) error {
+	r.saved = append(r.saved, e.ID)
+	return nil
+}
+
+func (r *recorder) Delete(ctx context.Context, id string) error { return nil }
+
+func (r *recorder) Replace(ctx context.Context, e *nostr.Event) (bool, error) {
+	return true, r.Save(ctx, e)
+}
+
+func (r *recorder) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	r.queried = append(r.queried, filters...)
+	return nil, nil
+}
+
+func (r *recorder) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	r.queried = append(r.queried, filters...)
+	return 0, nil
+}
+
+func TestWithLimits(t *testing.T) {
+	ctx := context.Background()
+	inner := &recorder{}
+	store := WithLimits(inner, QueryLimits{MaxKinds: 1, MaxLimit: 10}, WriteLimits{BannedKinds: []int{4}})
+
+	if err := store.Save(ctx, &nostr.Event{ID: "dm", Kind: 4}); !errors.Is(err, ErrBannedKind) {
+		t.Fatalf("expected error %v, got %v", ErrBannedKind, err)
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{ID: "profile", Kind: 0}); err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1, 7}, Limit: 1}); !errors.Is(err, ErrTooManyKinds) {
+		t.Fatalf("expected error %v, got %v", ErrTooManyKinds, err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}, Limit: 100}); err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(inner.saved, []string{"profile"}) {
+		t.Fatalf("expected only the profile to be saved, got %v", inner.saved)
+	}
+
+	expected := nostr.Filters{{Kinds: []int{1}, Limit: 10}}
+	if !reflect.DeepEqual(inner.queried, expected) {
+		t.Fatalf("expected filters %v, got %v", expected, inner.queried)
+	}
+
+	t.Run("count", func(t *testing.T) {
+		inner := &recorder{}
+		store := WithLimits(inner, QueryLimits{MaxFilters: 2, MaxKinds: 1}, WriteLimits{})
+
+		// counts don't carry limits, so filters without limit, with LimitZero or empty are counted as they are
+		filters := nostr.Filters{{Kinds: []int{1}}, {LimitZero: true}}
+		if _, err := store.Count(ctx, filters...); err != nil {
+			t.Fatalf("expected error nil, got %v", err)
+		}
+
+		if !reflect.DeepEqual(inner.queried, filters) {
+			t.Fatalf("expected filters %v, got %v", filters, inner.queried)
+		}
+
+		if _, err := store.Count(ctx, nostr.Filter{}); err != nil {
+			t.Fatalf("expected error nil, got %v", err)
+		}
+
+		if _, err := store.Count(ctx, nostr.Filter{Kinds: []int{1, 7}}); !errors.Is(err, ErrTooManyKinds) {
+			t.Fatalf("expected error %v, got %v", ErrTooManyKinds, err)
+		}
+
+		if _, err := store.Count(ctx, nostr.Filter{}, nostr.Filter{}, nostr.Filter{}); !errors.Is(err, ErrTooManyFilters) {
+			t.Fatalf("expected error %v, got %v", ErrTooManyFilters, err)
+		}
+	})
+}
+
+func TestRejection(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+		ok     bool
+	}{
+		{err: ErrUnspecifiedLimit, reason: "UnspecifiedLimit", ok: true},
+		{err: fmt.Errorf("%w: kind 1", ErrInvalidReplacement), reason: "InvalidReplacement", ok: true},
+		{err: WriteLimits{BannedKinds: []int{4}}.Validate(&nostr.Event{Kind: 4}), reason: "BannedKinds", ok: true},
+		{err: ErrDeleted, reason: "blocked", ok: true},
+		{err: errors.New("rate-limited: slow down"), reason: "rate-limited", ok: true},
+		{err: errors.New("auth-required: authenticate to write"), reason: "auth-required", ok: true},
+		{err: errors.New("connection refused"), ok: false},
+		{err: nil, ok: false},
+	}
+
+	for _, test := range tests {
+		reason, ok := Rejection(test.err)
+		if reason != test.reason || ok != test.ok {
+			t.Fatalf("%v: expected %q %v, got %q %v", test.err, test.reason, test.ok, reason, ok)
+		}
+	}
+}
+
+// sorted is a [Store] of events sorted from the newest to the oldest, which only supports until and limit.
+type sorted struct {
+	recorder
+	events []nostr.Event
+}
+
+func (s *sorted) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	var result []nostr.Event
+	for _, event := range s.events {
+		if event.CreatedAt <= *filters[0].Until && len(result) < filters[0].Limit {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	store := &sorted{}
+	for i := range 25 {
+		// many events share the same created_at, more than the batch size
+		store.events = append(store.events, nostr.Event{ID: fmt.Sprintf("%02d", i), CreatedAt: nostr.Timestamp(10 - i/5)})
+	}
+
+	visited := make(map[string]int)
+	err := Scan(ctx, store, nostr.Filter{}, 2, func(event nostr.Event) error {
+		visited[event.ID]++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if len(visited) != len(store.events) {
+		t.Fatalf("expected %d events visited, got %d", len(store.events), len(visited))
+	}
+
+	for id, times := range visited {
+		if times != 1 {
+			t.Fatalf("expected event ID %s to be visited once, got %d", id, times)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	a := &sorted{events: []nostr.Event{{ID: "d", CreatedAt: 4}, {ID: "c", CreatedAt: 3}, {ID: "b", CreatedAt: 2}, {ID: "a", CreatedAt: 1}}}
+	b := &sorted{events: []nostr.Event{{ID: "e", CreatedAt: 5}, {ID: "c", CreatedAt: 3}, {ID: "a", CreatedAt: 1}}}
+
+	onlyA, onlyB, err := Diff(ctx, a, b)
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(onlyA, []string{"b", "d"}) || !reflect.DeepEqual(onlyB, []string{"e"}) {
+		t.Fatalf("expected [b d] and [e], got %v and %v", onlyA, onlyB)
+	}
+
+	until := nostr.Timestamp(3)
+	onlyA, onlyB, err = Diff(ctx, a, b, nostr.Filter{Until: &until})
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(onlyA, []string{"b"}) || onlyB != nil {
+		t.Fatalf("expected [b] and none, got %v and %v", onlyA, onlyB)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	sign := func(createdAt nostr.Timestamp, tags nostr.Tags) nostr.Event {
+		event := nostr.Event{Kind: 1, CreatedAt: createdAt, Tags: tags}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	valid := sign(4, nostr.Tags{{"t", "nostr"}})
+	forged := sign(3, nostr.Tags{})
+	forged.Sig = valid.Sig
+	tampered := sign(2, nostr.Tags{})
+	tampered.Content = "tampered"
+	malformed := sign(1, nostr.Tags{{}})
+
+	store := &sorted{events: []nostr.Event{valid, forged, tampered, malformed}}
+	quarantine := &recorder{}
+
+	var invalid []string
+	report, err := Audit(ctx, store, AuditOptions{
+		Delete:     true,
+		Quarantine: quarantine,
+		OnInvalid:  func(event nostr.Event, problem error) { invalid = append(invalid, event.ID) },
+	})
+
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if report.Scanned != 4 || report.Invalid != 3 || report.Quarantined != 3 || report.Deleted != 3 || report.Failed != 0 {
+		t.Fatalf("expected 4 scanned, 3 invalid, quarantined and deleted, got %+v", report)
+	}
+
+	problems := map[error]int64{ErrInvalidSignature: 1, ErrInvalidID: 1, ErrMalformedTags: 1}
+	if !reflect.DeepEqual(report.Problems, problems) {
+		t.Fatalf("expected problems %v, got %v", problems, report.Problems)
+	}
+
+	if !reflect.DeepEqual(quarantine.saved, invalid) || len(invalid) != 3 {
+		t.Fatalf("expected the invalid events %v to be quarantined, got %v", invalid, quarantine.saved)
+	}
+}
+
+// undeletable is a [Store] that fails to delete events.
+type undeletable struct {
+	sorted
+}
+
+func (u *undeletable) Delete(ctx context.Context, id string) error {
+	return errors.New("read-only")
+}
+
+func TestAuditFailures(t *testing.T) {
+	ctx := context.Background()
+	store := &undeletable{sorted{events: []nostr.Event{{ID: "a", CreatedAt: 2}, {ID: "b", CreatedAt: 1}}}}
+
+	t.Run("quarantine only", func(t *testing.T) {
+		quarantine := &recorder{}
+		report, err := Audit(ctx, store, AuditOptions{Quarantine: quarantine, SkipSignatures: true})
+		if err != nil {
+			t.Fatalf("expected error nil, got %v", err)
+		}
+
+		if report.Quarantined != 2 || report.Deleted != 0 || !reflect.DeepEqual(quarantine.saved, []string{"a", "b"}) {
+			t.Fatalf("expected the invalid events to be quarantined and kept, got %+v", report)
+		}
+	})
+
+	t.Run("failed deletes", func(t *testing.T) {
+		report, err := Audit(ctx, store, AuditOptions{Delete: true, SkipSignatures: true})
+		if err != nil {
+			t.Fatalf("expected error nil, got %v", err)
+		}
+
+		if report.Scanned != 2 || report.Deleted != 0 || report.Failed != 2 || len(report.Failures) != 2 {
+			t.Fatalf("expected the audit to continue after the failed deletes, got %+v", report)
+		}
+	})
+}
+
+// panicky is a [Store] that panics on every query.
+type panicky struct {
+	recorder
+}
+
+func (p *panicky) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	panic("boom")
+}
+
+// observer is a [Collector] that records the observed operations.
+type observer struct {
+	NoMetrics
+	ops []Operation
+}
+
+func (o *observer) Observe(op Operation, took time.Duration, events int64, err error) {
+	o.ops = append(o.ops, op)
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	var logs []string
+	logf := func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+
+	metrics := &observer{}
+	store := Chain(&panicky{},
+		Recovery(),
+		Logging(logf),
+		Metrics(metrics),
+		Validation(DefaultFilterPolicy, WriteLimits{BannedKinds: []int{4}}.Validate),
+	)
+
+	if err := store.Save(ctx, &nostr.Event{ID: "note", Kind: 1}); err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "dm", Kind: 4}); !errors.Is(err, ErrBannedKind) {
+		t.Fatalf("expected error %v, got %v", ErrBannedKind, err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{}); !errors.Is(err, ErrUnspecifiedLimit) {
+		t.Fatalf("expected error %v, got %v", ErrUnspecifiedLimit, err)
+	}
+
+	// the panic of the store is recovered by the outermost middleware
+	_, err := store.Query(ctx, nostr.Filter{Limit: 1})
+	if !errors.Is(err, ErrPanic) || !errors.Is(err, ErrInternalQuery) {
+		t.Fatalf("expected error %v, got %v", ErrPanic, err)
+	}
+
+	expected := []Operation{OpSave, OpSave, OpQuery}
+	if !reflect.DeepEqual(metrics.ops, expected) {
+		t.Fatalf("expected operations %v, got %v", expected, metrics.ops)
+	}
+
+	if len(logs) != 3 || !strings.HasPrefix(logs[0], "nastro: save of 1 events took") || !strings.HasPrefix(logs[1], "nastro: save failed") {
+		t.Fatalf("expected the logs of the operations, got %v", logs)
+	}
+}
@@ -0,0 +1,131 @@
+package nastro
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RemoveZeros returns the filters without the ones with LimitZero set, which never match stored events.
+func RemoveZeros(filters ...nostr.Filter) nostr.Filters {
+	result := make(nostr.Filters, 0, len(filters))
+	for _, f := range filters {
+		if !f.LimitZero {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// Normalize returns a copy of the filter with sorted and deduplicated ids, authors, kinds and tag values,
+// and without the tag keys that have no values. The returned filter matches the same events.
+func Normalize(f nostr.Filter) nostr.Filter {
+	f = f.Clone()
+	f.IDs = dedupe(f.IDs)
+	f.Authors = dedupe(f.Authors)
+	f.Kinds = dedupe(f.Kinds)
+
+	for key, vals := range f.Tags {
+		if len(vals) == 0 {
+			delete(f.Tags, key)
+			continue
+		}
+		f.Tags[key] = dedupe(vals)
+	}
+
+	if len(f.Tags) == 0 {
+		f.Tags = nil
+	}
+	return f
+}
+
+// dedupe sorts the slice in place and removes duplicates.
+func dedupe[T cmp.Ordered](s []T) []T {
+	if len(s) == 0 {
+		return s
+	}
+	slices.Sort(s)
+	return slices.Compact(s)
+}
+
+// MergeFilters merges the filters that match the same events (see [nostr.FilterEqual]) into one,
+// with the highest of their limits, where a limit of zero means no limit. The order of the first occurrences is preserved.
+// Filters should be normalized first, so that equal filters are recognized regardless of the order of their values.
+func MergeFilters(filters ...nostr.Filter) nostr.Filters {
+	result := make(nostr.Filters, 0, len(filters))
+outer:
+	for _, f := range filters {
+		for i := range result {
+			if nostr.FilterEqual(result[i], f) {
+				if result[i].Limit == 0 || f.Limit == 0 {
+					result[i].Limit = 0
+				} else {
+					result[i].Limit = max(result[i].Limit, f.Limit)
+				}
+				continue outer
+			}
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// NormalizeFilters removes the filters with LimitZero set, normalizes the others with [Normalize],
+// and merges the ones that are equal with [MergeFilters].
+//
+// Filters subsumed by others are not removed, as the limit of the broader filter
+// might exclude events that the narrower one would return, see [Subsumes].
+func NormalizeFilters(filters ...nostr.Filter) nostr.Filters {
+	filters = RemoveZeros(filters...)
+	for i := range filters {
+		filters[i] = Normalize(filters[i])
+	}
+	return MergeFilters(filters...)
+}
+
+// Subsumes reports whether every event matching b also matches a, ignoring their limits.
+// It's conservative: it might return false for some filters where a subsumes b, but never the opposite.
+func Subsumes(a, b nostr.Filter) bool {
+	if a.Search != "" && a.Search != b.Search {
+		return false
+	}
+
+	if !subset(a.IDs, b.IDs) || !subset(a.Authors, b.Authors) || !subset(a.Kinds, b.Kinds) {
+		return false
+	}
+
+	for key, vals := range a.Tags {
+		if len(vals) > 0 && !subset(vals, b.Tags[key]) {
+			return false
+		}
+	}
+
+	if a.Since != nil && (b.Since == nil || *b.Since < *a.Since) {
+		return false
+	}
+
+	if a.Until != nil && (b.Until == nil || *b.Until > *a.Until) {
+		return false
+	}
+	return true
+}
+
+// subset reports whether the constraint b is at least as strict as the constraint a,
+// where an empty constraint matches everything.
+func subset[T comparable](a, b []T) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, v := range b {
+		if !slices.Contains(a, v) {
+			return false
+		}
+	}
+	return true
+}
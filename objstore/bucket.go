@@ -0,0 +1,84 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Bucket is where the objects of the store are written. Objects are written once and never modified,
+// except for the manifest, which is overwritten after each batch.
+type Bucket interface {
+	// Put writes the object with the provided name, replacing it if it exists.
+	Put(ctx context.Context, name string, data []byte) error
+
+	// Get reads the object with the provided name. If it doesn't exist, the error wraps [fs.ErrNotExist].
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// S3 is a [Bucket] of an S3-compatible object storage (AWS S3, MinIO, R2, B2...).
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 returns the bucket with the provided name, reached with the client, e.g.
+//
+//	client, err := minio.New("s3.amazonaws.com", &minio.Options{
+//		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+//		Secure: true,
+//	})
+func NewS3(client *minio.Client, bucket string) *S3 {
+	return &S3{client: client, bucket: bucket}
+}
+
+func (b *S3) Put(ctx context.Context, name string, data []byte) error {
+	_, err := b.client.PutObject(ctx, b.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+func (b *S3) Get(ctx context.Context, name string) ([]byte, error) {
+	object, err := b.client.GetObject(ctx, b.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return nil, fmt.Errorf("object %s: %w", name, fs.ErrNotExist)
+	}
+	return data, err
+}
+
+// Dir is a [Bucket] in a local directory, useful for tests and air-gapped archives.
+type Dir string
+
+func (d Dir) Put(ctx context.Context, name string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// writing to a temporary file first, so that readers never see a partial object
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d Dir) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("object %s: %w", name, fs.ErrNotExist)
+	}
+	return data, err
+}
@@ -0,0 +1,480 @@
+// The objstore package defines a cold archive of Nostr events in an object storage, like S3.
+//
+// Saved events are buffered in memory and written in immutable batches, gzip-compressed JSONL objects
+// named "batches/<sequence>.jsonl.gz". The manifest object ("manifest.json") lists the batches with the time range
+// and the kinds of their events, so that queries only download the batches that might match them.
+// Deleted and replaced events stay in their batches, but are recorded in the manifest and skipped by queries.
+//
+// Queries download and scan whole batches, so they are slow: the store is meant as the cold tier of an archive,
+// behind a faster store serving the recent events. Only one process at a time must write to the same bucket.
+package objstore
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// DefaultBatchSize is the number of events of each batch, see [WithBatchSize].
+const DefaultBatchSize = 10_000
+
+const manifestName = "manifest.json"
+
+// Manifest is the index of the archive, stored in the bucket as "manifest.json".
+type Manifest struct {
+	Batches []Batch  `json:"batches"`
+	Deleted []string `json:"deleted,omitempty"` // the ids of the deleted and replaced events
+}
+
+// Batch describes an object of the archive.
+type Batch struct {
+	Name  string          `json:"name"`
+	Since nostr.Timestamp `json:"since"` // the created_at of the oldest event
+	Until nostr.Timestamp `json:"until"` // the created_at of the newest event
+	Kinds []int           `json:"kinds"` // the kinds of the events, sorted
+	Count int             `json:"count"`
+}
+
+// Store of Nostr events that uses an object storage, see [Bucket].
+type Store struct {
+	bucket    Bucket
+	batchSize int
+
+	writeMu sync.Mutex // serializes the writes, so that replacements see the previous ones
+
+	mu       sync.RWMutex // guards the fields below
+	manifest Manifest
+	deleted  map[string]struct{}
+	pending  []nostr.Event
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithBatchSize sets the number of events buffered before they are written in a batch, which defaults to [DefaultBatchSize].
+func WithBatchSize(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("batch size must be positive")
+		}
+		s.batchSize = n
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before executing queries.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before inserting them into the archive.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store archiving events in the bucket, loading its manifest if it exists.
+func New(ctx context.Context, bucket Bucket, opts ...Option) (*Store, error) {
+	store := &Store{
+		bucket:          bucket,
+		batchSize:       DefaultBatchSize,
+		deleted:         make(map[string]struct{}),
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := bucket.Get(ctx, manifestName)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// a new archive
+
+	case err != nil:
+		return nil, fmt.Errorf("failed to read the manifest: %w", err)
+
+	default:
+		if err := json.Unmarshal(data, &store.manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the manifest: %w", err)
+		}
+
+		for _, id := range store.manifest.Deleted {
+			store.deleted[id] = struct{}{}
+		}
+	}
+	return store, nil
+}
+
+// Close writes the buffered events, see [Store.Flush].
+func (s *Store) Close() error {
+	return s.Flush(context.Background())
+}
+
+// Save the event in the buffer, which is written as a batch once it reaches the batch size.
+// Saving an event twice archives it twice, but queries return it once.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.save(ctx, event)
+}
+
+func (s *Store) save(ctx context.Context, event *nostr.Event) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, *event)
+	full := len(s.pending) >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		if err := s.flush(ctx); err != nil {
+			return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered events as a new batch, and the updated manifest.
+// If the write fails, the events stay in the buffer, and are written by the next flush.
+func (s *Store) Flush(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.flush(ctx)
+}
+
+func (s *Store) flush(ctx context.Context) error {
+	s.mu.RLock()
+	events := slices.Clone(s.pending)
+	manifest := Manifest{Batches: slices.Clone(s.manifest.Batches), Deleted: s.manifest.Deleted}
+	s.mu.RUnlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	data, err := encode(events)
+	if err != nil {
+		return fmt.Errorf("failed to encode the batch: %w", err)
+	}
+
+	batch := describe(fmt.Sprintf("batches/%010d.jsonl.gz", len(manifest.Batches)), events)
+	if err := s.bucket.Put(ctx, batch.Name, data); err != nil {
+		return fmt.Errorf("failed to write batch %s: %w", batch.Name, err)
+	}
+
+	manifest.Batches = append(manifest.Batches, batch)
+	if err := s.writeManifest(ctx, manifest); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.manifest = manifest
+	s.pending = s.pending[len(events):]
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) writeManifest(ctx context.Context, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the manifest: %w", err)
+	}
+
+	if err := s.bucket.Put(ctx, manifestName, data); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	return nil
+}
+
+// Delete the event with the provided id. Buffered events are dropped, while the ids of archived events
+// are recorded in the manifest, which is written immediately.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := s.delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *Store) delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	before := len(s.pending)
+	s.pending = slices.DeleteFunc(s.pending, func(e nostr.Event) bool { return e.ID == id })
+	buffered := len(s.pending) < before
+	_, deleted := s.deleted[id]
+	manifest := Manifest{Batches: s.manifest.Batches, Deleted: append(slices.Clip(s.manifest.Deleted), id)}
+	s.mu.Unlock()
+
+	if deleted || (buffered && len(manifest.Batches) == 0) {
+		// the event has already been deleted, or it was never archived
+		return nil
+	}
+
+	if err := s.writeManifest(ctx, manifest); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.manifest = manifest
+	s.deleted[id] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+// Finding the stored event of the same category is a query, which downloads the batches with events of the same kind.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}, Limit: 1}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": {event.Tags.GetD()}}
+	}
+
+	stored, err := s.query(ctx, s.snapshot(), filter)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+
+	if len(stored) > 0 {
+		if stored[0].CreatedAt >= event.CreatedAt {
+			return false, nil
+		}
+
+		if err := s.delete(ctx, stored[0].ID); err != nil {
+			return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+		}
+	}
+
+	if err := s.save(ctx, event); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// snapshot is the state of the store seen by a query.
+type snapshot struct {
+	batches []Batch
+	deleted map[string]struct{}
+	pending []nostr.Event
+}
+
+func (s *Store) snapshot() snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return snapshot{
+		batches: s.manifest.Batches,
+		deleted: maps.Clone(s.deleted),
+		pending: slices.Clone(s.pending),
+	}
+}
+
+// Query stored events matching the provided filters, sorted by created_at in descending order, and by id
+// in ascending order among events created at the same time. Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.query(ctx, s.snapshot(), filters...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return events, nil
+}
+
+// Count stored events matching the provided filters, returning the sum of the counts of each filter.
+// The limits of the filters are ignored.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	snap := s.snapshot()
+	var total int64
+	for _, filter := range filters {
+		filter.Limit = 0
+		filter.LimitZero = false
+
+		events, err := s.query(ctx, snap, filter)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+		total += int64(len(events))
+	}
+	return total, nil
+}
+
+// query returns the events of the snapshot matching the filters, downloading each batch that might match them once.
+// Each filter returns at most its Limit events. A limit of zero means no limit, unless LimitZero is set.
+func (s *Store) query(ctx context.Context, snap snapshot, filters ...nostr.Filter) ([]nostr.Event, error) {
+	batches := make(map[string][]nostr.Event)
+	var events []nostr.Event
+
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+
+		var matches []nostr.Event
+		collect := func(candidates []nostr.Event) {
+			for _, event := range candidates {
+				if _, deleted := snap.deleted[event.ID]; !deleted && filter.Matches(&event) {
+					matches = append(matches, event)
+				}
+			}
+		}
+
+		collect(snap.pending)
+		for _, batch := range snap.batches {
+			if !batch.mightMatch(filter) {
+				continue
+			}
+
+			if _, ok := batches[batch.Name]; !ok {
+				events, err := s.download(ctx, batch.Name)
+				if err != nil {
+					return nil, err
+				}
+				batches[batch.Name] = events
+			}
+			collect(batches[batch.Name])
+		}
+
+		slices.SortFunc(matches, compare)
+		matches = slices.CompactFunc(matches, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID })
+		if filter.Limit > 0 && len(matches) > filter.Limit {
+			matches = matches[:filter.Limit]
+		}
+		events = append(events, matches...)
+	}
+
+	slices.SortFunc(events, compare)
+	return slices.CompactFunc(events, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID }), nil
+}
+
+func (s *Store) download(ctx context.Context, name string) ([]nostr.Event, error) {
+	data, err := s.bucket.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch %s: %w", name, err)
+	}
+
+	events, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode batch %s: %w", name, err)
+	}
+	return events, nil
+}
+
+// mightMatch returns whether the batch might contain events matching the filter, judging by its time range and kinds.
+func (b Batch) mightMatch(filter nostr.Filter) bool {
+	if filter.Since != nil && b.Until < *filter.Since {
+		return false
+	}
+
+	if filter.Until != nil && b.Since > *filter.Until {
+		return false
+	}
+
+	if len(filter.Kinds) > 0 && !slices.ContainsFunc(filter.Kinds, func(k int) bool {
+		_, found := slices.BinarySearch(b.Kinds, k)
+		return found
+	}) {
+		return false
+	}
+	return true
+}
+
+// describe returns the batch with the provided name and events.
+func describe(name string, events []nostr.Event) Batch {
+	batch := Batch{Name: name, Since: events[0].CreatedAt, Until: events[0].CreatedAt, Count: len(events)}
+	for _, event := range events {
+		batch.Since = min(batch.Since, event.CreatedAt)
+		batch.Until = max(batch.Until, event.CreatedAt)
+		if i, found := slices.BinarySearch(batch.Kinds, event.Kind); !found {
+			batch.Kinds = slices.Insert(batch.Kinds, i, event.Kind)
+		}
+	}
+	return batch
+}
+
+// encode the events as gzip-compressed JSONL.
+func encode(events []nostr.Event) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	encoder.SetEscapeHTML(false)
+
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decode the gzip-compressed JSONL events.
+func decode(data []byte) ([]nostr.Event, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var events []nostr.Event
+	decoder := json.NewDecoder(zr)
+	for decoder.More() {
+		var event nostr.Event
+		if err := decoder.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
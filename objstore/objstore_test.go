@@ -0,0 +1,103 @@
+package objstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newStore(t *testing.T, bucket Bucket, opts ...Option) *Store {
+	store, err := New(ctx, bucket, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		// small batches, so that the suite reads both the buffer and the archived batches
+		return newStore(t, Dir(t.TempDir()), WithBatchSize(2))
+	})
+}
+
+func TestReopen(t *testing.T) {
+	bucket := Dir(t.TempDir())
+	store := newStore(t, bucket, WithBatchSize(2))
+
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1},
+		{ID: "b", PubKey: "alice", Kind: 7, CreatedAt: 2},
+		{ID: "c", PubKey: "bob", Kind: 1, CreatedAt: 3},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newStore(t, bucket)
+	if len(reopened.manifest.Batches) != 2 {
+		t.Fatalf("expected 2 batches, got %v", reopened.manifest.Batches)
+	}
+
+	results, err := reopened.Query(ctx, nostr.Filter{Kinds: []int{1, 7}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != "c" || results[1].ID != "b" {
+		t.Fatalf("expected events c and b, got %v", results)
+	}
+}
+
+func TestMightMatch(t *testing.T) {
+	since, until := nostr.Timestamp(50), nostr.Timestamp(150)
+	batch := describe("batch", []nostr.Event{
+		{Kind: 7, CreatedAt: 200},
+		{Kind: 1, CreatedAt: 100},
+		{Kind: 7, CreatedAt: 300},
+	})
+
+	if batch.Since != 100 || batch.Until != 300 || batch.Count != 3 || len(batch.Kinds) != 2 {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+
+	tests := []struct {
+		filter   nostr.Filter
+		expected bool
+	}{
+		{filter: nostr.Filter{}, expected: true},
+		{filter: nostr.Filter{Kinds: []int{0, 1}}, expected: true},
+		{filter: nostr.Filter{Kinds: []int{0}}, expected: false},
+		{filter: nostr.Filter{Since: &since}, expected: true},
+		{filter: nostr.Filter{Until: &since}, expected: false},
+		{filter: nostr.Filter{Until: &until}, expected: true},
+	}
+
+	for _, test := range tests {
+		if match := batch.mightMatch(test.filter); match != test.expected {
+			t.Fatalf("filter %v: expected %v, got %v", test.filter, test.expected, match)
+		}
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+	var _ Bucket = Dir("")
+	var _ Bucket = &S3{}
+}
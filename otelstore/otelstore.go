@@ -0,0 +1,171 @@
+// The otelstore package defines a store wrapper that traces the operations of a store with OpenTelemetry,
+// so that slow queries can be followed end-to-end, from the websocket handler of the relay to the database.
+//
+//	store := nastro.Chain(sqliteStore, otelstore.Middleware(otelstore.WithBackend("sqlite")))
+//
+// Spans are children of the span in the context of the operation, if any, and are annotated with:
+//   - nastro.backend: the name of the wrapped store
+//   - nostr.event.id, nostr.event.kind, nostr.event.pubkey: the event of a write
+//   - nastro.replaced: whether the event of a replacement superseded the stored one
+//   - nastro.filters: the number of filters of a query or count
+//   - nostr.filter.kinds: the kinds of the filters, without duplicates
+//   - nostr.filter.ids, nostr.filter.authors, nostr.filter.tags: the number of ids, authors and tag values of the filters
+//   - nastro.events: the number of events returned by a query, or counted by a count
+package otelstore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the name of the tracer of the package.
+const instrumentation = "github.com/pippellia-btc/nastro/otelstore"
+
+// Store wraps a [nastro.Store], tracing its operations.
+type Store struct {
+	nastro.Store
+	tracer  trace.Tracer
+	backend string
+}
+
+type Option func(*Store)
+
+// WithTracerProvider sets the provider of the tracer. The default is the global provider, see [otel.SetTracerProvider].
+func WithTracerProvider(p trace.TracerProvider) Option {
+	return func(s *Store) {
+		s.tracer = p.Tracer(instrumentation)
+	}
+}
+
+// WithBackend sets the name of the store in the nastro.backend attribute, e.g. "sqlite".
+// The default is the type of the store, e.g. "*sqlite.Store".
+func WithBackend(name string) Option {
+	return func(s *Store) {
+		s.backend = name
+	}
+}
+
+// New returns a store that traces the operations of the store.
+func New(store nastro.Store, opts ...Option) *Store {
+	s := &Store{
+		Store:   store,
+		backend: fmt.Sprintf("%T", store),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.tracer == nil {
+		s.tracer = otel.Tracer(instrumentation)
+	}
+	return s
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New].
+func Middleware(opts ...Option) nastro.Middleware {
+	return func(store nastro.Store) nastro.Store {
+		return New(store, opts...)
+	}
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	ctx, span := s.start(ctx, "Save", eventAttributes(event)...)
+	defer span.End()
+
+	err := s.Store.Save(ctx, event)
+	record(span, err)
+	return err
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	ctx, span := s.start(ctx, "Replace", eventAttributes(event)...)
+	defer span.End()
+
+	replaced, err := s.Store.Replace(ctx, event)
+	span.SetAttributes(attribute.Bool("nastro.replaced", replaced))
+	record(span, err)
+	return replaced, err
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	ctx, span := s.start(ctx, "Delete", attribute.String("nostr.event.id", id))
+	defer span.End()
+
+	err := s.Store.Delete(ctx, id)
+	record(span, err)
+	return err
+}
+
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	ctx, span := s.start(ctx, "Query", filterAttributes(filters)...)
+	defer span.End()
+
+	events, err := s.Store.Query(ctx, filters...)
+	span.SetAttributes(attribute.Int("nastro.events", len(events)))
+	record(span, err)
+	return events, err
+}
+
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	ctx, span := s.start(ctx, "Count", filterAttributes(filters)...)
+	defer span.End()
+
+	count, err := s.Store.Count(ctx, filters...)
+	span.SetAttributes(attribute.Int64("nastro.events", count))
+	record(span, err)
+	return count, err
+}
+
+// start a span for the operation, named e.g. "nastro.Query".
+func (s *Store) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("nastro.backend", s.backend))
+	return s.tracer.Start(ctx, "nastro."+op, trace.WithAttributes(attrs...))
+}
+
+// record the error, if any, on the span.
+func record(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func eventAttributes(event *nostr.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("nostr.event.id", event.ID),
+		attribute.Int("nostr.event.kind", event.Kind),
+		attribute.String("nostr.event.pubkey", event.PubKey),
+	}
+}
+
+// filterAttributes summarizes the filters, without their values which might be many and large.
+func filterAttributes(filters nostr.Filters) []attribute.KeyValue {
+	var kinds []int
+	var ids, authors, tags int
+	for _, f := range filters {
+		kinds = append(kinds, f.Kinds...)
+		ids += len(f.IDs)
+		authors += len(f.Authors)
+		for _, vals := range f.Tags {
+			tags += len(vals)
+		}
+	}
+
+	slices.Sort(kinds)
+	return []attribute.KeyValue{
+		attribute.Int("nastro.filters", len(filters)),
+		attribute.IntSlice("nostr.filter.kinds", slices.Compact(kinds)),
+		attribute.Int("nostr.filter.ids", ids),
+		attribute.Int("nostr.filter.authors", authors),
+		attribute.Int("nostr.filter.tags", tags),
+	}
+}
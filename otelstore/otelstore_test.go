@@ -0,0 +1,91 @@
+package otelstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var ctx = context.Background()
+
+func newBackend(t *testing.T) *ephemeral.Store {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return New(newBackend(t))
+	})
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	store := nastro.Chain(newBackend(t), Middleware(WithTracerProvider(provider), WithBackend("ephemeral")))
+
+	if err := store.Save(ctx, &nostr.Event{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	filters := nostr.Filters{
+		{Kinds: []int{7, 1}, Authors: []string{"alice"}, Limit: 10},
+		{Kinds: []int{1}, Tags: nostr.TagMap{"e": {"x", "y"}}, Limit: 10},
+	}
+
+	if _, err := store.Query(ctx, filters...); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{ID: "b", Kind: 1}); err == nil {
+		t.Fatal("expected an error replacing a regular event")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	names := []string{spans[0].Name(), spans[1].Name(), spans[2].Name()}
+	if !reflect.DeepEqual(names, []string{"nastro.Save", "nastro.Query", "nastro.Replace"}) {
+		t.Fatalf("unexpected span names %v", names)
+	}
+
+	attrs := attribute.NewSet(spans[1].Attributes()...)
+	expected := map[attribute.Key]attribute.Value{
+		"nastro.backend":       attribute.StringValue("ephemeral"),
+		"nastro.filters":       attribute.IntValue(2),
+		"nostr.filter.kinds":   attribute.IntSliceValue([]int{1, 7}),
+		"nostr.filter.authors": attribute.IntValue(1),
+		"nostr.filter.tags":    attribute.IntValue(2),
+		"nastro.events":        attribute.IntValue(1),
+		"nostr.filter.ids":     attribute.IntValue(0),
+	}
+
+	for key, value := range expected {
+		got, ok := attrs.Value(key)
+		if !ok || got != value {
+			t.Fatalf("attribute %s: expected %v, got %v", key, value.Emit(), got.Emit())
+		}
+	}
+
+	if status := spans[2].Status(); status.Code != codes.Error {
+		t.Fatalf("expected the status of the failed replacement to be an error, got %v", status)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
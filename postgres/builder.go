@@ -0,0 +1,198 @@
+package postgres
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultQueryBuilder builds a single query returning the events matching any of the filters,
+// sorted by created_at descending and id ascending.
+// Each filter is a subquery limited to its own Limit, and the subqueries are combined with a UNION,
+// so that events matching more than one filter are returned only once.
+func DefaultQueryBuilder(filters ...nostr.Filter) ([]Query, error) {
+	switch len(filters) {
+	case 0:
+		return nil, nil
+
+	case 1:
+		query, args := buildQuery(filters[0])
+		return []Query{{SQL: Rebind(query), Args: args}}, nil
+
+	default:
+		subQueries := make([]string, 0, len(filters))
+		allArgs := make([]any, 0, len(filters))
+		limit := 0
+
+		for _, filter := range filters {
+			query, args := buildQuery(filter)
+			subQueries = append(subQueries, "("+query+")")
+			allArgs = append(allArgs, args...)
+			limit += filter.Limit
+		}
+
+		query := "SELECT " + Columns + " FROM (" + strings.Join(subQueries, " UNION ") + ") AS e" +
+			" ORDER BY e.created_at DESC, e.id ASC LIMIT ?"
+		allArgs = append(allArgs, limit)
+		return []Query{{SQL: Rebind(query), Args: allArgs}}, nil
+	}
+}
+
+// DefaultCountBuilder counts the events matching any of the filters.
+// When multiple filters are provided, the matching IDs are combined with a UNION,
+// so that events matching more than one filter are counted only once.
+func DefaultCountBuilder(filters ...nostr.Filter) ([]Query, error) {
+	switch len(filters) {
+	case 0:
+		return nil, nil
+
+	case 1:
+		sql := ToSQL(filters[0])
+		query := "SELECT COUNT(e.id) FROM events AS e" + sql.Where()
+		return []Query{{SQL: Rebind(query), Args: sql.Args}}, nil
+
+	default:
+		subQueries := make([]string, 0, len(filters))
+		allArgs := make([]any, 0, len(filters))
+
+		for _, filter := range filters {
+			sql := ToSQL(filter)
+			subQueries = append(subQueries, "SELECT e.id FROM events AS e"+sql.Where())
+			allArgs = append(allArgs, sql.Args...)
+		}
+
+		query := "SELECT COUNT(*) FROM (" + strings.Join(subQueries, " UNION ") + ") AS u"
+		return []Query{{SQL: Rebind(query), Args: allArgs}}, nil
+	}
+}
+
+func buildQuery(filter nostr.Filter) (string, []any) {
+	sql := ToSQL(filter)
+	query := "SELECT " + Columns + " FROM events AS e" + sql.Where() + " ORDER BY e.created_at DESC, e.id ASC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		sql.Args = append(sql.Args, filter.Limit)
+	}
+	return query, sql.Args
+}
+
+// SQLFilter is the translation of a [nostr.Filter] into SQL conditions on the events table (aliased "e"),
+// which must be AND-ed together, and the arguments of their placeholders, in order.
+// Placeholders are written as "?", and converted to numbered placeholders by [Rebind].
+type SQLFilter struct {
+	Conditions []string
+	Args       []any
+}
+
+// Where returns the WHERE clause AND-ing the conditions, or the empty string if there are none.
+func (s SQLFilter) Where() string {
+	if len(s.Conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(s.Conditions, " AND ")
+}
+
+// ToSQL translates the filter into the conditions used by the default builders, excluding expired events.
+// The limit of the filter is ignored. It's meant for custom builders over additional schemas.
+func ToSQL(filter nostr.Filter) SQLFilter {
+	s := SQLFilter{}
+	if len(filter.IDs) > 0 {
+		s.Conditions = append(s.Conditions, "e.id"+EqualityClause(filter.IDs))
+		for _, id := range filter.IDs {
+			s.Args = append(s.Args, id)
+		}
+	}
+
+	if len(filter.Kinds) > 0 {
+		s.Conditions = append(s.Conditions, "e.kind"+EqualityClause(filter.Kinds))
+		for _, kind := range filter.Kinds {
+			s.Args = append(s.Args, kind)
+		}
+	}
+
+	if len(filter.Authors) > 0 {
+		s.Conditions = append(s.Conditions, "e.pubkey"+EqualityClause(filter.Authors))
+		for _, pk := range filter.Authors {
+			s.Args = append(s.Args, pk)
+		}
+	}
+
+	if filter.Until != nil {
+		s.Conditions = append(s.Conditions, "e.created_at <= ?")
+		s.Args = append(s.Args, filter.Until.Time().Unix())
+	}
+
+	if filter.Since != nil {
+		s.Conditions = append(s.Conditions, "e.created_at >= ?")
+		s.Args = append(s.Args, filter.Since.Time().Unix())
+	}
+
+	// expired events must never surface
+	s.Conditions = append(s.Conditions, "(e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now()))")
+
+	// Each tag key is a disjunction of containments, which uses the GIN index on the tags,
+	// followed by an exact check that the key and value are the first two elements of a tag,
+	// because the containment of arrays ignores the order of their elements.
+	// Keys are sorted to produce deterministic queries.
+	keys := make([]string, 0, len(filter.Tags))
+	for key, vals := range filter.Tags {
+		if len(vals) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		vals := filter.Tags[key]
+		contains := make([]string, len(vals))
+		for i, v := range vals {
+			contains[i] = "e.tags @> ?"
+			s.Args = append(s.Args, containment(key, v))
+		}
+
+		s.Conditions = append(s.Conditions, "("+strings.Join(contains, " OR ")+")")
+		s.Conditions = append(s.Conditions, "EXISTS (SELECT 1 FROM jsonb_array_elements(e.tags) AS t WHERE t->>0 = ? AND t->>1"+EqualityClause(vals)+")")
+		s.Args = append(s.Args, key)
+		for _, v := range vals {
+			s.Args = append(s.Args, v)
+		}
+	}
+	return s
+}
+
+// containment returns the JSON of the tags containing a tag with the provided key and value.
+func containment(key, value string) string {
+	tags, _ := json.Marshal([][]string{{key, value}})
+	return string(tags)
+}
+
+// EqualityClause returns the SQL clause to match the provided values, using "?" placeholders.
+func EqualityClause[T any](vals []T) string {
+	if len(vals) == 1 {
+		return " = ?"
+	}
+	return " IN (?" + strings.Repeat(",?", len(vals)-1) + ")"
+}
+
+// Rebind converts the "?" placeholders of the query into the numbered placeholders of PostgreSQL ($1, $2, ...).
+// The query must not contain question marks other than placeholders.
+func Rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
@@ -0,0 +1,313 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var ctx = context.Background()
+
+func TestDefaultQueryBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters nostr.Filters
+		query   Query
+	}{
+		{
+			name:    "single filter, kind",
+			filters: nostr.Filters{{Kinds: []int{0, 1}, Limit: 100}},
+			query: Query{
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind IN ($1,$2) AND (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now())) ORDER BY e.created_at DESC, e.id ASC LIMIT $3",
+				Args: []any{0, 1, 100},
+			},
+		},
+		{
+			name: "single filter, tags",
+			filters: nostr.Filters{{
+				Limit: 11,
+				Tags: nostr.TagMap{
+					"e": {"xxx", "yyy"},
+					"p": {"someone"},
+				},
+			}},
+			query: Query{
+				SQL: "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now())) AND " +
+					"(e.tags @> $1 OR e.tags @> $2) AND EXISTS (SELECT 1 FROM jsonb_array_elements(e.tags) AS t WHERE t->>0 = $3 AND t->>1 IN ($4,$5)) AND " +
+					"(e.tags @> $6) AND EXISTS (SELECT 1 FROM jsonb_array_elements(e.tags) AS t WHERE t->>0 = $7 AND t->>1 = $8) ORDER BY e.created_at DESC, e.id ASC LIMIT $9",
+				Args: []any{`[["e","xxx"]]`, `[["e","yyy"]]`, "e", "xxx", "yyy", `[["p","someone"]]`, "p", "someone", 11},
+			},
+		},
+		{
+			name: "multiple filter",
+			filters: nostr.Filters{
+				{Kinds: []int{0, 1}, Limit: 69},
+				{Authors: []string{"aaa"}, Limit: 420},
+			},
+			query: Query{
+				SQL: "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM (" +
+					"(SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind IN ($1,$2) AND (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now())) ORDER BY e.created_at DESC, e.id ASC LIMIT $3) UNION " +
+					"(SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.pubkey = $4 AND (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now())) ORDER BY e.created_at DESC, e.id ASC LIMIT $5)" +
+					") AS e ORDER BY e.created_at DESC, e.id ASC LIMIT $6",
+				Args: []any{0, 1, 69, "aaa", 420, 69 + 420},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := DefaultQueryBuilder(test.filters...)
+			if err != nil {
+				t.Fatalf("expected error nil, got %v", err)
+			}
+
+			if !reflect.DeepEqual(query[0], test.query) {
+				t.Fatalf("expected query %v, got %v", test.query, query[0])
+			}
+		})
+	}
+}
+
+func TestDefaultCountBuilder(t *testing.T) {
+	query, err := DefaultCountBuilder(nostr.Filter{Kinds: []int{1}}, nostr.Filter{IDs: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Query{
+		SQL: "SELECT COUNT(*) FROM (" +
+			"SELECT e.id FROM events AS e WHERE e.kind = $1 AND (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now())) UNION " +
+			"SELECT e.id FROM events AS e WHERE e.id IN ($2,$3) AND (e.expires_at IS NULL OR e.expires_at > extract(epoch FROM now()))" +
+			") AS u",
+		Args: []any{1, "a", "b"},
+	}
+
+	if !reflect.DeepEqual(query[0], expected) {
+		t.Fatalf("expected query %v, got %v", expected, query[0])
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := Rebind("SELECT 1 WHERE a = ? AND b IN (?,?)")
+	expected := "SELECT 1 WHERE a = $1 AND b IN ($2,$3)"
+	if query != expected {
+		t.Fatalf("expected %q, got %q", expected, query)
+	}
+}
+
+// newStore returns a store connected to the database at POSTGRES_URL, skipping the test if it's not set.
+// The events table is emptied, so the database must be dedicated to the tests.
+func newStore(t *testing.T, opts ...Option) *Store {
+	URL := os.Getenv("POSTGRES_URL")
+	if URL == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+
+	store, err := New(URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Exec(ctx, "TRUNCATE events"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestSaveAndQuery(t *testing.T) {
+	store := newStore(t)
+	events := []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 1, CreatedAt: 1, Tags: nostr.Tags{{"e", "xxx", "relay"}}},
+		{ID: "b", PubKey: "bob", Kind: 1, CreatedAt: 2, Tags: nostr.Tags{{"p", "xxx"}}},
+		{ID: "c", PubKey: "bob", Kind: 7, CreatedAt: 3, Tags: nostr.Tags{{"x", "e"}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// saving twice is a no-op
+	if err := store.Save(ctx, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"e": {"xxx"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].ID != "a" || !reflect.DeepEqual(results[0].Tags, events[0].Tags) {
+		t.Fatalf("expected event a, got %v", results)
+	}
+
+	results, err = store.Query(ctx, nostr.Filter{Authors: []string{"bob"}, Limit: 10}, nostr.Filter{Kinds: []int{7}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != "c" || results[1].ID != "b" {
+		t.Fatalf("expected events c and b, got %v", results)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Authors: []string{"bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 {
+		t.Fatalf("expected count 3, got %d", count)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	store := newStore(t)
+	steps := []struct {
+		event    *nostr.Event
+		replaced bool
+	}{
+		{event: &nostr.Event{ID: "a", PubKey: "alice", Kind: 0, CreatedAt: 2}, replaced: true},
+		{event: &nostr.Event{ID: "b", PubKey: "alice", Kind: 0, CreatedAt: 1}, replaced: false},
+		{event: &nostr.Event{ID: "c", PubKey: "alice", Kind: 0, CreatedAt: 3}, replaced: true},
+		{event: &nostr.Event{ID: "d", PubKey: "alice", Kind: 30023, CreatedAt: 1, Tags: nostr.Tags{{"d", "post"}}}, replaced: true},
+	}
+
+	for _, step := range steps {
+		replaced, err := store.Replace(ctx, step.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if replaced != step.replaced {
+			t.Fatalf("event %s: expected replaced %v, got %v", step.event.ID, step.replaced, replaced)
+		}
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Authors: []string{"alice"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != "c" || results[1].ID != "d" {
+		t.Fatalf("expected events c and d, got %v", results)
+	}
+
+	if _, err := store.Replace(ctx, &nostr.Event{Kind: 1}); !errors.Is(err, nastro.ErrInvalidReplacement) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrInvalidReplacement, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	store := newStore(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	events, err := store.Subscribe(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range []*nostr.Event{{ID: "a", Kind: 7}, {ID: "b", Kind: 1}} {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case event := <-events:
+		if event.ID != "b" {
+			t.Fatalf("expected event b, got %v", event)
+		}
+
+	case <-ctx.Done():
+		t.Fatal("expected an event, got none")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	store := &Store{maxRetries: 3}
+	conflict := &pgconn.PgError{Code: serializationFailure}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{name: "success", errs: []error{nil}, attempts: 1},
+		{name: "retried", errs: []error{conflict, conflict, nil}, attempts: 3},
+		{name: "not retryable", errs: []error{errors.New("boom")}, attempts: 1, err: errors.New("boom")},
+		{name: "too many retries", errs: []error{conflict, conflict, conflict, conflict, nil}, attempts: 4, err: conflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := store.retry(ctx, func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if attempts != test.attempts {
+				t.Fatalf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestCockroach(t *testing.T) {
+	URL := os.Getenv("COCKROACH_URL")
+	if URL == "" {
+		t.Skip("COCKROACH_URL is not set")
+	}
+
+	store, err := New(URL, WithCockroach())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Exec(ctx, "TRUNCATE events"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range []*nostr.Event{
+		{ID: "a", PubKey: "alice", Kind: 0, CreatedAt: 1, Tags: nostr.Tags{}},
+		{ID: "b", PubKey: "alice", Kind: 0, CreatedAt: 2, Tags: nostr.Tags{{"t", "nostr"}}},
+	} {
+		if _, err := store.Replace(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].ID != "b" {
+		t.Fatalf("expected event b, got %v", results)
+	}
+
+	if _, err := store.Subscribe(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected error %v, got %v", errors.ErrUnsupported, err)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// notifyChannel is the channel where the ID of every inserted event is notified, see the schema.
+const notifyChannel = "nastro_events"
+
+// DefaultSubscriptionBuffer is the number of events a subscription buffers before waiting for the subscriber.
+var DefaultSubscriptionBuffer = 100
+
+// Subscribe returns a channel of the events inserted from now on that match any of the filters,
+// including the ones inserted by other processes sharing the database, using LISTEN/NOTIFY.
+//
+// Each subscription holds a connection of the pool until the context is cancelled,
+// or the connection fails, after which the channel is closed.
+// With [WithCockroach], it returns [errors.ErrUnsupported], since CockroachDB has no LISTEN/NOTIFY.
+func (s *Store) Subscribe(ctx context.Context, filters ...nostr.Filter) (<-chan nostr.Event, error) {
+	if s.cockroach {
+		return nil, fmt.Errorf("failed to subscribe: %w", errors.ErrUnsupported)
+	}
+
+	conn, err := s.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire a connection: %w", err)
+	}
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to listen for new events: %w", err)
+	}
+
+	events := make(chan nostr.Event, DefaultSubscriptionBuffer)
+	go func() {
+		defer close(events)
+		defer func() {
+			// the connection goes back to the pool, so it must stop listening
+			if _, err := conn.Exec(context.Background(), "UNLISTEN "+notifyChannel); err != nil {
+				conn.Conn().Close(context.Background())
+			}
+			conn.Release()
+		}()
+
+		for {
+			notification, err := conn.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return
+			}
+
+			event, err := s.get(ctx, notification.Payload)
+			if err != nil || event == nil || !nostr.Filters(filters).Match(event) {
+				// the event might have been deleted or replaced in the meantime
+				continue
+			}
+
+			select {
+			case events <- *event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// get returns the event with the provided ID, or nil if it's not stored.
+func (s *Store) get(ctx context.Context, id string) (*nostr.Event, error) {
+	rows, err := s.Pool.Query(ctx, "SELECT "+Columns+" FROM events AS e WHERE e.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := pgx.CollectExactlyOneRow(rows, scanEvent)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
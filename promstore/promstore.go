@@ -0,0 +1,244 @@
+// The promstore package defines a middleware that exports the operations of any store as Prometheus metrics,
+// labelled by backend, so that relays get the same metrics whatever stores they use.
+//
+//	metrics, err := promstore.New("relay", prometheus.DefaultRegisterer)
+//	store := nastro.Chain(sqliteStore, metrics.Middleware("sqlite"))
+//
+// The names of the metrics are stable, and prefixed by the namespace and "nastro":
+//   - relay_nastro_operations_total{backend, operation, result}, where result is "ok", "error" or "rejected"
+//   - relay_nastro_operation_duration_seconds{backend, operation}
+//   - relay_nastro_result_events{backend, operation}: the events returned by queries, or counted by counts
+//   - relay_nastro_rejections_total{backend, reason}: the operations rejected by the store, see [nastro.Rejection]
+//   - relay_nastro_evictions_total{backend, reason} and relay_nastro_occupancy_{events,capacity,bytes}{backend},
+//     for the stores that report them to the [Metrics.Collector], like ephemeral
+//   - relay_nastro_size_bytes{backend}, for the stores tracked with [Metrics.TrackSize]
+package promstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "nastro"
+
+// Metrics of the operations of the stores. Many stores can share the same metrics, with different backend labels.
+type Metrics struct {
+	namespace string
+	registry  prom.Registerer
+
+	operations *prom.CounterVec
+	latency    *prom.HistogramVec
+	events     *prom.HistogramVec
+	rejections *prom.CounterVec
+	evictions  *prom.CounterVec
+	occupancy  *prom.GaugeVec
+	capacity   *prom.GaugeVec
+	bytes      *prom.GaugeVec
+}
+
+// New returns the [Metrics] prefixed by the namespace, after registering them on the registry.
+func New(namespace string, registry prom.Registerer) (*Metrics, error) {
+	if registry == nil {
+		return nil, errors.New("registry must not be nil")
+	}
+
+	m := &Metrics{
+		namespace: namespace,
+		registry:  registry,
+
+		operations: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "operations_total",
+			Help:      "The number of store operations, by result.",
+		}, []string{"backend", "operation", "result"}),
+
+		latency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "operation_duration_seconds",
+			Help:      "The latency of the store operations.",
+			Buckets:   prom.ExponentialBuckets(0.0001, 4, 10), // 100µs to ~26s
+		}, []string{"backend", "operation"}),
+
+		events: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "result_events",
+			Help:      "The number of events returned by the queries, or counted by the counts.",
+			Buckets:   prom.ExponentialBuckets(1, 4, 8), // 1 to 16384
+		}, []string{"backend", "operation"}),
+
+		rejections: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rejections_total",
+			Help:      "The number of store operations rejected by the policies of the store, by reason.",
+		}, []string{"backend", "reason"}),
+
+		evictions: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "evictions_total",
+			Help:      "The number of events removed to make room for new ones, or because they expired.",
+		}, []string{"backend", "reason"}),
+
+		occupancy: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "occupancy_events",
+			Help:      "The number of events stored.",
+		}, []string{"backend"}),
+
+		capacity: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "occupancy_capacity",
+			Help:      "The maximum number of events the store holds.",
+		}, []string{"backend"}),
+
+		bytes: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "occupancy_bytes",
+			Help:      "The approximate size in bytes of the events stored.",
+		}, []string{"backend"}),
+	}
+
+	for _, c := range []prom.Collector{m.operations, m.latency, m.events, m.rejections, m.evictions, m.occupancy, m.capacity, m.bytes} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register the metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// TrackSize registers a gauge of the size in bytes of the database of the backend, computed by size on each scrape,
+// e.g. with the file size of a sqlite database. Scrapes where size fails don't report the gauge.
+func (m *Metrics) TrackSize(backend string, size func() (int64, error)) error {
+	gauge := &sizeGauge{
+		desc: prom.NewDesc(prom.BuildFQName(m.namespace, subsystem, "size_bytes"),
+			"The size in bytes of the database of the store.", nil, prom.Labels{"backend": backend}),
+		size: size,
+	}
+
+	if err := m.registry.Register(gauge); err != nil {
+		return fmt.Errorf("failed to register the size of %s: %w", backend, err)
+	}
+	return nil
+}
+
+type sizeGauge struct {
+	desc *prom.Desc
+	size func() (int64, error)
+}
+
+func (g *sizeGauge) Describe(ch chan<- *prom.Desc) { ch <- g.desc }
+
+func (g *sizeGauge) Collect(ch chan<- prom.Metric) {
+	if size, err := g.size(); err == nil {
+		ch <- prom.MustNewConstMetric(g.desc, prom.GaugeValue, float64(size))
+	}
+}
+
+// Collector returns a [nastro.Collector] to be passed to the stores that report evictions and occupancy,
+// e.g. ephemeral.WithMetrics(metrics.Collector("ephemeral")). It ignores the other methods,
+// since the operations are observed by the [Metrics.Middleware].
+func (m *Metrics) Collector(backend string) nastro.Collector {
+	return collector{metrics: m, backend: backend}
+}
+
+type collector struct {
+	nastro.NoMetrics
+	metrics *Metrics
+	backend string
+}
+
+func (c collector) Evict(expired bool) {
+	reason := "capacity"
+	if expired {
+		reason = "expired"
+	}
+	c.metrics.evictions.WithLabelValues(c.backend, reason).Inc()
+}
+
+func (c collector) Occupancy(size, capacity, bytes int) {
+	c.metrics.occupancy.WithLabelValues(c.backend).Set(float64(size))
+	c.metrics.capacity.WithLabelValues(c.backend).Set(float64(capacity))
+	c.metrics.bytes.WithLabelValues(c.backend).Set(float64(bytes))
+}
+
+// Middleware returns a [nastro.Middleware] that observes the operations of the stores, labelled by the backend.
+func (m *Metrics) Middleware(backend string) nastro.Middleware {
+	return func(store nastro.Store) nastro.Store {
+		return &Store{Store: store, metrics: m, backend: backend}
+	}
+}
+
+// Store wraps a [nastro.Store], observing its operations.
+type Store struct {
+	nastro.Store
+	metrics *Metrics
+	backend string
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	start := time.Now()
+	err := s.Store.Save(ctx, event)
+	s.observe(nastro.OpSave, start, err)
+	return err
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	start := time.Now()
+	replaced, err := s.Store.Replace(ctx, event)
+	s.observe(nastro.OpReplace, start, err)
+	return replaced, err
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.Store.Delete(ctx, id)
+	s.observe(nastro.OpDelete, start, err)
+	return err
+}
+
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	start := time.Now()
+	events, err := s.Store.Query(ctx, filters...)
+	s.observe(nastro.OpQuery, start, err)
+	if err == nil {
+		s.metrics.events.WithLabelValues(s.backend, string(nastro.OpQuery)).Observe(float64(len(events)))
+	}
+	return events, err
+}
+
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	start := time.Now()
+	count, err := s.Store.Count(ctx, filters...)
+	s.observe(nastro.OpCount, start, err)
+	if err == nil {
+		s.metrics.events.WithLabelValues(s.backend, string(nastro.OpCount)).Observe(float64(count))
+	}
+	return count, err
+}
+
+func (s *Store) observe(op nastro.Operation, start time.Time, err error) {
+	s.metrics.latency.WithLabelValues(s.backend, string(op)).Observe(time.Since(start).Seconds())
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+		if reason, ok := nastro.Rejection(err); ok {
+			result = "rejected"
+			s.metrics.rejections.WithLabelValues(s.backend, reason).Inc()
+		}
+	}
+	s.metrics.operations.WithLabelValues(s.backend, string(op), result).Inc()
+}
@@ -0,0 +1,104 @@
+package promstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var ctx = context.Background()
+
+func newBackend(t *testing.T, opts ...ephemeral.Option) *ephemeral.Store {
+	backend, err := ephemeral.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		metrics, err := New("test", prom.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nastro.Chain(newBackend(t), metrics.Middleware("ephemeral"))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	registry := prom.NewRegistry()
+	metrics, err := New("relay", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := metrics.TrackSize("ephemeral", func() (int64, error) { return 1024, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newBackend(t, ephemeral.WithCapacity(1), ephemeral.WithMetrics(metrics.Collector("ephemeral")))
+	store := nastro.Chain(backend,
+		metrics.Middleware("ephemeral"),
+		nastro.Validation(nil, nastro.WriteLimits{BannedKinds: []int{4}}.Validate),
+	)
+
+	for _, event := range []*nostr.Event{
+		{ID: "a", Kind: 1, CreatedAt: 1},
+		{ID: "b", Kind: 1, CreatedAt: 2},
+		{ID: "dm", Kind: 4, CreatedAt: 3},
+	} {
+		store.Save(ctx, event)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP relay_nastro_evictions_total The number of events removed to make room for new ones, or because they expired.
+# TYPE relay_nastro_evictions_total counter
+relay_nastro_evictions_total{backend="ephemeral",reason="capacity"} 1
+# HELP relay_nastro_occupancy_events The number of events stored.
+# TYPE relay_nastro_occupancy_events gauge
+relay_nastro_occupancy_events{backend="ephemeral"} 1
+# HELP relay_nastro_operations_total The number of store operations, by result.
+# TYPE relay_nastro_operations_total counter
+relay_nastro_operations_total{backend="ephemeral",operation="query",result="ok"} 1
+relay_nastro_operations_total{backend="ephemeral",operation="save",result="ok"} 2
+relay_nastro_operations_total{backend="ephemeral",operation="save",result="rejected"} 1
+# HELP relay_nastro_rejections_total The number of store operations rejected by the policies of the store, by reason.
+# TYPE relay_nastro_rejections_total counter
+relay_nastro_rejections_total{backend="ephemeral",reason="BannedKinds"} 1
+# HELP relay_nastro_size_bytes The size in bytes of the database of the store.
+# TYPE relay_nastro_size_bytes gauge
+relay_nastro_size_bytes{backend="ephemeral"} 1024
+`
+
+	names := []string{
+		"relay_nastro_evictions_total",
+		"relay_nastro_occupancy_events",
+		"relay_nastro_operations_total",
+		"relay_nastro_rejections_total",
+		"relay_nastro_size_bytes",
+	}
+
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), names...); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(metrics.events); n != 1 {
+		t.Fatalf("expected 1 result histogram, got %d", n)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
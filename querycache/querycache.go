@@ -0,0 +1,277 @@
+// The querycache package defines a middleware that caches the results of the queries of a store in memory,
+// so that popular queries (the global feed, trending tags) don't hit the backend every time.
+//
+// Results are kept in a LRU cache for a TTL, keyed by the normalized filters of the query (see [nastro.NormalizeFilters]),
+// so that queries with the same filters in a different order share the result. Concurrent identical queries are sent
+// to the backend once. Writes invalidate the cached results that they might change: the ones with a filter
+// matching the written event, and the ones containing the deleted or replaced events.
+//
+// Writes that bypass the store (e.g. other processes sharing the same database) are only seen after the TTL.
+package querycache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// DefaultCapacity is the maximum number of query results cached.
+	DefaultCapacity = 1000
+
+	// DefaultTTL is how long a query result is cached.
+	DefaultTTL = 10 * time.Second
+)
+
+// Store wraps a [nastro.Store], caching the results of its queries.
+type Store struct {
+	nastro.Store
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *entry, from the most to the least recently used
+
+	// generation is incremented by every write, so that the results of the queries
+	// started before a write are not cached, as they might miss it
+	generation uint64
+
+	group singleflight.Group
+	now   func() time.Time
+}
+
+type entry struct {
+	key     string
+	filters nostr.Filters
+	events  []nostr.Event
+	expires time.Time
+}
+
+type Option func(*Store) error
+
+// WithCapacity sets the maximum number of query results cached. The least recently used are evicted first.
+func WithCapacity(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("capacity must be positive")
+		}
+		s.capacity = n
+		return nil
+	}
+}
+
+// WithTTL sets how long a query result is cached. It bounds how stale the results of queries whose events
+// depend on time are, e.g. the ones with expiring events (NIP-40).
+func WithTTL(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("TTL must be positive")
+		}
+		s.ttl = d
+		return nil
+	}
+}
+
+// New returns a store that caches the results of the queries of the store.
+func New(store nastro.Store, opts ...Option) (*Store, error) {
+	s := &Store{
+		Store:    store,
+		capacity: DefaultCapacity,
+		ttl:      DefaultTTL,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New].
+// It returns an error if any of the options is invalid.
+func Middleware(opts ...Option) (nastro.Middleware, error) {
+	if _, err := New(nil, opts...); err != nil {
+		return nil, err
+	}
+
+	return func(store nastro.Store) nastro.Store {
+		s, _ := New(store, opts...)
+		return s
+	}, nil
+}
+
+// Len returns the number of query results cached.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Query returns the cached result of the filters, or queries the store and caches its result.
+// The result of concurrent identical queries is shared, so they fail together if the context of the first is cancelled.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters = nastro.NormalizeFilters(filters...)
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	key, err := keyOf(filters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+
+	if events, ok := s.get(key); ok {
+		return slices.Clone(events), nil
+	}
+
+	result, err, _ := s.group.Do(key, func() (any, error) {
+		s.mu.Lock()
+		generation := s.generation
+		s.mu.Unlock()
+
+		events, err := s.Store.Query(ctx, filters...)
+		if err != nil {
+			return nil, err
+		}
+
+		s.put(key, filters, events, generation)
+		return events, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(result.([]nostr.Event)), nil
+}
+
+// Save the event in the store, invalidating the cached results with a filter matching the event.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	defer s.invalidate(func(e *entry) bool { return e.filters.Match(event) })
+	return s.Store.Save(ctx, event)
+}
+
+// Replace the event in the store, invalidating the cached results with a filter matching the event,
+// and the ones containing events of the same category, which might have been replaced.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	defer s.invalidate(func(e *entry) bool {
+		return e.filters.Match(event) || slices.ContainsFunc(e.events, func(old nostr.Event) bool {
+			return sameCategory(event, &old)
+		})
+	})
+	return s.Store.Replace(ctx, event)
+}
+
+// Delete the event from the store, invalidating the cached results containing it.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	defer s.invalidate(func(e *entry) bool {
+		return slices.ContainsFunc(e.events, func(event nostr.Event) bool { return event.ID == id })
+	})
+	return s.Store.Delete(ctx, id)
+}
+
+func (s *Store) get(key string) ([]nostr.Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := element.Value.(*entry)
+	if s.now().After(e.expires) {
+		s.remove(element)
+		return nil, false
+	}
+
+	s.lru.MoveToFront(element)
+	return e.events, true
+}
+
+// put the result in the cache, unless a write happened after the generation, evicting the least recently used.
+func (s *Store) put(key string, filters nostr.Filters, events []nostr.Event, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return
+	}
+
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+
+	e := &entry{key: key, filters: filters, events: events, expires: s.now().Add(s.ttl)}
+	s.entries[key] = s.lru.PushFront(e)
+
+	for s.lru.Len() > s.capacity {
+		s.remove(s.lru.Back())
+	}
+}
+
+// invalidate removes the cached results that match, and prevents caching the results of the queries in flight.
+func (s *Store) invalidate(match func(*entry) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	for element := s.lru.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*entry)) {
+			s.remove(element)
+		}
+		element = next
+	}
+}
+
+func (s *Store) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*entry).key)
+}
+
+// keyOf returns the key of the normalized filters, which doesn't depend on their order.
+func keyOf(filters nostr.Filters) (string, error) {
+	keys := make([]string, len(filters))
+	for i, f := range filters {
+		b, err := json.Marshal(f)
+		if err != nil {
+			return "", err
+		}
+		keys[i] = string(b)
+	}
+
+	slices.Sort(keys)
+	return strings.Join(keys, "\n"), nil
+}
+
+// sameCategory reports whether the two events are replaceable or addressable events of the same category,
+// so that one replaces the other.
+func sameCategory(a, b *nostr.Event) bool {
+	if a.Kind != b.Kind || a.PubKey != b.PubKey {
+		return false
+	}
+
+	switch {
+	case nostr.IsReplaceableKind(a.Kind):
+		return true
+	case nostr.IsAddressableKind(a.Kind):
+		return a.Tags.GetD() == b.Tags.GetD()
+	default:
+		return false
+	}
+}
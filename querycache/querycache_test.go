@@ -0,0 +1,199 @@
+package querycache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+// counter is a store that counts its queries, which block until release is closed, if not nil.
+type counter struct {
+	nastro.Store
+	queries atomic.Int64
+	release chan struct{}
+}
+
+func (c *counter) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	c.queries.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	return c.Store.Query(ctx, filters...)
+}
+
+func newStore(t *testing.T, opts ...Option) (*Store, *counter) {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &counter{Store: backend}
+	store, err := New(c, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, c
+}
+
+func query(t *testing.T, store nastro.Store, filters ...nostr.Filter) []string {
+	events, err := store.Query(ctx, filters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, _ := newStore(t)
+		return store
+	})
+}
+
+func TestCache(t *testing.T) {
+	store, backend := newStore(t)
+	notes := nostr.Filter{Kinds: []int{1, 7}, Limit: 10}
+	sameNotes := nostr.Filter{Kinds: []int{7, 1, 1}, Limit: 10}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	query(t, store, notes)
+	query(t, store, sameNotes)
+	if n := backend.queries.Load(); n != 1 {
+		t.Fatalf("expected 1 query to the backend, got %d", n)
+	}
+
+	// the profile doesn't match the cached filters
+	if _, err := store.Replace(ctx, &nostr.Event{ID: "profile", Kind: 0, CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	query(t, store, notes)
+	if n := backend.queries.Load(); n != 1 {
+		t.Fatalf("expected 1 query to the backend, got %d", n)
+	}
+
+	steps := []struct {
+		name  string
+		write func() error
+		ids   []string
+	}{
+		{
+			name:  "save",
+			write: func() error { return store.Save(ctx, &nostr.Event{ID: "b", Kind: 7, CreatedAt: 2}) },
+			ids:   []string{"b", "a"},
+		},
+		{
+			name:  "delete",
+			write: func() error { return store.Delete(ctx, "a") },
+			ids:   []string{"b"},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatal(err)
+		}
+
+		ids := query(t, store, notes)
+		if len(ids) != len(step.ids) || ids[0] != step.ids[0] {
+			t.Fatalf("%s: expected %v, got %v", step.name, step.ids, ids)
+		}
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		store, _ := newStore(t)
+		old := &nostr.Event{ID: "old", Kind: 0, CreatedAt: 1}
+		if _, err := store.Replace(ctx, old); err != nil {
+			t.Fatal(err)
+		}
+
+		// the new profile doesn't match the filter, but replaces the cached one
+		until := nostr.Timestamp(1)
+		filter := nostr.Filter{Kinds: []int{0}, Until: &until, Limit: 1}
+		query(t, store, filter)
+
+		if _, err := store.Replace(ctx, &nostr.Event{ID: "new", Kind: 0, CreatedAt: 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		if ids := query(t, store, filter); len(ids) != 0 {
+			t.Fatalf("expected no events, got %v", ids)
+		}
+	})
+}
+
+func TestSingleflight(t *testing.T) {
+	store, backend := newStore(t)
+	backend.release = make(chan struct{})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Query(ctx, nostr.Filter{Limit: 10}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// wait for the first query to reach the backend, and the others to wait for it
+	for backend.queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	close(backend.release)
+	wg.Wait()
+
+	if n := backend.queries.Load(); n != 1 {
+		t.Fatalf("expected 1 query to the backend, got %d", n)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	store, backend := newStore(t, WithCapacity(2), WithTTL(time.Minute))
+	now := time.Unix(1700000000, 0)
+	store.now = func() time.Time { return now }
+
+	for _, limit := range []int{1, 2, 3} {
+		query(t, store, nostr.Filter{Limit: limit})
+	}
+
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 cached results, got %d", store.Len())
+	}
+
+	// the least recently used was evicted
+	query(t, store, nostr.Filter{Limit: 1})
+	if n := backend.queries.Load(); n != 4 {
+		t.Fatalf("expected 4 queries to the backend, got %d", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	query(t, store, nostr.Filter{Limit: 1})
+	if n := backend.queries.Load(); n != 5 {
+		t.Fatalf("expected the expired result to be queried again, got %d queries", n)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,215 @@
+// The ratelimit package defines a middleware that limits the events each pubkey can write to a store,
+// with a token bucket per pubkey and rule, e.g. 10 kind-1 events per minute.
+//
+//	limiter, err := ratelimit.New(
+//		ratelimit.Rule{Kinds: []int{1}, Events: 10, Per: time.Minute},
+//		ratelimit.Rule{Events: 100, Per: time.Hour},
+//	)
+//	store := nastro.Chain(sqliteStore, limiter.Middleware())
+//
+// Writes over the limits fail with an error wrapping [ErrRateLimited], whose message can be sent to the client
+// as the reason of the OK message. The rules can be changed while the relay runs with [Limiter.SetRules].
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// ErrRateLimited is wrapped by the errors of the writes over the limits, see [LimitError].
+var ErrRateLimited = errors.New("rate-limited: slow down")
+
+// sweepInterval is how often the buckets that are full again are removed, so that the pubkeys
+// that stopped writing don't take memory.
+const sweepInterval = time.Minute
+
+// Rule limits the events of the kinds each pubkey can write in a period. The events of all the kinds
+// of the rule share the same bucket: to limit kinds separately, use a rule for each.
+type Rule struct {
+	Kinds  []int         // the kinds limited by the rule, or all the kinds if empty
+	Events int           // the number of events each pubkey can write in the period, which is also the burst
+	Per    time.Duration // the period
+}
+
+func (r Rule) validate() error {
+	if r.Events < 1 {
+		return errors.New("the events of a rule must be positive")
+	}
+
+	if r.Per <= 0 {
+		return errors.New("the period of a rule must be positive")
+	}
+	return nil
+}
+
+func (r Rule) matches(kind int) bool {
+	return len(r.Kinds) == 0 || slices.Contains(r.Kinds, kind)
+}
+
+// rate returns the tokens per second of the rule.
+func (r Rule) rate() float64 {
+	return float64(r.Events) / r.Per.Seconds()
+}
+
+// LimitError is the error of a write over the limits. It wraps [ErrRateLimited].
+type LimitError struct {
+	Pubkey     string
+	Kind       int
+	Rule       Rule
+	RetryAfter time.Duration // the time after which the write would be accepted
+}
+
+func (e *LimitError) Unwrap() error { return ErrRateLimited }
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v: at most %d events every %v, retry in %v", ErrRateLimited, e.Rule.Events, e.Rule.Per, e.RetryAfter.Round(time.Second))
+}
+
+type key struct {
+	pubkey string
+	rule   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter of the writes of the pubkeys. Many stores can share the same limiter, so that the limits are global.
+type Limiter struct {
+	mu        sync.Mutex
+	rules     []Rule
+	buckets   map[key]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New returns a [Limiter] that enforces the rules.
+func New(rules ...Rule) (*Limiter, error) {
+	l := &Limiter{
+		buckets: make(map[key]*bucket),
+		now:     time.Now,
+	}
+
+	if err := l.SetRules(rules...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetRules replaces the rules of the limiter, which can be done while the limiter is used.
+// All the buckets restart full.
+func (l *Limiter) SetRules(rules ...Rule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rules = slices.Clone(rules)
+	clear(l.buckets)
+	return nil
+}
+
+// Rules returns the rules of the limiter.
+func (l *Limiter) Rules() []Rule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.rules)
+}
+
+// Allow takes a token from the buckets of all the rules matching the event, and returns a [LimitError]
+// if any of them is empty, in which case no token is taken.
+func (l *Limiter) Allow(event *nostr.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var buckets []*bucket
+	for i, rule := range l.rules {
+		if !rule.matches(event.Kind) {
+			continue
+		}
+
+		k := key{pubkey: event.PubKey, rule: i}
+		b, ok := l.buckets[k]
+		if !ok {
+			b = &bucket{tokens: float64(rule.Events), last: now}
+			l.buckets[k] = b
+		}
+
+		b.refill(rule, now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / rule.rate() * float64(time.Second))
+			return &LimitError{Pubkey: event.PubKey, Kind: event.Kind, Rule: rule, RetryAfter: wait}
+		}
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
+
+func (b *bucket) refill(rule Rule, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = min(float64(rule.Events), b.tokens+elapsed*rule.rate())
+	b.last = now
+}
+
+// sweep removes the buckets that are full again, at most once every sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		rule := l.rules[k.rule]
+		b.refill(rule, now)
+		if b.tokens >= float64(rule.Events) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Middleware returns a [nastro.Middleware] that checks the events saved or replaced with [Limiter.Allow].
+// Deletions, queries and counts are not limited.
+func (l *Limiter) Middleware() nastro.Middleware {
+	return func(store nastro.Store) nastro.Store {
+		return &Store{Store: store, limiter: l}
+	}
+}
+
+// Store wraps a [nastro.Store], limiting the writes of the pubkeys.
+type Store struct {
+	nastro.Store
+	limiter *Limiter
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.limiter.Allow(event); err != nil {
+		return err
+	}
+	return s.Store.Save(ctx, event)
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if err := s.limiter.Allow(event); err != nil {
+		return false, err
+	}
+	return s.Store.Replace(ctx, event)
+}
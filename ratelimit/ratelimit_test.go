@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+)
+
+var ctx = context.Background()
+
+// clock is a fake time, advanced by the tests.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newLimiter(t *testing.T, rules ...Rule) (*Limiter, *clock) {
+	limiter, err := New(rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &clock{t: time.Unix(1700000000, 0)}
+	limiter.now = c.now
+	return limiter, c
+}
+
+func TestAllow(t *testing.T) {
+	limiter, clock := newLimiter(t,
+		Rule{Kinds: []int{1}, Events: 2, Per: time.Minute},
+		Rule{Events: 3, Per: time.Hour},
+	)
+
+	note := &nostr.Event{PubKey: "alice", Kind: 1}
+	reaction := &nostr.Event{PubKey: "alice", Kind: 7}
+
+	steps := []struct {
+		event   *nostr.Event
+		advance time.Duration
+		allowed bool
+	}{
+		{event: note, allowed: true},
+		{event: note, allowed: true},
+		{event: note, allowed: false},                                // the kind-1 bucket is empty
+		{event: &nostr.Event{PubKey: "bob", Kind: 1}, allowed: true}, // buckets are per pubkey
+		{event: note, advance: 30 * time.Second, allowed: true},      // one kind-1 token refilled
+		{event: reaction, allowed: false},                            // the hourly bucket is empty
+	}
+
+	for i, step := range steps {
+		clock.advance(step.advance)
+		err := limiter.Allow(step.event)
+		if step.allowed && err != nil {
+			t.Fatalf("step %d: expected error nil, got %v", i, err)
+		}
+
+		if !step.allowed && !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("step %d: expected error %v, got %v", i, ErrRateLimited, err)
+		}
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	limiter, _ := newLimiter(t, Rule{Kinds: []int{1}, Events: 1, Per: time.Minute})
+	note := &nostr.Event{PubKey: "alice", Kind: 1}
+	limiter.Allow(note)
+
+	var limitErr *LimitError
+	if err := limiter.Allow(note); !errors.As(err, &limitErr) {
+		t.Fatalf("expected a limit error, got %v", err)
+	}
+
+	if limitErr.RetryAfter != time.Minute {
+		t.Fatalf("expected to retry after %v, got %v", time.Minute, limitErr.RetryAfter)
+	}
+
+	if reason, ok := nastro.Rejection(limitErr); !ok || reason != "rate-limited" {
+		t.Fatalf("expected a rate-limited rejection, got %q", reason)
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	limiter, _ := newLimiter(t, Rule{Events: 1, Per: time.Hour})
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := nastro.Chain(backend, limiter.Middleware())
+	if err := store.Save(ctx, &nostr.Event{ID: "a", PubKey: "alice", Kind: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "b", PubKey: "alice", Kind: 1}); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected error %v, got %v", ErrRateLimited, err)
+	}
+
+	if err := limiter.SetRules(Rule{Events: 0, Per: time.Hour}); err == nil {
+		t.Fatal("expected an error for an invalid rule")
+	}
+
+	if err := limiter.SetRules(Rule{Events: 10, Per: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "b", PubKey: "alice", Kind: 1}); err != nil {
+		t.Fatalf("expected error nil after reloading the rules, got %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	limiter, clock := newLimiter(t, Rule{Events: 1, Per: time.Second})
+	limiter.Allow(&nostr.Event{PubKey: "alice"})
+
+	clock.advance(sweepInterval)
+	limiter.Allow(&nostr.Event{PubKey: "bob"})
+
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("expected only the bucket of bob, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,613 @@
+// The redis package defines a Redis store for Nostr events, meant as hot storage shared by several relay instances.
+//
+// Events are stored in hashes, and indexed by sorted sets of event ids scored by created_at:
+//
+//	{nastro}:event:<id>                     hash of the event JSON, created_at, content, index keys and address
+//	{nastro}:time                           the ids of all the events
+//	{nastro}:kind:<kind>                    the ids of the events of a kind
+//	{nastro}:pubkey:<pubkey>                the ids of the events of an author
+//	{nastro}:tag:<key>:<value>              the ids of the events with a single-letter tag
+//	{nastro}:address:<kind>:<pubkey>:<d>    -> the id of the latest replaceable or addressable event
+//
+// Writes run as Lua scripts, so they are atomic across the relay instances sharing the database.
+// The default prefix (see [WithPrefix]) is a hash tag, so that on Redis Cluster all the keys live in the same slot,
+// as the scripts require.
+//
+// Events expire with their NIP-40 expiration, or once older than the TTL set with [WithTTL]. Expired events are skipped
+// by queries, which also remove their ids from the sorted sets. Call [Store.Trim] periodically to remove the rest.
+// With [WithSearch], the content of the events is indexed by RediSearch, and NIP-50 filters are served by [Store.Search].
+package redis
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+	"github.com/pippellia-btc/nastro"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix is the prefix of all the keys of the store, see [WithPrefix].
+const DefaultPrefix = "{nastro}:"
+
+// pageSize is the number of ids read from a sorted set at once.
+const pageSize = 500
+
+// Store of Nostr events that uses a Redis database.
+// It embeds the *goredis.Client for direct interaction, e.g. to call Close or Ping.
+type Store struct {
+	*goredis.Client
+	options *goredis.Options // the client options, modified by the options before the client is created
+
+	prefix string
+	ttl    time.Duration
+	search string // the name of the RediSearch index, empty if search is disabled
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithPrefix sets the prefix of all the keys of the store, which defaults to [DefaultPrefix].
+// On Redis Cluster, the prefix must be a hash tag like "{relay}:", so that all the keys live in the same slot.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) error {
+		if prefix == "" {
+			return errors.New("prefix must not be empty")
+		}
+		s.prefix = prefix
+		return nil
+	}
+}
+
+// WithTTL sets how long events are kept after their created_at. By default events are kept until deleted.
+// Events already older than the TTL are not saved.
+func WithTTL(d time.Duration) Option {
+	return func(s *Store) error {
+		if d < time.Second {
+			return fmt.Errorf("TTL must be at least one second, got %v", d)
+		}
+		s.ttl = d
+		return nil
+	}
+}
+
+// WithSearch indexes the content of the events with RediSearch in the index of the provided name,
+// creating it if needed, so that NIP-50 filters can be served by [Store.Search].
+// The Redis server must have the search module, which is bundled with Redis 8 and Redis Stack.
+func WithSearch(index string) Option {
+	return func(s *Store) error {
+		if index == "" {
+			return errors.New("search index name must not be empty")
+		}
+		s.search = index
+		return nil
+	}
+}
+
+// WithPoolSize sets the maximum number of connections of the client.
+func WithPoolSize(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("pool size must be positive")
+		}
+		s.options.PoolSize = n
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before executing queries.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before inserting them into the database.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a Redis store connected to the database at the provided URL, e.g. "redis://:password@localhost:6379/0".
+func New(URL string, opts ...Option) (*Store, error) {
+	options, err := goredis.ParseURL(URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the database URL: %w", err)
+	}
+
+	store := &Store{
+		options:         options,
+		prefix:          DefaultPrefix,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.search != "" {
+		// the search commands have stable replies only with RESP2
+		options.Protocol = 2
+	}
+
+	ctx := context.Background()
+	store.Client = goredis.NewClient(options)
+	if err := store.Ping(ctx).Err(); err != nil {
+		store.Client.Close()
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+
+	if store.search != "" {
+		if err := store.createIndex(ctx); err != nil {
+			store.Client.Close()
+			return nil, fmt.Errorf("failed to create the search index: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// createIndex creates the search index over the content of the event hashes, unless it already exists.
+func (s *Store) createIndex(ctx context.Context) error {
+	err := s.FTCreate(ctx, s.search,
+		&goredis.FTCreateOptions{OnHash: true, Prefix: []any{s.eventKey("")}},
+		&goredis.FieldSchema{FieldName: "content", FieldType: goredis.SearchFieldTypeText},
+		&goredis.FieldSchema{FieldName: "created_at", FieldType: goredis.SearchFieldTypeNumeric, Sortable: true},
+	).Err()
+
+	if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		return err
+	}
+	return nil
+}
+
+// library defines the functions shared by the write scripts.
+//
+// insert saves the event described by ARGV (id, json, created_at, content, index keys, address, expires_at or 0, event prefix)
+// unless it's already stored, and points the address to it if it's the latest of its category.
+// remove deletes the event stored in the hash, with its index entries and the address pointing to it.
+const library = `
+local function remove(eventKey, id)
+	local indexes = redis.call('HGET', eventKey, 'indexes')
+	if not indexes then return 0 end
+	for _, key in ipairs(cjson.decode(indexes)) do
+		redis.call('ZREM', key, id)
+	end
+	local address = redis.call('HGET', eventKey, 'address')
+	if address and address ~= '' and redis.call('GET', address) == id then
+		redis.call('DEL', address)
+	end
+	redis.call('DEL', eventKey)
+	return 1
+end
+
+local function insert(eventKey)
+	if redis.call('EXISTS', eventKey) == 1 then return 0 end
+	local id, createdAt, address, expiresAt = ARGV[1], tonumber(ARGV[3]), ARGV[6], tonumber(ARGV[7])
+	redis.call('HSET', eventKey, 'json', ARGV[2], 'created_at', ARGV[3], 'content', ARGV[4], 'indexes', ARGV[5], 'address', address)
+	if expiresAt > 0 then redis.call('EXPIREAT', eventKey, expiresAt) end
+	for _, key in ipairs(cjson.decode(ARGV[5])) do
+		redis.call('ZADD', key, createdAt, id)
+	end
+	if address ~= '' then
+		local latest = redis.call('GET', address)
+		local latestCreatedAt = latest and tonumber(redis.call('HGET', ARGV[8] .. latest, 'created_at'))
+		if not latestCreatedAt or createdAt > latestCreatedAt then
+			redis.call('SET', address, id)
+			if expiresAt > 0 then redis.call('EXPIREAT', address, expiresAt) end
+		end
+	end
+	return 1
+end
+`
+
+// KEYS: event. Returns 1 if the event was saved.
+var saveScript = goredis.NewScript(library + `
+return insert(KEYS[1])`)
+
+// KEYS: event, address. Returns 1 if the event was saved, 0 if the latest of its category is newer or equal.
+var replaceScript = goredis.NewScript(library + `
+local latest = redis.call('GET', KEYS[2])
+if latest then
+	local latestKey = ARGV[8] .. latest
+	local latestCreatedAt = tonumber(redis.call('HGET', latestKey, 'created_at'))
+	if latestCreatedAt and latestCreatedAt >= tonumber(ARGV[3]) then return 0 end
+	remove(latestKey, latest)
+end
+return insert(KEYS[1])`)
+
+// KEYS: event. ARGV: id. Returns 1 if the event was deleted.
+var deleteScript = goredis.NewScript(library + `
+return remove(KEYS[1], ARGV[1])`)
+
+// KEYS: index. ARGV: event prefix, ids. Returns the JSON of the events, false for the ones that are gone.
+var fetchScript = goredis.NewScript(`
+local events = {}
+for i = 2, #ARGV do
+	events[i - 1] = redis.call('HGET', ARGV[1] .. ARGV[i], 'json')
+end
+return events`)
+
+func (s *Store) eventKey(id string) string       { return s.prefix + "event:" + id }
+func (s *Store) timeKey() string                 { return s.prefix + "time" }
+func (s *Store) kindKey(kind int) string         { return s.prefix + "kind:" + strconv.Itoa(kind) }
+func (s *Store) pubkeyKey(pubkey string) string  { return s.prefix + "pubkey:" + pubkey }
+func (s *Store) tagKey(key, value string) string { return s.prefix + "tag:" + key + ":" + value }
+func (s *Store) addressKey(event *nostr.Event) string {
+	if nostr.IsAddressableKind(event.Kind) {
+		return fmt.Sprintf("%saddress:%d:%s:%s", s.prefix, event.Kind, event.PubKey, event.Tags.GetD())
+	}
+	return fmt.Sprintf("%saddress:%d:%s:", s.prefix, event.Kind, event.PubKey)
+}
+
+// indexKeys returns the sorted sets indexing the event. Single-letter tags are indexed, each value once.
+func (s *Store) indexKeys(event *nostr.Event) []string {
+	keys := []string{s.timeKey(), s.kindKey(event.Kind), s.pubkeyKey(event.PubKey)}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+
+		key := s.tagKey(tag[0], tag[1])
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// expiresAt returns when the event expires in unix seconds, the earliest of its NIP-40 expiration and created_at plus the TTL,
+// or 0 if it never expires.
+func (s *Store) expiresAt(event *nostr.Event) int64 {
+	var deadline int64
+	if s.ttl > 0 {
+		deadline = int64(event.CreatedAt) + int64(s.ttl/time.Second)
+	}
+
+	if ts := nip40.GetExpiration(event.Tags); ts >= 0 && (deadline == 0 || int64(ts) < deadline) {
+		deadline = int64(ts)
+	}
+	return deadline
+}
+
+// args returns the arguments of the write scripts for the event, and false if the event already expired.
+func (s *Store) args(event *nostr.Event) ([]any, bool, error) {
+	expiresAt := s.expiresAt(event)
+	if expiresAt > 0 && expiresAt <= time.Now().Unix() {
+		return nil, false, nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal the event: %w", err)
+	}
+
+	indexes, err := json.Marshal(s.indexKeys(event))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal the index keys: %w", err)
+	}
+
+	var address string
+	if nastro.IsValidReplacement(event.Kind) {
+		address = s.addressKey(event)
+	}
+
+	return []any{event.ID, data, int64(event.CreatedAt), event.Content, indexes, address, expiresAt, s.eventKey("")}, true, nil
+}
+
+// Save the event in the store. If the event is already stored or expired, nothing happens and nil is returned.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	args, ok, err := s.args(event)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := saveScript.Run(ctx, s.Client, []string{s.eventKey(event.ID)}, args...).Err(); err != nil {
+		return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+// The replacement runs in a single script, so it's atomic across the processes sharing the database.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	args, ok, err := s.args(event)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	replaced, err := replaceScript.Run(ctx, s.Client, []string{s.eventKey(event.ID), s.addressKey(event)}, args...).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+	return replaced == 1, nil
+}
+
+// Delete the event with the provided id. If the event is not found, nothing happens and nil is returned.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := deleteScript.Run(ctx, s.Client, []string{s.eventKey(id)}, id).Err(); err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// Trim removes from the sorted sets the ids of the events older than the TTL set with [WithTTL], and returns how many were removed.
+// Ids of events that expired earlier (e.g. with NIP-40) are removed by the queries that find them.
+func (s *Store) Trim(ctx context.Context) (int64, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+
+	cutoff := "(" + strconv.FormatInt(time.Now().Add(-s.ttl).Unix(), 10)
+	var removed int64
+
+	iter := s.ScanType(ctx, 0, s.prefix+"*", 1000, "zset").Iterator()
+	for iter.Next(ctx) {
+		n, err := s.ZRemRangeByScore(ctx, iter.Val(), "-inf", cutoff).Result()
+		if err != nil {
+			return removed, fmt.Errorf("failed to trim %s: %w", iter.Val(), err)
+		}
+		removed += n
+	}
+
+	if err := iter.Err(); err != nil {
+		return removed, fmt.Errorf("failed to scan the sorted sets: %w", err)
+	}
+	return removed, nil
+}
+
+// Query stored events matching the provided filters, sorted by created_at in descending order, and by id
+// in ascending order among events created at the same time. Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for i, filter := range filters {
+		result, err := s.query(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to query filter %d: %w", nastro.ErrInternalQuery, i, err)
+		}
+
+		for _, event := range result {
+			if _, ok := seen[event.ID]; !ok {
+				seen[event.ID] = struct{}{}
+				events = append(events, event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count stored events matching the provided filters, returning the sum of the counts of each filter.
+// The limits of the filters are ignored. Counting scans the same sorted sets as a query.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var total int64
+	for i, filter := range filters {
+		filter.Limit = 0
+		filter.LimitZero = false
+
+		events, err := s.query(ctx, filter)
+		if err != nil {
+			return 0, fmt.Errorf("%w: failed to count filter %d: %w", nastro.ErrInternalQuery, i, err)
+		}
+		total += int64(len(events))
+	}
+	return total, nil
+}
+
+// query returns the events matching the filter, sorted with [compare] and truncated to the filter's limit.
+// A limit of zero means no limit, unless LimitZero is set.
+func (s *Store) query(ctx context.Context, filter nostr.Filter) ([]nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
+	}
+
+	var events []nostr.Event
+	if len(filter.IDs) > 0 {
+		found, err := s.fetch(ctx, s.timeKey(), filter.IDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range found {
+			if event != nil && filter.Matches(event) {
+				events = append(events, *event)
+			}
+		}
+	} else {
+		for _, key := range s.plan(filter) {
+			matches, err := s.scan(ctx, key, filter)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, matches...)
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	events = slices.CompactFunc(events, func(e1, e2 nostr.Event) bool { return e1.ID == e2.ID })
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// scan the sorted set from the newest to the oldest id within the filter's time range,
+// and returns the events matching the filter, up to the filter's limit.
+// The ids of the events that are gone are removed from the sorted set.
+func (s *Store) scan(ctx context.Context, key string, filter nostr.Filter) ([]nostr.Event, error) {
+	min, max := "-inf", "+inf"
+	if s.ttl > 0 {
+		min = strconv.FormatInt(time.Now().Add(-s.ttl).Unix(), 10)
+	}
+	if filter.Since != nil && (s.ttl <= 0 || int64(*filter.Since) > time.Now().Add(-s.ttl).Unix()) {
+		min = strconv.FormatInt(int64(*filter.Since), 10)
+	}
+	if filter.Until != nil {
+		max = strconv.FormatInt(int64(*filter.Until), 10)
+	}
+
+	var events []nostr.Event
+	var gone []any
+	defer func() {
+		if len(gone) > 0 {
+			// best effort, the ids are removed by the next query otherwise
+			s.ZRem(context.WithoutCancel(ctx), key, gone...)
+		}
+	}()
+
+	var last nostr.Timestamp
+	for offset := int64(0); ; offset += pageSize {
+		ids, err := s.ZRevRangeByScore(ctx, key, &goredis.ZRangeBy{Min: min, Max: max, Offset: offset, Count: pageSize}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+
+		found, err := s.fetch(ctx, key, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, event := range found {
+			if event == nil {
+				gone = append(gone, ids[i])
+				continue
+			}
+
+			if filter.Limit > 0 && len(events) >= filter.Limit && event.CreatedAt != last {
+				// the events with the same created_at as the last one might sort before it by id
+				return events, nil
+			}
+
+			if filter.Matches(event) {
+				events = append(events, *event)
+				last = event.CreatedAt
+			}
+		}
+
+		if len(ids) < pageSize {
+			return events, nil
+		}
+	}
+}
+
+// fetch returns the events with the provided ids, nil for the ones that are not stored.
+// The key only routes the script to the node holding the keys of the store.
+func (s *Store) fetch(ctx context.Context, key string, ids []string) ([]*nostr.Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, s.eventKey(""))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	data, err := fetchScript.Run(ctx, s.Client, []string{key}, args...).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the events: %w", err)
+	}
+
+	events := make([]*nostr.Event, len(data))
+	for i, d := range data {
+		raw, ok := d.(string)
+		if !ok {
+			continue
+		}
+
+		event := &nostr.Event{}
+		if err := json.Unmarshal([]byte(raw), event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event ID %s: %w", ids[i], err)
+		}
+		events[i] = event
+	}
+	return events, nil
+}
+
+// plan returns the sorted sets to scan for the filter, using the most selective index available.
+// Authors are preferred, followed by the tags with the fewest values, kinds, and lastly the time index.
+// The other conditions of the filter are checked on the events.
+func (s *Store) plan(filter nostr.Filter) []string {
+	if len(filter.Authors) > 0 {
+		keys := make([]string, len(filter.Authors))
+		for i, author := range filter.Authors {
+			keys[i] = s.pubkeyKey(author)
+		}
+		return keys
+	}
+
+	var key string
+	var values []string
+	for k, v := range filter.Tags {
+		if len(v) == 0 || len(k) != 1 {
+			// events with tags that aren't indexed would be missed
+			continue
+		}
+
+		if values == nil || len(v) < len(values) || (len(v) == len(values) && k < key) {
+			key, values = k, v
+		}
+	}
+
+	if values != nil {
+		keys := make([]string, len(values))
+		for i, value := range values {
+			keys[i] = s.tagKey(key, value)
+		}
+		return keys
+	}
+
+	if len(filter.Kinds) > 0 {
+		keys := make([]string, len(filter.Kinds))
+		for i, kind := range filter.Kinds {
+			keys[i] = s.kindKey(kind)
+		}
+		return keys
+	}
+
+	return []string{s.timeKey()}
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func TestIndexKeys(t *testing.T) {
+	store := &Store{prefix: DefaultPrefix}
+	event := &nostr.Event{
+		PubKey: "alice",
+		Kind:   1,
+		Tags: nostr.Tags{
+			{"e", "xxx"},
+			{"e", "xxx"},
+			{"p", "yyy"},
+			{"title", "not indexed"},
+			{"t"},
+		},
+	}
+
+	expected := []string{
+		"{nastro}:time",
+		"{nastro}:kind:1",
+		"{nastro}:pubkey:alice",
+		"{nastro}:tag:e:xxx",
+		"{nastro}:tag:p:yyy",
+	}
+
+	if keys := store.indexKeys(event); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestAddressKey(t *testing.T) {
+	store := &Store{prefix: DefaultPrefix}
+	tests := []struct {
+		event    *nostr.Event
+		expected string
+	}{
+		{event: &nostr.Event{PubKey: "alice", Kind: 0, Tags: nostr.Tags{{"d", "ignored"}}}, expected: "{nastro}:address:0:alice:"},
+		{event: &nostr.Event{PubKey: "alice", Kind: 30023, Tags: nostr.Tags{{"d", "post"}}}, expected: "{nastro}:address:30023:alice:post"},
+		{event: &nostr.Event{PubKey: "alice", Kind: 30023}, expected: "{nastro}:address:30023:alice:"},
+	}
+
+	for _, test := range tests {
+		if key := store.addressKey(test.event); key != test.expected {
+			t.Fatalf("expected key %s, got %s", test.expected, key)
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		event    *nostr.Event
+		expected int64
+	}{
+		{name: "never", event: &nostr.Event{CreatedAt: 100}, expected: 0},
+		{name: "ttl", ttl: time.Minute, event: &nostr.Event{CreatedAt: 100}, expected: 160},
+		{name: "nip-40", event: &nostr.Event{CreatedAt: 100, Tags: nostr.Tags{{"expiration", "150"}}}, expected: 150},
+		{name: "nip-40 before ttl", ttl: time.Minute, event: &nostr.Event{CreatedAt: 100, Tags: nostr.Tags{{"expiration", "150"}}}, expected: 150},
+		{name: "ttl before nip-40", ttl: time.Minute, event: &nostr.Event{CreatedAt: 100, Tags: nostr.Tags{{"expiration", "500"}}}, expected: 160},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &Store{ttl: test.ttl}
+			if deadline := store.expiresAt(test.event); deadline != test.expected {
+				t.Fatalf("expected %d, got %d", test.expected, deadline)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	store := &Store{prefix: DefaultPrefix}
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		expected []string
+	}{
+		{
+			name:     "authors",
+			filter:   nostr.Filter{Authors: []string{"alice", "bob"}, Kinds: []int{1}},
+			expected: []string{"{nastro}:pubkey:alice", "{nastro}:pubkey:bob"},
+		},
+		{
+			name:     "fewest tag values",
+			filter:   nostr.Filter{Tags: nostr.TagMap{"e": {"x", "y"}, "p": {"z"}, "title": {"w"}}, Kinds: []int{1}},
+			expected: []string{"{nastro}:tag:p:z"},
+		},
+		{
+			name:     "kinds",
+			filter:   nostr.Filter{Kinds: []int{1, 7}, Tags: nostr.TagMap{"title": {"w"}}},
+			expected: []string{"{nastro}:kind:1", "{nastro}:kind:7"},
+		},
+		{
+			name:     "time",
+			filter:   nostr.Filter{},
+			expected: []string{"{nastro}:time"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if keys := store.plan(test.filter); !reflect.DeepEqual(keys, test.expected) {
+				t.Fatalf("expected keys %v, got %v", test.expected, keys)
+			}
+		})
+	}
+}
+
+func TestSearchWords(t *testing.T) {
+	words := searchWords("Hello, hello WORLD! language:en nostr-relay")
+	expected := []string{"hello", "world", "nostr", "relay"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Fatalf("expected words %v, got %v", expected, words)
+	}
+}
+
+// newStore returns a store with a random prefix on the database at REDIS_URL, skipping the test if it's not set.
+func newStore(t *testing.T, opts ...Option) *Store {
+	URL := os.Getenv("REDIS_URL")
+	if URL == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	prefix := "{nastro-test-" + hex.EncodeToString(b) + "}:"
+
+	store, err := New(URL, append([]Option{WithPrefix(prefix)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		iter := store.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			store.Del(ctx, iter.Val())
+		}
+		store.Close()
+	})
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store { return newStore(t) })
+}
+
+func TestTTL(t *testing.T) {
+	store := newStore(t, WithTTL(time.Hour))
+	now := nostr.Now()
+
+	fresh := &nostr.Event{ID: "fresh", PubKey: "alice", Kind: 1, CreatedAt: now}
+	old := &nostr.Event{ID: "old", PubKey: "alice", Kind: 1, CreatedAt: now - 2*3600}
+	expired := &nostr.Event{ID: "expired", PubKey: "alice", Kind: 1, CreatedAt: now, Tags: nostr.Tags{{"expiration", strconv.FormatInt(int64(now)-1, 10)}}}
+
+	for _, event := range []*nostr.Event{fresh, old, expired} {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Authors: []string{"alice"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].ID != "fresh" {
+		t.Fatalf("expected the fresh event, got %v", results)
+	}
+
+	if ttl := store.TTL(ctx, store.eventKey("fresh")).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expected the event to expire within an hour, got %v", ttl)
+	}
+
+	removed, err := store.Trim(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 {
+		t.Fatalf("expected no index entries to trim, got %d", removed)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+	var _ nastro.Searcher = &Store{}
+}
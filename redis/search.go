@@ -0,0 +1,150 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Search stored events matching the provided filters, like [Store.Query], with the addition that filters
+// with a Search field only match events whose content contains all of its words, as indexed by RediSearch.
+// NIP-50 extensions (key:value words) are ignored.
+//
+// Unlike what NIP-50 suggests, results are not sorted by relevance, but in the same order as [Store.Query].
+// The store must have been created with [WithSearch], otherwise [nastro.ErrUnsupportedSearch] is returned.
+func (s *Store) Search(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if s.search == "" {
+		return nil, fmt.Errorf("%w: the store was created without WithSearch", nastro.ErrUnsupportedSearch)
+	}
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for i, filter := range filters {
+		// the filter policy is applied without the search, as it might reject it
+		search := filter.Search
+		filter.Search = ""
+
+		sanitized, err := s.sanitizeFilters(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range sanitized {
+			var result []nostr.Event
+			if words := searchWords(search); len(words) > 0 {
+				result, err = s.searchContent(ctx, f, words)
+			} else {
+				result, err = s.query(ctx, f)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%w: failed to search filter %d: %w", nastro.ErrInternalQuery, i, err)
+			}
+
+			for _, event := range result {
+				if _, ok := seen[event.ID]; !ok {
+					seen[event.ID] = struct{}{}
+					events = append(events, event)
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// searchContent returns the events whose content contains all the words and that match the filter,
+// sorted with [compare] and truncated to the filter's limit.
+func (s *Store) searchContent(ctx context.Context, filter nostr.Filter, words []string) ([]nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
+	}
+
+	options := &goredis.FTSearchOptions{
+		Return:         []goredis.FTSearchReturn{{FieldName: "json"}},
+		SortBy:         []goredis.FTSearchSortBy{{FieldName: "created_at", Desc: true}},
+		Limit:          pageSize,
+		DialectVersion: 2,
+	}
+
+	if filter.Since != nil || filter.Until != nil {
+		timeRange := goredis.FTSearchFilter{FieldName: "created_at", Min: "-inf", Max: "+inf"}
+		if filter.Since != nil {
+			timeRange.Min = int64(*filter.Since)
+		}
+		if filter.Until != nil {
+			timeRange.Max = int64(*filter.Until)
+		}
+		options.Filters = []goredis.FTSearchFilter{timeRange}
+	}
+
+	query := "@content:(" + strings.Join(words, " ") + ")"
+
+	var events []nostr.Event
+	var last nostr.Timestamp
+pages:
+	for offset := 0; ; offset += pageSize {
+		options.LimitOffset = offset
+		result, err := s.FTSearchWithArgs(ctx, s.search, query, options).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %q: %w", query, err)
+		}
+
+		for _, doc := range result.Docs {
+			event := &nostr.Event{}
+			if err := json.Unmarshal([]byte(doc.Fields["json"]), event); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal %s: %w", doc.ID, err)
+			}
+
+			if filter.Limit > 0 && len(events) >= filter.Limit && event.CreatedAt != last {
+				// the events with the same created_at as the last one might sort before it by id
+				break pages
+			}
+
+			if filter.Matches(event) {
+				events = append(events, *event)
+				last = event.CreatedAt
+			}
+		}
+
+		if len(result.Docs) < pageSize {
+			break pages
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// searchWords returns the unique lowercase words of the search, made of letters and digits,
+// skipping the NIP-50 extensions.
+func searchWords(search string) []string {
+	var words []string
+	for _, field := range strings.Fields(search) {
+		if strings.Contains(field, ":") {
+			continue
+		}
+
+		parts := strings.FieldsFunc(strings.ToLower(field), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		for _, word := range parts {
+			if !slices.Contains(words, word) {
+				words = append(words, word)
+			}
+		}
+	}
+	return words
+}
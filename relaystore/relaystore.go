@@ -0,0 +1,319 @@
+// The relaystore package defines a store backed by a remote Nostr relay, so that applications can use
+// the same [nastro.Store] abstraction whether their events are local or remote.
+//
+// Query sends a REQ for each filter, Save and Replace publish the event with EVENT, Delete publishes a NIP-09
+// deletion request (kind 5), and Count sends a NIP-45 COUNT for each filter.
+// The relay has the last word: it might reject events, ignore deletions or cap the limits of the filters.
+package relaystore
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// DefaultTimeout is how long an operation waits for the relay, see [WithTimeout].
+const DefaultTimeout = 10 * time.Second
+
+// Store of Nostr events that uses a remote relay. The connection is re-established when lost.
+type Store struct {
+	url         string
+	timeout     time.Duration
+	secretKey   string
+	assumeValid bool
+
+	mu    sync.Mutex
+	relay *nostr.Relay
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithTimeout sets how long each operation waits for the relay, which defaults to [DefaultTimeout].
+func WithTimeout(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		s.timeout = d
+		return nil
+	}
+}
+
+// WithSecretKey sets the hex secret key that signs the deletion requests of [Store.Delete],
+// and answers the NIP-42 authentication challenges of the relay.
+// Relays only honor the deletion requests of the authors of the events.
+func WithSecretKey(sk string) Option {
+	return func(s *Store) error {
+		if _, err := nostr.GetPublicKey(sk); err != nil {
+			return fmt.Errorf("invalid secret key: %w", err)
+		}
+		s.secretKey = sk
+		return nil
+	}
+}
+
+// WithAssumeValid skips verifying the signatures of the events received from the relay, which must be trusted.
+func WithAssumeValid() Option {
+	return func(s *Store) error {
+		s.assumeValid = true
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before sending them to the relay.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before publishing them to the relay.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store connected to the relay at the provided URL, e.g. "wss://relay.example.com".
+func New(ctx context.Context, URL string, opts ...Option) (*Store, error) {
+	store := &Store{
+		url:             URL,
+		timeout:         DefaultTimeout,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := store.Relay(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Relay returns the connection to the relay, reconnecting if it was lost.
+func (s *Store) Relay(ctx context.Context) (*nostr.Relay, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.relay != nil && s.relay.IsConnected() {
+		return s.relay, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	relay := nostr.NewRelay(context.Background(), s.url)
+	relay.AssumeValid = s.assumeValid
+	if err := relay.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.url, err)
+	}
+
+	s.relay = relay
+	return relay, nil
+}
+
+// Close the connection to the relay.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.relay == nil {
+		return nil
+	}
+	return s.relay.Close()
+}
+
+// Save the event by publishing it to the relay. If the relay already has the event, nil is returned.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	if err := s.publish(ctx, event); err != nil {
+		return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
+
+// publish the event, authenticating and retrying once if the relay requires it.
+func (s *Store) publish(ctx context.Context, event *nostr.Event) error {
+	relay, err := s.Relay(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err = relay.Publish(ctx, *event)
+	if err != nil && strings.Contains(err.Error(), "auth-required:") && s.secretKey != "" {
+		if err := relay.Auth(ctx, func(e *nostr.Event) error { return e.Sign(s.secretKey) }); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+		err = relay.Publish(ctx, *event)
+	}
+
+	if err != nil && strings.Contains(err.Error(), "duplicate:") {
+		return nil
+	}
+	return err
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+// The relay is queried for the stored event of the same category before publishing, so concurrent
+// replacements through other clients might be reported inaccurately, although the relay keeps the newest event.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}, Limit: 1}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": {event.Tags.GetD()}}
+	}
+
+	stored, err := s.query(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+
+	if len(stored) > 0 && stored[0].CreatedAt >= event.CreatedAt {
+		return false, nil
+	}
+
+	if err := s.publish(ctx, event); err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+	return true, nil
+}
+
+// Delete the event with the provided id, by publishing a NIP-09 deletion request signed with [WithSecretKey].
+// The relay only deletes the event if it has been published by the same key.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if s.secretKey == "" {
+		return fmt.Errorf("failed to delete event ID %s: the store has no secret key, see WithSecretKey", id)
+	}
+
+	request := &nostr.Event{
+		Kind:      nostr.KindDeletion,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"e", id}},
+	}
+
+	if err := request.Sign(s.secretKey); err != nil {
+		return fmt.Errorf("failed to sign the deletion request of event ID %s: %w", id, err)
+	}
+
+	if err := s.publish(ctx, request); err != nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// Query the relay for the events matching the provided filters, sending one REQ per filter.
+// Events are sorted by created_at in descending order, and by id in ascending order among events created at the same time.
+// Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.query(ctx, filters...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+	return events, nil
+}
+
+func (s *Store) query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	relay, err := s.Relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+
+		result, err := relay.QuerySync(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			// the relay didn't send EOSE in time, so the result might be partial
+			return nil, err
+		}
+
+		for _, event := range result {
+			if _, ok := seen[event.ID]; !ok {
+				seen[event.ID] = struct{}{}
+				events = append(events, *event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count the events matching the provided filters with NIP-45, returning the sum of the counts of each filter.
+// Relays that don't support NIP-45 never answer, so the count fails after the timeout.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	relay, err := s.Relay(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var total int64
+	for _, filter := range filters {
+		count, _, err := relay.Count(ctx, nostr.Filters{filter})
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
@@ -0,0 +1,172 @@
+package relaystore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+// newRelay starts a minimal relay backed by an ephemeral store, and returns its URL.
+// Unlike real relays, it doesn't verify signatures and honors the deletion requests of any author.
+func newRelay(t *testing.T) string {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+
+			var responses []nostr.Envelope
+			switch env := nostr.ParseMessage(string(data)).(type) {
+			case *nostr.EventEnvelope:
+				err := handleEvent(ctx, store, &env.Event)
+				ok := &nostr.OKEnvelope{EventID: env.Event.ID, OK: err == nil}
+				if err != nil {
+					ok.Reason = "error: " + err.Error()
+				}
+				responses = append(responses, ok)
+
+			case *nostr.ReqEnvelope:
+				events, _ := store.Query(ctx, env.Filters...)
+				for _, event := range events {
+					responses = append(responses, &nostr.EventEnvelope{SubscriptionID: &env.SubscriptionID, Event: event})
+				}
+				eose := nostr.EOSEEnvelope(env.SubscriptionID)
+				responses = append(responses, &eose)
+
+			case *nostr.CountEnvelope:
+				count, _ := store.Count(ctx, env.Filter)
+				responses = append(responses, &nostr.CountEnvelope{SubscriptionID: env.SubscriptionID, Count: &count})
+			}
+
+			for _, response := range responses {
+				data, _ := response.MarshalJSON()
+				if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+					return
+				}
+			}
+		}
+	}))
+
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func handleEvent(ctx context.Context, store nastro.Store, event *nostr.Event) error {
+	switch {
+	case event.Kind == nostr.KindDeletion:
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "e" {
+				continue
+			}
+
+			if err := store.Delete(ctx, tag[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case nastro.IsValidReplacement(event.Kind):
+		_, err := store.Replace(ctx, event)
+		return err
+
+	default:
+		return store.Save(ctx, event)
+	}
+}
+
+func newStore(t *testing.T, opts ...Option) *Store {
+	store, err := New(ctx, newRelay(t), append([]Option{WithAssumeValid()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return newStore(t, WithSecretKey(nostr.GeneratePrivateKey()))
+	})
+}
+
+func TestStore(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	store := newStore(t, WithSecretKey(sk))
+
+	pubkey, _ := nostr.GetPublicKey(sk)
+	events := []*nostr.Event{
+		{PubKey: pubkey, Kind: 1, CreatedAt: 1, Content: "hello"},
+		{PubKey: pubkey, Kind: 1, CreatedAt: 2, Content: "world"},
+		{PubKey: pubkey, Kind: 0, CreatedAt: 3, Content: "{}"},
+	}
+
+	for _, event := range events {
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, event := range events[:2] {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replaced, err := store.Replace(ctx, events[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !replaced {
+		t.Fatalf("expected the profile to be saved")
+	}
+
+	if err := store.Delete(ctx, events[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := store.Query(ctx, nostr.Filter{Authors: []string{pubkey}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].ID != events[2].ID || results[1].ID != events[1].ID {
+		t.Fatalf("expected the profile and the second note, got %v", results)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected count 2, got %d", count)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,95 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+type opKind int
+
+const (
+	opSave opKind = iota
+	opReplace
+	opDelete
+)
+
+// operation is a write of the primary to be applied to the replicas.
+type operation struct {
+	kind  opKind
+	event nostr.Event
+	id    string // the id of the deleted event
+}
+
+func (op operation) apply(ctx context.Context, store nastro.Store) error {
+	switch op.kind {
+	case opSave:
+		if err := store.Save(ctx, &op.event); err != nil && !errors.Is(err, nastro.ErrDuplicate) {
+			return err
+		}
+		return nil
+
+	case opReplace:
+		_, err := store.Replace(ctx, &op.event)
+		return err
+
+	default:
+		return store.Delete(ctx, op.id)
+	}
+}
+
+var errEvicted = errors.New("operation evicted from the journal")
+
+// journal is a ring-buffer of the latest operations, identified by increasing sequence numbers.
+type journal struct {
+	mu      sync.Mutex
+	ops     []operation
+	next    uint64        // the sequence number of the next operation
+	updated chan struct{} // closed and replaced on every append
+}
+
+func newJournal(size int) *journal {
+	return &journal{
+		ops:     make([]operation, size),
+		updated: make(chan struct{}),
+	}
+}
+
+func (j *journal) append(op operation) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.ops[j.next%uint64(len(j.ops))] = op
+	j.next++
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// end returns the sequence number of the next operation.
+func (j *journal) end() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.next
+}
+
+// get returns the operation with the provided sequence number.
+// If the operation has yet to be appended, it returns a channel closed on the next append.
+// If the operation has been evicted, it returns [errEvicted].
+func (j *journal) get(seq uint64) (operation, <-chan struct{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	switch {
+	case seq >= j.next:
+		return operation{}, j.updated, nil
+
+	case j.next-seq > uint64(len(j.ops)):
+		return operation{}, nil, errEvicted
+
+	default:
+		return j.ops[seq%uint64(len(j.ops))], nil, nil
+	}
+}
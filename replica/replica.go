@@ -0,0 +1,362 @@
+// The replica package defines a store that writes to a primary store and replicates the writes
+// to one or more replicas asynchronously, reading from the replicas when the primary fails.
+// It gives small relays high availability for reads without external infrastructure.
+//
+// Writes are recorded in a bounded in-memory journal, which each replica applies in order, retrying on errors.
+// A replica that falls behind by more than the journal catches up by copying all the events of the primary.
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+var (
+	DefaultJournalSize   = 10_000
+	DefaultRetryInterval = time.Second
+	DefaultBatchSize     = 1000
+)
+
+// Store of Nostr events that writes to a primary store and replicates to the replicas.
+type Store struct {
+	primary  nastro.Store
+	replicas []*replica
+	journal  *journal
+
+	retryInterval time.Duration
+	batchSize     int
+	onError       func(replica int, err error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+// replica is a store and the sequence number of the next operation of the journal it must apply.
+type replica struct {
+	store nastro.Store
+	next  atomic.Uint64
+
+	mu       sync.Mutex
+	progress chan struct{} // closed and replaced every time next advances
+}
+
+type Option func(*Store) error
+
+// WithJournalSize sets the maximum number of writes kept for the replicas, which defaults to [DefaultJournalSize].
+// Replicas that fall further behind catch up by copying all the events of the primary.
+func WithJournalSize(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("journal size must be positive")
+		}
+		s.journal = newJournal(n)
+		return nil
+	}
+}
+
+// WithRetryInterval sets how long a replica waits before retrying a failed write, which defaults to [DefaultRetryInterval].
+func WithRetryInterval(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("retry interval must be positive")
+		}
+		s.retryInterval = d
+		return nil
+	}
+}
+
+// WithBatchSize sets how many events are copied at a time when a replica catches up, which defaults to [DefaultBatchSize].
+func WithBatchSize(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("batch size must be positive")
+		}
+		s.batchSize = n
+		return nil
+	}
+}
+
+// WithErrorHandler sets a function called with the index and the error of a replica every time it fails to replicate.
+// The failed write is retried, so the function is useful for logging and alerting.
+func WithErrorHandler(fn func(replica int, err error)) Option {
+	return func(s *Store) error {
+		s.onError = fn
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before querying the primary or the replicas.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before writing them to the primary.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store that writes to the primary and replicates to the replicas, which are assumed
+// to be in sync with the primary. The replicas must accept all the events accepted by the primary.
+func New(primary nastro.Store, replicas []nastro.Store, opts ...Option) (*Store, error) {
+	if primary == nil {
+		return nil, errors.New("primary store must not be nil")
+	}
+
+	store := &Store{
+		primary:         primary,
+		journal:         newJournal(DefaultJournalSize),
+		retryInterval:   DefaultRetryInterval,
+		batchSize:       DefaultBatchSize,
+		onError:         func(int, error) {},
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store.cancel = cancel
+
+	for _, r := range replicas {
+		store.replicas = append(store.replicas, &replica{store: r, progress: make(chan struct{})})
+	}
+
+	for i := range store.replicas {
+		store.wg.Add(1)
+		go func() {
+			defer store.wg.Done()
+			store.replicate(ctx, i)
+		}()
+	}
+	return store, nil
+}
+
+// Close stops the replication and closes the primary and the replicas that implement [io.Closer].
+// Writes not yet replicated are lost, see [Store.Sync].
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+
+	var errs []error
+	if closer, ok := s.primary.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+
+	for _, r := range s.replicas {
+		if closer, ok := r.store.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lag returns, for each replica, the number of writes of the primary it has yet to apply.
+func (s *Store) Lag() []uint64 {
+	next := s.journal.end()
+	lag := make([]uint64, len(s.replicas))
+	for i, r := range s.replicas {
+		lag[i] = next - r.next.Load()
+	}
+	return lag
+}
+
+// Sync waits until all the replicas have applied the writes made before the call, or the context is done.
+func (s *Store) Sync(ctx context.Context) error {
+	target := s.journal.end()
+	for _, r := range s.replicas {
+		for {
+			r.mu.Lock()
+			progress := r.progress
+			r.mu.Unlock()
+
+			if r.next.Load() >= target {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-progress:
+			}
+		}
+	}
+	return nil
+}
+
+// Save the event in the primary, and replicate it if successful.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	if err := s.primary.Save(ctx, event); err != nil {
+		return err
+	}
+
+	s.journal.append(operation{kind: opSave, event: *event})
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store], in the primary,
+// and replicate the replacement if successful.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	replaced, err := s.primary.Replace(ctx, event)
+	if err != nil || !replaced {
+		return replaced, err
+	}
+
+	s.journal.append(operation{kind: opReplace, event: *event})
+	return true, nil
+}
+
+// Delete the event with the provided id from the primary, and replicate the deletion if successful.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if err := s.primary.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	s.journal.append(operation{kind: opDelete, id: id})
+	return nil
+}
+
+// Query the primary for the events matching the provided filters.
+// If the primary fails, the replicas are queried in order, returning the results of the first that succeeds.
+// Replicas might not have the latest writes of the primary.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.primary.Query(ctx, filters...)
+	if err == nil || ctx.Err() != nil {
+		return events, err
+	}
+
+	errs := []error{fmt.Errorf("primary: %w", err)}
+	for i, r := range s.replicas {
+		events, err := r.store.Query(ctx, filters...)
+		if err == nil {
+			return events, nil
+		}
+		errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Count the events matching the provided filters in the primary.
+// If the primary fails, the replicas are asked in order, returning the count of the first that succeeds.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	count, err := s.primary.Count(ctx, filters...)
+	if err == nil || ctx.Err() != nil {
+		return count, err
+	}
+
+	errs := []error{fmt.Errorf("primary: %w", err)}
+	for i, r := range s.replicas {
+		count, err := r.store.Count(ctx, filters...)
+		if err == nil {
+			return count, nil
+		}
+		errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+	}
+	return 0, errors.Join(errs...)
+}
+
+// replicate applies the operations of the journal to the i-th replica, until the context is cancelled.
+func (s *Store) replicate(ctx context.Context, i int) {
+	r := s.replicas[i]
+	for {
+		op, wait, err := s.journal.get(r.next.Load())
+		switch {
+		case errors.Is(err, errEvicted):
+			err = s.catchUp(ctx, r)
+
+		case wait != nil:
+			select {
+			case <-ctx.Done():
+				return
+			case <-wait:
+				continue
+			}
+
+		default:
+			err = op.apply(ctx, r.store)
+			if err == nil {
+				r.advance(r.next.Load() + 1)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			s.onError(i, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.retryInterval):
+			}
+		}
+	}
+}
+
+// catchUp copies all the events of the primary to the replica, skipping the operations of the journal made before.
+// Deletions the replica missed while it was too far behind are not replicated.
+func (s *Store) catchUp(ctx context.Context, r *replica) error {
+	next := s.journal.end()
+	err := nastro.Scan(ctx, s.primary, nostr.Filter{}, s.batchSize, func(event nostr.Event) error {
+		kind := opSave
+		if nastro.IsValidReplacement(event.Kind) {
+			kind = opReplace
+		}
+		return operation{kind: kind, event: event}.apply(ctx, r.store)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to catch up: %w", err)
+	}
+
+	r.advance(next)
+	return nil
+}
+
+func (r *replica) advance(next uint64) {
+	r.next.Store(next)
+	r.mu.Lock()
+	close(r.progress)
+	r.progress = make(chan struct{})
+	r.mu.Unlock()
+}
@@ -0,0 +1,240 @@
+package replica
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+var errDown = errors.New("store is down")
+
+// flaky is a store that fails every operation while it's down.
+type flaky struct {
+	nastro.Store
+	down atomic.Bool
+}
+
+func (f *flaky) Save(ctx context.Context, event *nostr.Event) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.Store.Save(ctx, event)
+}
+
+func (f *flaky) Delete(ctx context.Context, id string) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.Store.Delete(ctx, id)
+}
+
+func (f *flaky) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if f.down.Load() {
+		return false, errDown
+	}
+	return f.Store.Replace(ctx, event)
+}
+
+func (f *flaky) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if f.down.Load() {
+		return nil, errDown
+	}
+	return f.Store.Query(ctx, filters...)
+}
+
+func (f *flaky) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if f.down.Load() {
+		return 0, errDown
+	}
+	return f.Store.Count(ctx, filters...)
+}
+
+func newFlaky(t *testing.T) *flaky {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &flaky{Store: store}
+}
+
+func newStore(t *testing.T, primary nastro.Store, replicas []nastro.Store, opts ...Option) *Store {
+	opts = append([]Option{WithRetryInterval(time.Millisecond)}, opts...)
+	store, err := New(primary, replicas, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func waitSync(t *testing.T, store *Store) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := store.Sync(ctx); err != nil {
+		t.Fatalf("failed to sync the replicas with lag %v: %v", store.Lag(), err)
+	}
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newEvent(kind int, createdAt nostr.Timestamp) *nostr.Event {
+	return &nostr.Event{ID: randHex(32), PubKey: randHex(32), Kind: kind, CreatedAt: createdAt}
+}
+
+func expectIDs(t *testing.T, store nastro.Store, expected ...*nostr.Event) {
+	t.Helper()
+	events, err := store.Query(ctx, nostr.Filter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+
+	for i := range events {
+		if events[i].ID != expected[i].ID {
+			t.Fatalf("expected event ID %s at position %d, got %s", expected[i].ID, i, events[i].ID)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		return newStore(t, newFlaky(t), []nastro.Store{newFlaky(t)})
+	})
+}
+
+func TestReplication(t *testing.T) {
+	replicas := []nastro.Store{newFlaky(t), newFlaky(t)}
+	store := newStore(t, newFlaky(t), replicas)
+
+	note := newEvent(1, 10)
+	deleted := newEvent(1, 20)
+	profile := newEvent(0, 30)
+	for _, event := range []*nostr.Event{note, deleted} {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Replace(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSync(t, store)
+	for _, replica := range replicas {
+		expectIDs(t, replica, profile, note)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	primary, replica := newFlaky(t), newFlaky(t)
+	store := newStore(t, primary, []nastro.Store{replica})
+
+	event := newEvent(1, 10)
+	if err := store.Save(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSync(t, store)
+	primary.down.Store(true)
+
+	if err := store.Save(ctx, newEvent(1, 20)); !errors.Is(err, errDown) {
+		t.Fatalf("expected error %v, got %v", errDown, err)
+	}
+
+	expectIDs(t, store, event)
+	count, err := store.Count(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected count 1, got %d", count)
+	}
+
+	replica.down.Store(true)
+	if _, err := store.Query(ctx, nostr.Filter{Limit: 1}); !errors.Is(err, errDown) {
+		t.Fatalf("expected error %v, got %v", errDown, err)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	replica := newFlaky(t)
+	replica.down.Store(true)
+
+	var failures atomic.Int64
+	store := newStore(t, newFlaky(t), []nastro.Store{replica},
+		WithJournalSize(2),
+		WithBatchSize(2),
+		WithErrorHandler(func(int, error) { failures.Add(1) }),
+	)
+
+	events := make([]*nostr.Event, 5)
+	for i := range events {
+		events[i] = newEvent(1, nostr.Timestamp(5-i))
+		if err := store.Save(ctx, events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lag := store.Lag(); lag[0] != 5 {
+		t.Fatalf("expected lag 5, got %d", lag[0])
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); failures.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failures to be reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	replica.down.Store(false)
+	waitSync(t, store)
+	expectIDs(t, replica, events...)
+}
+
+func TestJournal(t *testing.T) {
+	journal := newJournal(2)
+	if _, wait, err := journal.get(0); wait == nil || err != nil {
+		t.Fatalf("expected to wait, got error %v", err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		journal.append(operation{kind: opDelete, id: id})
+	}
+
+	if _, _, err := journal.get(0); !errors.Is(err, errEvicted) {
+		t.Fatalf("expected error %v, got %v", errEvicted, err)
+	}
+
+	op, wait, err := journal.get(1)
+	if op.id != "b" || wait != nil || err != nil {
+		t.Fatalf("expected operation b, got %v with error %v", op, err)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
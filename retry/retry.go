@@ -0,0 +1,310 @@
+// The retry package defines a middleware that retries the operations of a store that fail with transient errors,
+// with exponential backoff, and stops calling the store with a circuit breaker when it keeps failing,
+// which is useful for network stores (postgres, redis, relaystore) and for sqlite databases locked by other writers.
+//
+//	store, err := retry.New(sqliteStore,
+//		retry.WithRetryable(sqlite.IsDatabaseLocked),
+//		retry.WithBreaker(5, 30*time.Second),
+//	)
+//
+// The operations are retried as they are, so they must be idempotent, which is true for the operations of [nastro.Store],
+// except that a write that succeeded but reported an error might be reported as a duplicate or as not replaced by the retry.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// ErrCircuitOpen is returned without calling the store while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("error: the store is temporarily unavailable")
+
+var (
+	// DefaultAttempts is the number of times an operation is attempted, including the first.
+	DefaultAttempts = 3
+
+	// DefaultBaseBackoff is the maximum wait before the first retry, which doubles at every retry.
+	DefaultBaseBackoff = 50 * time.Millisecond
+
+	// DefaultMaxBackoff is the maximum wait between two attempts.
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+// Store wraps a [nastro.Store], retrying its operations.
+type Store struct {
+	nastro.Store
+	attempts  int
+	base      time.Duration
+	max       time.Duration
+	retryable func(error) bool
+	breaker   breaker
+	metrics   nastro.Collector
+}
+
+type Option func(*Store) error
+
+// WithAttempts sets the number of times an operation is attempted, including the first.
+func WithAttempts(n int) Option {
+	return func(s *Store) error {
+		if n < 1 {
+			return errors.New("attempts must be positive")
+		}
+		s.attempts = n
+		return nil
+	}
+}
+
+// WithBackoff sets the maximum wait before the first retry, which doubles at every retry up to max.
+// Each wait is random between zero and its maximum (full jitter), so that clients retrying together spread out.
+func WithBackoff(base, max time.Duration) Option {
+	return func(s *Store) error {
+		if base <= 0 || max < base {
+			return errors.New("backoff must be positive, and the max at least the base")
+		}
+		s.base = base
+		s.max = max
+		return nil
+	}
+}
+
+// WithRetryable sets the function that decides whether an error is transient, and the operation should be retried.
+// The default is [IsTransient].
+func WithRetryable(f func(error) bool) Option {
+	return func(s *Store) error {
+		if f == nil {
+			return errors.New("retryable function must not be nil")
+		}
+		s.retryable = f
+		return nil
+	}
+}
+
+// WithBreaker opens the circuit breaker after the provided number of consecutive operations failed with transient
+// errors after all their attempts. While open, operations fail with [ErrCircuitOpen] without calling the store.
+// After the cooldown, a single operation is let through: if it succeeds the breaker closes, otherwise it opens again.
+// By default there is no circuit breaker.
+func WithBreaker(failures int, cooldown time.Duration) Option {
+	return func(s *Store) error {
+		if failures < 1 || cooldown <= 0 {
+			return errors.New("failures and cooldown of the breaker must be positive")
+		}
+		s.breaker.threshold = failures
+		s.breaker.cooldown = cooldown
+		return nil
+	}
+}
+
+// WithMetrics sets a [nastro.Collector] that receives [nastro.Collector.Retry] for every retry,
+// and [nastro.Collector.Conflict] for every operation that failed after all its attempts.
+func WithMetrics(c nastro.Collector) Option {
+	return func(s *Store) error {
+		s.metrics = c
+		return nil
+	}
+}
+
+// New returns a store that retries the operations of the store.
+func New(store nastro.Store, opts ...Option) (*Store, error) {
+	s := &Store{
+		Store:     store,
+		attempts:  DefaultAttempts,
+		base:      DefaultBaseBackoff,
+		max:       DefaultMaxBackoff,
+		retryable: IsTransient,
+		breaker:   breaker{now: time.Now},
+		metrics:   nastro.NoMetrics{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Middleware returns a [nastro.Middleware] that wraps the stores with [New], each with its own circuit breaker.
+// It returns an error if any of the options is invalid.
+func Middleware(opts ...Option) (nastro.Middleware, error) {
+	if _, err := New(nil, opts...); err != nil {
+		return nil, err
+	}
+
+	return func(store nastro.Store) nastro.Store {
+		s, _ := New(store, opts...)
+		return s
+	}, nil
+}
+
+// IsTransient is the default retryable function, which retries all the errors except the rejections
+// of the store (see [nastro.Rejection]) and the cancellation of the context.
+func IsTransient(err error) bool {
+	if _, ok := nastro.Rejection(err); ok {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// Open reports whether the circuit breaker is open.
+func (s *Store) Open() bool {
+	return s.breaker.open()
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	return s.do(ctx, nastro.OpSave, func() error {
+		return s.Store.Save(ctx, event)
+	})
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	var replaced bool
+	err := s.do(ctx, nastro.OpReplace, func() (err error) {
+		replaced, err = s.Store.Replace(ctx, event)
+		return err
+	})
+	return replaced, err
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return s.do(ctx, nastro.OpDelete, func() error {
+		return s.Store.Delete(ctx, id)
+	})
+}
+
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	var events []nostr.Event
+	err := s.do(ctx, nastro.OpQuery, func() (err error) {
+		events, err = s.Store.Query(ctx, filters...)
+		return err
+	})
+	return events, err
+}
+
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var count int64
+	err := s.do(ctx, nastro.OpCount, func() (err error) {
+		count, err = s.Store.Count(ctx, filters...)
+		return err
+	})
+	return count, err
+}
+
+// do calls fn until it succeeds or fails with an error that is not transient, at most attempts times.
+func (s *Store) do(ctx context.Context, op nastro.Operation, fn func() error) error {
+	if !s.breaker.allow() {
+		if op == nastro.OpQuery || op == nastro.OpCount {
+			return fmt.Errorf("%w: %w", nastro.ErrInternalQuery, ErrCircuitOpen)
+		}
+		return ErrCircuitOpen
+	}
+
+	backoff := s.base
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !s.retryable(err) {
+			s.breaker.success()
+			return err
+		}
+
+		if attempt >= s.attempts {
+			s.metrics.Conflict(op)
+			s.breaker.failure()
+			return err
+		}
+
+		s.metrics.Retry(op)
+		select {
+		case <-ctx.Done():
+			s.breaker.release()
+			return errors.Join(err, ctx.Err())
+		case <-time.After(rand.N(backoff)):
+		}
+		backoff = min(2*backoff, s.max)
+	}
+}
+
+// breaker is a circuit breaker, disabled if the threshold is zero.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int       // the consecutive failures
+	openedAt time.Time // when the breaker opened, or zero if it's closed
+	probing  bool      // whether an operation is let through after the cooldown
+}
+
+// allow reports whether an operation can call the store.
+func (b *breaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.openedAt.IsZero():
+		return true
+
+	case b.probing || b.now().Sub(b.openedAt) < b.cooldown:
+		return false
+
+	default:
+		b.probing = true
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	if b.threshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openedAt = time.Time{}
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	if b.threshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.failures = 0
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// release lets another operation through after the cooldown, if the one let through was interrupted.
+func (b *breaker) release() {
+	if b.threshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
@@ -0,0 +1,174 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var (
+	ctx        = context.Background()
+	errTimeout = errors.New("i/o timeout")
+)
+
+// flaky is a store whose saves fail with its errors, one per call, before succeeding.
+type flaky struct {
+	nastro.Store
+	errs  []error
+	saves int
+}
+
+func (f *flaky) Save(ctx context.Context, event *nostr.Event) error {
+	f.saves++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	return f.Store.Save(ctx, event)
+}
+
+// counter is a collector that counts the retries and conflicts.
+type counter struct {
+	nastro.NoMetrics
+	retries, conflicts int
+}
+
+func (c *counter) Retry(nastro.Operation)    { c.retries++ }
+func (c *counter) Conflict(nastro.Operation) { c.conflicts++ }
+
+func newStore(t *testing.T, opts ...Option) (*Store, *flaky) {
+	backend, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &flaky{Store: backend}
+	opts = append([]Option{WithBackoff(time.Millisecond, time.Millisecond)}, opts...)
+	store, err := New(f, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, f
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, _ := newStore(t)
+		return store
+	})
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		err       error
+		saves     int
+		retries   int
+		conflicts int
+	}{
+		{name: "success", saves: 1},
+		{name: "transient", errs: []error{errTimeout, errTimeout}, saves: 3, retries: 2},
+		{name: "exhausted", errs: []error{errTimeout, errTimeout, errTimeout}, err: errTimeout, saves: 3, retries: 2, conflicts: 1},
+		{name: "rejected", errs: []error{nastro.ErrDuplicate}, err: nastro.ErrDuplicate, saves: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := &counter{}
+			store, backend := newStore(t, WithAttempts(3), WithMetrics(metrics))
+			backend.errs = test.errs
+
+			err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if backend.saves != test.saves {
+				t.Fatalf("expected %d saves, got %d", test.saves, backend.saves)
+			}
+
+			if metrics.retries != test.retries || metrics.conflicts != test.conflicts {
+				t.Fatalf("expected %d retries and %d conflicts, got %d and %d", test.retries, test.conflicts, metrics.retries, metrics.conflicts)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	store, backend := newStore(t, WithBackoff(time.Hour, time.Hour))
+	backend.errs = []error{errTimeout}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1})
+	if !errors.Is(err, errTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the error and the deadline, got %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	store, backend := newStore(t, WithAttempts(1), WithBreaker(2, time.Minute))
+	now := time.Unix(1700000000, 0)
+	store.breaker.now = func() time.Time { return now }
+
+	save := func(id string) error {
+		return store.Save(ctx, &nostr.Event{ID: id, Kind: 1})
+	}
+
+	backend.errs = []error{errTimeout, errTimeout, errTimeout}
+	save("a")
+	save("a")
+	if !store.Open() {
+		t.Fatal("expected the breaker to be open")
+	}
+
+	if err := save("a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected error %v, got %v", ErrCircuitOpen, err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{}); !errors.Is(err, nastro.ErrInternalQuery) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected an internal query error, got %v", err)
+	}
+
+	if backend.saves != 2 {
+		t.Fatalf("expected the store not to be called while open, got %d saves", backend.saves)
+	}
+
+	// the operation let through after the cooldown fails, so the breaker opens again
+	now = now.Add(time.Minute)
+	if err := save("a"); !errors.Is(err, errTimeout) {
+		t.Fatalf("expected error %v, got %v", errTimeout, err)
+	}
+
+	if err := save("a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected error %v, got %v", ErrCircuitOpen, err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := save("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Open() {
+		t.Fatal("expected the breaker to be closed")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	if _, err := Middleware(WithAttempts(0)); err == nil {
+		t.Fatal("expected an error for invalid options")
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,68 @@
+package nastro
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Scan calls fn on all the events of the store matching the filter, from the newest to the oldest,
+// querying batchSize events at a time by moving the until of the filter, whose limit is ignored.
+// It stops at the first error of fn, which is returned. fn may write to the store, for example to delete the event.
+//
+// The scan might end early on stores that clamp the limit of the filters to less than the number
+// of matching events they store with the same created_at.
+func Scan(ctx context.Context, store Store, filter nostr.Filter, batchSize int, fn func(event nostr.Event) error) error {
+	if batchSize < 1 {
+		return errors.New("batch size must be positive")
+	}
+
+	until := nostr.Timestamp(math.MaxUint32)
+	if filter.Until != nil {
+		until = *filter.Until
+	}
+
+	filter.Until = &until
+	filter.LimitZero = false
+	filter.Limit = batchSize
+	seen := make(map[string]struct{}) // the events visited that have created_at == until
+
+	for {
+		page, err := store.Query(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		fresh := 0
+		for _, event := range page {
+			if _, ok := seen[event.ID]; ok {
+				continue
+			}
+
+			fresh++
+			if event.CreatedAt < until {
+				until = event.CreatedAt
+				clear(seen)
+			}
+
+			seen[event.ID] = struct{}{}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case fresh > 0:
+			filter.Limit = batchSize
+
+		case len(page) >= filter.Limit:
+			// the page is made of events already visited with the same created_at, so it must grow to find the others
+			filter.Limit *= 2
+
+		default:
+			return nil
+		}
+	}
+}
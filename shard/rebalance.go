@@ -0,0 +1,113 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Rebalance moves the events that are not in their shard, for example after adding a store or changing the shard function:
+//
+//	// from two shards to three
+//	store, err := shard.New([]nastro.Store{s0, s1, s2}, shard.ByPubkey)
+//	moved, err := store.Rebalance(ctx, 1000)
+//
+// Each shard is scanned from the newest event to the oldest, batchSize events at a time.
+// Misplaced events are written to their shard before being deleted from the old one, so they are never lost,
+// although queries running concurrently might return them twice. It returns the number of events moved.
+//
+// The scan might end early on shards that clamp the limit of the filters to less than the number
+// of events they store with the same created_at.
+func (s *Store) Rebalance(ctx context.Context, batchSize int) (int, error) {
+	if batchSize < 1 {
+		return 0, errors.New("batch size must be positive")
+	}
+
+	var moved int
+	for i := range s.stores {
+		n, err := s.rebalance(ctx, i, batchSize)
+		moved += n
+		if err != nil {
+			return moved, fmt.Errorf("failed to rebalance shard %d: %w", i, err)
+		}
+	}
+	return moved, nil
+}
+
+// rebalance moves the misplaced events of the i-th shard, returning how many were moved.
+func (s *Store) rebalance(ctx context.Context, i, batchSize int) (int, error) {
+	var moved int
+	until := nostr.Timestamp(math.MaxUint32)
+	limit := batchSize
+	kept := make(map[string]struct{}) // the events kept in the shard that have created_at == until
+
+	for {
+		page, err := s.stores[i].Query(ctx, nostr.Filter{Until: &until, Limit: limit})
+		if err != nil {
+			return moved, err
+		}
+
+		fresh := 0
+		for _, event := range page {
+			if _, ok := kept[event.ID]; ok {
+				continue
+			}
+
+			fresh++
+			if event.CreatedAt < until {
+				until = event.CreatedAt
+				clear(kept)
+			}
+
+			j, err := s.of(&event)
+			if err != nil {
+				return moved, err
+			}
+
+			if j == i {
+				kept[event.ID] = struct{}{}
+				continue
+			}
+
+			if err := s.move(ctx, &event, i, j); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+
+		switch {
+		case fresh > 0:
+			limit = batchSize
+
+		case len(page) >= limit:
+			// the page is made of events already kept with the same created_at, so it must grow to find the others
+			limit *= 2
+
+		default:
+			return moved, nil
+		}
+	}
+}
+
+// move the event from the shard i to the shard j.
+func (s *Store) move(ctx context.Context, event *nostr.Event, i, j int) error {
+	var err error
+	if nastro.IsValidReplacement(event.Kind) {
+		_, err = s.stores[j].Replace(ctx, event)
+	} else {
+		err = s.stores[j].Save(ctx, event)
+	}
+
+	if err != nil && !errors.Is(err, nastro.ErrDuplicate) {
+		return fmt.Errorf("failed to move event ID %s to shard %d: %w", event.ID, j, err)
+	}
+
+	if err := s.stores[i].Delete(ctx, event.ID); err != nil {
+		return fmt.Errorf("failed to delete event ID %s after moving it to shard %d: %w", event.ID, j, err)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// The shard package defines a store that distributes events across several underlying stores,
+// for example several sqlite files to avoid the bottleneck of a single writer.
+//
+// Writes go to the shard of the event, chosen by a [Func] such as [ByPubkey] or [ByKind].
+// Queries and counts are sent to all the shards concurrently, and their results are merged.
+package shard
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Func returns the shard of the event, in [0, n).
+// It must return the same shard for all the events of the same category (kind, pubkey, and d-tag if addressable),
+// so that Replace finds the event it supersedes.
+type Func func(event *nostr.Event, n int) int
+
+// ByPubkey assigns events to shards by the hash of their pubkey, keeping all the events of an author together.
+func ByPubkey(event *nostr.Event, n int) int {
+	return hash(event.PubKey, n)
+}
+
+// ByKind assigns events to shards by their kind.
+func ByKind(event *nostr.Event, n int) int {
+	return event.Kind % n
+}
+
+func hash(s string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Store of Nostr events sharded across the underlying stores.
+type Store struct {
+	stores []nastro.Store
+	shard  Func
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before sending them to the shards,
+// which apply their own policies as well.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before sending them to their shard.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store that distributes events across the provided stores with the shard function.
+// The order of the stores matters, as the shard function returns their index.
+func New(stores []nastro.Store, shard Func, opts ...Option) (*Store, error) {
+	if len(stores) == 0 {
+		return nil, errors.New("at least one store is required")
+	}
+
+	if shard == nil {
+		return nil, errors.New("shard function must not be nil")
+	}
+
+	store := &Store{
+		stores:          slices.Clone(stores),
+		shard:           shard,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Close the shards that implement [io.Closer], returning their errors joined.
+func (s *Store) Close() error {
+	var errs []error
+	for _, store := range s.stores {
+		if closer, ok := store.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shards returns the underlying stores.
+func (s *Store) Shards() []nastro.Store {
+	return slices.Clone(s.stores)
+}
+
+// of returns the index of the shard of the event.
+func (s *Store) of(event *nostr.Event) (int, error) {
+	i := s.shard(event, len(s.stores))
+	if i < 0 || i >= len(s.stores) {
+		return 0, fmt.Errorf("shard function returned %d for event ID %s, out of [0, %d)", i, event.ID, len(s.stores))
+	}
+	return i, nil
+}
+
+// Save the event in its shard.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	i, err := s.of(event)
+	if err != nil {
+		return err
+	}
+	return s.stores[i].Save(ctx, event)
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store], in the shard of the event.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	i, err := s.of(event)
+	if err != nil {
+		return false, err
+	}
+	return s.stores[i].Replace(ctx, event)
+}
+
+// Delete the event with the provided id from all the shards, as the id alone doesn't tell its shard.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return fanout(len(s.stores), func(i int) error {
+		if err := s.stores[i].Delete(ctx, id); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		return nil
+	})
+}
+
+// Query the shards for the events matching the provided filters, and merge the results.
+// Each filter is sent to all the shards, and the merged events are truncated to its limit.
+// Events are sorted by created_at in descending order, and by id in ascending order among events created at the same time.
+// Events matching more than one filter are returned once.
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []nostr.Event
+	seen := make(map[string]struct{})
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+
+		results := make([][]nostr.Event, len(s.stores))
+		err := fanout(len(s.stores), func(i int) error {
+			result, err := s.stores[i].Query(ctx, filter)
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", i, err)
+			}
+
+			results[i] = result
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+		}
+
+		matches := slices.Concat(results...)
+		slices.SortFunc(matches, compare)
+		if filter.Limit > 0 && len(matches) > filter.Limit {
+			matches = matches[:filter.Limit]
+		}
+
+		for _, event := range matches {
+			if _, ok := seen[event.ID]; !ok {
+				seen[event.ID] = struct{}{}
+				events = append(events, event)
+			}
+		}
+	}
+
+	slices.SortFunc(events, compare)
+	return events, nil
+}
+
+// Count the events matching the provided filters in all the shards, returning the sum of their counts.
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	counts := make([]int64, len(s.stores))
+	err := fanout(len(s.stores), func(i int) error {
+		count, err := s.stores[i].Count(ctx, filters...)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+
+		counts[i] = count
+		return nil
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, err)
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	return total, nil
+}
+
+// fanout calls fn concurrently for every index in [0, n), returning the errors of all the calls, joined.
+func fanout(n int, fn func(i int) error) error {
+	if n == 1 {
+		return fn(0)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// compare sorts events by created_at in descending order, and by id in ascending order.
+func compare(e1, e2 nostr.Event) int {
+	if c := cmp.Compare(e2.CreatedAt, e1.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(e1.ID, e2.ID)
+}
@@ -0,0 +1,135 @@
+package shard
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+func newStores(t *testing.T, n int) []nastro.Store {
+	stores := make([]nastro.Store, n)
+	for i := range n {
+		store, err := ephemeral.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = store
+	}
+	return stores
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newEvent(createdAt nostr.Timestamp) *nostr.Event {
+	return &nostr.Event{ID: randHex(32), PubKey: randHex(32), Kind: 1, CreatedAt: createdAt}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, err := New(newStores(t, 3), ByPubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestQueryLimit(t *testing.T) {
+	store, err := New(newStores(t, 3), ByPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 30 {
+		if err := store.Save(ctx, newEvent(nostr.Timestamp(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+
+	for i, event := range events {
+		if event.CreatedAt != nostr.Timestamp(29-i) {
+			t.Fatalf("expected the newest events in order, got created_at %d at position %d", event.CreatedAt, i)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	stores := newStores(t, 3)
+	old, err := New(stores[:1], ByPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]*nostr.Event, 50)
+	for i := range events {
+		events[i] = newEvent(nostr.Timestamp(i % 7)) // many events share the same created_at
+		if err := old.Save(ctx, events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := New(stores, ByPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := store.Rebalance(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	misplaced := 0
+	for _, event := range events {
+		i := ByPubkey(event, len(stores))
+		if i != 0 {
+			misplaced++
+		}
+
+		results, err := stores[i].Query(ctx, nostr.Filter{IDs: []string{event.ID}, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 1 {
+			t.Fatalf("expected event ID %s in shard %d", event.ID, i)
+		}
+	}
+
+	if moved != misplaced {
+		t.Fatalf("expected %d events moved, got %d", misplaced, moved)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != int64(len(events)) {
+		t.Fatalf("expected %d events, got %d", len(events), count)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
@@ -0,0 +1,37 @@
+package sink
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SubjectFunc returns the subject an event is published to.
+type SubjectFunc func(event *nostr.Event) string
+
+// ByKind returns a [SubjectFunc] that publishes events to the subject "<prefix>.<kind>", e.g. "nostr.events.1",
+// so that consumers can subscribe to the kinds they index with subjects like "nostr.events.1" or "nostr.events.>".
+func ByKind(prefix string) SubjectFunc {
+	return func(event *nostr.Event) string {
+		return prefix + "." + strconv.Itoa(event.Kind)
+	}
+}
+
+// JetStream returns a [Publisher] to the NATS JetStream stream that captures the subjects returned by subject.
+// The id of the event is the message id, so that the stream discards the events published twice
+// within its duplicate window.
+//
+//	nc, err := nats.Connect(nats.DefaultURL)
+//	js, err := jetstream.New(nc)
+//	_, err = js.CreateStream(ctx, jetstream.StreamConfig{Name: "NOSTR", Subjects: []string{"nostr.events.>"}})
+//	store, err := sink.New(sink.JetStream(js, sink.ByKind("nostr.events")))
+func JetStream(js jetstream.JetStream, subject SubjectFunc) Publisher {
+	return PublisherFunc(func(ctx context.Context, event *nostr.Event, data []byte) error {
+		msg := &nats.Msg{Subject: subject(event), Data: data}
+		_, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(event.ID))
+		return err
+	})
+}
@@ -0,0 +1,215 @@
+// The sink package defines a store that publishes the events it saves to an append-only log,
+// like NATS JetStream or Kafka, for firehose pipelines that feed indexers and other consumers.
+//
+// Queries and counts are served by an optional cache, usually a bounded store like ephemeral,
+// and are unsupported otherwise.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Publisher publishes the JSON encoding of the event to the log.
+type Publisher interface {
+	Publish(ctx context.Context, event *nostr.Event, data []byte) error
+}
+
+// PublisherFunc adapts a function to a [Publisher], for example to publish to Kafka:
+//
+//	writer := &kafka.Writer{Addr: kafka.TCP("localhost:9092"), Topic: "nostr-events"}
+//	publisher := sink.PublisherFunc(func(ctx context.Context, event *nostr.Event, data []byte) error {
+//		return writer.WriteMessages(ctx, kafka.Message{Key: []byte(event.PubKey), Value: data})
+//	})
+type PublisherFunc func(ctx context.Context, event *nostr.Event, data []byte) error
+
+func (f PublisherFunc) Publish(ctx context.Context, event *nostr.Event, data []byte) error {
+	return f(ctx, event, data)
+}
+
+// Store of Nostr events that publishes them to a log.
+type Store struct {
+	publisher Publisher
+	cache     nastro.Store
+
+	sanitizeFilters nastro.FilterPolicy
+	validateEvent   nastro.EventPolicy
+}
+
+type Option func(*Store) error
+
+// WithCache sets the store that keeps a copy of the published events, which serves queries and counts
+// and decides whether replaceable events supersede the previous ones.
+// A bounded store like ephemeral keeps the latest events, as a compacted view of the log.
+func WithCache(cache nastro.Store) Option {
+	return func(s *Store) error {
+		if cache == nil {
+			return errors.New("cache must not be nil")
+		}
+		s.cache = cache
+		return nil
+	}
+}
+
+// WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
+// It will be used to validate and modify filters before querying the cache.
+func WithFilterPolicy(v nastro.FilterPolicy) Option {
+	return func(s *Store) error {
+		s.sanitizeFilters = v
+		return nil
+	}
+}
+
+// WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
+// It will be used to validate events before publishing them.
+func WithEventPolicy(v nastro.EventPolicy) Option {
+	return func(s *Store) error {
+		s.validateEvent = v
+		return nil
+	}
+}
+
+// New returns a store that publishes events with the publisher.
+func New(publisher Publisher, opts ...Option) (*Store, error) {
+	if publisher == nil {
+		return nil, errors.New("publisher must not be nil")
+	}
+
+	store := &Store{
+		publisher:       publisher,
+		sanitizeFilters: nastro.DefaultFilterPolicy,
+		validateEvent:   func(*nostr.Event) error { return nil },
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Save publishes the event and then saves it in the cache, if any.
+// Events already in the cache are not published again, and [nastro.ErrDuplicate] is returned
+// if the cache returns it.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	if err := s.validateEvent(event); err != nil {
+		return err
+	}
+
+	if s.cache != nil {
+		cached, err := s.cache.Query(ctx, nostr.Filter{IDs: []string{event.ID}, Limit: 1})
+		if err != nil {
+			return fmt.Errorf("failed to save event ID %s: %w", event.ID, err)
+		}
+
+		if len(cached) > 0 {
+			return s.cache.Save(ctx, event)
+		}
+	}
+
+	if err := s.publish(ctx, event); err != nil {
+		return err
+	}
+
+	if s.cache != nil {
+		return s.cache.Save(ctx, event)
+	}
+	return nil
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store].
+// With a cache, the event is published only if it supersedes the cached one. Without a cache,
+// it's always published and true is returned, leaving the replacement to the consumers of the log.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	if err := s.validateEvent(event); err != nil {
+		return false, err
+	}
+
+	if s.cache == nil {
+		return true, s.publish(ctx, event)
+	}
+
+	// publish before writing to the cache, so that a failed publish can be retried
+	latest, err := s.latest(ctx, event)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace event ID %s: %w", event.ID, err)
+	}
+
+	if latest != nil && event.CreatedAt <= latest.CreatedAt {
+		return false, nil
+	}
+
+	if err := s.publish(ctx, event); err != nil {
+		return false, err
+	}
+	return s.cache.Replace(ctx, event)
+}
+
+// latest returns the cached event that the replaceable or addressable event would replace, if any.
+func (s *Store) latest(ctx context.Context, event *nostr.Event) (*nostr.Event, error) {
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}, Limit: 1}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": {event.Tags.GetD()}}
+	}
+
+	cached, err := s.cache.Query(ctx, filter)
+	if err != nil || len(cached) == 0 {
+		return nil, err
+	}
+	return &cached[0], nil
+}
+
+// Delete the event with the provided id from the cache. The log is append-only, so consumers
+// learn about deletions from the NIP-09 deletion requests (kind 5) published with [Store.Save].
+// Without a cache, it returns [errors.ErrUnsupported].
+func (s *Store) Delete(ctx context.Context, id string) error {
+	if s.cache == nil {
+		return fmt.Errorf("failed to delete event ID %s: %w", id, errors.ErrUnsupported)
+	}
+	return s.cache.Delete(ctx, id)
+}
+
+// Query the cache for the events matching the provided filters.
+// Without a cache, it returns [errors.ErrUnsupported].
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	if s.cache == nil {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, errors.ErrUnsupported)
+	}
+
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+	return s.cache.Query(ctx, filters...)
+}
+
+// Count the events in the cache matching the provided filters.
+// Without a cache, it returns [errors.ErrUnsupported].
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	if s.cache == nil {
+		return 0, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, errors.ErrUnsupported)
+	}
+	return s.cache.Count(ctx, filters...)
+}
+
+func (s *Store) publish(ctx context.Context, event *nostr.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event ID %s: %w", event.ID, err)
+	}
+
+	if err := s.publisher.Publish(ctx, event, data); err != nil {
+		return fmt.Errorf("failed to publish event ID %s: %w", event.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+// log is a [Publisher] that records the ids of the published events.
+type log struct {
+	ids []string
+}
+
+func (l *log) Publish(ctx context.Context, event *nostr.Event, data []byte) error {
+	l.ids = append(l.ids, event.ID)
+	return nil
+}
+
+func newCache(t *testing.T) nastro.Store {
+	cache, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store, err := New(&log{}, WithCache(newCache(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestPublish(t *testing.T) {
+	note := &nostr.Event{ID: "note", Kind: 1, CreatedAt: 1}
+	profile := &nostr.Event{ID: "profile", PubKey: "alice", Kind: 0, CreatedAt: 2}
+	old := &nostr.Event{ID: "old", PubKey: "alice", Kind: 0, CreatedAt: 1}
+
+	t.Run("without cache", func(t *testing.T) {
+		log := &log{}
+		store, err := New(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, event := range []*nostr.Event{note, note} {
+			if err := store.Save(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, event := range []*nostr.Event{profile, old} {
+			if _, err := store.Replace(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []string{"note", "note", "profile", "old"}
+		if !reflect.DeepEqual(log.ids, expected) {
+			t.Fatalf("expected published %v, got %v", expected, log.ids)
+		}
+
+		if _, err := store.Query(ctx, nostr.Filter{Limit: 1}); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("expected error %v, got %v", errors.ErrUnsupported, err)
+		}
+
+		if err := store.Delete(ctx, note.ID); !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("expected error %v, got %v", errors.ErrUnsupported, err)
+		}
+	})
+
+	t.Run("with cache", func(t *testing.T) {
+		log := &log{}
+		store, err := New(log, WithCache(newCache(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, event := range []*nostr.Event{note, note} {
+			if err := store.Save(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, event := range []*nostr.Event{profile, old} {
+			if _, err := store.Replace(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []string{"note", "profile"}
+		if !reflect.DeepEqual(log.ids, expected) {
+			t.Fatalf("expected published %v, got %v", expected, log.ids)
+		}
+
+		count, err := store.Count(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 2 {
+			t.Fatalf("expected count 2, got %d", count)
+		}
+	})
+}
+
+func TestRetry(t *testing.T) {
+	failing := true
+	var published []string
+	publisher := PublisherFunc(func(ctx context.Context, event *nostr.Event, data []byte) error {
+		if failing {
+			return errors.New("log unavailable")
+		}
+		published = append(published, event.ID)
+		return nil
+	})
+
+	store, err := New(publisher, WithCache(newCache(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := &nostr.Event{ID: "profile", PubKey: "alice", Kind: 0, CreatedAt: 1}
+	if _, err := store.Replace(ctx, profile); err == nil {
+		t.Fatal("expected an error from the publisher")
+	}
+
+	failing = false
+	replaced, err := store.Replace(ctx, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !replaced || !reflect.DeepEqual(published, []string{"profile"}) {
+		t.Fatalf("expected the retry to publish the event, got replaced %v and published %v", replaced, published)
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	URL := os.Getenv("NATS_URL")
+	if URL == "" {
+		t.Skip("NATS_URL is not set")
+	}
+
+	nc, err := nats.Connect(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	name := "NASTRO_TEST"
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: name, Subjects: []string{"nastro-test.>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.DeleteStream(ctx, name)
+
+	store, err := New(JetStream(js, ByKind("nastro-test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &nostr.Event{ID: "note", Kind: 1, CreatedAt: 1, Tags: nostr.Tags{}}
+	for range 2 {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := stream.GetLastMsgForSubject(ctx, "nastro-test.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published nostr.Event
+	if err := json.Unmarshal(msg.Data, &published); err != nil {
+		t.Fatal(err)
+	}
+
+	if published.ID != event.ID || msg.Sequence != 1 {
+		t.Fatalf("expected event ID %s published once, got %s at sequence %d", event.ID, published.ID, msg.Sequence)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
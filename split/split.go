@@ -0,0 +1,143 @@
+// The split package defines a store that sends the writes to one store and the reads to a pool of others,
+// for example writing to a badger primary and reading from sqlite replicas built by the replica package.
+//
+//	primary, _ := replica.New(badgerStore, replicas)
+//	store, err := split.New(primary, replicas)
+//
+// Reads are spread across the readers in turn. A reader that fails is skipped, and the read is retried on the next one.
+// The readers are usually updated asynchronously, so a read right after a write might not see it.
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Store of Nostr events that writes to the writer and reads from the readers.
+type Store struct {
+	writer   nastro.Store
+	readers  []nastro.Store
+	next     atomic.Uint64
+	fallback bool
+}
+
+type Option func(*Store) error
+
+// WithFallback makes the reads fall back to the writer when all the readers fail.
+func WithFallback() Option {
+	return func(s *Store) error {
+		s.fallback = true
+		return nil
+	}
+}
+
+// New returns a store that sends Save, Replace and Delete to the writer, and Query and Count to the readers.
+// The stores apply their own filter and event policies.
+func New(writer nastro.Store, readers []nastro.Store, opts ...Option) (*Store, error) {
+	if writer == nil {
+		return nil, errors.New("writer must not be nil")
+	}
+
+	if len(readers) == 0 {
+		return nil, errors.New("at least one reader is required")
+	}
+
+	store := &Store{
+		writer:  writer,
+		readers: slices.Clone(readers),
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Close the writer and the readers that implement [io.Closer], returning their errors joined.
+// A store that is both the writer and a reader is closed once.
+func (s *Store) Close() error {
+	var errs []error
+	closed := make(map[io.Closer]bool)
+	for _, store := range append([]nastro.Store{s.writer}, s.readers...) {
+		if closer, ok := store.(io.Closer); ok && !closed[closer] {
+			closed[closer] = true
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Writer returns the store of the writes.
+func (s *Store) Writer() nastro.Store {
+	return s.writer
+}
+
+// Readers returns the stores of the reads.
+func (s *Store) Readers() []nastro.Store {
+	return slices.Clone(s.readers)
+}
+
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	return s.writer.Save(ctx, event)
+}
+
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	return s.writer.Replace(ctx, event)
+}
+
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return s.writer.Delete(ctx, id)
+}
+
+// Query the next reader for the events matching the provided filters, see [Store].
+func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	var events []nostr.Event
+	err := s.read(ctx, func(store nastro.Store) (err error) {
+		events, err = store.Query(ctx, filters...)
+		return err
+	})
+	return events, err
+}
+
+// Count the events matching the provided filters in the next reader, see [Store].
+func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
+	var count int64
+	err := s.read(ctx, func(store nastro.Store) (err error) {
+		count, err = store.Count(ctx, filters...)
+		return err
+	})
+	return count, err
+}
+
+// read calls fn with the readers, starting from the next in turn, until one succeeds.
+// Errors that the other readers would return as well, such as invalid filters or a cancelled context, are returned right away.
+func (s *Store) read(ctx context.Context, fn func(nastro.Store) error) error {
+	start := int(s.next.Add(1) - 1)
+	stores := make([]nastro.Store, 0, len(s.readers)+1)
+	for i := range s.readers {
+		stores = append(stores, s.readers[(start+i)%len(s.readers)])
+	}
+
+	if s.fallback {
+		stores = append(stores, s.writer)
+	}
+
+	var errs []error
+	for _, store := range stores {
+		err := fn(store)
+		if err == nil || !errors.Is(err, nastro.ErrInternalQuery) || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("%w: all the readers failed: %w", nastro.ErrInternalQuery, errors.Join(errs...))
+}
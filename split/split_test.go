@@ -0,0 +1,126 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var (
+	ctx     = context.Background()
+	errDown = errors.New("connection refused")
+)
+
+// reader is a store that counts its queries, and fails them if down.
+type reader struct {
+	nastro.Store
+	queries int
+	down    bool
+}
+
+func (r *reader) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
+	r.queries++
+	if r.down {
+		return nil, fmt.Errorf("%w: %w", nastro.ErrInternalQuery, errDown)
+	}
+	return r.Store.Query(ctx, filters...)
+}
+
+func newEphemeral(t *testing.T) nastro.Store {
+	store, err := ephemeral.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		backend := newEphemeral(t)
+		store, err := New(backend, []nastro.Store{backend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestSplit(t *testing.T) {
+	writer := newEphemeral(t)
+	r1, r2 := &reader{Store: newEphemeral(t)}, &reader{Store: newEphemeral(t)}
+
+	store, err := New(writer, []nastro.Store{r1, r2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, &nostr.Event{ID: "a", Kind: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if events, _ := writer.Query(ctx, nostr.Filter{Limit: 10}); len(events) != 1 {
+		t.Fatalf("expected the event in the writer, got %v", events)
+	}
+
+	for range 4 {
+		if _, err := store.Query(ctx, nostr.Filter{Limit: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r1.queries != 2 || r2.queries != 2 {
+		t.Fatalf("expected the queries to be spread, got %d and %d", r1.queries, r2.queries)
+	}
+
+	r1.down = true
+	for range 2 {
+		if _, err := store.Query(ctx, nostr.Filter{Limit: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r2.queries != 4 {
+		t.Fatalf("expected the queries to skip the reader that is down, got %d queries", r2.queries)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	writer := newEphemeral(t)
+	down := &reader{Store: newEphemeral(t), down: true}
+	if err := writer.Save(ctx, &nostr.Event{ID: "a", Kind: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(writer, []nastro.Store{down})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Limit: 10}); !errors.Is(err, nastro.ErrInternalQuery) || !errors.Is(err, errDown) {
+		t.Fatalf("expected an internal query error, got %v", err)
+	}
+
+	store, err = New(writer, []nastro.Store{down}, WithFallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Query(ctx, nostr.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected the event of the writer, got %v", events)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}
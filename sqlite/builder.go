@@ -0,0 +1,138 @@
+package sqlite
+
+import (
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Builder generates the queries of the default builders, routing filters to the [Partitions]
+// and translating tag conditions according to its configuration.
+// The zero value generates the same queries as [DefaultQueryBuilder], [DefaultPageBuilder] and [DefaultCountBuilder].
+type Builder struct {
+	Partitions Partitions
+
+	// PrefixTags are the tag keys whose values are matched as prefixes, e.g. a 16 characters
+	// "#e" value matches all the events referencing an ID that starts with it.
+	PrefixTags []string
+
+	// NoCaseTags are the tag keys whose values are matched ignoring the case of ASCII letters.
+	NoCaseTags []string
+}
+
+// WithTagPrefixes makes the default builders match the values of the tags with the provided keys as prefixes,
+// for clients that send truncated values, e.g. a 16 characters "#e" value. Matching uses the event_tags index,
+// so the keys must be indexed, see [WithIndexedTags].
+//
+// It also sets the query, page and count builders to the ones of the store's [Builder],
+// so custom builders should be specified after this option.
+func WithTagPrefixes(keys ...string) Option {
+	return func(s *Store) error {
+		s.builder.PrefixTags = keys
+		s.useBuilder()
+		return nil
+	}
+}
+
+// useBuilder sets the query, page and count builders of the store to the ones of its [Builder].
+func (s *Store) useBuilder() {
+	s.queryBuilder = s.builder.QueryBuilder
+	s.pageBuilder = s.builder.PageBuilder
+	s.countBuilder = s.builder.CountBuilder
+}
+
+// QueryBuilder is the [QueryBuilder] of the builder.
+func (b Builder) QueryBuilder(filters ...nostr.Filter) ([]Query, error) {
+	return b.PageBuilder(Cursor{}, filters...)
+}
+
+// PageBuilder is the [PageBuilder] of the builder.
+func (b Builder) PageBuilder(after Cursor, filters ...nostr.Filter) ([]Query, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	subQueries := make([]string, 0, len(filters))
+	allArgs := make([]any, 0, len(filters))
+	limit := 0
+
+	for _, filter := range filters {
+		for _, part := range b.Partitions.split(filter) {
+			query, args := b.buildQuery(part.table, part.filter, after)
+			subQueries = append(subQueries, query)
+			allArgs = append(allArgs, args...)
+		}
+		limit += filter.Limit
+	}
+
+	if len(subQueries) == 1 {
+		query := subQueries[0] + " ORDER BY e.created_at DESC, e.id ASC LIMIT ?"
+		allArgs = append(allArgs, limit)
+		return []Query{{SQL: query, Args: allArgs}}, nil
+	}
+
+	query := "SELECT * FROM (" + strings.Join(subQueries, " UNION ALL ") + ")" +
+		" GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?"
+	allArgs = append(allArgs, limit)
+	return []Query{{SQL: query, Args: allArgs}}, nil
+}
+
+// CountBuilder is the deduplicating count builder, see [DefaultCountBuilder].
+func (b Builder) CountBuilder(filters ...nostr.Filter) ([]Query, error) {
+	parts := b.splitAll(filters...)
+	switch len(parts) {
+	case 0:
+		return nil, nil
+
+	case 1:
+		query, args := b.buildCount(parts[0].table, parts[0].filter)
+		return []Query{{SQL: query, Args: args}}, nil
+
+	default:
+		subQueries := make([]string, 0, len(parts))
+		allArgs := make([]any, 0, len(parts))
+
+		for _, part := range parts {
+			query, args := b.buildIDs(part.table, part.filter)
+			subQueries = append(subQueries, query)
+			allArgs = append(allArgs, args...)
+		}
+
+		query := "SELECT COUNT(*) FROM (" + strings.Join(subQueries, " UNION ") + ")"
+		return []Query{{SQL: query, Args: allArgs}}, nil
+	}
+}
+
+// ApproxCountBuilder is the approximate count builder, see [ApproxCountBuilder].
+func (b Builder) ApproxCountBuilder(filters ...nostr.Filter) ([]Query, error) {
+	parts := b.splitAll(filters...)
+	switch len(parts) {
+	case 0:
+		return nil, nil
+
+	case 1:
+		query, args := b.buildCount(parts[0].table, parts[0].filter)
+		return []Query{{SQL: query, Args: args}}, nil
+
+	default:
+		subQueries := make([]string, 0, len(parts))
+		allArgs := make([]any, 0, len(parts))
+
+		for _, part := range parts {
+			query, args := b.buildCount(part.table, part.filter)
+			subQueries = append(subQueries, "("+query+")")
+			allArgs = append(allArgs, args...)
+		}
+
+		query := "SELECT (" + strings.Join(subQueries, " + ") + ")"
+		return []Query{{SQL: query, Args: allArgs}}, nil
+	}
+}
+
+func (b Builder) splitAll(filters ...nostr.Filter) []part {
+	parts := make([]part, 0, len(filters))
+	for _, filter := range filters {
+		parts = append(parts, b.Partitions.split(filter)...)
+	}
+	return parts
+}
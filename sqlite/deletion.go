@@ -0,0 +1,135 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// WithTombstoneRetention makes the purge job (see [WithPurgeInterval]) prune the tombstones
+// older than the provided retention, see [Store.PruneTombstones].
+func WithTombstoneRetention(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("tombstone retention must be positive")
+		}
+		s.tombstoneRetention = d
+		return nil
+	}
+}
+
+// HandleDeletion applies the NIP-09 deletion request, deleting the events it references that
+// have been published by the same author. It doesn't save the deletion request itself.
+//
+// Every event referenced with an "e" tag gets a tombstone in the deleted_events table, so that
+// [Store.Save] refuses to store it again with [nastro.ErrDeleted], even if it arrives after the deletion.
+// Addressable or replaceable events referenced with an "a" tag are deleted up to the deletion's created_at.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/09.md
+func (s *Store) HandleDeletion(ctx context.Context, deletion *nostr.Event) error {
+	if deletion.Kind != nostr.KindDeletion {
+		return fmt.Errorf("event ID %s is not a deletion request: kind %d", deletion.ID, deletion.Kind)
+	}
+
+	remove := "DELETE FROM %s"
+	if s.softDelete {
+		remove = "UPDATE %s SET deleted_at = unixepoch()"
+	}
+
+	start := time.Now()
+	err := s.withRetries(nastro.OpDeletion, func() error {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to initiate the transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		for _, tag := range deletion.Tags {
+			if len(tag) < 2 {
+				continue
+			}
+
+			switch tag[0] {
+			case "e":
+				_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO deleted_events (id, deleted_at, by_pubkey) VALUES ($1, unixepoch(), $2)", tag[1], deletion.PubKey)
+				if err != nil {
+					return fmt.Errorf("failed to save the tombstone of event ID %s: %w", tag[1], err)
+				}
+
+				for _, table := range s.builder.Partitions.tables() {
+					query := fmt.Sprintf(remove, table) + " WHERE id = $1 AND pubkey = $2"
+					if _, err := tx.ExecContext(ctx, query, tag[1], deletion.PubKey); err != nil {
+						return fmt.Errorf("failed to delete event ID %s: %w", tag[1], err)
+					}
+				}
+
+			case "a":
+				kind, pubkey, d, ok := parseAddress(tag[1])
+				if !ok || pubkey != deletion.PubKey {
+					continue
+				}
+
+				query := fmt.Sprintf(remove, "events") + " WHERE kind = $1 AND pubkey = $2 AND created_at <= $3"
+				args := []any{kind, pubkey, deletion.CreatedAt}
+
+				if nostr.IsAddressableKind(kind) {
+					query += " AND id IN (SELECT event_id FROM event_tags WHERE key = 'd' AND value = $4)"
+					args = append(args, d)
+				}
+
+				if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+					return fmt.Errorf("failed to delete the events of address %s: %w", tag[1], err)
+				}
+			}
+		}
+		return tx.Commit()
+	})
+
+	s.metrics.Observe(nastro.OpDeletion, time.Since(start), 0, err)
+	if err != nil {
+		return fmt.Errorf("failed to handle deletion request %s: %w", deletion.ID, err)
+	}
+	return nil
+}
+
+// parseAddress parses an address of the form <kind>:<pubkey>:<d-tag>.
+func parseAddress(address string) (kind int, pubkey, d string, ok bool) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", "", false
+	}
+	return kind, parts[1], parts[2], true
+}
+
+// PruneTombstones removes the tombstones recorded before the provided time, and returns how many were removed.
+// After a tombstone is removed, the event it refers to can be saved again.
+func (s *Store) PruneTombstones(ctx context.Context, olderThan time.Time) (int64, error) {
+	var pruned int64
+	start := time.Now()
+	err := s.withRetries(nastro.OpPurge, func() error {
+		res, err := s.DB.ExecContext(ctx, "DELETE FROM deleted_events WHERE deleted_at <= $1", olderThan.Unix())
+		if err != nil {
+			return err
+		}
+
+		pruned, err = res.RowsAffected()
+		return err
+	})
+
+	s.metrics.Observe(nastro.OpPurge, time.Since(start), pruned, err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune tombstones: %w", err)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,168 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// importBatchSize is the number of events inserted in a single transaction by [Store.ImportFast].
+const importBatchSize = 10_000
+
+// deferredSchema lists the indexes and triggers of the events table that are dropped during
+// [Store.ImportFast], and recreated at the end by re-applying the base schema.
+const deferredSchema = `
+	DROP INDEX IF EXISTS pubkey_idx;
+	DROP INDEX IF EXISTS time_idx;
+	DROP INDEX IF EXISTS kind_idx;
+	DROP INDEX IF EXISTS event_tags_key_value_event_idx;
+	DROP INDEX IF EXISTS event_tags_key_value_nocase_idx;
+	DROP TRIGGER IF EXISTS stats_ai;`
+
+// ImportStats reports the outcome of [Store.ImportFast].
+type ImportStats struct {
+	Imported int64         // the number of events newly stored
+	Skipped  int64         // the number of events rejected by the event policy, duplicated or deleted
+	Took     time.Duration // the time it took, including the rebuild of indexes and stats
+}
+
+// Rate returns the number of events processed per second.
+func (s ImportStats) Rate() float64 {
+	if s.Took <= 0 {
+		return 0
+	}
+	return float64(s.Imported+s.Skipped) / s.Took.Seconds()
+}
+
+// ImportFast saves the events in large transactions, which is much faster than calling [Store.Save]
+// for each one, and it's meant for the initial seeding of a store from a dump.
+//
+// The secondary indexes and the stats trigger of the events table are dropped for the duration of the import,
+// and rebuilt at the end, so concurrent queries will be slower (but still correct) during the import.
+// Events are validated with the event policy, and the ones that fail are skipped.
+func (s *Store) ImportFast(ctx context.Context, events iter.Seq[*nostr.Event]) (ImportStats, error) {
+	start := time.Now()
+	stats := ImportStats{}
+
+	if _, err := s.DB.ExecContext(ctx, deferredSchema); err != nil {
+		return stats, fmt.Errorf("failed to drop the indexes before the import: %w", err)
+	}
+
+	batch := make([]*nostr.Event, 0, importBatchSize)
+	var err error
+
+	for event := range events {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		batch = append(batch, event)
+		if len(batch) < importBatchSize {
+			continue
+		}
+
+		if err = s.importBatch(ctx, batch, &stats); err != nil {
+			break
+		}
+		batch = batch[:0]
+	}
+
+	if err == nil && len(batch) > 0 {
+		err = s.importBatch(ctx, batch, &stats)
+	}
+
+	// the indexes must be rebuilt even if the import failed
+	if rebuildErr := s.rebuild(context.Background()); rebuildErr != nil {
+		err = errors.Join(err, rebuildErr)
+	}
+
+	stats.Took = time.Since(start)
+	return stats, err
+}
+
+// importBatch inserts the events in a single transaction, updating the import stats on success.
+func (s *Store) importBatch(ctx context.Context, events []*nostr.Event, stats *ImportStats) error {
+	var imported, skipped int64
+	start := time.Now()
+	err := s.withRetries(nastro.OpImport, func() error {
+		imported, skipped = 0, 0
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to initiate the transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		for _, event := range events {
+			if err := s.validateEvent(event); err != nil {
+				skipped++
+				continue
+			}
+
+			saved, err := s.insert(ctx, tx, event)
+			if errors.Is(err, nastro.ErrDeleted) {
+				skipped++
+				continue
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to import event with ID %s: %w", event.ID, err)
+			}
+
+			if saved {
+				imported++
+			} else {
+				skipped++
+			}
+		}
+		return tx.Commit()
+	})
+
+	s.metrics.Observe(nastro.OpImport, time.Since(start), imported, err)
+	if err != nil {
+		return err
+	}
+
+	stats.Imported += imported
+	stats.Skipped += skipped
+	return nil
+}
+
+// rebuild recreates the indexes and triggers dropped by the import, and recomputes the stats of all tables.
+func (s *Store) rebuild(ctx context.Context) error {
+	if _, err := s.DB.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("failed to rebuild the indexes after the import: %w", err)
+	}
+
+	if len(s.builder.NoCaseTags) > 0 {
+		if _, err := s.DB.ExecContext(ctx, nocaseSchema); err != nil {
+			return fmt.Errorf("failed to rebuild the case-insensitive tags index after the import: %w", err)
+		}
+	}
+
+	return s.withRetries(nastro.OpImport, func() error {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to initiate the transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM stats"); err != nil {
+			return fmt.Errorf("failed to reset the stats: %w", err)
+		}
+
+		for _, table := range s.builder.Partitions.tables() {
+			_, err := tx.ExecContext(ctx, `INSERT INTO stats (pubkey, kind, count, bytes)
+				SELECT pubkey, kind, COUNT(*), SUM(octet_length(tags) + octet_length(content)) FROM `+table+` WHERE true GROUP BY pubkey, kind
+				ON CONFLICT (pubkey, kind) DO UPDATE SET count = count + excluded.count, bytes = bytes + excluded.bytes`)
+			if err != nil {
+				return fmt.Errorf("failed to rebuild the stats of table %s: %w", table, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,56 @@
+package sqlite
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/tursodatabase/libsql-client-go/libsql"
+)
+
+var errPragmasUnsupported = errors.New("per-connection pragmas are not supported by stores opened with OpenConnector")
+
+// NewLibsql returns a store connected to the remote libsql database (e.g. hosted by Turso) at the URL,
+// which starts with libsql://, https:// or wss://, authenticated with the token (empty for none).
+// It's a shorthand for [OpenConnector] with the connector of the pure Go libsql client.
+//
+//	store, err := sqlite.NewLibsql("libsql://nastro-example.turso.io", os.Getenv("TURSO_AUTH_TOKEN"))
+func NewLibsql(URL, authToken string, opts ...Option) (*Store, error) {
+	var clientOpts []libsql.Option
+	if authToken != "" {
+		clientOpts = append(clientOpts, libsql.WithAuthToken(authToken))
+	}
+
+	connector, err := libsql.NewConnector(URL, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to libsql at %s: %w", URL, err)
+	}
+	return open(connector, "libsql at "+URL, opts...)
+}
+
+// OpenConnector returns a store whose connections are opened by the provided connector, after applying
+// the base schema and the provided options. It allows to use the drivers of databases compatible with sqlite,
+// like the embedded replicas of libsql, which serve reads from a local file and sync it with the remote database:
+//
+//	import "github.com/tursodatabase/go-libsql"
+//
+//	connector, err := libsql.NewEmbeddedReplicaConnector("replica.db", "libsql://nastro-example.turso.io",
+//		libsql.WithAuthToken(token),
+//		libsql.WithSyncInterval(time.Minute),
+//	)
+//	store, err := sqlite.OpenConnector(connector)
+//
+// The journal of the database is managed by the driver, so the store doesn't set the WAL mode nor checkpoints it
+// on [Store.Close], and the options that set per-connection pragmas ([WithAutoCheckpoint], [WithReplication]) fail.
+// Like [sql.DB.Close], [Store.Close] closes the connector if it implements io.Closer.
+func OpenConnector(c driver.Connector, opts ...Option) (*Store, error) {
+	return open(c, "the database of the connector", opts...)
+}
+
+func open(c driver.Connector, name string, opts ...Option) (*Store, error) {
+	store := defaultStore()
+	store.DB = sql.OpenDB(c)
+	store.external = true
+	return setup(store, name, opts...)
+}
@@ -0,0 +1,26 @@
+package sqlite
+
+import (
+	"github.com/pippellia-btc/nastro"
+)
+
+// WithMetrics sets a [nastro.Collector] on the Store, which receives the latency, rows, lock retries and
+// transaction conflicts of each operation, and the filters rejected or clamped by the query limits. See the prometheus subpackage for a ready-made adapter.
+//
+// The store calls Observe, Retry and Conflict for its operations:
+//   - [nastro.OpSave] for [Store.Save] and [Store.SaveResult]
+//   - [nastro.OpReplace] for [Store.Replace], when an older event is replaced
+//   - [nastro.OpDelete] and [nastro.OpUndelete] for [Store.Delete] and [Store.Undelete]
+//   - [nastro.OpDeletion] for [Store.HandleDeletion]
+//   - [nastro.OpQuery] for [Store.Query], [Store.QueryWithBuilder] and [Store.QueryPage]
+//   - [nastro.OpCount] for [Store.Count] and [Store.CountWithBuilder]
+//   - [nastro.OpPurge] for [Store.PurgeExpired], [Store.PurgeDeleted] and [Store.PruneTombstones]
+//   - [nastro.OpImport] for each batch of [Store.ImportFast]
+//
+// Limit is called for the filters rejected or clamped by [WithQueryLimits]. Evict and Occupancy are never called.
+func WithMetrics(c nastro.Collector) Option {
+	return func(s *Store) error {
+		s.metrics = c
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations add the columns introduced after the first version of the schema to existing events tables,
+// which [schema] doesn't modify as it only creates the tables that don't exist yet.
+// The backfill statement, if any, is executed once after the column is added.
+var migrations = []struct {
+	column     string
+	definition string
+	backfill   string
+}{
+	{
+		column:     "expires_at",
+		definition: "INTEGER",
+		backfill: `UPDATE events SET expires_at = (
+			SELECT CAST(json_extract(t.value, '$[1]') AS INTEGER) FROM json_each(events.tags) AS t
+			WHERE json_type(t.value) = 'array' AND json_array_length(t.value) > 1 AND json_extract(t.value, '$[0]') = 'expiration'
+			LIMIT 1)`,
+	},
+	{
+		column:     "deleted_at",
+		definition: "INTEGER",
+	},
+}
+
+// migrate adds the missing columns to the events table, if it exists, so that the schema can be applied to databases
+// created by previous versions of the store.
+func migrate(db *sql.DB) error {
+	columns, err := tableColumns(db, "events")
+	if err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		// the table doesn't exist yet, and the schema creates it with all the columns
+		return nil
+	}
+
+	for _, m := range migrations {
+		if _, ok := columns[m.column]; ok {
+			continue
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE events ADD COLUMN %s %s", m.column, m.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", m.column, err)
+		}
+
+		if m.backfill != "" {
+			if _, err := db.Exec(m.backfill); err != nil {
+				return fmt.Errorf("failed to backfill column %s: %w", m.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the names of the columns of the table, which are none if the table doesn't exist.
+func tableColumns(db *sql.DB, table string) (map[string]struct{}, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = struct{}{}
+	}
+	return columns, rows.Err()
+}
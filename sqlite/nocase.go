@@ -0,0 +1,40 @@
+package sqlite
+
+import (
+	"fmt"
+)
+
+// nocaseSchema is the index used to match the values of case-insensitive tags, see [WithCaseInsensitiveTags].
+// The default index can't be used by comparisons with a different collation.
+const nocaseSchema = `
+	CREATE INDEX IF NOT EXISTS event_tags_key_value_nocase_idx ON event_tags(key, value COLLATE NOCASE, event_id);`
+
+// WithCaseInsensitiveTags makes the default builders match the values of the tags with the provided keys
+// ignoring the case of ASCII letters, so that for example #t:["bitcoin"] matches an event tagged "Bitcoin".
+// Values are stored as they are, and compared with the NOCASE collation using a dedicated index,
+// which is created when the option is first used. The keys must be indexed, see [WithIndexedTags].
+//
+// It also sets the query, page and count builders to the ones of the store's [Builder],
+// so custom builders should be specified after this option.
+func WithCaseInsensitiveTags(keys ...string) Option {
+	return func(s *Store) error {
+		if _, err := s.DB.Exec(nocaseSchema); err != nil {
+			return fmt.Errorf("failed to apply the case-insensitive tags schema: %w", err)
+		}
+
+		s.builder.NoCaseTags = keys
+		s.useBuilder()
+		return nil
+	}
+}
+
+// lowerASCII returns the string with ASCII letters mapped to lower case, like the NOCASE collation does.
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
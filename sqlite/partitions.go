@@ -0,0 +1,134 @@
+package sqlite
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// partitionSchema is the schema of a partition table holding the events of a single kind.
+// It mirrors the events table, without the indexes and triggers that are useless for a single regular kind.
+const partitionSchema = `
+	CREATE TABLE IF NOT EXISTS events_%[1]d (
+       id TEXT PRIMARY KEY,
+       pubkey TEXT NOT NULL,
+       created_at INTEGER NOT NULL,
+       kind INTEGER NOT NULL,
+       tags JSONB NOT NULL,
+       content TEXT NOT NULL,
+       sig TEXT NOT NULL,
+       expires_at INTEGER,
+       deleted_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS events_%[1]d_pubkey_idx ON events_%[1]d(pubkey);
+	CREATE INDEX IF NOT EXISTS events_%[1]d_time_idx ON events_%[1]d(created_at DESC);
+	CREATE INDEX IF NOT EXISTS events_%[1]d_expires_idx ON events_%[1]d(expires_at) WHERE expires_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS events_%[1]d_deleted_idx ON events_%[1]d(deleted_at) WHERE deleted_at IS NOT NULL;
+
+	CREATE TRIGGER IF NOT EXISTS events_%[1]d_tags_ad AFTER DELETE ON events_%[1]d
+	BEGIN
+	DELETE FROM event_tags WHERE event_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS events_%[1]d_stats_ai AFTER INSERT ON events_%[1]d
+	BEGIN
+	INSERT INTO stats (pubkey, kind, count, bytes)
+		VALUES (NEW.pubkey, NEW.kind, 1, octet_length(NEW.tags) + octet_length(NEW.content))
+		ON CONFLICT (pubkey, kind) DO UPDATE SET count = count + 1, bytes = bytes + excluded.bytes;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS events_%[1]d_stats_ad AFTER DELETE ON events_%[1]d
+	BEGIN
+	UPDATE stats
+		SET count = count - 1, bytes = bytes - (octet_length(OLD.tags) + octet_length(OLD.content))
+		WHERE pubkey = OLD.pubkey AND kind = OLD.kind;
+	END;`
+
+// Partitions is the list of kinds whose events are stored in dedicated tables named events_<kind>,
+// instead of the events table. Partitioning high-volume kinds (e.g. 1 and 7) keeps the indexes smaller
+// and vacuums faster on very large databases.
+//
+// The [Builder] routes each filter to the tables that can contain matching events.
+type Partitions []int
+
+// WithPartitions stores the events of the provided kinds in dedicated tables, see [Partitions].
+// Only regular kinds can be partitioned, as replacement only looks into the events table.
+//
+// It also sets the query, page and count builders to the ones of the store's [Builder],
+// so custom builders should be specified after this option, and must be aware of the partitions.
+func WithPartitions(kinds ...int) Option {
+	return func(s *Store) error {
+		for _, kind := range kinds {
+			if !nostr.IsRegularKind(kind) {
+				return fmt.Errorf("failed to partition kind %d: only regular kinds can be partitioned", kind)
+			}
+
+			if _, err := s.DB.Exec(fmt.Sprintf(partitionSchema, kind)); err != nil {
+				return fmt.Errorf("failed to apply the schema of partition %d: %w", kind, err)
+			}
+		}
+
+		s.builder.Partitions = kinds
+		s.useBuilder()
+		return nil
+	}
+}
+
+// table returns the name of the table storing the events of the kind.
+func (p Partitions) table(kind int) string {
+	if slices.Contains(p, kind) {
+		return fmt.Sprintf("events_%d", kind)
+	}
+	return "events"
+}
+
+// tables returns the names of all the tables storing events.
+func (p Partitions) tables() []string {
+	tables := make([]string, 0, len(p)+1)
+	tables = append(tables, "events")
+	for _, kind := range p {
+		tables = append(tables, p.table(kind))
+	}
+	return tables
+}
+
+// part is a filter restricted to a single table.
+type part struct {
+	table  string
+	filter nostr.Filter
+}
+
+// split the filter into parts, one for each table that can contain matching events.
+// The kinds of the filter are distributed among the parts.
+func (p Partitions) split(filter nostr.Filter) []part {
+	if len(p) == 0 {
+		return []part{{table: "events", filter: filter}}
+	}
+
+	if len(filter.Kinds) == 0 {
+		parts := make([]part, 0, len(p)+1)
+		for _, table := range p.tables() {
+			parts = append(parts, part{table: table, filter: filter})
+		}
+		return parts
+	}
+
+	var parts []part
+	index := make(map[string]int) // table --> position in parts
+	for _, kind := range filter.Kinds {
+		table := p.table(kind)
+		i, ok := index[table]
+		if !ok {
+			f := filter
+			f.Kinds = nil
+			parts = append(parts, part{table: table, filter: f})
+
+			i = len(parts) - 1
+			index[table] = i
+		}
+		parts[i].filter.Kinds = append(parts[i].filter.Kinds, kind)
+	}
+	return parts
+}
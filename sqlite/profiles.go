@@ -0,0 +1,180 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// profilesSchema materializes the latest metadata (kind 0) and relay list (kind 10002) of each pubkey.
+// The triggers only move forward in time, so the order in which events are saved doesn't matter.
+const profilesSchema = `
+	CREATE TABLE IF NOT EXISTS profiles (
+		pubkey TEXT PRIMARY KEY,
+		metadata_id TEXT,
+		metadata TEXT,
+		metadata_at INTEGER,
+		relays_id TEXT,
+		relays TEXT,
+		relays_at INTEGER
+	);
+
+	CREATE TRIGGER IF NOT EXISTS profiles_metadata_ai AFTER INSERT ON events
+	WHEN NEW.kind = 0
+	BEGIN
+	INSERT INTO profiles (pubkey, metadata_id, metadata, metadata_at)
+		VALUES (NEW.pubkey, NEW.id, NEW.content, NEW.created_at)
+		ON CONFLICT (pubkey) DO UPDATE SET
+			metadata_id = excluded.metadata_id,
+			metadata = excluded.metadata,
+			metadata_at = excluded.metadata_at
+		WHERE metadata_at IS NULL OR excluded.metadata_at > metadata_at;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS profiles_relays_ai AFTER INSERT ON events
+	WHEN NEW.kind = 10002
+	BEGIN
+	INSERT INTO profiles (pubkey, relays_id, relays, relays_at)
+		VALUES (NEW.pubkey, NEW.id, json(NEW.tags), NEW.created_at)
+		ON CONFLICT (pubkey) DO UPDATE SET
+			relays_id = excluded.relays_id,
+			relays = excluded.relays,
+			relays_at = excluded.relays_at
+		WHERE relays_at IS NULL OR excluded.relays_at > relays_at;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS profiles_ad AFTER DELETE ON events
+	WHEN OLD.kind IN (0, 10002)
+	BEGIN
+	UPDATE profiles SET metadata_id = NULL, metadata = NULL, metadata_at = NULL WHERE metadata_id = OLD.id;
+	UPDATE profiles SET relays_id = NULL, relays = NULL, relays_at = NULL WHERE relays_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS profiles_au AFTER UPDATE OF deleted_at ON events
+	WHEN NEW.kind IN (0, 10002) AND NEW.deleted_at IS NOT NULL
+	BEGIN
+	UPDATE profiles SET metadata_id = NULL, metadata = NULL, metadata_at = NULL WHERE metadata_id = NEW.id;
+	UPDATE profiles SET relays_id = NULL, relays = NULL, relays_at = NULL WHERE relays_id = NEW.id;
+	END;`
+
+// profilesBackfill populates the profiles table from the events already stored.
+const profilesBackfill = `
+	INSERT INTO profiles (pubkey, metadata_id, metadata, metadata_at)
+		SELECT pubkey, id, content, MAX(created_at) FROM events
+		WHERE kind = 0 AND deleted_at IS NULL
+		GROUP BY pubkey;
+
+	INSERT INTO profiles (pubkey, relays_id, relays, relays_at)
+		SELECT pubkey, id, json(tags), MAX(created_at) FROM events
+		WHERE kind = 10002 AND deleted_at IS NULL
+		GROUP BY pubkey
+		ON CONFLICT (pubkey) DO UPDATE SET
+			relays_id = excluded.relays_id,
+			relays = excluded.relays,
+			relays_at = excluded.relays_at;`
+
+var ErrProfileNotFound = errors.New("profile not found")
+
+// Profile is the materialized metadata and relay list of a pubkey.
+// Fields are empty if the corresponding event is not stored.
+type Profile struct {
+	PubKey string
+
+	// Metadata is the content of the latest kind 0 event, published at MetadataAt.
+	Metadata   string
+	MetadataAt nostr.Timestamp
+
+	// Relays are the tags of the latest kind 10002 event, published at RelaysAt.
+	Relays   nostr.Tags
+	RelaysAt nostr.Timestamp
+}
+
+// WithProfiles materializes the latest metadata (kind 0) and relay list (kind 10002) of each pubkey
+// in the profiles table, so that [Store.Profile] can serve profile lookups without a filter query.
+// Events already stored are materialized when the profiles table is first created.
+func WithProfiles() Option {
+	return func(s *Store) error {
+		var exists bool
+		row := s.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'profiles')")
+		if err := row.Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check the profiles table: %w", err)
+		}
+
+		if _, err := s.DB.Exec(profilesSchema); err != nil {
+			return fmt.Errorf("failed to apply the profiles schema: %w", err)
+		}
+
+		if !exists {
+			if _, err := s.DB.Exec(profilesBackfill); err != nil {
+				return fmt.Errorf("failed to backfill the profiles: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// Profile returns the materialized profile of the pubkey, or [ErrProfileNotFound].
+// The store must have been created with [WithProfiles].
+func (s *Store) Profile(ctx context.Context, pubkey string) (Profile, error) {
+	profiles, err := s.Profiles(ctx, pubkey)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if len(profiles) == 0 {
+		return Profile{}, fmt.Errorf("%w: pubkey %s", ErrProfileNotFound, pubkey)
+	}
+	return profiles[0], nil
+}
+
+// Profiles returns the materialized profiles of the pubkeys. Pubkeys without a profile are skipped.
+// The store must have been created with [WithProfiles].
+func (s *Store) Profiles(ctx context.Context, pubkeys ...string) ([]Profile, error) {
+	if len(pubkeys) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, len(pubkeys))
+	for i, pk := range pubkeys {
+		args[i] = pk
+	}
+
+	query := "SELECT pubkey, metadata, metadata_at, relays, relays_at FROM profiles WHERE pubkey" + EqualityClause(pubkeys)
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []Profile
+	for rows.Next() {
+		var profile Profile
+		var metadata, relays sql.NullString
+		var metadataAt, relaysAt sql.NullInt64
+
+		if err := rows.Scan(&profile.PubKey, &metadata, &metadataAt, &relays, &relaysAt); err != nil {
+			return nil, fmt.Errorf("failed to scan profile: %w", err)
+		}
+
+		profile.Metadata = metadata.String
+		profile.MetadataAt = nostr.Timestamp(metadataAt.Int64)
+		profile.RelaysAt = nostr.Timestamp(relaysAt.Int64)
+
+		if relays.Valid {
+			if err := json.Unmarshal([]byte(relays.String), &profile.Relays); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal the relays of pubkey %s: %w", profile.PubKey, err)
+			}
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan profile: %w", err)
+	}
+	return profiles, nil
+}
@@ -0,0 +1,120 @@
+// The prometheus package adapts the metrics of the sqlite store to Prometheus.
+//
+//	metrics := prometheus.New("relay")
+//	registry.MustRegister(metrics)
+//
+//	store, err := sqlite.New(URL, sqlite.WithMetrics(metrics))
+package prometheus
+
+import (
+	"time"
+
+	"github.com/pippellia-btc/nastro"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a [nastro.Collector] that exports the metrics of the sqlite store as Prometheus metrics,
+// labelled by operation. It's also a [prom.Collector], so it can be registered directly.
+type Collector struct {
+	nastro.NoMetrics // the sqlite store doesn't report evictions and occupancy
+
+	latency   *prom.HistogramVec
+	rows      *prom.CounterVec
+	errors    *prom.CounterVec
+	retries   *prom.CounterVec
+	conflicts *prom.CounterVec
+	limits    *prom.CounterVec
+}
+
+// New returns a [Collector] whose metrics are prefixed by the namespace, e.g. "relay_sqlite_operation_seconds".
+func New(namespace string) *Collector {
+	labels := []string{"operation"}
+	return &Collector{
+		latency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "operation_seconds",
+			Help:      "The latency of the store operations.",
+			Buckets:   prom.ExponentialBuckets(0.0001, 4, 10), // 100µs to ~26s
+		}, labels),
+
+		rows: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "rows_total",
+			Help:      "The number of rows returned or written by the store operations.",
+		}, labels),
+
+		errors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "errors_total",
+			Help:      "The number of store operations that failed.",
+		}, labels),
+
+		retries: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "retries_total",
+			Help:      "The number of times a store operation was retried because the database was locked.",
+		}, labels),
+
+		conflicts: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "conflicts_total",
+			Help:      "The number of store operations that failed because the database was still locked after all retries.",
+		}, labels),
+
+		limits: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sqlite",
+			Name:      "limits_total",
+			Help:      "The number of filters rejected or clamped by the query limits.",
+		}, []string{"limit", "action"}),
+	}
+}
+
+func (c *Collector) Observe(op nastro.Operation, took time.Duration, rows int64, err error) {
+	c.latency.WithLabelValues(string(op)).Observe(took.Seconds())
+	c.rows.WithLabelValues(string(op)).Add(float64(rows))
+	if err != nil {
+		c.errors.WithLabelValues(string(op)).Inc()
+	}
+}
+
+func (c *Collector) Retry(op nastro.Operation) {
+	c.retries.WithLabelValues(string(op)).Inc()
+}
+
+func (c *Collector) Conflict(op nastro.Operation) {
+	c.conflicts.WithLabelValues(string(op)).Inc()
+}
+
+func (c *Collector) Limit(limit string, clamped bool) {
+	action := "rejected"
+	if clamped {
+		action = "clamped"
+	}
+	c.limits.WithLabelValues(limit, action).Inc()
+}
+
+// Describe implements [prom.Collector].
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.latency.Describe(ch)
+	c.rows.Describe(ch)
+	c.errors.Describe(ch)
+	c.retries.Describe(ch)
+	c.conflicts.Describe(ch)
+	c.limits.Describe(ch)
+}
+
+// Collect implements [prom.Collector].
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	c.latency.Collect(ch)
+	c.rows.Collect(ch)
+	c.errors.Collect(ch)
+	c.retries.Collect(ch)
+	c.conflicts.Collect(ch)
+	c.limits.Collect(ch)
+}
@@ -0,0 +1,72 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+)
+
+// replicationPragmas configure the connections for continuous replication tools like Litestream and LiteFS,
+// which read the WAL as it's written, and checkpoint it themselves.
+var replicationPragmas = []string{
+	"PRAGMA busy_timeout = 5000;",     // wait for the replication tool to release its locks, instead of failing
+	"PRAGMA wal_autocheckpoint = 0;",  // the replication tool checkpoints after copying the WAL
+	"PRAGMA journal_size_limit = -1;", // never truncate the WAL, as the replication tool tracks it by offset
+}
+
+var ErrReadOnly = errors.New("the store is a read-only replica")
+
+// WithReplication makes the store compatible with continuous replication tools like Litestream and LiteFS.
+// It sets a busy timeout, disables automatic checkpoints and WAL truncation (including the one of [Store.Close]),
+// leaving the checkpoints to the replication tool. Don't use [WithAutoCheckpoint] together with this option.
+//
+// More info here: https://litestream.io/tips/
+func WithReplication() Option {
+	return func(s *Store) error {
+		if s.external {
+			return errPragmasUnsupported
+		}
+
+		for _, pragma := range replicationPragmas {
+			if _, err := s.DB.Exec(pragma); err != nil {
+				return fmt.Errorf("failed to execute %q: %w", pragma, err)
+			}
+		}
+
+		// the pragmas are per-connection, so they must also be executed on new connections
+		s.pragmas = append(s.pragmas, replicationPragmas...)
+		s.replicated = true
+		return nil
+	}
+}
+
+// ReplicaOpen returns a read-only store connected to the sqlite file located at the URL, which is meant to be
+// a replica restored or mounted by a replication tool like Litestream or LiteFS.
+// The schema is not applied, as it's the primary that owns it, and all writes fail with [ErrReadOnly].
+//
+// Options that write to the database (e.g. [WithPartitions] on a new kind, or [WithPurgeInterval]) are refused.
+func ReplicaOpen(URL string, opts ...Option) (*Store, error) {
+	store := newStore(URL)
+	store.readOnly = true
+	store.pragmas = []string{"PRAGMA query_only = ON;"}
+
+	var exists bool
+	row := store.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'events')")
+	if err := row.Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to open the replica at %s: %w", URL, err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("failed to open the replica at %s: the events table doesn't exist", URL)
+	}
+
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, fmt.Errorf("failed to open the replica at %s: %w", URL, err)
+		}
+	}
+
+	if store.purgeInterval > 0 {
+		return nil, fmt.Errorf("failed to open the replica at %s: the purge job requires writes", URL)
+	}
+	return store, nil
+}
@@ -0,0 +1,181 @@
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// scanEvent scans the current row into the event, avoiding the reflection of [sql.Rows.Scan]
+// for named types and the json unmarshalling of the tags, which dominate large result sets.
+// The row must have the [Columns] in order.
+func scanEvent(rows *sql.Rows, event *nostr.Event) error {
+	var createdAt, kind int64
+	var tags sql.RawBytes
+
+	if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &kind, &tags, &event.Content, &event.Sig); err != nil {
+		return err
+	}
+
+	var err error
+	event.CreatedAt = nostr.Timestamp(createdAt)
+	event.Kind = int(kind)
+	event.Tags, err = decodeTags(tags)
+	return err
+}
+
+// decodeTags decodes a JSON array of arrays of strings into tags, producing the same result as [json.Unmarshal].
+// Strings without escape sequences are converted directly, the others are unquoted by [json.Unmarshal].
+func decodeTags(data []byte) (nostr.Tags, error) {
+	d := tagsDecoder{data: data}
+	d.skipSpace()
+
+	if bytes.HasPrefix(d.data[d.pos:], []byte("null")) {
+		d.pos += len("null")
+		return nil, d.end()
+	}
+
+	if err := d.expect('['); err != nil {
+		return nil, err
+	}
+
+	tags := make(nostr.Tags, 0, bytes.Count(data, []byte("[")))
+	if d.peek() == ']' {
+		d.pos++
+		return tags, d.end()
+	}
+
+	for {
+		tag, err := d.tag()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+
+		switch d.peek() {
+		case ',':
+			d.pos++
+
+		case ']':
+			d.pos++
+			return tags, d.end()
+
+		default:
+			return nil, d.errorf("expected ',' or ']'")
+		}
+	}
+}
+
+type tagsDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *tagsDecoder) tag() (nostr.Tag, error) {
+	if err := d.expect('['); err != nil {
+		return nil, err
+	}
+
+	tag := make(nostr.Tag, 0, 4)
+	if d.peek() == ']' {
+		d.pos++
+		return tag, nil
+	}
+
+	for {
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		tag = append(tag, s)
+
+		switch d.peek() {
+		case ',':
+			d.pos++
+
+		case ']':
+			d.pos++
+			return tag, nil
+
+		default:
+			return nil, d.errorf("expected ',' or ']'")
+		}
+	}
+}
+
+func (d *tagsDecoder) string() (string, error) {
+	if err := d.expect('"'); err != nil {
+		return "", err
+	}
+
+	start := d.pos
+	escaped := false
+
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case '\\':
+			escaped = true
+			d.pos += 2
+
+		case '"':
+			d.pos++
+			if !escaped {
+				return string(d.data[start : d.pos-1]), nil
+			}
+
+			var s string
+			if err := json.Unmarshal(d.data[start-1:d.pos], &s); err != nil {
+				return "", err
+			}
+			return s, nil
+
+		default:
+			d.pos++
+		}
+	}
+	return "", d.errorf("unterminated string")
+}
+
+func (d *tagsDecoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next non-space byte without consuming it, or 0 if there are none.
+func (d *tagsDecoder) peek() byte {
+	d.skipSpace()
+	if d.pos >= len(d.data) {
+		return 0
+	}
+	return d.data[d.pos]
+}
+
+func (d *tagsDecoder) expect(c byte) error {
+	if d.peek() != c {
+		return d.errorf("expected '%c'", c)
+	}
+	d.pos++
+	return nil
+}
+
+// end returns an error if there is anything but spaces left to decode.
+func (d *tagsDecoder) end() error {
+	d.skipSpace()
+	if d.pos != len(d.data) {
+		return d.errorf("unexpected trailing data")
+	}
+	return nil
+}
+
+func (d *tagsDecoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("failed to decode tags at position %d: "+format, append([]any{d.pos}, args...)...)
+}
@@ -4,15 +4,20 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand/v2"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
 	"github.com/pippellia-btc/nastro"
 )
 
@@ -24,45 +29,112 @@ const schema = `
        kind INTEGER NOT NULL,
        tags JSONB NOT NULL,
        content TEXT NOT NULL,
-       sig TEXT NOT NULL
+       sig TEXT NOT NULL,
+       expires_at INTEGER,
+       deleted_at INTEGER
 	);
 
 	CREATE INDEX IF NOT EXISTS pubkey_idx ON events(pubkey);
 	CREATE INDEX IF NOT EXISTS time_idx ON events(created_at DESC);
 	CREATE INDEX IF NOT EXISTS kind_idx ON events(kind);
+	CREATE INDEX IF NOT EXISTS expires_idx ON events(expires_at) WHERE expires_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS deleted_idx ON events(deleted_at) WHERE deleted_at IS NOT NULL;
 	
 	CREATE TABLE IF NOT EXISTS event_tags (
 		event_id TEXT NOT NULL,
 		key TEXT NOT NULL,
 		value TEXT NOT NULL,
 		
-		PRIMARY KEY (event_id, key, value),
-		FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		PRIMARY KEY (event_id, key, value)
 	);
 
-	CREATE INDEX IF NOT EXISTS event_tags_key_value_idx ON event_tags(key, value);
+	DROP INDEX IF EXISTS event_tags_key_value_idx;
+	CREATE INDEX IF NOT EXISTS event_tags_key_value_event_idx ON event_tags(key, value, event_id);
 
-	CREATE TRIGGER IF NOT EXISTS d_tags_ai AFTER INSERT ON events
-	WHEN NEW.kind BETWEEN 30000 AND 39999 
+	-- tags are indexed explicitly in the write path, see Store.insert
+	DROP TRIGGER IF EXISTS d_tags_ai;
+
+	CREATE TRIGGER IF NOT EXISTS tags_ad AFTER DELETE ON events
+	BEGIN
+	DELETE FROM event_tags WHERE event_id = OLD.id;
+	END;
+
+	CREATE TABLE IF NOT EXISTS deleted_events (
+		id TEXT PRIMARY KEY,
+		deleted_at INTEGER NOT NULL,
+		by_pubkey TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS deleted_events_time_idx ON deleted_events(deleted_at);
+
+	CREATE TABLE IF NOT EXISTS stats (
+		pubkey TEXT NOT NULL,
+		kind INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+
+		PRIMARY KEY (pubkey, kind)
+	) WITHOUT ROWID;
+
+	INSERT INTO stats (pubkey, kind, count, bytes)
+		SELECT pubkey, kind, COUNT(*), SUM(octet_length(tags) + octet_length(content))
+		FROM events
+		WHERE NOT EXISTS (SELECT 1 FROM stats)
+		GROUP BY pubkey, kind;
+
+	CREATE TRIGGER IF NOT EXISTS stats_ai AFTER INSERT ON events
+	BEGIN
+	INSERT INTO stats (pubkey, kind, count, bytes)
+		VALUES (NEW.pubkey, NEW.kind, 1, octet_length(NEW.tags) + octet_length(NEW.content))
+		ON CONFLICT (pubkey, kind) DO UPDATE SET count = count + 1, bytes = bytes + excluded.bytes;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS stats_ad AFTER DELETE ON events
 	BEGIN
-	INSERT INTO event_tags (event_id, key, value)
-		SELECT NEW.id, 'd', json_extract(value, '$[1]')
-		FROM json_each(NEW.tags)
-		WHERE json_type(value) = 'array' AND json_array_length(value) > 1 AND json_extract(value, '$[0]') = 'd'
-		LIMIT 1;
+	UPDATE stats
+		SET count = count - 1, bytes = bytes - (octet_length(OLD.tags) + octet_length(OLD.content))
+		WHERE pubkey = OLD.pubkey AND kind = OLD.kind;
 	END;`
 
+// insertEvent is the insert statement, formatted with the name of the table.
+const insertEvent = `INSERT OR IGNORE INTO %s (id, pubkey, created_at, kind, tags, content, sig, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+// Columns are the columns of the events table (aliased "e") that are scanned into a [nostr.Event].
+// Queries returned by a custom [QueryBuilder] must select them in this order.
+const Columns = "e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig"
+
 // Store of Nostr events that uses an sqlite3 database.
 // It embeds the *sql.DB connection for direct interaction and manages optional validators and query builders.
 type Store struct {
 	*sql.DB
 	retries int // the maximum number of retries after a write failure "database is locked"
 
+	softDelete bool     // whether Delete marks events as deleted instead of removing them
+	replicated bool     // whether the database is replicated by an external tool, see [WithReplication]
+	readOnly   bool     // whether the store is a read-only replica, see [ReplicaOpen]
+	external   bool     // whether the connections are opened by another driver, e.g. libsql, see [OpenConnector]
+	duplicates bool     // whether Save returns [nastro.ErrDuplicate] for events already stored
+	builder    Builder  // the configuration of the default builders, including the partitions
+	pragmas    []string // the per-connection pragmas, executed on every new connection
+	tagKeys    []string // the keys of the tags indexed in event_tags, in addition to the d tag of addressable events
+
 	sanitizeFilters nastro.FilterPolicy
 	validateEvent   nastro.EventPolicy
 
 	queryBuilder QueryBuilder
 	countBuilder QueryBuilder
+	pageBuilder  PageBuilder
+
+	logQuery QueryLogger
+	metrics  nastro.Collector
+
+	pinned *sql.Conn // keeps in-memory databases alive, see [NewMemory]
+
+	purgeInterval      time.Duration // how often expired events are purged. Zero disables the purge job
+	tombstoneRetention time.Duration // how long tombstones are kept by the purge job. Zero keeps them forever
+	done               chan struct{}
+	closeOnce          sync.Once
 }
 
 // QueryBuilder converts multiple nostr filters into one or more sqlite queries and lists of arguments.
@@ -75,15 +147,45 @@ type Store struct {
 // For examples, check out the [DefaultQueryBuilder] and [DefaultCountBuilder]
 type QueryBuilder func(filters ...nostr.Filter) (queries []Query, err error)
 
+// PageBuilder is a [QueryBuilder] that only returns events that come strictly after
+// the provided [Cursor] in the result ordering (created_at DESC, id ASC).
+// It's used by [Store.QueryPage] to paginate without OFFSET scans.
+//
+// For an example, check out the [DefaultPageBuilder]
+type PageBuilder func(after Cursor, filters ...nostr.Filter) (queries []Query, err error)
+
 type Query struct {
 	SQL  string
 	Args []any
 }
 
+// Cursor identifies the position of an event in the result ordering (created_at DESC, id ASC).
+// The zero value means "from the beginning".
+type Cursor struct {
+	CreatedAt nostr.Timestamp
+	ID        string
+}
+
+// CursorOf returns the cursor pointing at the provided event.
+// It's typically called on the last event of a page to fetch the next one.
+func CursorOf(e nostr.Event) Cursor {
+	return Cursor{CreatedAt: e.CreatedAt, ID: e.ID}
+}
+
+func (c Cursor) IsZero() bool {
+	return c.CreatedAt == 0 && c.ID == ""
+}
+
+// QueryLogger is called after each query executed by [Store.Query] and [Store.Count],
+// with the time it took and the number of rows it returned.
+type QueryLogger func(query Query, took time.Duration, rows int)
+
 type Option func(*Store) error
 
 // WithRetries sets how many times to retry a locked database operation
 // after the first failed attempt. Each retry waits 20ms + jitter (~5ms on average).
+// For exponential backoff and a circuit breaker, use WithRetries(0) and wrap the store with the retry package,
+// retrying the errors reported by [IsDatabaseLocked].
 func WithRetries(n int) Option {
 	return func(s *Store) error {
 		if n < 0 {
@@ -94,6 +196,37 @@ func WithRetries(n int) Option {
 	}
 }
 
+// WithSoftDelete makes [Store.Delete] mark events as deleted instead of removing them.
+// Deleted events are hidden from queries, but can be restored with [Store.Undelete],
+// until they are permanently removed with [Store.PurgeDeleted].
+func WithSoftDelete() Option {
+	return func(s *Store) error {
+		s.softDelete = true
+		return nil
+	}
+}
+
+// WithDuplicateError makes [Store.Save] return [nastro.ErrDuplicate] when the event is already stored,
+// so that relays can answer with "OK false duplicate:" as per NIP-01.
+// By default, duplicates are silently ignored.
+func WithDuplicateError() Option {
+	return func(s *Store) error {
+		s.duplicates = true
+		return nil
+	}
+}
+
+// WithIndexedTags sets the keys of the tags that are indexed in the event_tags table for every event,
+// making them queryable with the default builders. For example, WithIndexedTags("e", "p", "t").
+//
+// The d tag of addressable events is always indexed, as it's required by [Store.Replace].
+func WithIndexedTags(keys ...string) Option {
+	return func(s *Store) error {
+		s.tagKeys = keys
+		return nil
+	}
+}
+
 // WithFilterPolicy sets a custom [nastro.FilterPolicy] on the Store.
 // It will be used to validate and modify filters before executing queries.
 func WithFilterPolicy(v nastro.FilterPolicy) Option {
@@ -103,6 +236,34 @@ func WithFilterPolicy(v nastro.FilterPolicy) Option {
 	}
 }
 
+// WithQueryLimits sets the filter policy of the Store to [nastro.QueryLimits.Validate],
+// so that filters exceeding the limits are rejected, and limits above MaxLimit are clamped (or rejected).
+// Rejected and clamped filters are reported to the [nastro.Collector], see [WithMetrics].
+func WithQueryLimits(l nastro.QueryLimits) Option {
+	return func(s *Store) error {
+		observe := l.Observe
+		l.Observe = func(limit string, clamped bool) {
+			s.metrics.Limit(limit, clamped)
+			if observe != nil {
+				observe(limit, clamped)
+			}
+		}
+
+		s.sanitizeFilters = l.Validate
+		return nil
+	}
+}
+
+// WithWriteLimits sets the event policy of the Store to [nastro.WriteLimits.Validate],
+// so that events exceeding the limits are rejected before being written.
+// Together with [WithQueryLimits] and [WithRetries], it makes all the limits of the store configurable as options.
+func WithWriteLimits(l nastro.WriteLimits) Option {
+	return func(s *Store) error {
+		s.validateEvent = l.Validate
+		return nil
+	}
+}
+
 // WithEventPolicy sets a custom [nastro.EventPolicy] on the Store.
 // It will be used to validate events before inserting them into the database.
 func WithEventPolicy(v nastro.EventPolicy) Option {
@@ -128,6 +289,55 @@ func WithCountBuilder(b QueryBuilder) Option {
 	}
 }
 
+// WithPageBuilder allows to specify the page builder used by the store in [Store.QueryPage].
+func WithPageBuilder(b PageBuilder) Option {
+	return func(s *Store) error {
+		s.pageBuilder = b
+		return nil
+	}
+}
+
+// WithQueryLogger sets a [QueryLogger] on the Store, useful to find slow queries.
+// For inspecting how sqlite executes a query, check out [Store.ExplainQuery].
+func WithQueryLogger(l QueryLogger) Option {
+	return func(s *Store) error {
+		s.logQuery = l
+		return nil
+	}
+}
+
+// WithPurgeInterval starts a background job that calls [Store.PurgeExpired] every interval.
+// The job is stopped by [Store.Close]. Expired events never surface in queries,
+// so the job only serves to reclaim space.
+func WithPurgeInterval(d time.Duration) Option {
+	return func(s *Store) error {
+		if d <= 0 {
+			return errors.New("purge interval must be positive")
+		}
+		s.purgeInterval = d
+		return nil
+	}
+}
+
+// WithAutoCheckpoint sets the number of pages after which the WAL is automatically checkpointed.
+// A non-positive value disables automatic checkpoints, which should then be done with [Store.Checkpoint].
+func WithAutoCheckpoint(pages int) Option {
+	return func(s *Store) error {
+		if s.external {
+			return errPragmasUnsupported
+		}
+
+		pragma := fmt.Sprintf("PRAGMA wal_autocheckpoint = %d;", pages)
+		if _, err := s.DB.Exec(pragma); err != nil {
+			return fmt.Errorf("failed to set wal_autocheckpoint: %w", err)
+		}
+
+		// the pragma is per-connection, so it must also be executed on new connections
+		s.pragmas = append(s.pragmas, pragma)
+		return nil
+	}
+}
+
 // WithAdditionalSchema allows to specify an additional database schema, like new tables,
 // virtual tables, indexes and triggers.
 func WithAdditionalSchema(schema string) Option {
@@ -142,38 +352,211 @@ func WithAdditionalSchema(schema string) Option {
 // New returns an sqlite3 store connected to the sqlite file located at the URL,
 // after applying the base schema, and the provided options.
 func New(URL string, opts ...Option) (*Store, error) {
-	DB, err := sql.Open("sqlite3", URL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to sqlite3 at %s: %w", URL, err)
+	return setup(newStore(URL), "sqlite3 at "+URL, opts...)
+}
+
+// setup applies the base schema and the provided options to the store, whose database is described by name in errors.
+func setup(store *Store, name string, opts ...Option) (*Store, error) {
+	if err := migrate(store.DB); err != nil {
+		return nil, fmt.Errorf("failed to migrate %s: %w", name, err)
 	}
 
-	if _, err := DB.Exec(schema); err != nil {
-		return nil, fmt.Errorf("failed to apply base schema: %w", err)
+	if _, err := store.DB.Exec(schema); err != nil {
+		return nil, fmt.Errorf("failed to apply base schema to %s: %w", name, err)
 	}
 
-	if _, err := DB.Exec("PRAGMA journal_mode = WAL;"); err != nil {
-		return nil, fmt.Errorf("failed to set WAL mode: %w", err)
+	if !store.external {
+		// the journal of databases opened by other drivers is managed by their server
+		if _, err := store.DB.Exec("PRAGMA journal_mode = WAL;"); err != nil {
+			return nil, fmt.Errorf("failed to set WAL mode: %w", err)
+		}
 	}
 
-	store := &Store{
-		DB:              DB,
+	for _, opt := range opts {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.purgeInterval > 0 {
+		go store.purgeEvery(store.purgeInterval)
+	}
+	return store, nil
+}
+
+// newStore returns a store with the default settings, connected to the sqlite file located at the URL.
+// The connection is opened lazily, so the per-connection pragmas can still be set.
+func newStore(URL string) *Store {
+	store := defaultStore()
+	store.DB = sql.OpenDB(connector{
+		URL:    URL,
+		driver: &sqlite3.SQLiteDriver{ConnectHook: store.onConnect},
+	})
+	return store
+}
+
+// defaultStore returns a store with the default settings and without a database.
+func defaultStore() *Store {
+	return &Store{
 		sanitizeFilters: nastro.DefaultFilterPolicy,
 		validateEvent:   func(e *nostr.Event) error { return nil },
 		queryBuilder:    DefaultQueryBuilder,
 		countBuilder:    DefaultCountBuilder,
+		pageBuilder:     DefaultPageBuilder,
+		logQuery:        func(Query, time.Duration, int) {},
+		metrics:         nastro.NoMetrics{},
+		done:            make(chan struct{}),
 	}
+}
 
-	for _, opt := range opts {
-		if err := opt(store); err != nil {
-			return nil, err
+var memoryDatabases atomic.Int64
+
+// MemoryURL returns the URL of the in-memory database with the provided name.
+// The cache is shared, so that all the connections of the pool use the same database.
+func MemoryURL(name string) string {
+	return "file:" + name + "?mode=memory&cache=shared"
+}
+
+// NewMemory returns an sqlite3 store backed by a new in-memory database, after applying the base schema,
+// and the provided options. Each call returns a store with its own database, which lives until [Store.Close].
+//
+// It's useful for tests and ephemeral relays that need the full SQL feature set, without temporary files.
+func NewMemory(opts ...Option) (*Store, error) {
+	name := fmt.Sprintf("nastro-%d", memoryDatabases.Add(1))
+	opts = append([]Option{withPinnedConnection()}, opts...)
+	return New(MemoryURL(name), opts...)
+}
+
+// withPinnedConnection keeps a connection open until [Store.Close].
+// An in-memory database is destroyed as soon as its last connection is closed, which
+// would otherwise happen whenever the pool closes its idle connections.
+func withPinnedConnection() Option {
+	return func(s *Store) error {
+		conn, err := s.DB.Conn(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to pin a connection: %w", err)
 		}
+		s.pinned = conn
+		return nil
 	}
-	return store, nil
 }
 
-// IsDatabaseLocked returns true if the error indicates a locked SQLite database.
+// connector opens connections to the sqlite database at the URL with the driver.
+// Unlike [sql.Open], it allows to specify a driver with a connection hook.
+type connector struct {
+	URL    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.URL) }
+func (c connector) Driver() driver.Driver                        { return c.driver }
+
+// onConnect executes the per-connection pragmas on a new connection.
+func (s *Store) onConnect(conn *sqlite3.SQLiteConn) error {
+	for _, pragma := range s.pragmas {
+		if _, err := conn.Exec(pragma, nil); err != nil {
+			return fmt.Errorf("failed to execute %q on the new connection: %w", pragma, err)
+		}
+	}
+	return nil
+}
+
+// Close stops the background jobs (if any), truncates the WAL and closes the database.
+// The WAL is left untouched if the store is replicated, read-only or opened with [OpenConnector].
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	var err error
+	if !s.replicated && !s.readOnly && !s.external {
+		err = s.Checkpoint(context.Background(), CheckpointTruncate)
+	}
+
+	if s.pinned != nil {
+		err = errors.Join(err, s.pinned.Close())
+	}
+	return errors.Join(err, s.DB.Close())
+}
+
+// CheckpointMode is the mode of a WAL checkpoint. More info here: https://www.sqlite.org/pragma.html#pragma_wal_checkpoint
+type CheckpointMode string
+
+const (
+	// CheckpointPassive checkpoints as many frames as possible without waiting for readers or writers.
+	CheckpointPassive CheckpointMode = "PASSIVE"
+
+	// CheckpointFull blocks new writers until all frames are checkpointed.
+	CheckpointFull CheckpointMode = "FULL"
+
+	// CheckpointRestart is like [CheckpointFull], and also waits for readers so that the next writer restarts the WAL.
+	CheckpointRestart CheckpointMode = "RESTART"
+
+	// CheckpointTruncate is like [CheckpointRestart], and also truncates the WAL file to zero bytes.
+	CheckpointTruncate CheckpointMode = "TRUNCATE"
+)
+
+var ErrCheckpointBusy = errors.New("checkpoint could not complete because of concurrent readers or writers")
+
+// Checkpoint transfers the content of the WAL into the database with the provided mode.
+// Under constant read load automatic checkpoints might never complete, making the WAL file grow
+// indefinitely, so it's useful to periodically call Checkpoint with [CheckpointTruncate].
+// It returns [ErrCheckpointBusy] if the checkpoint could not complete.
+func (s *Store) Checkpoint(ctx context.Context, mode CheckpointMode) error {
+	switch mode {
+	case CheckpointPassive, CheckpointFull, CheckpointRestart, CheckpointTruncate:
+	default:
+		return fmt.Errorf("invalid checkpoint mode %q", mode)
+	}
+
+	var busy, logFrames, checkpointed int
+	row := s.DB.QueryRowContext(ctx, "PRAGMA wal_checkpoint("+string(mode)+");")
+	if err := row.Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return fmt.Errorf("failed to checkpoint: %w", err)
+	}
+
+	if busy == 1 {
+		return fmt.Errorf("%w: checkpointed %d frames out of %d", ErrCheckpointBusy, checkpointed, logFrames)
+	}
+	return nil
+}
+
+// Stats summarizes the events stored by a pubkey.
+// Bytes is the size of the tags and content of the events.
+type Stats struct {
+	Count int64
+	Bytes int64
+}
+
+// Stats returns the number and size of the events of the pubkey, optionally restricted to the provided kinds.
+// Stats are maintained by triggers in the write path, so this is a lookup that doesn't scan the events table,
+// making it suitable for quota enforcement.
+func (s *Store) Stats(ctx context.Context, pubkey string, kinds ...int) (Stats, error) {
+	query := "SELECT COALESCE(SUM(count), 0), COALESCE(SUM(bytes), 0) FROM stats WHERE pubkey = ?"
+	args := []any{pubkey}
+
+	if len(kinds) > 0 {
+		query += " AND kind" + EqualityClause(kinds)
+		for _, kind := range kinds {
+			args = append(args, kind)
+		}
+	}
+
+	var stats Stats
+	row := s.DB.QueryRowContext(ctx, query, args...)
+	if err := row.Scan(&stats.Count, &stats.Bytes); err != nil {
+		return Stats{}, fmt.Errorf("failed to fetch stats of pubkey %s: %w", pubkey, err)
+	}
+	return stats, nil
+}
+
+// IsDatabaseLocked returns true if the error indicates a locked SQLite database,
+// or a locked table when using a shared cache (e.g. with [NewMemory]).
 func IsDatabaseLocked(err error) bool {
-	return err != nil && strings.Contains(err.Error(), "database is locked")
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
 }
 
 // withRetries executes the given database operation with automatic retries
@@ -183,7 +566,12 @@ func IsDatabaseLocked(err error) bool {
 //
 // Note: this function is only useful for writes and not reads if the journal
 // mode is set to WAL (default), as readers don't lock the database.
-func (s *Store) withRetries(op func() error) error {
+// If the store is a read-only replica, it returns [ErrReadOnly] without executing the operation.
+func (s *Store) withRetries(name nastro.Operation, op func() error) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	for i := range s.retries + 1 {
 		err := op()
 		if !IsDatabaseLocked(err) {
@@ -192,47 +580,219 @@ func (s *Store) withRetries(op func() error) error {
 
 		if i < s.retries {
 			// sleep unless it's the last try
+			s.metrics.Retry(name)
 			jitter := time.Duration(rand.IntN(10)) * time.Millisecond
 			time.Sleep(20*time.Millisecond + jitter)
 		}
 	}
+
+	s.metrics.Conflict(name)
 	return fmt.Errorf("database is locked: performed (%d) attempts", s.retries+1)
 }
 
+// Save the event in the store. If the event is already stored, nothing happens and nil is returned,
+// unless the store uses [WithDuplicateError].
 func (s *Store) Save(ctx context.Context, e *nostr.Event) error {
-	if err := s.validateEvent(e); err != nil {
+	saved, err := s.SaveResult(ctx, e)
+	if err != nil {
 		return err
 	}
 
+	if !saved && s.duplicates {
+		return fmt.Errorf("%w: event ID %s", nastro.ErrDuplicate, e.ID)
+	}
+	return nil
+}
+
+// SaveResult saves the event in the store, and reports whether it was newly stored (true)
+// or it was already present (false).
+func (s *Store) SaveResult(ctx context.Context, e *nostr.Event) (bool, error) {
+	if err := s.validateEvent(e); err != nil {
+		return false, err
+	}
+
+	var saved bool
+	start := time.Now()
+	err := s.withRetries(nastro.OpSave, func() error {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to initiate the transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		saved, err = s.insert(ctx, tx, e)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+
+	s.metrics.Observe(nastro.OpSave, time.Since(start), written(saved), err)
+	if err != nil {
+		return false, fmt.Errorf("failed to save event with ID %s: %w", e.ID, err)
+	}
+	return saved, nil
+}
+
+// insert the event and its indexed tags within the transaction, reporting whether the event was inserted.
+// If the event was already present, its tags are left untouched.
+func (s *Store) insert(ctx context.Context, tx *sql.Tx, e *nostr.Event) (bool, error) {
 	tags, err := json.Marshal(e.Tags)
 	if err != nil {
-		return fmt.Errorf("failed to marshal the tags of event with ID %s: %w", e.ID, err)
+		return false, fmt.Errorf("failed to marshal the tags: %w", err)
 	}
 
-	err = s.withRetries(func() error {
-		_, err := s.DB.ExecContext(ctx, `INSERT OR IGNORE INTO events (id, pubkey, created_at, kind, tags, content, sig)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)`, e.ID, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content, e.Sig)
-		return err
-	})
+	var deleted bool
+	row := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM deleted_events WHERE id = $1 AND by_pubkey = $2)", e.ID, e.PubKey)
+	if err := row.Scan(&deleted); err != nil {
+		return false, fmt.Errorf("failed to check the deleted events: %w", err)
+	}
+
+	if deleted {
+		return false, nastro.ErrDeleted
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(insertEvent, s.builder.Partitions.table(e.Kind)), e.ID, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content, e.Sig, expiration(e))
+	if err != nil {
+		return false, err
+	}
 
+	inserted, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to save event with ID %s: %w", e.ID, err)
+		return false, err
+	}
+
+	if inserted == 0 {
+		return false, nil
+	}
+
+	for _, tag := range e.Tags {
+		if len(tag) < 2 || !s.isIndexed(e, tag[0]) {
+			continue
+		}
+
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO event_tags (event_id, key, value) VALUES ($1, $2, $3)", e.ID, tag[0], tag[1])
+		if err != nil {
+			return false, fmt.Errorf("failed to index tag %v: %w", tag, err)
+		}
+	}
+	return true, nil
+}
+
+// isIndexed returns whether the tag with the provided key of the event should be indexed in event_tags.
+func (s *Store) isIndexed(e *nostr.Event, key string) bool {
+	if key == "d" && nostr.IsAddressableKind(e.Kind) {
+		return true
+	}
+	return slices.Contains(s.tagKeys, key)
+}
+
+// expiration returns the NIP-40 expiration of the event, or nil if the event doesn't expire.
+func expiration(e *nostr.Event) any {
+	if ts := nip40.GetExpiration(e.Tags); ts >= 0 {
+		return int64(ts)
 	}
 	return nil
 }
 
-func (s *Store) Delete(ctx context.Context, id string) error {
-	err := s.withRetries(func() error {
-		_, err := s.DB.ExecContext(ctx, "DELETE FROM events WHERE id = $1", id)
-		return err
-	})
+// written returns the number of rows written by an operation that writes one event if saved.
+func written(saved bool) int64 {
+	if saved {
+		return 1
+	}
+	return 0
+}
 
+// PurgeExpired deletes all events whose NIP-40 expiration is in the past,
+// and returns how many events were deleted.
+func (s *Store) PurgeExpired(ctx context.Context) (int64, error) {
+	deleted, err := s.execAll(ctx, nastro.OpPurge, "DELETE FROM %s WHERE expires_at <= unixepoch()")
 	if err != nil {
+		return 0, fmt.Errorf("failed to purge expired events: %w", err)
+	}
+	return deleted, nil
+}
+
+// execAll executes the statement on all the tables storing events, and returns the total rows affected.
+// The statement is formatted with the name of each table, and it's reported as the operation.
+func (s *Store) execAll(ctx context.Context, op nastro.Operation, statement string, args ...any) (total int64, err error) {
+	start := time.Now()
+	defer func() { s.metrics.Observe(op, time.Since(start), total, err) }()
+
+	for _, table := range s.builder.Partitions.tables() {
+		var affected int64
+		err := s.withRetries(op, func() error {
+			res, err := s.DB.ExecContext(ctx, fmt.Sprintf(statement, table), args...)
+			if err != nil {
+				return err
+			}
+
+			affected, err = res.RowsAffected()
+			return err
+		})
+
+		if err != nil {
+			return total, err
+		}
+		total += affected
+	}
+	return total, nil
+}
+
+// purgeEvery calls [Store.PurgeExpired] every interval, until the store is closed.
+// If a tombstone retention is set, it also calls [Store.PruneTombstones].
+// Errors are ignored, as the purge will be attempted again at the next tick.
+func (s *Store) purgeEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-ticker.C:
+			s.PurgeExpired(context.Background())
+			if s.tombstoneRetention > 0 {
+				s.PruneTombstones(context.Background(), time.Now().Add(-s.tombstoneRetention))
+			}
+		}
+	}
+}
+
+// Delete the event with the provided id. If the store uses [WithSoftDelete], the event
+// is only marked as deleted, and the time of deletion is recorded.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	statement := "DELETE FROM %s WHERE id = $1"
+	if s.softDelete {
+		statement = "UPDATE %s SET deleted_at = unixepoch() WHERE id = $1 AND deleted_at IS NULL"
+	}
+
+	if _, err := s.execAll(ctx, nastro.OpDelete, statement, id); err != nil {
 		return fmt.Errorf("failed to delete event with ID %s: %w", id, err)
 	}
 	return nil
 }
 
+// Undelete restores the soft-deleted event with the provided id.
+// If the event is not found or it's not deleted, nothing happens and nil is returned.
+func (s *Store) Undelete(ctx context.Context, id string) error {
+	if _, err := s.execAll(ctx, nastro.OpUndelete, "UPDATE %s SET deleted_at = NULL WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to undelete event with ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// PurgeDeleted permanently removes the events that have been soft-deleted before the provided time,
+// and returns how many events were removed.
+func (s *Store) PurgeDeleted(ctx context.Context, olderThan time.Time) (int64, error) {
+	purged, err := s.execAll(ctx, nastro.OpPurge, "DELETE FROM %s WHERE deleted_at <= $1", olderThan.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted events: %w", err)
+	}
+	return purged, nil
+}
+
 func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
 	if err := s.validateEvent(event); err != nil {
 		return false, err
@@ -243,11 +803,11 @@ func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
 
 	switch {
 	case nostr.IsReplaceableKind(event.Kind):
-		query = "SELECT id, created_at FROM events WHERE kind = $1 AND pubkey = $2"
+		query = "SELECT id, created_at FROM events WHERE kind = $1 AND pubkey = $2 AND deleted_at IS NULL"
 		args = []any{event.Kind, event.PubKey}
 
 	case nostr.IsAddressableKind(event.Kind):
-		query = "SELECT e.id, e.created_at FROM events AS e JOIN event_tags AS t ON e.id = t.event_id WHERE e.kind = $1 AND e.pubkey = $2 AND t.key = 'd' AND t.value = $3;"
+		query = "SELECT e.id, e.created_at FROM events AS e JOIN event_tags AS t ON e.id = t.event_id WHERE e.kind = $1 AND e.pubkey = $2 AND t.key = 'd' AND t.value = $3 AND e.deleted_at IS NULL;"
 		args = []any{event.Kind, event.PubKey, event.Tags.GetD()}
 
 	default:
@@ -275,34 +835,35 @@ func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
 		return false, nil
 	}
 
-	if err = s.replace(ctx, event, oldID); err != nil {
-		return false, err
-	}
-	return true, nil
+	return s.replace(ctx, event, oldID)
 }
 
-// replace the event with the provided id with the new event.
-// It's an atomic version of Save(ctx, new) + Delete(ctx, id)
-func (s *Store) replace(ctx context.Context, new *nostr.Event, id string) error {
-	tags, err := json.Marshal(new.Tags)
-	if err != nil {
-		return fmt.Errorf("failed to marshal the tags: %w", err)
-	}
-
-	return s.withRetries(func() error {
+// replace the event with the provided id with the new event, and reports whether the new event was saved.
+// It's an atomic version of Save(ctx, new) + Delete(ctx, id), which also removes the indexed tags
+// of the old event. If the new event was already present, nothing is replaced.
+func (s *Store) replace(ctx context.Context, new *nostr.Event, id string) (bool, error) {
+	var replaced bool
+	start := time.Now()
+	err := s.withRetries(nastro.OpReplace, func() error {
 		tx, err := s.DB.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("failed to initiate the transaction: %w", err)
 		}
 		defer tx.Rollback()
 
-		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO events (id, pubkey, created_at, kind, tags, content, sig)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`, new.ID, new.PubKey, new.CreatedAt, new.Kind, tags, new.Content, new.Sig)
-
+		replaced, err = s.insert(ctx, tx, new)
 		if err != nil {
 			return fmt.Errorf("failed to save event with ID %s: %w", new.ID, err)
 		}
 
+		if !replaced {
+			return nil
+		}
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM event_tags WHERE event_id = $1", id); err != nil {
+			return fmt.Errorf("failed to delete the tags of old event with ID %s: %w", id, err)
+		}
+
 		if _, err = tx.ExecContext(ctx, "DELETE FROM events WHERE id = $1", id); err != nil {
 			return fmt.Errorf("failed to delete old event with ID %s: %w", id, err)
 		}
@@ -312,6 +873,9 @@ func (s *Store) replace(ctx context.Context, new *nostr.Event, id string) error
 		}
 		return nil
 	})
+
+	s.metrics.Observe(nastro.OpReplace, time.Since(start), written(replaced), err)
+	return replaced, err
 }
 
 func (s *Store) Query(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error) {
@@ -329,9 +893,34 @@ func (s *Store) QueryWithBuilder(ctx context.Context, build QueryBuilder, filter
 	if err != nil {
 		return nil, fmt.Errorf("failed to build query: %w", err)
 	}
+	return s.fetch(ctx, queries)
+}
+
+// QueryPage returns the events matching the filters that come strictly after the provided cursor
+// in the result ordering (created_at DESC, id ASC). Use [CursorOf] on the last event of a page
+// to get the cursor for the next one. A zero cursor returns the first page.
+func (s *Store) QueryPage(ctx context.Context, after Cursor, filters ...nostr.Filter) ([]nostr.Event, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := s.pageBuilder(after, filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build page query: %w", err)
+	}
+	return s.fetch(ctx, queries)
+}
+
+// fetch executes the queries and returns the scanned events.
+func (s *Store) fetch(ctx context.Context, queries []Query) (events []nostr.Event, err error) {
+	start := time.Now()
+	defer func() { s.metrics.Observe(nastro.OpQuery, time.Since(start), int64(len(events)), err) }()
 
-	var events []nostr.Event
 	for i, query := range queries {
+		start := time.Now()
+		fetched := len(events)
+
 		rows, err := s.DB.QueryContext(ctx, query.SQL, query.Args...)
 		if errors.Is(err, sql.ErrNoRows) {
 			continue
@@ -343,8 +932,7 @@ func (s *Store) QueryWithBuilder(ctx context.Context, build QueryBuilder, filter
 
 		for rows.Next() {
 			var event nostr.Event
-			err = rows.Scan(&event.ID, &event.PubKey, &event.CreatedAt, &event.Kind, &event.Tags, &event.Content, &event.Sig)
-			if err != nil {
+			if err := scanEvent(rows, &event); err != nil {
 				return events, fmt.Errorf("%w: failed to scan event row: %w", nastro.ErrInternalQuery, err)
 			}
 
@@ -354,10 +942,65 @@ func (s *Store) QueryWithBuilder(ctx context.Context, build QueryBuilder, filter
 		if err := rows.Err(); err != nil {
 			return events, fmt.Errorf("%w: failed to scan event row: %w", nastro.ErrInternalQuery, err)
 		}
+
+		s.logQuery(query, time.Since(start), len(events)-fetched)
 	}
 	return events, nil
 }
 
+// ExplainQuery returns the output of EXPLAIN QUERY PLAN for each of the queries
+// generated by the store's [QueryBuilder] for the filters.
+// Each plan contains one line per step, indented according to its depth in the plan tree.
+func (s *Store) ExplainQuery(ctx context.Context, filters ...nostr.Filter) ([]string, error) {
+	filters, err := s.sanitizeFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := s.queryBuilder(filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	plans := make([]string, 0, len(queries))
+	for _, query := range queries {
+		plan, err := s.explain(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// explain returns the EXPLAIN QUERY PLAN output of the query.
+func (s *Store) explain(ctx context.Context, query Query) (string, error) {
+	rows, err := s.DB.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query.SQL, query.Args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to explain query %s: %w", query, err)
+	}
+	defer rows.Close()
+
+	depth := make(map[int]int) // step id --> depth in the plan tree
+	var plan strings.Builder
+
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return "", fmt.Errorf("failed to scan query plan: %w", err)
+		}
+
+		depth[id] = depth[parent] + 1
+		plan.WriteString(strings.Repeat("  ", depth[id]-1) + detail + "\n")
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to scan query plan: %w", err)
+	}
+	return plan.String(), nil
+}
+
 func (s *Store) Count(ctx context.Context, filters ...nostr.Filter) (int64, error) {
 	return s.CountWithBuilder(ctx, s.countBuilder, filters...)
 }
@@ -369,129 +1012,115 @@ func (s *Store) CountWithBuilder(ctx context.Context, build QueryBuilder, filter
 		return 0, fmt.Errorf("failed to build count query: %w", err)
 	}
 
-	var total int64
+	return s.count(ctx, queries)
+}
+
+// count executes the count queries and returns the sum of their counts.
+func (s *Store) count(ctx context.Context, queries []Query) (total int64, err error) {
+	start := time.Now()
+	defer func() { s.metrics.Observe(nastro.OpCount, time.Since(start), total, err) }()
+
 	for i, query := range queries {
 		var count int64
+		start := time.Now()
+
 		row := s.DB.QueryRowContext(ctx, query.SQL, query.Args...)
 		err := row.Scan(&count)
 		if err != nil {
 			return 0, fmt.Errorf("failed to count events with query %s: %w", queries[i], err)
 		}
 
+		s.logQuery(query, time.Since(start), 1)
+
 		total += count
 	}
 	return total, nil
 }
 
 func DefaultQueryBuilder(filters ...nostr.Filter) ([]Query, error) {
-	switch len(filters) {
-	case 0:
-		return nil, nil
-
-	case 1:
-		query, args := buildQuery(filters[0])
-		query += " ORDER BY e.created_at DESC, e.id ASC LIMIT ?"
-		args = append(args, filters[0].Limit)
-		return []Query{{SQL: query, Args: args}}, nil
-
-	default:
-		subQueries := make([]string, 0, len(filters))
-		allArgs := make([]any, 0, len(filters))
-		limit := 0
-
-		for _, filter := range filters {
-			query, args := buildQuery(filter)
-			subQueries = append(subQueries, query)
-			allArgs = append(allArgs, args...)
-			limit += filter.Limit
-		}
+	return Builder{}.QueryBuilder(filters...)
+}
 
-		query := "SELECT * FROM (" + strings.Join(subQueries, " UNION ALL ") + ")" +
-			" GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?"
-		allArgs = append(allArgs, limit)
-		return []Query{{SQL: query, Args: allArgs}}, nil
-	}
+// DefaultPageBuilder builds the same queries as [DefaultQueryBuilder], adding to each filter
+// the keyset predicate that skips all events up to and including the cursor.
+// If the cursor is zero, no predicate is added.
+func DefaultPageBuilder(after Cursor, filters ...nostr.Filter) ([]Query, error) {
+	return Builder{}.PageBuilder(after, filters...)
 }
 
+// DefaultCountBuilder counts the events matching any of the filters.
+// When multiple filters are provided, the matching IDs are combined with a UNION,
+// so that events matching more than one filter are counted only once.
 func DefaultCountBuilder(filters ...nostr.Filter) ([]Query, error) {
-	switch len(filters) {
-	case 0:
-		return nil, nil
-
-	case 1:
-		query, args := buildCount(filters[0])
-		return []Query{{SQL: query, Args: args}}, nil
-
-	default:
-		subQueries := make([]string, 0, len(filters))
-		allArgs := make([]any, 0, len(filters))
-
-		for _, filter := range filters {
-			query, args := buildCount(filter)
-			subQueries = append(subQueries, "("+query+")")
-			allArgs = append(allArgs, args...)
-		}
+	return Builder{}.CountBuilder(filters...)
+}
 
-		// TODO: we are summing all counts together, without any deduplication
-		query := "SELECT (" + strings.Join(subQueries, " + ") + ")"
-		return []Query{{SQL: query, Args: allArgs}}, nil
-	}
+// ApproxCountBuilder sums the counts of each filter, without any deduplication.
+// It's faster than [DefaultCountBuilder], but it overstates the count when filters overlap.
+func ApproxCountBuilder(filters ...nostr.Filter) ([]Query, error) {
+	return Builder{}.ApproxCountBuilder(filters...)
 }
 
-func buildQuery(filter nostr.Filter) (string, []any) {
-	sql := toSql(filter)
-	if sql.JoinTags {
-		query := "SELECT e.* FROM events AS e JOIN event_tags AS t ON t.event_id = e.id" +
-			" WHERE " + strings.Join(sql.Conditions, " AND ") + " GROUP BY e.id"
-		return query, sql.Args
+func (b Builder) buildQuery(table string, filter nostr.Filter, after Cursor) (string, []any) {
+	sql := b.ToSQL(filter)
+	if !after.IsZero() {
+		sql.Conditions = append(sql.Conditions, "(e.created_at < ? OR (e.created_at = ? AND e.id > ?))")
+		sql.Args = append(sql.Args, after.CreatedAt, after.CreatedAt, after.ID)
 	}
 
-	query := "SELECT e.* FROM events AS e"
-	if len(sql.Conditions) > 0 {
-		query += " WHERE " + strings.Join(sql.Conditions, " AND ")
-	}
+	query := "SELECT " + Columns + " FROM " + table + " AS e" + sql.Where()
 	return query, sql.Args
 }
 
-func buildCount(filter nostr.Filter) (string, []any) {
-	sql := toSql(filter)
-	if sql.JoinTags {
-		query := "SELECT COUNT(DISTINCT e.id) FROM events AS e JOIN event_tags AS t ON t.event_id = e.id" +
-			" WHERE " + strings.Join(sql.Conditions, " AND ")
-		return query, sql.Args
-	}
+func (b Builder) buildIDs(table string, filter nostr.Filter) (string, []any) {
+	sql := b.ToSQL(filter)
+	query := "SELECT e.id FROM " + table + " AS e" + sql.Where()
+	return query, sql.Args
+}
 
-	query := "SELECT COUNT(e.id) FROM events AS e"
-	if len(sql.Conditions) > 0 {
-		query += " WHERE " + strings.Join(sql.Conditions, " AND ")
-	}
+func (b Builder) buildCount(table string, filter nostr.Filter) (string, []any) {
+	sql := b.ToSQL(filter)
+	query := "SELECT COUNT(e.id) FROM " + table + " AS e" + sql.Where()
 	return query, sql.Args
 }
 
-type sqlFilter struct {
+// SQLFilter is the translation of a [nostr.Filter] into SQL conditions on the events table (aliased "e"),
+// which must be AND-ed together, and the arguments of their placeholders, in order.
+// Tag conditions are subqueries on the event_tags table, so no join is required.
+type SQLFilter struct {
 	Conditions []string
 	Args       []any
-	JoinTags   bool
 }
 
-func toSql(filter nostr.Filter) sqlFilter {
-	s := sqlFilter{}
+// Where returns the WHERE clause AND-ing the conditions, or the empty string if there are none.
+func (s SQLFilter) Where() string {
+	if len(s.Conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(s.Conditions, " AND ")
+}
+
+// ToSQL translates the filter into the conditions used by the builder, excluding expired and deleted events.
+// The limit of the filter is ignored. It's meant for custom builders over additional schemas (e.g. FTS or geo tables),
+// which can append their own conditions and joins, see [WithAdditionalSchema].
+func (b Builder) ToSQL(filter nostr.Filter) SQLFilter {
+	s := SQLFilter{}
 	if len(filter.IDs) > 0 {
-		s.Conditions = append(s.Conditions, "e.id"+equalityClause(filter.IDs))
+		s.Conditions = append(s.Conditions, "e.id"+EqualityClause(filter.IDs))
 		for _, id := range filter.IDs {
 			s.Args = append(s.Args, id)
 		}
 	}
 
 	if len(filter.Kinds) > 0 {
-		s.Conditions = append(s.Conditions, "e.kind"+equalityClause(filter.Kinds))
+		s.Conditions = append(s.Conditions, "e.kind"+EqualityClause(filter.Kinds))
 		for _, kind := range filter.Kinds {
 			s.Args = append(s.Args, kind)
 		}
 	}
 
 	if len(filter.Authors) > 0 {
-		s.Conditions = append(s.Conditions, "e.pubkey"+equalityClause(filter.Authors))
+		s.Conditions = append(s.Conditions, "e.pubkey"+EqualityClause(filter.Authors))
 		for _, pk := range filter.Authors {
 			s.Args = append(s.Args, pk)
 		}
@@ -507,37 +1136,103 @@ func toSql(filter nostr.Filter) sqlFilter {
 		s.Args = append(s.Args, filter.Since.Time().Unix())
 	}
 
-	if len(filter.Tags) > 0 {
-		conds := make([]string, 0, len(filter.Tags))
-		args := make([]any, 0, len(filter.Tags))
-
-		for key, vals := range filter.Tags {
-			if len(vals) == 0 {
-				continue
-			}
-
-			conds = append(conds, "(t.key = ? AND t.value"+equalityClause(vals)+")")
-			args = append(args, key)
+	// expired and deleted events must never surface
+	s.Conditions = append(s.Conditions, "(e.expires_at IS NULL OR e.expires_at > unixepoch())", "e.deleted_at IS NULL")
+
+	// Each tag key is an indexed subquery on event_tags(key, value, event_id), and different keys are AND-ed,
+	// as NIP-01 requires events to match all the conditions of a filter.
+	// This avoids the JOIN + GROUP BY that forces sqlite to materialize all events with a popular tag,
+	// letting the planner choose between the tag index and the time index.
+	// Keys are sorted to produce deterministic queries.
+	keys := make([]string, 0, len(filter.Tags))
+	for key, vals := range filter.Tags {
+		if len(vals) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		vals := filter.Tags[key]
+		nocase := slices.Contains(b.NoCaseTags, key)
+
+		var cond string
+		var args []any
+		if slices.Contains(b.PrefixTags, key) {
+			cond, args = prefixClause(vals, nocase)
+		} else {
+			cond = valueColumn(nocase) + EqualityClause(vals)
 			for _, v := range vals {
 				args = append(args, v)
 			}
 		}
 
-		if len(conds) > 0 {
-			s.JoinTags = true
-			s.Conditions = append(s.Conditions, strings.Join(conds, " OR "))
-			s.Args = append(s.Args, args...)
-		}
+		s.Conditions = append(s.Conditions, "e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND "+cond+")")
+		s.Args = append(s.Args, key)
+		s.Args = append(s.Args, args...)
 	}
 	return s
 }
 
-// equalityClause returns the appropriate SQL comparison operator and placeholder(s)
+// valueColumn returns the tag value column, with the NOCASE collation if nocase is true.
+func valueColumn(nocase bool) string {
+	if nocase {
+		return "t.value COLLATE NOCASE"
+	}
+	return "t.value"
+}
+
+// prefixClause returns the condition matching tag values that start with any of the prefixes.
+// Each prefix is translated into the range [prefix, prefixEnd(prefix)), which is equivalent to
+// LIKE prefix || '%' (but case sensitive) and, unlike LIKE, can use the index on event_tags(key, value).
+// If nocase is true, the range is computed and compared with the NOCASE collation.
+func prefixClause(prefixes []string, nocase bool) (string, []any) {
+	value := valueColumn(nocase)
+	conds := make([]string, 0, len(prefixes))
+	args := make([]any, 0, 2*len(prefixes))
+
+	for _, prefix := range prefixes {
+		if nocase {
+			prefix = lowerASCII(prefix)
+		}
+
+		end := prefixEnd(prefix)
+		if nocase && strings.HasSuffix(end, "A") {
+			// NOCASE sorts upper case letters as lower case ones, so the byte that follows '@' is '['
+			end = end[:len(end)-1] + "["
+		}
+
+		if end == "" {
+			conds = append(conds, value+" >= ?")
+			args = append(args, prefix)
+			continue
+		}
+
+		conds = append(conds, "("+value+" >= ? AND "+value+" < ?)")
+		args = append(args, prefix, end)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// prefixEnd returns the smallest string greater than all the strings with the prefix,
+// or the empty string if there is none (the prefix is empty or made only of 0xff bytes).
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// EqualityClause returns the appropriate SQL comparison operator and placeholder(s)
 // for use in a WHERE clause, based on the number of values provided.
 // If the slice contains one value, it returns " = ?".
 // If it contains multiple values, it returns " IN (?, ?, ... )" with the correct number of placeholders.
 // It panics is vals is nil or empty.
-func equalityClause[T any](vals []T) string {
+func EqualityClause[T any](vals []T) string {
 	if len(vals) == 1 {
 		return " = ?"
 	}
@@ -2,10 +2,19 @@ package sqlite
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/pippellia-btc/nastro"
 )
@@ -46,6 +55,36 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestSaveDuplicate(t *testing.T) {
+	store, err := New(URL, WithDuplicateError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	saved, err := store.SaveResult(ctx, &event1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !saved {
+		t.Fatalf("expected the event to be saved")
+	}
+
+	saved, err = store.SaveResult(ctx, &event1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved {
+		t.Fatalf("expected the event to be reported as duplicate")
+	}
+
+	if err := store.Save(ctx, &event1); !errors.Is(err, nastro.ErrDuplicate) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrDuplicate, err)
+	}
+}
+
 var event10 = nostr.Event{ID: "bbb", Kind: 0, PubKey: "key", CreatedAt: 10, Sig: "xx", Content: "{}"}
 var event100 = nostr.Event{ID: "aaa", Kind: 0, PubKey: "key", CreatedAt: 100, Sig: "xx", Content: "{}"}
 
@@ -115,6 +154,79 @@ func TestReplace(t *testing.T) {
 	}
 }
 
+func TestReplaceThenQueryByTag(t *testing.T) {
+	tests := []struct {
+		name string
+		old  nostr.Event
+		new  nostr.Event
+		tag  string
+	}{
+		{
+			name: "replaceable",
+			old:  nostr.Event{ID: "old", Kind: 0, PubKey: "key", CreatedAt: 10, Tags: nostr.Tags{{"t", "old"}}},
+			new:  nostr.Event{ID: "new", Kind: 0, PubKey: "key", CreatedAt: 100, Tags: nostr.Tags{{"t", "new"}}},
+			tag:  "t",
+		},
+		{
+			name: "addressable",
+			old:  nostr.Event{ID: "old", Kind: 30000, PubKey: "key", CreatedAt: 10, Tags: nostr.Tags{{"d", "x"}, {"t", "old"}}},
+			new:  nostr.Event{ID: "new", Kind: 30000, PubKey: "key", CreatedAt: 100, Tags: nostr.Tags{{"d", "x"}, {"t", "new"}}},
+			tag:  "t",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := New(URL, WithIndexedTags("t"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer Remove(URL)
+
+			if _, err := store.Replace(ctx, &test.old); err != nil {
+				t.Fatal(err)
+			}
+
+			replaced, err := store.Replace(ctx, &test.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !replaced {
+				t.Fatalf("expected the event to be replaced")
+			}
+
+			res, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{test.tag: {"old"}}, Limit: 10})
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+
+			if len(res) != 0 {
+				t.Fatalf("expected no events with the old tag, got %v", res)
+			}
+
+			res, err = store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{test.tag: {"new"}}, Limit: 10})
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+
+			if len(res) != 1 || res[0].ID != test.new.ID {
+				t.Fatalf("expected event %s, got %v", test.new.ID, res)
+			}
+
+			var orphans int
+			row := store.DB.QueryRow("SELECT COUNT(*) FROM event_tags WHERE event_id = ?", test.old.ID)
+			if err := row.Scan(&orphans); err != nil {
+				t.Fatal(err)
+			}
+
+			if orphans != 0 {
+				t.Fatalf("expected no tags of the old event, got %d", orphans)
+			}
+		})
+	}
+}
+
 func TestDefaultQueryBuilder(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -125,7 +237,7 @@ func TestDefaultQueryBuilder(t *testing.T) {
 			name:    "single filter, kind",
 			filters: nostr.Filters{{Kinds: []int{0, 1}, Limit: 100}},
 			query: Query{
-				SQL:  "SELECT e.* FROM events AS e WHERE e.kind IN (?,?) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
 				Args: []any{0, 1, 100},
 			},
 		},
@@ -133,7 +245,7 @@ func TestDefaultQueryBuilder(t *testing.T) {
 			name:    "single filter, authors",
 			filters: nostr.Filters{{Authors: []string{"aaa", "bbb", "xxx"}, Limit: 11}},
 			query: Query{
-				SQL:  "SELECT e.* FROM events AS e WHERE e.pubkey IN (?,?,?) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.pubkey IN (?,?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
 				Args: []any{"aaa", "bbb", "xxx", 11},
 			},
 		},
@@ -147,7 +259,7 @@ func TestDefaultQueryBuilder(t *testing.T) {
 			}},
 
 			query: Query{
-				SQL:  "SELECT e.* FROM events AS e JOIN event_tags AS t ON t.event_id = e.id WHERE (t.key = ? AND t.value = ?) GROUP BY e.id ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value = ?) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
 				Args: []any{"e", "xxx", 11},
 			},
 		},
@@ -162,7 +274,7 @@ func TestDefaultQueryBuilder(t *testing.T) {
 			}},
 
 			query: Query{
-				SQL:  "SELECT e.* FROM events AS e JOIN event_tags AS t ON t.event_id = e.id WHERE (t.key = ? AND t.value IN (?,?)) OR (t.key = ? AND t.value = ?) GROUP BY e.id ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value IN (?,?)) AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value = ?) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
 				Args: []any{"e", "xxx", "yyy", "p", "someone", 11},
 			},
 		},
@@ -173,7 +285,7 @@ func TestDefaultQueryBuilder(t *testing.T) {
 				{Authors: []string{"aaa", "bbb"}, Limit: 420},
 			},
 			query: Query{
-				SQL:  "SELECT * FROM (SELECT e.* FROM events AS e WHERE e.kind IN (?,?) UNION ALL SELECT e.* FROM events AS e WHERE e.pubkey IN (?,?)) GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?",
+				SQL:  "SELECT * FROM (SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL UNION ALL SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.pubkey IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL) GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?",
 				Args: []any{0, 1, "aaa", "bbb", 69 + 420},
 			},
 		},
@@ -193,6 +305,91 @@ func TestDefaultQueryBuilder(t *testing.T) {
 	}
 }
 
+func TestDefaultPageBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		after   Cursor
+		filters nostr.Filters
+		query   Query
+	}{
+		{
+			name:    "zero cursor",
+			filters: nostr.Filters{{Kinds: []int{0}, Limit: 10}},
+			query: Query{
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				Args: []any{0, 10},
+			},
+		},
+		{
+			name:    "single filter",
+			after:   Cursor{CreatedAt: 100, ID: "aaa"},
+			filters: nostr.Filters{{Kinds: []int{0}, Limit: 10}},
+			query: Query{
+				SQL:  "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND (e.created_at < ? OR (e.created_at = ? AND e.id > ?)) ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+				Args: []any{0, nostr.Timestamp(100), nostr.Timestamp(100), "aaa", 10},
+			},
+		},
+		{
+			name:  "multiple filter",
+			after: Cursor{CreatedAt: 100, ID: "aaa"},
+			filters: nostr.Filters{
+				{Kinds: []int{0}, Limit: 10},
+				{Authors: []string{"bbb"}, Limit: 5},
+			},
+			query: Query{
+				SQL:  "SELECT * FROM (SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND (e.created_at < ? OR (e.created_at = ? AND e.id > ?)) UNION ALL SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.pubkey = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND (e.created_at < ? OR (e.created_at = ? AND e.id > ?))) GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?",
+				Args: []any{0, nostr.Timestamp(100), nostr.Timestamp(100), "aaa", "bbb", nostr.Timestamp(100), nostr.Timestamp(100), "aaa", 15},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := DefaultPageBuilder(test.after, test.filters...)
+			if err != nil {
+				t.Fatalf("expected error nil, got %v", err)
+			}
+
+			if !reflect.DeepEqual(query[0], test.query) {
+				t.Fatalf("expected query %v, got %v", test.query, query[0])
+			}
+		})
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	for _, event := range []nostr.Event{event10, event100} {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := nostr.Filter{Authors: []string{"key"}, Limit: 1}
+	page, err := store.QueryPage(ctx, Cursor{}, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 1 || page[0].ID != event100.ID {
+		t.Fatalf("expected first page with event %s, got %v", event100.ID, page)
+	}
+
+	page, err = store.QueryPage(ctx, CursorOf(page[0]), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 1 || page[0].ID != event10.ID {
+		t.Fatalf("expected second page with event %s, got %v", event10.ID, page)
+	}
+}
+
 func TestDefaultCountBuilder(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -203,7 +400,7 @@ func TestDefaultCountBuilder(t *testing.T) {
 			name:    "single filter, kind",
 			filters: nostr.Filters{{Kinds: []int{0}}},
 			query: Query{
-				SQL:  "SELECT COUNT(e.id) FROM events AS e WHERE e.kind = ?",
+				SQL:  "SELECT COUNT(e.id) FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL",
 				Args: []any{0},
 			},
 		},
@@ -211,7 +408,7 @@ func TestDefaultCountBuilder(t *testing.T) {
 			name:    "single filter, authors",
 			filters: nostr.Filters{{Authors: []string{"aaa", "bbb", "xxx"}}},
 			query: Query{
-				SQL:  "SELECT COUNT(e.id) FROM events AS e WHERE e.pubkey IN (?,?,?)",
+				SQL:  "SELECT COUNT(e.id) FROM events AS e WHERE e.pubkey IN (?,?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL",
 				Args: []any{"aaa", "bbb", "xxx"},
 			},
 		},
@@ -226,7 +423,7 @@ func TestDefaultCountBuilder(t *testing.T) {
 			}},
 
 			query: Query{
-				SQL:  "SELECT COUNT(DISTINCT e.id) FROM events AS e JOIN event_tags AS t ON t.event_id = e.id WHERE (t.key = ? AND t.value IN (?,?)) OR (t.key = ? AND t.value = ?)",
+				SQL:  "SELECT COUNT(e.id) FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value IN (?,?)) AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value = ?)",
 				Args: []any{"e", "xxx", "yyy", "p", "someone"},
 			},
 		},
@@ -237,10 +434,21 @@ func TestDefaultCountBuilder(t *testing.T) {
 				{Authors: []string{"aaa", "bbb"}},
 			},
 			query: Query{
-				SQL:  "SELECT ((SELECT COUNT(e.id) FROM events AS e WHERE e.kind IN (?,?)) + (SELECT COUNT(e.id) FROM events AS e WHERE e.pubkey IN (?,?)))",
+				SQL:  "SELECT COUNT(*) FROM (SELECT e.id FROM events AS e WHERE e.kind IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL UNION SELECT e.id FROM events AS e WHERE e.pubkey IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL)",
 				Args: []any{0, 1, "aaa", "bbb"},
 			},
 		},
+		{
+			name: "multiple filter, tags",
+			filters: nostr.Filters{
+				{Kinds: []int{0}},
+				{Tags: nostr.TagMap{"e": {"xxx"}}},
+			},
+			query: Query{
+				SQL:  "SELECT COUNT(*) FROM (SELECT e.id FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL UNION SELECT e.id FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND t.value = ?))",
+				Args: []any{0, "e", "xxx"},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -257,6 +465,1018 @@ func TestDefaultCountBuilder(t *testing.T) {
 	}
 }
 
+func TestApproxCountBuilder(t *testing.T) {
+	filters := nostr.Filters{
+		{Kinds: []int{0, 1}},
+		{Authors: []string{"aaa", "bbb"}},
+	}
+	expected := Query{
+		SQL:  "SELECT ((SELECT COUNT(e.id) FROM events AS e WHERE e.kind IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL) + (SELECT COUNT(e.id) FROM events AS e WHERE e.pubkey IN (?,?) AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL))",
+		Args: []any{0, 1, "aaa", "bbb"},
+	}
+
+	query, err := ApproxCountBuilder(filters...)
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(query[0], expected) {
+		t.Fatalf("expected query %v, got %v", expected, query[0])
+	}
+}
+
+func TestCountOverlappingFilters(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := store.Save(ctx, &event100); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{0}}, nostr.Filter{Authors: []string{"key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected count 1, got %d", count)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	store, err := New(URL, WithQueryLimits(nastro.QueryLimits{MaxLimit: 1, AllowEmptyFilter: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	for _, event := range []nostr.Event{event10, event100} {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Authors: []string{"key"}, Limit: 1000})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 || res[0].ID != event100.ID {
+		t.Fatalf("expected the limit to be clamped to 1, got %v", res)
+	}
+
+	// an empty filter matches all events up to the limit
+	res, err = store.Query(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 || res[0].ID != event100.ID {
+		t.Fatalf("expected the latest event, got %v", res)
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	store, err := New(URL, WithWriteLimits(nastro.WriteLimits{BannedKinds: []int{4}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := store.Save(ctx, &nostr.Event{ID: "dm", PubKey: "key", Kind: 4}); !errors.Is(err, nastro.ErrBannedKind) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrBannedKind, err)
+	}
+
+	if err := store.Save(ctx, &event10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	expired := nostr.Event{ID: "ccc", Kind: 1, PubKey: "key", CreatedAt: 10, Tags: nostr.Tags{{"expiration", "20"}}}
+	if err := store.Save(ctx, &expired); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{IDs: []string{expired.ID}, Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected no events, got %v", res)
+	}
+
+	deleted, err := store.PurgeExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 1 {
+		t.Fatalf("expected 1 purged event, got %d", deleted)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	store, err := New(URL, WithSoftDelete())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := store.Save(ctx, &event100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, event100.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := nostr.Filter{IDs: []string{event100.ID}, Limit: 1}
+	res, err := store.Query(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected no events, got %v", res)
+	}
+
+	if err := store.Undelete(ctx, event100.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = store.Query(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 {
+		t.Fatalf("expected one event, got %v", res)
+	}
+
+	if err := store.Delete(ctx, event100.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := store.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("expected 1 purged event, got %d", purged)
+	}
+}
+
+func ExampleBuilder_ToSQL() {
+	// A query builder for a store with the additional FTS5 table events_fts(id, content),
+	// which matches the NIP-50 search of each filter on top of the base conditions.
+	searchBuilder := func(filters ...nostr.Filter) ([]Query, error) {
+		queries := make([]Query, 0, len(filters))
+		for _, filter := range filters {
+			sql := Builder{}.ToSQL(filter)
+			if filter.Search != "" {
+				sql.Conditions = append(sql.Conditions, "f.content MATCH ?")
+				sql.Args = append(sql.Args, filter.Search)
+			}
+
+			query := "SELECT " + Columns + " FROM events AS e JOIN events_fts AS f ON f.id = e.id" + sql.Where() + " ORDER BY f.rank LIMIT ?"
+			queries = append(queries, Query{SQL: query, Args: append(sql.Args, filter.Limit)})
+		}
+		return queries, nil
+	}
+
+	queries, _ := searchBuilder(nostr.Filter{Kinds: []int{1}, Search: "nostr", Limit: 10})
+	fmt.Println(queries[0].SQL)
+	fmt.Println(queries[0].Args)
+	// Output:
+	// SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e JOIN events_fts AS f ON f.id = e.id WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL AND f.content MATCH ? ORDER BY f.rank LIMIT ?
+	// [1 nostr 10]
+}
+
+func TestPartitionsQueryBuilder(t *testing.T) {
+	builder := Builder{Partitions: Partitions{1, 7}}
+	filters := nostr.Filters{{Kinds: []int{0, 1, 7}, Limit: 10}}
+	expected := Query{
+		SQL: "SELECT * FROM (" +
+			"SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL" +
+			" UNION ALL SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events_1 AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL" +
+			" UNION ALL SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events_7 AS e WHERE e.kind = ? AND (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL" +
+			") GROUP BY id ORDER BY created_at DESC, id ASC LIMIT ?",
+		Args: []any{0, 1, 7, 10},
+	}
+
+	query, err := builder.QueryBuilder(filters...)
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(query[0], expected) {
+		t.Fatalf("expected query %v, got %v", expected, query[0])
+	}
+}
+
+func TestTagPrefixes(t *testing.T) {
+	builder := Builder{PrefixTags: []string{"e"}}
+	filters := nostr.Filters{{Tags: nostr.TagMap{"e": {"abc", "de"}}, Limit: 10}}
+	expected := Query{
+		SQL: "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM events AS e WHERE (e.expires_at IS NULL OR e.expires_at > unixepoch()) AND e.deleted_at IS NULL" +
+			" AND e.id IN (SELECT t.event_id FROM event_tags AS t WHERE t.key = ? AND ((t.value >= ? AND t.value < ?) OR (t.value >= ? AND t.value < ?)))" +
+			" ORDER BY e.created_at DESC, e.id ASC LIMIT ?",
+		Args: []any{"e", "abc", "abd", "de", "df", 10},
+	}
+
+	query, err := builder.QueryBuilder(filters...)
+	if err != nil {
+		t.Fatalf("expected error nil, got %v", err)
+	}
+
+	if !reflect.DeepEqual(query[0], expected) {
+		t.Fatalf("expected query %v, got %v", expected, query[0])
+	}
+
+	store, err := New(URL, WithIndexedTags("e", "p"), WithTagPrefixes("e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	events := []nostr.Event{
+		{ID: "1", Kind: 1, PubKey: "key", CreatedAt: 1, Tags: nostr.Tags{{"e", "abcdef"}, {"p", "abcdef"}}},
+		{ID: "2", Kind: 1, PubKey: "key", CreatedAt: 2, Tags: nostr.Tags{{"e", "abd"}}},
+		{ID: "3", Kind: 1, PubKey: "key", CreatedAt: 3, Tags: nostr.Tags{{"e", "ab"}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"e": {"abc"}}, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 || res[0].ID != "1" {
+		t.Fatalf("expected event 1, got %v", res)
+	}
+
+	// keys not listed are still matched exactly
+	res, err = store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"p": {"abc"}}, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected no events, got %v", res)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{prefix: "", expected: ""},
+		{prefix: "abc", expected: "abd"},
+		{prefix: "ab\xff", expected: "ac"},
+		{prefix: "\xff\xff", expected: ""},
+	}
+
+	for _, test := range tests {
+		if end := prefixEnd(test.prefix); end != test.expected {
+			t.Errorf("prefix %q: expected %q, got %q", test.prefix, test.expected, end)
+		}
+	}
+}
+
+func TestCaseInsensitiveTags(t *testing.T) {
+	store, err := New(URL, WithIndexedTags("t"), WithCaseInsensitiveTags("t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	events := []nostr.Event{
+		{ID: "1", Kind: 1, PubKey: "key", CreatedAt: 1, Tags: nostr.Tags{{"t", "Bitcoin"}}},
+		{ID: "2", Kind: 1, PubKey: "key", CreatedAt: 2, Tags: nostr.Tags{{"t", "BITCOIN"}}},
+		{ID: "3", Kind: 1, PubKey: "key", CreatedAt: 3, Tags: nostr.Tags{{"t", "bitcoiner"}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {"bitcoin"}}, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 2 || res[0].ID != "2" || res[1].ID != "1" {
+		t.Fatalf("expected events 2 and 1, got %v", res)
+	}
+
+	plans, err := store.ExplainQuery(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {"bitcoin"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plans) != 1 || !strings.Contains(plans[0], "event_tags_key_value_nocase_idx") {
+		t.Fatalf("expected the plan to use the case-insensitive index, got %v", plans)
+	}
+
+	builder := Builder{PrefixTags: []string{"t"}, NoCaseTags: []string{"t"}}
+	store.queryBuilder = builder.QueryBuilder
+
+	res, err = store.Query(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {"BitCoin"}}, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 3 {
+		t.Fatalf("expected 3 events, got %v", res)
+	}
+}
+
+func TestLowerASCII(t *testing.T) {
+	if s := lowerASCII("Bitcoin-ÀZ@"); s != "bitcoin-Àz@" {
+		t.Fatalf("expected %q, got %q", "bitcoin-Àz@", s)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	store, err := New(URL, WithPartitions(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	note := nostr.Event{ID: "ddd", Kind: 1, PubKey: "key", CreatedAt: 50}
+	for _, event := range []nostr.Event{event10, note} {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var partitioned int
+	row := store.DB.QueryRow("SELECT COUNT(*) FROM events_1")
+	if err := row.Scan(&partitioned); err != nil {
+		t.Fatal(err)
+	}
+
+	if partitioned != 1 {
+		t.Fatalf("expected one event in the partition, got %d", partitioned)
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{Authors: []string{"key"}, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 2 || res[0].ID != note.ID || res[1].ID != event10.ID {
+		t.Fatalf("expected events %s and %s, got %v", note.ID, event10.ID, res)
+	}
+
+	if err := store.Delete(ctx, note.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.Count(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected count 0, got %d", count)
+	}
+}
+
+func TestHandleDeletion(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := store.Save(ctx, &event100); err != nil {
+		t.Fatal(err)
+	}
+
+	deletion := nostr.Event{ID: "del", Kind: nostr.KindDeletion, PubKey: event100.PubKey, Tags: nostr.Tags{{"e", event100.ID}}}
+	if err := store.HandleDeletion(ctx, &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{IDs: []string{event100.ID}, Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected no events, got %v", res)
+	}
+
+	if err := store.Save(ctx, &event100); !errors.Is(err, nastro.ErrDeleted) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrDeleted, err)
+	}
+
+	pruned, err := store.PruneTombstones(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 1 {
+		t.Fatalf("expected 1 pruned tombstone, got %d", pruned)
+	}
+
+	if err := store.Save(ctx, &event100); err != nil {
+		t.Fatalf("expected the event to be saved after pruning, got %v", err)
+	}
+}
+
+func TestImportFast(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	events := []*nostr.Event{&event10, &event100, &event10}
+	stats, err := store.ImportFast(ctx, slices.Values(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Imported != 2 || stats.Skipped != 1 {
+		t.Fatalf("expected 2 imported and 1 skipped, got %+v", stats)
+	}
+
+	var indexes int
+	row := store.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name IN ('pubkey_idx', 'time_idx', 'kind_idx')")
+	if err := row.Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+
+	if indexes != 3 {
+		t.Fatalf("expected the indexes to be rebuilt, got %d", indexes)
+	}
+
+	pubkeyStats, err := store.Stats(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pubkeyStats.Count != 2 {
+		t.Fatalf("expected stats count 2, got %d", pubkeyStats.Count)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	store, err := New(URL, WithProfiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	relays := nostr.Event{ID: "relays", Kind: 10002, PubKey: "key", CreatedAt: 10, Tags: nostr.Tags{{"r", "wss://relay.example.com"}}}
+	for _, event := range []nostr.Event{event100, event10, relays} {
+		if _, err := store.Replace(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	profile, err := store.Profile(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Profile{
+		PubKey:     "key",
+		Metadata:   event100.Content,
+		MetadataAt: event100.CreatedAt,
+		Relays:     relays.Tags,
+		RelaysAt:   relays.CreatedAt,
+	}
+
+	if !reflect.DeepEqual(profile, expected) {
+		t.Fatalf("expected profile %v, got %v", expected, profile)
+	}
+
+	if _, err := store.Profile(ctx, "unknown"); !errors.Is(err, ErrProfileNotFound) {
+		t.Fatalf("expected error %v, got %v", ErrProfileNotFound, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	for _, event := range []nostr.Event{event10, event100} {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, event10.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.Stats(ctx, "key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Count != 1 {
+		t.Fatalf("expected count 1, got %d", stats.Count)
+	}
+
+	if stats.Bytes == 0 {
+		t.Fatalf("expected non-zero bytes")
+	}
+}
+
+type collector struct {
+	nastro.NoMetrics
+	mu     sync.Mutex
+	rows   map[nastro.Operation]int64
+	limits []string
+}
+
+func (c *collector) Observe(op nastro.Operation, took time.Duration, rows int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rows[op] += rows
+}
+
+func (c *collector) Limit(limit string, clamped bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = append(c.limits, fmt.Sprintf("%s %v", limit, clamped))
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &collector{rows: make(map[nastro.Operation]int64)}
+	store, err := New(URL, WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	for _, event := range []nostr.Event{event1, event10, event100} {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Authors: []string{"key"}, Limit: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Count(ctx, nostr.Filter{Authors: []string{"key"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, event1.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[nastro.Operation]int64{nastro.OpSave: 3, nastro.OpQuery: 2, nastro.OpCount: 2, nastro.OpDelete: 1}
+	if !reflect.DeepEqual(metrics.rows, expected) {
+		t.Fatalf("expected rows %v, got %v", expected, metrics.rows)
+	}
+}
+
+func TestLimitMetrics(t *testing.T) {
+	metrics := &collector{rows: make(map[nastro.Operation]int64)}
+	store, err := New(URL, WithQueryLimits(nastro.QueryLimits{MaxKinds: 1, MaxLimit: 10}), WithMetrics(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1}, Limit: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Query(ctx, nostr.Filter{Kinds: []int{1, 7}, Limit: 1}); !errors.Is(err, nastro.ErrTooManyKinds) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrTooManyKinds, err)
+	}
+
+	expected := []string{"MaxLimit true", "MaxKinds false"}
+	if !reflect.DeepEqual(metrics.limits, expected) {
+		t.Fatalf("expected limits %v, got %v", expected, metrics.limits)
+	}
+}
+
+func TestExplainQuery(t *testing.T) {
+	store, err := New(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	plans, err := store.ExplainQuery(ctx, nostr.Filter{Authors: []string{"key"}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plans) != 1 || plans[0] == "" {
+		t.Fatalf("expected one non-empty plan, got %v", plans)
+	}
+}
+
+// BenchmarkQueryTagWithTimeWindow measures a popular tag combined with a since/until window,
+// the case that used to degrade because of the JOIN + GROUP BY on event_tags.
+// It uses the d tag because it's the only one indexed by the base schema.
+func BenchmarkQueryTagWithTimeWindow(b *testing.B) {
+	store, err := New(URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer Remove(URL)
+
+	for i := range 10000 {
+		event := nostr.Event{
+			ID:        fmt.Sprintf("%064d", i),
+			PubKey:    "key",
+			CreatedAt: nostr.Timestamp(i),
+			Kind:      30000,
+			Tags:      nostr.Tags{{"d", "popular"}},
+		}
+
+		if err := store.Save(ctx, &event); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	since, until := nostr.Timestamp(5000), nostr.Timestamp(5100)
+	filter := nostr.Filter{Tags: nostr.TagMap{"d": {"popular"}}, Since: &since, Until: &until, Limit: 100}
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := store.Query(ctx, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	store, err := New(URL, WithAutoCheckpoint(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := store.Save(ctx, &event100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Checkpoint(ctx, CheckpointTruncate); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Checkpoint(ctx, "INVALID"); err == nil {
+		t.Fatal("expected error for invalid mode, got nil")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicaOpen(t *testing.T) {
+	primary, err := New(URL, WithReplication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	if err := primary.Save(ctx, &event10); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := ReplicaOpen(URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	res, err := replica.Query(ctx, nostr.Filter{IDs: []string{event10.ID}, Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 || res[0].ID != event10.ID {
+		t.Fatalf("expected event %s, got %v", event10.ID, res)
+	}
+
+	if err := replica.Save(ctx, &event100); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected error %v, got %v", ErrReadOnly, err)
+	}
+
+	if err := replica.Delete(ctx, event10.ID); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected error %v, got %v", ErrReadOnly, err)
+	}
+
+	if _, err := replica.DB.Exec("DELETE FROM events"); err == nil {
+		t.Fatalf("expected the replica to refuse direct writes")
+	}
+
+	if _, err := ReplicaOpen(URL, WithPurgeInterval(time.Minute)); err == nil {
+		t.Fatalf("expected the replica to refuse the purge job")
+	}
+}
+
+func TestLibsql(t *testing.T) {
+	// the libsql client opens file URLs with the sqlite3 driver, like the local copies of embedded replicas
+	store, err := NewLibsql("file:"+URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+	defer store.Close()
+
+	if err := store.Save(ctx, &event10); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := store.Query(ctx, nostr.Filter{IDs: []string{event10.ID}, Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 || res[0].ID != event10.ID {
+		t.Fatalf("expected event %s, got %v", event10.ID, res)
+	}
+
+	var mode string
+	if err := store.DB.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+
+	if mode == "wal" {
+		t.Fatalf("expected the journal mode to be left to the driver")
+	}
+
+	connector := connector{URL: URL, driver: &sqlite3.SQLiteDriver{}}
+	if _, err := OpenConnector(connector, WithAutoCheckpoint(100)); !errors.Is(err, errPragmasUnsupported) {
+		t.Fatalf("expected error %v, got %v", errPragmasUnsupported, err)
+	}
+}
+
+func TestNewMemory(t *testing.T) {
+	store1, err := NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store1.Close()
+
+	store2, err := NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store2.Close()
+
+	if err := store1.Save(ctx, &event100); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := nostr.Filter{IDs: []string{event100.ID}, Limit: 1}
+	res, err := store1.Query(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 1 {
+		t.Fatalf("expected one event, got %v", res)
+	}
+
+	res, err = store2.Query(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+
+	if len(res) != 0 {
+		t.Fatalf("expected the databases to be separate, got %v", res)
+	}
+}
+
+// baselineSchema is the schema of the events table created by the first version of the store.
+const baselineSchema = `
+	CREATE TABLE events (
+		id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		tags JSONB NOT NULL,
+		content TEXT NOT NULL,
+		sig TEXT NOT NULL
+	);
+
+	CREATE INDEX pubkey_idx ON events(pubkey);
+	CREATE INDEX time_idx ON events(created_at DESC);
+	CREATE INDEX kind_idx ON events(kind);`
+
+func TestMigrate(t *testing.T) {
+	URL := t.TempDir() + "/baseline.sqlite"
+	db, err := sql.Open("sqlite3", URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO events (id, pubkey, created_at, kind, tags, content, sig) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		"a", "alice", 1, 1, `[["expiration","1000"],["e","xxx"]]`, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := New(URL)
+	if err != nil {
+		t.Fatalf("failed to open a database with the baseline schema: %v", err)
+	}
+	defer store.Close()
+
+	var expiresAt int64
+	if err := store.DB.QueryRow("SELECT expires_at FROM events WHERE id = 'a'").Scan(&expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if expiresAt != 1000 {
+		t.Fatalf("expected expires_at to be backfilled to 1000, got %d", expiresAt)
+	}
+
+	// soft deletion relies on the deleted_at column
+	soft, err := New(URL, WithSoftDelete())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer soft.Close()
+
+	if err := soft.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted bool
+	if err := soft.DB.QueryRow("SELECT deleted_at IS NOT NULL FROM events WHERE id = 'a'").Scan(&deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if !deleted {
+		t.Fatal("expected the event to be marked as deleted")
+	}
+}
+
+func TestDecodeTags(t *testing.T) {
+	tests := []string{
+		`null`,
+		`[]`,
+		` [ [ ] , ["a"] ] `,
+		`[["e","abc","wss://relay.example.com"],["p","xyz"]]`,
+		`[["t","escaped \"quote\" and \\ backslash"],["emoji","\u00e8\ud83d\ude00"]]`,
+	}
+
+	for _, data := range tests {
+		var expected nostr.Tags
+		if err := json.Unmarshal([]byte(data), &expected); err != nil {
+			t.Fatalf("invalid test data %s: %v", data, err)
+		}
+
+		tags, err := decodeTags([]byte(data))
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", data, err)
+		}
+
+		if !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("expected tags %#v, got %#v", expected, tags)
+		}
+	}
+
+	for _, data := range []string{`[`, `[["a"]`, `[["a" "b"]]`, `[[1]]`, `[] x`} {
+		if _, err := decodeTags([]byte(data)); err == nil {
+			t.Fatalf("expected error decoding %s, got nil", data)
+		}
+	}
+}
+
+func BenchmarkQuery5k(b *testing.B) {
+	store, err := New(URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer Remove(URL)
+
+	events := make([]*nostr.Event, 5000)
+	for i := range events {
+		events[i] = &nostr.Event{
+			ID:        fmt.Sprintf("%064d", i),
+			PubKey:    "key",
+			CreatedAt: nostr.Timestamp(i),
+			Kind:      1,
+			Content:   "hello world",
+			Tags: nostr.Tags{
+				{"e", fmt.Sprintf("%064d", i+1), "wss://relay.example.com", "reply"},
+				{"p", fmt.Sprintf("%064d", i+2)},
+				{"t", "nostr"},
+			},
+		}
+	}
+
+	if _, err := store.ImportFast(ctx, slices.Values(events)); err != nil {
+		b.Fatal(err)
+	}
+
+	filter := nostr.Filter{Authors: []string{"key"}, Limit: 5000}
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := store.Query(ctx, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeTags(b *testing.B) {
+	data := []byte(`[["e","0000000000000000000000000000000000000000000000000000000000000001","wss://relay.example.com","reply"],["p","0000000000000000000000000000000000000000000000000000000000000002"],["t","nostr"]]`)
+
+	b.Run("json.Unmarshal", func(b *testing.B) {
+		for range b.N {
+			var tags nostr.Tags
+			if err := json.Unmarshal(data, &tags); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("decodeTags", func(b *testing.B) {
+		for range b.N {
+			if _, err := decodeTags(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTagKeys(t *testing.T) {
+	store, err := New(URL, WithIndexedTags("e", "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(URL)
+
+	events := []nostr.Event{
+		{ID: "both", PubKey: "key", CreatedAt: 3, Kind: 1, Tags: nostr.Tags{{"e", "xxx"}, {"p", "someone"}}},
+		{ID: "only-e", PubKey: "key", CreatedAt: 2, Kind: 1, Tags: nostr.Tags{{"e", "xxx"}}},
+		{ID: "only-p", PubKey: "key", CreatedAt: 1, Kind: 1, Tags: nostr.Tags{{"p", "someone"}}},
+	}
+
+	for _, event := range events {
+		if err := store.Save(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// following NIP-01, events must match all the tag keys of a filter
+	filter := nostr.Filter{Tags: nostr.TagMap{"e": {"xxx", "yyy"}, "p": {"someone"}}, Limit: 10}
+	res, err := store.Query(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 1 || res[0].ID != "both" {
+		t.Fatalf("expected only the event with both tags, got %v", res)
+	}
+
+	count, err := store.Count(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected count 1, got %d", count)
+	}
+}
+
 func TestInterface(t *testing.T) {
 	var _ nastro.Store = &Store{}
 }
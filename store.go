@@ -3,6 +3,7 @@ package nastro
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -12,8 +13,44 @@ var (
 	ErrInternalQuery      = errors.New("internal query error")
 	ErrUnspecifiedLimit   = errors.New("unspecified filter's limit")
 	ErrUnsupportedSearch  = errors.New("NIP-50 search is not supported")
+	ErrDuplicate          = errors.New("duplicate: event already stored")
+	ErrDeleted            = errors.New("blocked: event has been deleted by its author")
 )
 
+// prefixes are the machine-readable prefixes of NIP-01, used as the reason of the rejections.
+var prefixes = []string{"invalid", "blocked", "rate-limited", "restricted", "pow", "duplicate", "auth-required"}
+
+// Rejection returns the reason why an operation was rejected by the store, and false if the error is not a rejection
+// but a failure. The reason is the limit of a [Violation] (e.g. "MaxKinds"), the name of the errors
+// without a NIP-01 prefix (e.g. "UnspecifiedLimit"), or the NIP-01 prefix of the error (e.g. "blocked").
+func Rejection(err error) (string, bool) {
+	var v Violation
+	switch {
+	case err == nil:
+		return "", false
+
+	case errors.As(err, &v):
+		return v.Limit(), true
+
+	case errors.Is(err, ErrUnspecifiedLimit):
+		return "UnspecifiedLimit", true
+
+	case errors.Is(err, ErrUnsupportedSearch):
+		return "UnsupportedSearch", true
+
+	case errors.Is(err, ErrInvalidReplacement):
+		return "InvalidReplacement", true
+	}
+
+	msg := err.Error()
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(msg, prefix+":") {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
 type Store interface {
 	// Save the event in the store. For replaceable/addressable event, it is
 	// recommended to call Replace instead
@@ -43,6 +80,15 @@ type Store interface {
 	Count(ctx context.Context, filters ...nostr.Filter) (int64, error)
 }
 
+// Searcher is implemented by stores that support NIP-50 search.
+// Search works like Query, except that filters with a Search field are accepted,
+// and only match events whose content matches the search.
+//
+// More info here: https://github.com/nostr-protocol/nips/blob/master/50.md
+type Searcher interface {
+	Search(ctx context.Context, filters ...nostr.Filter) ([]nostr.Event, error)
+}
+
 // FilterPolicy sanitizes a list of filters before building a query.
 // It returns a potentially modified list and an error if the input is invalid.
 type FilterPolicy func(...nostr.Filter) (nostr.Filters, error)
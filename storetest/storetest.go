@@ -0,0 +1,254 @@
+// The storetest package defines a conformance suite for the implementations of [nastro.Store],
+// so that all the stores behave the same way according to the contract of the interface.
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) nastro.Store {
+//			store, err := New(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { store.Close() })
+//			return store
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+// Factory returns a new and empty store, which must be valid until the end of the test.
+// The store must accept the filters with a limit, as with [nastro.DefaultFilterPolicy].
+type Factory func(t *testing.T) nastro.Store
+
+// Run runs the conformance suite against the stores returned by the factory, one store per subtest.
+func Run(t *testing.T, new Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, nastro.Store)
+	}{
+		{name: "save and query", test: testSaveAndQuery},
+		{name: "save twice", test: testSaveTwice},
+		{name: "order", test: testOrder},
+		{name: "delete", test: testDelete},
+		{name: "replace", test: testReplace},
+		{name: "replace addressable", test: testReplaceAddressable},
+		{name: "invalid replacement", test: testInvalidReplacement},
+		{name: "count", test: testCount},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, new(t))
+		})
+	}
+}
+
+var ctx = context.Background()
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newEvent returns an event with random id and signature, which are not verified by the stores.
+func newEvent(pubkey string, kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	return &nostr.Event{
+		ID:        randHex(32),
+		PubKey:    pubkey,
+		Kind:      kind,
+		CreatedAt: createdAt,
+		Tags:      tags,
+		Content:   "conformance",
+		Sig:       randHex(64),
+	}
+}
+
+func save(t *testing.T, store nastro.Store, events ...*nostr.Event) {
+	t.Helper()
+	for _, event := range events {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatalf("failed to save event %s: %v", event.ID, err)
+		}
+	}
+}
+
+func query(t *testing.T, store nastro.Store, filters ...nostr.Filter) []nostr.Event {
+	t.Helper()
+	events, err := store.Query(ctx, filters...)
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	return events
+}
+
+// expectIDs fails the test if the events don't have the ids of the expected events, in the same order.
+func expectIDs(t *testing.T, events []nostr.Event, expected ...*nostr.Event) {
+	t.Helper()
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+
+	for i := range events {
+		if events[i].ID != expected[i].ID {
+			t.Fatalf("expected event %s at position %d, got %s", expected[i].ID, i, events[i].ID)
+		}
+	}
+}
+
+func testSaveAndQuery(t *testing.T, store nastro.Store) {
+	alice := randHex(32)
+	event := newEvent(alice, 1, 100, nostr.Tag{"e", randHex(32)})
+	save(t, store, event)
+
+	events := query(t, store, nostr.Filter{IDs: []string{event.ID}, Limit: 1})
+	if len(events) != 1 {
+		t.Fatalf("expected the event, got %v", events)
+	}
+
+	if events[0].ID != event.ID || events[0].PubKey != event.PubKey || events[0].Content != event.Content || events[0].Sig != event.Sig {
+		t.Fatalf("expected event %v, got %v", event, events[0])
+	}
+
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{alice}, Limit: 10}), event)
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{randHex(32)}, Limit: 10}))
+}
+
+func testSaveTwice(t *testing.T, store nastro.Store) {
+	event := newEvent(randHex(32), 1, 100)
+	save(t, store, event)
+
+	// saving an event twice either succeeds or reports the duplicate
+	if err := store.Save(ctx, event); err != nil && !errors.Is(err, nastro.ErrDuplicate) {
+		t.Fatalf("expected nil or %v, got %v", nastro.ErrDuplicate, err)
+	}
+
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{event.PubKey}, Limit: 10}), event)
+}
+
+func testOrder(t *testing.T, store nastro.Store) {
+	alice := randHex(32)
+	older := newEvent(alice, 1, 100)
+	newer := newEvent(alice, 1, 200)
+	save(t, store, older, newer)
+
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{alice}, Limit: 10}), newer, older)
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{alice}, Limit: 1}), newer)
+
+	// events matching more than one filter are returned once
+	expectIDs(t, query(t, store,
+		nostr.Filter{Authors: []string{alice}, Limit: 10},
+		nostr.Filter{Kinds: []int{1}, Limit: 10},
+	), newer, older)
+}
+
+func testDelete(t *testing.T, store nastro.Store) {
+	event := newEvent(randHex(32), 1, 100)
+	save(t, store, event)
+
+	if err := store.Delete(ctx, event.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIDs(t, query(t, store, nostr.Filter{IDs: []string{event.ID}, Limit: 1}))
+
+	// deleting a missing event is not an error
+	if err := store.Delete(ctx, randHex(32)); err != nil {
+		t.Fatalf("expected no error deleting a missing event, got %v", err)
+	}
+}
+
+func testReplace(t *testing.T, store nastro.Store) {
+	alice := randHex(32)
+	steps := []struct {
+		event    *nostr.Event
+		replaced bool
+	}{
+		{event: newEvent(alice, 0, 200), replaced: true},
+		{event: newEvent(alice, 0, 100), replaced: false},
+		{event: newEvent(alice, 0, 200), replaced: false},
+		{event: newEvent(alice, 0, 300), replaced: true},
+	}
+
+	for i, step := range steps {
+		replaced, err := store.Replace(ctx, step.event)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+
+		if replaced != step.replaced {
+			t.Fatalf("step %d: expected replaced %v, got %v", i, step.replaced, replaced)
+		}
+	}
+
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{alice}, Kinds: []int{0}, Limit: 10}), steps[3].event)
+}
+
+func testReplaceAddressable(t *testing.T, store nastro.Store) {
+	alice := randHex(32)
+	post := newEvent(alice, 30023, 100, nostr.Tag{"d", "post"})
+	other := newEvent(alice, 30023, 100, nostr.Tag{"d", "other"})
+	edited := newEvent(alice, 30023, 200, nostr.Tag{"d", "post"})
+
+	for _, event := range []*nostr.Event{post, other, edited} {
+		replaced, err := store.Replace(ctx, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !replaced {
+			t.Fatalf("expected event %s to be saved", event.ID)
+		}
+	}
+
+	expectIDs(t, query(t, store, nostr.Filter{Authors: []string{alice}, Limit: 10}), edited, other)
+}
+
+func testInvalidReplacement(t *testing.T, store nastro.Store) {
+	replaced, err := store.Replace(ctx, newEvent(randHex(32), 1, 100))
+	if !errors.Is(err, nastro.ErrInvalidReplacement) {
+		t.Fatalf("expected error %v, got %v", nastro.ErrInvalidReplacement, err)
+	}
+
+	if replaced {
+		t.Fatalf("expected the event not to be replaced")
+	}
+}
+
+func testCount(t *testing.T, store nastro.Store) {
+	alice, bob := randHex(32), randHex(32)
+	save(t, store,
+		newEvent(alice, 1, 100),
+		newEvent(alice, 7, 200),
+		newEvent(bob, 1, 300),
+	)
+
+	tests := []struct {
+		filters  nostr.Filters
+		expected int64
+	}{
+		{filters: nostr.Filters{{Authors: []string{alice}}}, expected: 2},
+		{filters: nostr.Filters{{Kinds: []int{1}}}, expected: 2},
+		{filters: nostr.Filters{{Authors: []string{alice}, Kinds: []int{1}}}, expected: 1},
+		{filters: nostr.Filters{{Authors: []string{randHex(32)}}}, expected: 0},
+	}
+
+	for _, test := range tests {
+		count, err := store.Count(ctx, test.filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.expected {
+			t.Fatalf("filters %v: expected count %d, got %d", test.filters, test.expected, count)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// The wal package defines a store wrapper that appends every write to a journal file before sending it to the store,
+// and replays the journal on startup, so that stores without durability of their own (ephemeral, redis)
+// recover their events after a crash.
+//
+// The journal is a JSONL file of operations. Writes are serialized, so that the journal records them in the order
+// the store applied them. Operations that the store rejects are marked as aborted, and skipped by the replay.
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+)
+
+const (
+	opSave    = "save"
+	opReplace = "replace"
+	opDelete  = "delete"
+	opAbort   = "abort" // the previous operation failed, and must not be replayed
+)
+
+// record is a line of the journal.
+type record struct {
+	Op    string       `json:"op"`
+	Event *nostr.Event `json:"event,omitempty"`
+	ID    string       `json:"id,omitempty"`
+}
+
+// Store wraps a [nastro.Store], journaling its writes. Queries and counts are sent to the store directly.
+type Store struct {
+	nastro.Store
+	path string
+	sync bool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+type Option func(*Store) error
+
+// WithSync makes every write call fsync on the journal before writing to the store,
+// which survives crashes of the operating system and not only of the process, at the cost of throughput.
+func WithSync() Option {
+	return func(s *Store) error {
+		s.sync = true
+		return nil
+	}
+}
+
+// New returns a store that journals the writes to the store in the file at the provided path, creating it if needed.
+// The operations of the journal are replayed to the store before returning, skipping events already stored.
+// A partial line at the end of the journal, left by a crash during a write, is discarded.
+func New(ctx context.Context, store nastro.Store, path string, opts ...Option) (*Store, error) {
+	s := &Store{Store: store, path: path}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the journal: %w", err)
+	}
+
+	s.file = file
+	if err := s.replay(ctx); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to replay the journal: %w", err)
+	}
+	return s, nil
+}
+
+// Close the journal, and the store if it implements [io.Closer].
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := []error{s.file.Close()}
+	if closer, ok := s.Store.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// replay the operations of the journal to the store.
+func (s *Store) replay(ctx context.Context) error {
+	records, err := read(s.file)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range records {
+		if r.Op == opAbort || (i+1 < len(records) && records[i+1].Op == opAbort) {
+			continue
+		}
+
+		if err := apply(ctx, s.Store, r); err != nil && !errors.Is(err, nastro.ErrDuplicate) {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// read the records of the journal, truncating a partial line at its end.
+func read(file *os.File) ([]record, error) {
+	var records []record
+	var offset int64
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// a partial write, which is truncated so that the next append starts on a new line
+				return records, file.Truncate(offset)
+			}
+			return records, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("invalid record at offset %d: %w", offset, err)
+		}
+
+		records = append(records, r)
+		offset += int64(len(line))
+	}
+}
+
+func apply(ctx context.Context, store nastro.Store, r record) error {
+	switch r.Op {
+	case opSave:
+		return store.Save(ctx, r.Event)
+
+	case opReplace:
+		_, err := store.Replace(ctx, r.Event)
+		return err
+
+	case opDelete:
+		return store.Delete(ctx, r.ID)
+
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+}
+
+// append the record to the journal.
+func (s *Store) append(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write the journal: %w", err)
+	}
+
+	if s.sync {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync the journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// write journals the record and then applies it to the store. If the store fails, the record is marked as aborted.
+func (s *Store) write(r record, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(r); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		if abortErr := s.append(record{Op: opAbort}); abortErr != nil {
+			return errors.Join(err, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Save the event in the journal and then in the store.
+func (s *Store) Save(ctx context.Context, event *nostr.Event) error {
+	return s.write(record{Op: opSave, Event: event}, func() error {
+		return s.Store.Save(ctx, event)
+	})
+}
+
+// Replace an old event with the new one according to NIP-01, see [nastro.Store], journaling it first.
+func (s *Store) Replace(ctx context.Context, event *nostr.Event) (bool, error) {
+	if !nastro.IsValidReplacement(event.Kind) {
+		return false, fmt.Errorf("%w: event ID %s, kind %d", nastro.ErrInvalidReplacement, event.ID, event.Kind)
+	}
+
+	var replaced bool
+	err := s.write(record{Op: opReplace, Event: event}, func() error {
+		var err error
+		replaced, err = s.Store.Replace(ctx, event)
+		return err
+	})
+	return replaced, err
+}
+
+// Delete the event with the provided id from the store, journaling the deletion first.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return s.write(record{Op: opDelete, ID: id}, func() error {
+		return s.Store.Delete(ctx, id)
+	})
+}
+
+// Compact rewrites the journal with the events currently in the store, querying batchSize events at a time,
+// so that it stops growing with the events that have been deleted, replaced or evicted.
+// The events are held in memory during the compaction, which blocks writes.
+func (s *Store) Compact(ctx context.Context, batchSize int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to compact the journal: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	// the events are journaled from the oldest, so that their replay respects the eviction order of the store
+	var events []nostr.Event
+	err = nastro.Scan(ctx, s.Store, nostr.Filter{}, batchSize, func(event nostr.Event) error {
+		events = append(events, event)
+		return nil
+	})
+
+	writer := bufio.NewWriter(temp)
+	for i := len(events) - 1; i >= 0 && err == nil; i-- {
+		r := record{Op: opSave, Event: &events[i]}
+		if nastro.IsValidReplacement(events[i].Kind) {
+			r.Op = opReplace
+		}
+
+		var line []byte
+		if line, err = json.Marshal(r); err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact the journal: %w", err)
+	}
+
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to compact the journal: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen the journal: %w", err)
+	}
+
+	s.file.Close()
+	s.file = file
+	return nil
+}
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/nastro"
+	"github.com/pippellia-btc/nastro/ephemeral"
+	"github.com/pippellia-btc/nastro/storetest"
+)
+
+var ctx = context.Background()
+
+var errBanned = errors.New("banned kind")
+
+// newEphemeral returns an in-memory store that rejects events of kind 4.
+func newEphemeral(t *testing.T) *ephemeral.Store {
+	store, err := ephemeral.New(ephemeral.WithEventPolicy(func(e *nostr.Event) error {
+		if e.Kind == 4 {
+			return errBanned
+		}
+		return nil
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func newStore(t *testing.T, path string) *Store {
+	store, err := New(ctx, newEphemeral(t), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newEvent(kind int, createdAt nostr.Timestamp) *nostr.Event {
+	return &nostr.Event{ID: randHex(32), PubKey: randHex(32), Kind: kind, CreatedAt: createdAt}
+}
+
+func expectIDs(t *testing.T, store nastro.Store, expected ...*nostr.Event) {
+	t.Helper()
+	events, err := store.Query(ctx, nostr.Filter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+
+	for i := range events {
+		if events[i].ID != expected[i].ID {
+			t.Fatalf("expected event ID %s at position %d, got %s", expected[i].ID, i, events[i].ID)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) nastro.Store {
+		store := newStore(t, filepath.Join(t.TempDir(), "journal.jsonl"))
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	store := newStore(t, path)
+
+	note := newEvent(1, 10)
+	deleted := newEvent(1, 20)
+	profile := newEvent(0, 30)
+	for _, event := range []*nostr.Event{note, deleted} {
+		if err := store.Save(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Replace(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(ctx, newEvent(4, 40)); !errors.Is(err, errBanned) {
+		t.Fatalf("expected error %v, got %v", errBanned, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash during a write leaves a partial line
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"save","event":{"id":`)
+	file.Close()
+
+	store = newStore(t, path)
+	defer store.Close()
+	expectIDs(t, store, profile, note)
+
+	if err := store.Save(ctx, newEvent(1, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(lines))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	store := newStore(t, path)
+
+	events := make([]*nostr.Event, 5)
+	for i := range events {
+		events[i] = newEvent(1, nostr.Timestamp(5-i))
+		if err := store.Save(ctx, events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, event := range events[3:] {
+		if err := store.Delete(ctx, event.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Compact(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(lines))
+	}
+
+	store = newStore(t, path)
+	defer store.Close()
+	expectIDs(t, store, events[:3]...)
+}
+
+func TestInterface(t *testing.T) {
+	var _ nastro.Store = &Store{}
+}